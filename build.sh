@@ -1,5 +1,6 @@
 #!/bin/bash -xv
 rm -rf bin
 mkdir bin
-go build -o bin/mds mds/main/main.go
-go build -o bin/client client/main/main.go
\ No newline at end of file
+go build -o bin/mds ./mds/main
+go build -o bin/client ./client/main
+go build -o bin/ddbctl ./ddbctl/main
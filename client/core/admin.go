@@ -0,0 +1,531 @@
+package client
+
+import (
+	"context"
+	"time"
+)
+
+// Job types
+const (
+	JobBackup     = "backup"
+	JobCompaction = "compaction"
+	JobSplit      = "split"
+)
+
+// Job states, a job ends in JobSucceeded, JobFailed or JobCanceled
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCanceled  = "canceled"
+)
+
+// Job is a long running admin operation executed by the server in the
+// background, jobs which didn't finish are resumed after a restart
+type Job struct {
+	Id    string `json:"id"`
+	Type  string `json:"type"`
+	State string `json:"state"`
+	// Completed fraction of the work from 0 to 1
+	Progress float64 `json:"progress"`
+	Error    string  `json:"error,omitempty"`
+	Path     string  `json:"path,omitempty"`
+	// Unix nanoseconds
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+	// Key range [Start, End) moved to the Target api address by a split,
+	// empty End means no upper bound
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+// Done reports whether the job reached a final state
+func (job *Job) Done() bool {
+	switch job.State {
+	case JobSucceeded, JobFailed, JobCanceled:
+		return true
+	default:
+		return false
+	}
+}
+
+type CreateJobRequest struct {
+	BaseRequest
+	Type   string `json:"type"`
+	Path   string `json:"path,omitempty"`
+	Start  string `json:"start,omitempty"`
+	End    string `json:"end,omitempty"`
+	Target string `json:"target,omitempty"`
+}
+
+type JobResponse struct {
+	BaseResponse
+	Job Job `json:"job"`
+}
+
+type JobsResponse struct {
+	BaseResponse
+	Jobs []Job `json:"jobs"`
+}
+
+// TableProperties describes a sstable of a server
+type TableProperties struct {
+	Path  string `json:"path"`
+	MinId int64  `json:"minId"`
+	MaxId int64  `json:"maxId"`
+	Size  int64  `json:"size"`
+	Nodes int64  `json:"nodes"`
+	// Nodes per index block chosen by the size of the table and its values
+	KeysPerIndex int    `json:"keysPerIndex"`
+	IndexEntries int    `json:"indexEntries"`
+	Compression  string `json:"compression"`
+	Checksum     string `json:"checksum"`
+	MaxVersion   uint64 `json:"maxVersion"`
+	// Memory held by the prefix compressed index
+	IndexBytes int64 `json:"indexBytes"`
+
+	// Oldest, newest and mean write time of the values in unix nanoseconds,
+	// values written before write times were recorded aren't counted
+	MinWrittenAt  int64 `json:"minWrittenAt"`
+	MaxWrittenAt  int64 `json:"maxWrittenAt"`
+	MeanWrittenAt int64 `json:"meanWrittenAt"`
+	WrittenNodes  int64 `json:"writtenNodes"`
+}
+
+type TablesResponse struct {
+	BaseResponse
+	Tables []TableProperties `json:"tables"`
+}
+
+// Event is a state transition of the server storage: open, recovery,
+// flush, merge, error or close
+type Event struct {
+	Seq uint64 `json:"seq"`
+	// Unix nanoseconds
+	Time       int64  `json:"time"`
+	Type       string `json:"type"`
+	Message    string `json:"message"`
+	DurationMs int64  `json:"durationMs,omitempty"`
+}
+
+type EventsResponse struct {
+	BaseResponse
+	Events []Event `json:"events"`
+}
+
+// Key range states: writes to a frozen range fail with ErrFrozen while it
+// is copied, requests for keys of a moved range are redirected to its
+// target
+const (
+	RangeFrozen = "frozen"
+	RangeMoved  = "moved"
+)
+
+// KeyRange is the state of keys [Start, End) being split off to Target,
+// empty End means no upper bound
+type KeyRange struct {
+	Start  string `json:"start"`
+	End    string `json:"end,omitempty"`
+	Target string `json:"target"`
+	State  string `json:"state"`
+}
+
+type RangesResponse struct {
+	BaseResponse
+	Ranges []KeyRange `json:"ranges"`
+}
+
+// RequestSample is an api request captured by request sampling
+type RequestSample struct {
+	Seq uint64 `json:"seq"`
+	// Unix nanoseconds the request arrived at
+	Time      int64  `json:"time"`
+	RequestId string `json:"requestId,omitempty"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Query     string `json:"query,omitempty"`
+	Key       string `json:"key,omitempty"`
+	// Request headers, credentials are redacted
+	Headers       map[string]string `json:"headers"`
+	RequestBytes  int64             `json:"requestBytes"`
+	Status        int               `json:"status"`
+	ResponseBytes int64             `json:"responseBytes"`
+	// Time until the response header was written and until the handler
+	// returned in microseconds
+	HeaderUs   int64 `json:"headerUs"`
+	DurationUs int64 `json:"durationUs"`
+}
+
+type SamplesResponse struct {
+	BaseResponse
+	Samples []RequestSample `json:"samples"`
+}
+
+type WarmupResponse struct {
+	BaseResponse
+	// Tables whose indexes and bloom filters are resident and the memory
+	// held by the indexes
+	Tables     int   `json:"tables"`
+	IndexBytes int64 `json:"indexBytes"`
+	// Blocks read into the cache, profiled blocks no longer in the storage
+	// and the cache size afterwards
+	Blocks    int64 `json:"blocks"`
+	Skipped   int64 `json:"skipped"`
+	CacheSize int64 `json:"cacheSize"`
+}
+
+type AdminRequest struct {
+	BaseRequest
+	Path string `json:"path"`
+	// Validate a restore without touching the storage
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+type AdminResponse struct {
+	BaseResponse
+	Path      string            `json:"path,omitempty"`
+	Preflight *RestorePreflight `json:"preflight,omitempty"`
+}
+
+// RestorePreflight is the outcome of a restore dry run
+type RestorePreflight struct {
+	// Whether the backup has a catalog, backups without one are checked
+	// by reading every node
+	Catalog       bool   `json:"catalog"`
+	FormatVersion uint32 `json:"formatVersion,omitempty"`
+	Compatible    bool   `json:"compatible"`
+	MaxVersion    uint64 `json:"maxVersion,omitempty"`
+	Files         int    `json:"files"`
+	Size          int64  `json:"size"`
+	// Missing, resized or corrupt files, empty if the backup is intact
+	Problems []string `json:"problems"`
+	// Space a restore copying the files takes and the free space of the
+	// storage, files linked from the same file system take none
+	DiskNeeded int64 `json:"diskNeeded"`
+	DiskFree   int64 `json:"diskFree"`
+	// Time the backup took to read once, a restore copying it takes about
+	// as long plus the log replay
+	EstimatedMs int64 `json:"estimatedMs"`
+}
+
+// Ok reports whether a restore of the backup can go ahead
+func (p *RestorePreflight) Ok() bool {
+	return p.Compatible && len(p.Problems) == 0 && p.DiskNeeded <= p.DiskFree
+}
+
+// Admin requests are served on the debug address, the client has to be
+// created with that address as its endpoint.
+
+// Backup writes a consistent snapshot of the storage into dir on the server
+// host, dir must not exist. The backup runs as a job which is waited for.
+func (c *Client) Backup(ctx context.Context, dir string) error {
+	if dir == "" {
+		return ErrBadRequest
+	}
+
+	job, err := c.CreateJob(ctx, JobBackup, dir)
+	if err != nil {
+		return err
+	}
+
+	job, err = c.WaitJob(ctx, job.Id, 0)
+	if err != nil {
+		return err
+	}
+	return jobError(job)
+}
+
+// Restore replaces the server storage with the snapshot in dir on the
+// server host and returns the directory the previous storage was moved to
+func (c *Client) Restore(ctx context.Context, dir string) (string, error) {
+	if dir == "" {
+		return "", ErrBadRequest
+	}
+
+	var req AdminRequest
+	req.RequestId = c.newRequestId()
+	req.Path = dir
+
+	var resp AdminResponse
+	err := c.postJson(ctx, "/admin/restore", &req, &resp, false)
+	if err != nil {
+		return "", err
+	}
+	return resp.Path, nil
+}
+
+// RestorePreflight validates the backup in dir on the server host and
+// estimates the restore without touching the storage
+func (c *Client) RestorePreflight(ctx context.Context, dir string) (*RestorePreflight, error) {
+	if dir == "" {
+		return nil, ErrBadRequest
+	}
+
+	var req AdminRequest
+	req.RequestId = c.newRequestId()
+	req.Path = dir
+	req.DryRun = true
+
+	var resp AdminResponse
+	err := c.postJson(ctx, "/admin/restore", &req, &resp, true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Preflight == nil {
+		return nil, ErrInternal
+	}
+	return resp.Preflight, nil
+}
+
+// CreateJob starts a job of jobType, path is the job argument if the type
+// takes one
+func (c *Client) CreateJob(ctx context.Context, jobType string, path string) (*Job, error) {
+	if jobType == "" {
+		return nil, ErrBadRequest
+	}
+
+	var req CreateJobRequest
+	req.RequestId = c.newRequestId()
+	req.Type = jobType
+	req.Path = path
+
+	var resp JobResponse
+	err := c.postJson(ctx, "/admin/jobs", &req, &resp, false)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Job, nil
+}
+
+// Split starts a job moving keys [start, end) of the server to the server
+// at the target api address: writes to the range are frozen while it's
+// copied, then requests for it are redirected to target and the keys are
+// deleted from the server. A failed or canceled split is rolled back
+// until the redirect starts.
+func (c *Client) Split(ctx context.Context, start string, end string, target string) (*Job, error) {
+	if target == "" || (end != "" && start >= end) {
+		return nil, ErrBadRequest
+	}
+
+	var req CreateJobRequest
+	req.RequestId = c.newRequestId()
+	req.Type = JobSplit
+	req.Start = start
+	req.End = end
+	req.Target = target
+
+	var resp JobResponse
+	err := c.postJson(ctx, "/admin/jobs", &req, &resp, false)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Job, nil
+}
+
+// Ranges returns the key ranges of the server frozen or moved by splits
+func (c *Client) Ranges(ctx context.Context) ([]KeyRange, error) {
+	var resp RangesResponse
+	err := c.getJson(ctx, "/admin/ranges", &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Ranges, nil
+}
+
+func (c *Client) GetJob(ctx context.Context, id string) (*Job, error) {
+	if id == "" {
+		return nil, ErrBadRequest
+	}
+
+	var resp JobResponse
+	err := c.getJson(ctx, "/admin/jobs/"+id, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Job, nil
+}
+
+// ListJobs returns jobs in creation order including recently finished ones
+func (c *Client) ListJobs(ctx context.Context) ([]Job, error) {
+	var resp JobsResponse
+	err := c.getJson(ctx, "/admin/jobs", &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Jobs, nil
+}
+
+// OpStats describe the requests of an operation, latency quantiles are
+// the upper bounds of histogram buckets and those above the largest bucket
+// report its bound
+type OpStats struct {
+	Count uint64 `json:"count"`
+	// Requests per second
+	Rate   float64 `json:"rate"`
+	MeanMs float64 `json:"meanMs"`
+	P50Ms  float64 `json:"p50Ms"`
+	P99Ms  float64 `json:"p99Ms"`
+}
+
+type StatsResponse struct {
+	BaseResponse
+	// Window the stats cover, empty for the totals since the start or the
+	// last reset
+	Window string `json:"window,omitempty"`
+	// Start of the covered time in unix nanoseconds
+	Since int64              `json:"since"`
+	Ops   map[string]OpStats `json:"ops"`
+	// Responses by http status code, only in the totals
+	Responses map[string]uint64 `json:"responses,omitempty"`
+}
+
+// Stats returns the request stats of the last window of the server, at
+// most an hour, zero window returns the totals since the start or the last
+// ResetStats
+func (c *Client) Stats(ctx context.Context, window time.Duration) (*StatsResponse, error) {
+	path := "/stats"
+	if window > 0 {
+		path += "?window=" + window.String()
+	}
+
+	var resp StatsResponse
+	err := c.getJson(ctx, path, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// ResetStats restarts the request stats totals and windows of the server
+func (c *Client) ResetStats(ctx context.Context) error {
+	var req BaseRequest
+	req.RequestId = c.newRequestId()
+
+	var resp BaseResponse
+	return c.postJson(ctx, "/admin/stats/reset", &req, &resp, true)
+}
+
+// ListTables returns properties of the sstables of the server from the
+// oldest to the newest
+func (c *Client) ListTables(ctx context.Context) ([]TableProperties, error) {
+	var resp TablesResponse
+	err := c.getJson(ctx, "/admin/tables", &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Tables, nil
+}
+
+// Events returns the latest storage events of the server from the oldest,
+// a gap in Seq means older events were dropped
+func (c *Client) Events(ctx context.Context) ([]Event, error) {
+	var resp EventsResponse
+	err := c.getJson(ctx, "/admin/events", &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Events, nil
+}
+
+// Samples returns the latest sampled requests of the server from the
+// oldest
+func (c *Client) Samples(ctx context.Context) ([]RequestSample, error) {
+	var resp SamplesResponse
+	err := c.getJson(ctx, "/admin/samples", &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Samples, nil
+}
+
+// SuspendBackground stops background flushes and merges of the server, it
+// returns once those in progress finished. Writes fail with ErrBusy once
+// the memtable grows far beyond the flush threshold.
+func (c *Client) SuspendBackground(ctx context.Context) error {
+	var req BaseRequest
+	req.RequestId = c.newRequestId()
+
+	var resp BaseResponse
+	return c.postJson(ctx, "/admin/background/suspend", &req, &resp, true)
+}
+
+// ResumeBackground restarts background flushes and merges of the server
+func (c *Client) ResumeBackground(ctx context.Context) error {
+	var req BaseRequest
+	req.RequestId = c.newRequestId()
+
+	var resp BaseResponse
+	return c.postJson(ctx, "/admin/background/resume", &req, &resp, true)
+}
+
+// Warmup reads the blocks hot before the last restart of the server into
+// its cache
+func (c *Client) Warmup(ctx context.Context) (*WarmupResponse, error) {
+	var req BaseRequest
+	req.RequestId = c.newRequestId()
+
+	var resp WarmupResponse
+	err := c.postJson(ctx, "/admin/warmup", &req, &resp, true)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// CancelJob requests cancellation of a job, the returned job may still be
+// running until the operation notices it
+func (c *Client) CancelJob(ctx context.Context, id string) (*Job, error) {
+	if id == "" {
+		return nil, ErrBadRequest
+	}
+
+	var req BaseRequest
+	req.RequestId = c.newRequestId()
+
+	var resp JobResponse
+	err := c.postJson(ctx, "/admin/jobs/"+id+"/cancel", &req, &resp, true)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Job, nil
+}
+
+const defaultJobPollInterval = 100 * time.Millisecond
+
+// WaitJob polls the job every interval until it is done, zero interval
+// means default
+func (c *Client) WaitJob(ctx context.Context, id string, interval time.Duration) (*Job, error) {
+	if interval <= 0 {
+		interval = defaultJobPollInterval
+	}
+
+	for {
+		job, err := c.GetJob(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if job.Done() {
+			return job, nil
+		}
+
+		select {
+		case <-c.clock.After(interval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// jobError converts the outcome of a finished job into a client error
+func jobError(job *Job) error {
+	switch job.State {
+	case JobSucceeded:
+		return nil
+	case JobCanceled:
+		return ErrCanceled
+	default:
+		return resultError(job.Error)
+	}
+}
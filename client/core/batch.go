@@ -0,0 +1,359 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+const (
+	BatchOpSet    = "set"
+	BatchOpGet    = "get"
+	BatchOpDelete = "delete"
+
+	// Maximum number of operations accepted in a single batch request
+	MaxBatchOperations = 1000
+)
+
+type BatchOperation struct {
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+type BatchRequest struct {
+	BaseRequest
+	Operations []BatchOperation `json:"operations"`
+	// When the writes are acknowledged, empty means the server default
+	Durability string `json:"durability,omitempty"`
+}
+
+type BatchResult struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Version of the value read or written by a transaction operation
+	Version uint64 `json:"version,omitempty"`
+}
+
+type DeleteKeysRequest struct {
+	BaseRequest
+	Keys []string `json:"keys"`
+}
+
+type BatchResponse struct {
+	BaseResponse
+	Results []BatchResult `json:"results"`
+}
+
+var errorByMessage = map[string]error{
+	ErrNotFound.Error():       ErrNotFound,
+	ErrBadRequest.Error():     ErrBadRequest,
+	ErrCorrupted.Error():      ErrCorrupted,
+	ErrDiskFull.Error():       ErrDiskFull,
+	ErrBusy.Error():           ErrBusy,
+	ErrClosed.Error():         ErrClosed,
+	ErrNotImplemented.Error(): ErrNotImplemented,
+	ErrEmptyKey.Error():       ErrEmptyKey,
+	ErrEmptyValue.Error():     ErrEmptyValue,
+	ErrReadOnly.Error():       ErrReadOnly,
+	ErrValueTooLarge.Error():  ErrValueTooLarge,
+	ErrFrozen.Error():         ErrFrozen,
+	ErrMoved.Error():          ErrMoved,
+	// admin operations report an existing target as already exists
+	"Already exists": ErrConflict,
+}
+
+// resultError converts a per operation error message into a client error
+func resultError(message string) error {
+	if message == "" {
+		return nil
+	}
+
+	err, ok := errorByMessage[message]
+	if !ok {
+		return ErrInternal
+	}
+	return err
+}
+
+func (c *Client) postJson(ctx context.Context, path string, req interface{}, resp interface{}, idempotent bool) error {
+	return c.postJsonTo(ctx, c.endpoint, path, req, resp, idempotent)
+}
+
+// postJsonTo sends req and decodes the response into resp, idempotent
+// requests are retried on failures which may be transient
+func (c *Client) postJsonTo(ctx context.Context, endpoint string, path string, req interface{}, resp interface{}, idempotent bool) error {
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	httpReq, err := http.NewRequest("POST", endpoint+path, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if r, ok := req.(interface{ GetRequestId() string }); ok {
+		httpReq.Header.Set("X-Request-Id", r.GetRequestId())
+	}
+
+	httpResp, err := c.do(ctx, httpReq, idempotent)
+	if err != nil {
+		return err
+	}
+	defer closeBody(httpResp)
+
+	if httpResp.StatusCode != http.StatusOK {
+		return responseToError(httpResp)
+	}
+
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (c *Client) getJson(ctx context.Context, path string, resp interface{}) error {
+	return c.getJsonTo(ctx, c.endpoint, path, resp)
+}
+
+func (c *Client) getJsonTo(ctx context.Context, endpoint string, path string, resp interface{}) error {
+	httpReq, err := http.NewRequest("GET", endpoint+path, nil)
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("X-Request-Id", c.newRequestId())
+
+	httpResp, err := c.do(ctx, httpReq, true)
+	if err != nil {
+		return err
+	}
+	defer closeBody(httpResp)
+
+	err = responseToError(httpResp)
+	if err != nil {
+		return err
+	}
+
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+// Batch submits operations in a single request per endpoint, the requests
+// to different endpoints run in parallel. Results are returned in the order
+// of operations and carry per operation errors
+func (c *Client) Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	if len(ops) > MaxBatchOperations {
+		return nil, ErrBadRequest
+	}
+
+	keys := make([]string, len(ops))
+	for i, op := range ops {
+		keys[i] = op.Key
+	}
+
+	results := make([]BatchResult, len(ops))
+	err := eachGroup(ctx, c.groupByOwner(keys, false), func(ctx context.Context, endpoint string, indexes []int) error {
+		return c.batchTo(ctx, endpoint, ops, indexes, results)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// during a rebalance keys may still be at their previous endpoint
+	moved := make(map[string][]int)
+	for endpoint, indexes := range c.groupByOwner(keys, true) {
+		for _, i := range indexes {
+			if ops[i].Op == BatchOpGet || ops[i].Op == BatchOpDelete {
+				moved[endpoint] = append(moved[endpoint], i)
+			}
+		}
+	}
+
+	prevResults := make([]BatchResult, len(ops))
+	err = eachGroup(ctx, moved, func(ctx context.Context, endpoint string, indexes []int) error {
+		return c.batchTo(ctx, endpoint, ops, indexes, prevResults)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, indexes := range moved {
+		for _, i := range indexes {
+			if results[i].Error == ErrNotFound.Error() {
+				results[i] = prevResults[i]
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// batchTo sends ops at indexes to endpoint and stores their results at the
+// same indexes
+func (c *Client) batchTo(ctx context.Context, endpoint string, ops []BatchOperation, indexes []int, results []BatchResult) error {
+	var req BatchRequest
+	req.RequestId = c.newRequestId()
+	req.Durability = c.durability
+	req.Operations = make([]BatchOperation, len(indexes))
+	for j, i := range indexes {
+		req.Operations[j] = ops[i]
+	}
+
+	var resp BatchResponse
+	err := c.postJsonTo(ctx, endpoint, "/batch", &req, &resp, true)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Results) != len(indexes) {
+		return ErrInternal
+	}
+
+	for j, i := range indexes {
+		results[i] = resp.Results[j]
+	}
+	return nil
+}
+
+func (c *Client) BatchSet(ctx context.Context, kv map[string]string) error {
+	ops := make([]BatchOperation, 0, len(kv))
+	for key, value := range kv {
+		if key == "" {
+			return ErrEmptyKey
+		}
+		if value == "" {
+			return ErrEmptyValue
+		}
+		ops = append(ops, BatchOperation{Op: BatchOpSet, Key: key, Value: value})
+	}
+
+	results, err := c.Batch(ctx, ops)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		err = resultError(result.Error)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchGet returns values of the found keys, missing keys are omitted
+func (c *Client) BatchGet(ctx context.Context, keys []string) (map[string]string, error) {
+	ops := make([]BatchOperation, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			return nil, ErrEmptyKey
+		}
+		ops = append(ops, BatchOperation{Op: BatchOpGet, Key: key})
+	}
+
+	results, err := c.Batch(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	kv := make(map[string]string, len(results))
+	for _, result := range results {
+		err = resultError(result.Error)
+		if err != nil {
+			if err == ErrNotFound {
+				continue
+			}
+			return nil, err
+		}
+		kv[result.Key] = result.Value
+	}
+	return kv, nil
+}
+
+func (c *Client) BatchDelete(ctx context.Context, keys []string) error {
+	ops := make([]BatchOperation, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			return ErrEmptyKey
+		}
+		ops = append(ops, BatchOperation{Op: BatchOpDelete, Key: key})
+	}
+
+	results, err := c.Batch(ctx, ops)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		err = resultError(result.Error)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteKeys deletes keys in a single parallel request per endpoint which
+// the server applies as one log write, the returned slice holds per key
+// errors
+func (c *Client) DeleteKeys(ctx context.Context, keys []string) ([]error, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	if len(keys) > MaxBatchOperations {
+		return nil, ErrBadRequest
+	}
+
+	errs := make([]error, len(keys))
+	err := eachGroup(ctx, c.groupByOwner(keys, false), func(ctx context.Context, endpoint string, indexes []int) error {
+		return c.deleteKeysAt(ctx, endpoint, keys, indexes, errs)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// a key is deleted if either endpoint had it during a rebalance
+	moved := c.groupByOwner(keys, true)
+	prevErrs := make([]error, len(keys))
+	err = eachGroup(ctx, moved, func(ctx context.Context, endpoint string, indexes []int) error {
+		return c.deleteKeysAt(ctx, endpoint, keys, indexes, prevErrs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, indexes := range moved {
+		for _, i := range indexes {
+			if errs[i] == ErrNotFound {
+				errs[i] = prevErrs[i]
+			}
+		}
+	}
+	return errs, nil
+}
+
+func (c *Client) deleteKeysAt(ctx context.Context, endpoint string, keys []string, indexes []int, errs []error) error {
+	var req DeleteKeysRequest
+	req.RequestId = c.newRequestId()
+	req.Keys = make([]string, len(indexes))
+	for j, i := range indexes {
+		req.Keys[j] = keys[i]
+	}
+
+	var resp BatchResponse
+	err := c.postJsonTo(ctx, endpoint, "/mdelete", &req, &resp, true)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Results) != len(indexes) {
+		return ErrInternal
+	}
+
+	for j, i := range indexes {
+		errs[i] = resultError(resp.Results[j].Error)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package client
+
+import (
+	"net/url"
+	"sync"
+	"time"
+
+	"ddb/lib/common/clock"
+)
+
+// An endpoint failing consecutive requests with connection errors, timeouts
+// or a status retryableStatus accepts opens its circuit breaker: requests to
+// it fail at once with ErrCircuitOpen instead of waiting for the endpoint.
+// After a cooldown a single probe request is let through, the breaker closes
+// if it succeeds and opens again otherwise.
+
+// Circuit breaker states
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+type breaker struct {
+	lock      sync.Mutex
+	clock     clock.Clock
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+	// A half-open breaker has a probe in flight
+	probing bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration, c clock.Clock) *breaker {
+	return &breaker{clock: c, threshold: threshold, cooldown: cooldown, state: BreakerClosed}
+}
+
+// allow reports whether a request may be sent, every allowed request must
+// be followed by success, failure or abandon
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.clock.Now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) success() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+func (b *breaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = b.clock.Now()
+	}
+	b.probing = false
+}
+
+// abandon releases an allowed request which told nothing about the
+// endpoint, e.g. it was canceled by the caller
+func (b *breaker) abandon() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.probing = false
+}
+
+func (b *breaker) getState() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.state
+}
+
+// breakerFor returns the breaker of the endpoint host
+func (c *Client) breakerFor(host string) *breaker {
+	c.breakersLock.Lock()
+	defer c.breakersLock.Unlock()
+
+	b, ok := c.breakers[host]
+	if !ok {
+		b = newBreaker(c.breakerThreshold, c.breakerCooldown, c.clock)
+		c.breakers[host] = b
+	}
+	return b
+}
+
+// BreakerState returns the circuit breaker state of endpoint: BreakerClosed,
+// BreakerOpen or BreakerHalfOpen
+func (c *Client) BreakerState(endpoint string) string {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return BreakerClosed
+	}
+	return c.breakerFor(u.Host).getState()
+}
@@ -2,58 +2,183 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
 	uuid "github.com/pborman/uuid"
+
+	"ddb/lib/common/auth"
+	"ddb/lib/common/clock"
+	"ddb/lib/common/random"
 )
 
 var (
-	ErrNotFound   = fmt.Errorf("Not found")
-	ErrConflict   = fmt.Errorf("Conflict")
-	ErrBadRequest = fmt.Errorf("Bad request")
-	ErrInternal   = fmt.Errorf("Internal error")
-	ErrUnknown    = fmt.Errorf("Unknown error")
-	ErrEmptyKey   = fmt.Errorf("Empty key")
-	ErrEmptyValue = fmt.Errorf("Empty value")
+	ErrNotFound       = fmt.Errorf("Not found")
+	ErrConflict       = fmt.Errorf("Conflict")
+	ErrBadRequest     = fmt.Errorf("Bad request")
+	ErrInternal       = fmt.Errorf("Internal error")
+	ErrCorrupted      = fmt.Errorf("Data corrupted")
+	ErrDiskFull       = fmt.Errorf("Disk full")
+	ErrBusy           = fmt.Errorf("Busy")
+	ErrClosed         = fmt.Errorf("Closed")
+	ErrNotImplemented = fmt.Errorf("Not implemented")
+	ErrUnknown        = fmt.Errorf("Unknown error")
+	ErrEmptyKey       = fmt.Errorf("Empty key")
+	ErrEmptyValue     = fmt.Errorf("Empty value")
+	ErrCanceled       = fmt.Errorf("Canceled")
+	ErrReadOnly       = fmt.Errorf("Read only")
+	ErrValueTooLarge  = fmt.Errorf("Value too large")
+	ErrUnauthorized   = fmt.Errorf("Unauthorized")
+	ErrForbidden      = fmt.Errorf("Forbidden")
+	ErrCircuitOpen    = fmt.Errorf("Circuit open")
+	ErrFrozen         = fmt.Errorf("Frozen")
+	ErrMoved          = fmt.Errorf("Moved")
+)
+
+// Durabilities of writes: acknowledged once the server log is synced, once
+// logged with a sync following within the server sync interval or once
+// logged without requesting a sync
+const (
+	DurabilityFsync   = "fsync"
+	DurabilityBatched = "batched"
+	DurabilityNone    = "none"
+	// Same as DurabilityBatched
+	DurabilityBuffered = "buffered"
 )
 
 type BaseRequest struct {
 	RequestId string `json:"requestId"`
 }
 
+// GetRequestId returns the id of any request embedding BaseRequest
+func (req *BaseRequest) GetRequestId() string {
+	return req.RequestId
+}
+
 type SetKeyRequest struct {
 	BaseRequest
 	Value string `json:"value"`
+	// Expire the value after this many seconds, zero means never
+	TtlSeconds int64 `json:"ttlSeconds,omitempty"`
+	// Only set the value if its current version equals ExpectedVersion
+	CompareVersion  bool   `json:"compareVersion,omitempty"`
+	ExpectedVersion uint64 `json:"expectedVersion,omitempty"`
+	// When the write is acknowledged, empty means the server default
+	Durability string `json:"durability,omitempty"`
+}
+
+type SetKeyResponse struct {
+	BaseResponse
+	Version uint64 `json:"version,omitempty"`
+}
+
+type DeleteKeyRequest struct {
+	BaseRequest
+	// Only delete the value if its current version equals ExpectedVersion
+	CompareVersion  bool   `json:"compareVersion,omitempty"`
+	ExpectedVersion uint64 `json:"expectedVersion,omitempty"`
+	Durability      string `json:"durability,omitempty"`
 }
 
 type BaseResponse struct {
 	RequestId string `json:"requestId"`
 	Error     string `json:"error"`
+
+	// Seconds to wait before sending a failed request again, same as the
+	// Retry-After header, zero if a retry won't help
+	RetryAfter int `json:"retryAfter,omitempty"`
+	// Address of the raft leader a write rejected by another node is to
+	// be sent to, empty if unknown
+	Leader string `json:"leader,omitempty"`
 }
 
 type GetKeyResponse struct {
 	BaseResponse
 	Value string `json:"value"`
+	// Expiration time in unix nanoseconds, zero if the value never expires
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// Version of the value, it changes with every write of the key
+	Version uint64 `json:"version,omitempty"`
+}
+
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
 }
 
+const (
+	// Upper bound of pairs returned by a single scan, matches the server
+	MaxScanLimit = 10000
+)
+
+type ScanResponse struct {
+	BaseResponse
+	Items []KeyValue `json:"items"`
+}
+
+// Client distributes keys over its endpoints by consistent hashing, scans
+// query every endpoint while admin and replication requests go to the first
 type Client struct {
 	endpoint   string
 	httpClient *http.Client
+	ring       *shardRing
+	// Ring before the last SetEndpoints, nil unless a rebalance is in
+	// progress
+	prevRing *shardRing
+	ringLock sync.RWMutex
+	clock    clock.Clock
+	random   random.Source
+	// Durability of sets, deletes and batches not setting their own
+	durability string
+
+	// Retries of idempotent requests and the backoff between them
+	maxRetries      int
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	maxRetryAfter   time.Duration
+
+	// Circuit breakers by endpoint host
+	breakers         map[string]*breaker
+	breakersLock     sync.Mutex
+	breakerThreshold int
+	breakerCooldown  time.Duration
 }
 
 func httpStatusToError(status int) error {
 	switch status {
 	case http.StatusInternalServerError:
 		return ErrInternal
+	case http.StatusInsufficientStorage:
+		return ErrDiskFull
+	case http.StatusTooManyRequests:
+		return ErrBusy
+	case http.StatusServiceUnavailable:
+		return ErrClosed
+	case http.StatusNotImplemented:
+		return ErrNotImplemented
 	case http.StatusBadRequest:
 		return ErrBadRequest
 	case http.StatusConflict:
 		return ErrConflict
 	case http.StatusNotFound:
 		return ErrNotFound
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrReadOnly
+	case http.StatusRequestEntityTooLarge:
+		return ErrValueTooLarge
+	case http.StatusMisdirectedRequest:
+		return ErrMoved
 	case http.StatusOK:
 		return nil
 	default:
@@ -61,15 +186,192 @@ func httpStatusToError(status int) error {
 	}
 }
 
-func NewClient(endpoint string) *Client {
-	c := &Client{endpoint: endpoint,
-		httpClient: &http.Client{Transport: &http.Transport{
-			MaxIdleConns:        10,
-			IdleConnTimeout:     30 * time.Second,
-			DisableCompression:  true,
-			MaxIdleConnsPerHost: 10,
-			DisableKeepAlives:   true,
-		}}}
+// responseToError converts a failed response into an error, the response
+// body is consulted to tell errors sharing the same status code apart
+func responseToError(httpResp *http.Response) error {
+	err := httpStatusToError(httpResp.StatusCode)
+	if err != ErrInternal && err != ErrReadOnly && err != ErrClosed {
+		return err
+	}
+
+	var resp BaseResponse
+	if json.NewDecoder(httpResp.Body).Decode(&resp) == nil {
+		switch resp.Error {
+		case ErrCorrupted.Error():
+			return ErrCorrupted
+		case ErrForbidden.Error():
+			return ErrForbidden
+		case ErrFrozen.Error():
+			return ErrFrozen
+		}
+	}
+	return err
+}
+
+// IsRetryable reports whether a request failed with err may succeed if it
+// is retried later
+func IsRetryable(err error) bool {
+	switch err {
+	case ErrBusy, ErrClosed, ErrDiskFull, ErrFrozen:
+		return true
+	default:
+		return false
+	}
+}
+
+// ClientOptions configures client timeouts, zero values mean defaults
+type ClientOptions struct {
+	// Time to establish a tcp connection
+	DialTimeout time.Duration
+	// Time to complete a tls handshake
+	TlsHandshakeTimeout time.Duration
+	// Time to wait for response headers once the request is written
+	RequestTimeout time.Duration
+	// Overall time limit of an operation including reading the response
+	OperationTimeout time.Duration
+	// Time source of polling waits and request signing and the source of
+	// retry jitter, nil means the system clock and a time seed
+	Clock  clock.Clock
+	Random random.Source
+	// Credentials sent with every request, nil sends none
+	Credentials *Credentials
+	// Tls config of https endpoints, nil means the system defaults, see
+	// NewTlsConfig
+	TlsConfig *tls.Config
+	// Durability of sets, deletes and batches, empty means the server
+	// default
+	Durability string
+
+	// Retries of idempotent requests failing with a connection error or a
+	// 5xx or 429 status, negative disables retries
+	MaxRetries int
+	// Wait before the first retry, doubled for every further retry up to
+	// MaxRetryBackoff. Up to half of a wait is skipped at random so clients
+	// failing together don't retry together.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+	// Longest Retry-After wait of the server honored, a failure asking to
+	// wait longer isn't retried
+	MaxRetryAfter time.Duration
+	// Idle connections kept open to every endpoint for reuse
+	MaxIdleConnsPerHost int
+	// Consecutive failed requests to an endpoint after which its requests
+	// fail with ErrCircuitOpen for BreakerCooldown, negative disables the
+	// circuit breaker
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+}
+
+// Credentials authenticate the client, Token is sent as a bearer token
+// while KeyId and Secret sign each request without sending the secret
+type Credentials = auth.Credentials
+
+const (
+	defaultDialTimeout         = 5 * time.Second
+	defaultTlsHandshakeTimeout = 5 * time.Second
+	defaultRequestTimeout      = 30 * time.Second
+	defaultOperationTimeout    = 60 * time.Second
+	defaultMaxRetries          = 3
+	defaultRetryBackoff        = 50 * time.Millisecond
+	defaultMaxRetryBackoff     = 2 * time.Second
+	defaultMaxRetryAfter       = 10 * time.Second
+	defaultMaxIdleConnsPerHost = 16
+	defaultBreakerThreshold    = 5
+	defaultBreakerCooldown     = 5 * time.Second
+)
+
+func (opts *ClientOptions) withDefaults() *ClientOptions {
+	o := ClientOptions{}
+	if opts != nil {
+		o = *opts
+	}
+
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = defaultDialTimeout
+	}
+	if o.TlsHandshakeTimeout <= 0 {
+		o.TlsHandshakeTimeout = defaultTlsHandshakeTimeout
+	}
+	if o.RequestTimeout <= 0 {
+		o.RequestTimeout = defaultRequestTimeout
+	}
+	if o.OperationTimeout <= 0 {
+		o.OperationTimeout = defaultOperationTimeout
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = defaultMaxRetries
+	} else if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+	if o.RetryBackoff <= 0 {
+		o.RetryBackoff = defaultRetryBackoff
+	}
+	if o.MaxRetryBackoff <= 0 {
+		o.MaxRetryBackoff = defaultMaxRetryBackoff
+	}
+	if o.MaxRetryAfter <= 0 {
+		o.MaxRetryAfter = defaultMaxRetryAfter
+	}
+	if o.MaxIdleConnsPerHost <= 0 {
+		o.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+	if o.BreakerThreshold == 0 {
+		o.BreakerThreshold = defaultBreakerThreshold
+	} else if o.BreakerThreshold < 0 {
+		o.BreakerThreshold = 0
+	}
+	if o.BreakerCooldown <= 0 {
+		o.BreakerCooldown = defaultBreakerCooldown
+	}
+	return &o
+}
+
+func NewClient(endpoints ...string) *Client {
+	return NewShardedClientWithOptions(endpoints, nil)
+}
+
+func NewClientWithOptions(endpoint string, opts *ClientOptions) *Client {
+	return NewShardedClientWithOptions([]string{endpoint}, opts)
+}
+
+// NewShardedClientWithOptions creates a client which partitions keys over
+// independent servers at endpoints
+func NewShardedClientWithOptions(endpoints []string, opts *ClientOptions) *Client {
+	opts = opts.withDefaults()
+	endpoints = append([]string(nil), endpoints...)
+	if len(endpoints) == 0 {
+		endpoints = append(endpoints, "")
+	}
+
+	dialer := &net.Dialer{
+		Timeout: opts.DialTimeout,
+	}
+
+	var transport http.RoundTripper = &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       opts.TlsConfig,
+		TLSHandshakeTimeout:   opts.TlsHandshakeTimeout,
+		ResponseHeaderTimeout: opts.RequestTimeout,
+		IdleConnTimeout:       30 * time.Second,
+		DisableCompression:    true,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+	}
+	if opts.Credentials != nil {
+		transport = &auth.Transport{Base: transport, Credentials: opts.Credentials, Clock: opts.Clock}
+	}
+
+	c := &Client{endpoint: endpoints[0], ring: newShardRing(endpoints), clock: clock.OrReal(opts.Clock),
+		random: opts.Random, durability: opts.Durability, maxRetries: opts.MaxRetries,
+		retryBackoff: opts.RetryBackoff, maxRetryBackoff: opts.MaxRetryBackoff, maxRetryAfter: opts.MaxRetryAfter,
+		breakers: make(map[string]*breaker), breakerThreshold: opts.BreakerThreshold,
+		breakerCooldown: opts.BreakerCooldown,
+		httpClient: &http.Client{
+			Timeout:   opts.OperationTimeout,
+			Transport: transport,
+		}}
+	if c.random == nil {
+		c.random = random.NewTimeSource()
+	}
 
 	return c
 }
@@ -78,103 +380,210 @@ func (c *Client) newRequestId() string {
 	return uuid.New()
 }
 
-func (c *Client) GetKey(key string) (string, error) {
+func (c *Client) GetKey(ctx context.Context, key string) (string, error) {
+	resp, err := c.getKey(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// GetKeyVersion returns the value with its version for SetKeyIf and
+// DeleteKeyIf
+func (c *Client) GetKeyVersion(ctx context.Context, key string) (string, uint64, error) {
+	resp, err := c.getKey(ctx, key)
+	if err != nil {
+		return "", 0, err
+	}
+	return resp.Value, resp.Version, nil
+}
+
+func (c *Client) getKey(ctx context.Context, key string) (*GetKeyResponse, error) {
 	if key == "" {
-		return "", ErrEmptyKey
+		return nil, ErrEmptyKey
 	}
 
+	current, previous := c.owners(key)
+	resp, err := c.getKeyFrom(ctx, current, key)
+	if err == ErrNotFound && previous != "" {
+		return c.getKeyFrom(ctx, previous, key)
+	}
+	return resp, err
+}
+
+func (c *Client) getKeyFrom(ctx context.Context, endpoint string, key string) (*GetKeyResponse, error) {
 	var req BaseRequest
 	req.RequestId = c.newRequestId()
 
 	reqBody, err := json.Marshal(&req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	httpReq, err := http.NewRequest("GET", c.endpoint+"/get/"+key, bytes.NewBuffer(reqBody))
+	httpReq, err := http.NewRequest("GET", endpoint+"/get/"+key, bytes.NewBuffer(reqBody))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Request-Id", req.RequestId)
 
-	httpResp, err := c.httpClient.Do(httpReq)
+	httpResp, err := c.do(ctx, httpReq, true)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer httpResp.Body.Close()
+	defer closeBody(httpResp)
 
-	err = httpStatusToError(httpResp.StatusCode)
+	err = responseToError(httpResp)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	var resp GetKeyResponse
 	err = json.NewDecoder(httpResp.Body).Decode(&resp)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return resp.Value, nil
+	return &resp, nil
+}
+
+func (c *Client) SetKey(ctx context.Context, key string, value string) error {
+	_, err := c.setKey(ctx, key, "", &SetKeyRequest{Value: value})
+	return err
+}
+
+// CreateKey sets the value only if the key doesn't exist, otherwise it
+// fails with ErrConflict
+func (c *Client) CreateKey(ctx context.Context, key string, value string) error {
+	_, err := c.setKey(ctx, key, "?mode=create", &SetKeyRequest{Value: value})
+	return err
+}
+
+// SetKeyTTL sets a value which reads as not found once ttl passed, ttl is
+// rounded up to whole seconds
+func (c *Client) SetKeyTTL(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrBadRequest
+	}
+
+	req := &SetKeyRequest{Value: value, TtlSeconds: int64((ttl + time.Second - 1) / time.Second)}
+	_, err := c.setKey(ctx, key, "", req)
+	return err
+}
+
+// SetKeyIf sets the value only if the current value has expectedVersion as
+// returned by GetKeyVersion, otherwise it fails with ErrConflict. It
+// returns the version of the new value.
+func (c *Client) SetKeyIf(ctx context.Context, key string, value string, expectedVersion uint64) (uint64, error) {
+	req := &SetKeyRequest{Value: value, CompareVersion: true, ExpectedVersion: expectedVersion}
+	return c.setKey(ctx, key, "", req)
 }
 
-func (c *Client) SetKey(key string, value string) error {
+func (c *Client) setKey(ctx context.Context, key string, query string, req *SetKeyRequest) (uint64, error) {
 	if key == "" {
-		return ErrEmptyKey
+		return 0, ErrEmptyKey
 	}
 
-	if value == "" {
-		return ErrEmptyValue
+	if req.Value == "" {
+		return 0, ErrEmptyValue
 	}
 
-	var req SetKeyRequest
-	req.RequestId = c.newRequestId()
-	req.Value = value
+	// a journaled write brings its own id so resends are deduplicated
+	if req.RequestId == "" {
+		req.RequestId = c.newRequestId()
+	}
+	if req.Durability == "" {
+		req.Durability = c.durability
+	}
 
-	reqBody, err := json.Marshal(&req)
+	reqBody, err := json.Marshal(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	httpResp, err := c.httpClient.Post(c.endpoint+"/set/"+key, "application/json", bytes.NewBuffer(reqBody))
+	httpReq, err := http.NewRequest("POST", c.GetShardFor(key)+"/set/"+key+query, bytes.NewBuffer(reqBody))
 	if err != nil {
-		return err
+		return 0, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Request-Id", req.RequestId)
+
+	// creates and conditional sets fail with ErrConflict once applied
+	httpResp, err := c.do(ctx, httpReq, query == "" && !req.CompareVersion)
+	if err != nil {
+		return 0, err
 	}
-	defer httpResp.Body.Close()
+	defer closeBody(httpResp)
 
-	err = httpStatusToError(httpResp.StatusCode)
+	err = responseToError(httpResp)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	var resp BaseResponse
+	var resp SetKeyResponse
 	err = json.NewDecoder(httpResp.Body).Decode(&resp)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	return nil
+	return resp.Version, nil
 }
 
-func (c *Client) DeleteKey(key string) error {
+func (c *Client) DeleteKey(ctx context.Context, key string) error {
 	if key == "" {
 		return ErrEmptyKey
 	}
 
-	var req BaseRequest
-	req.RequestId = c.newRequestId()
+	// a key is deleted if either endpoint had it during a rebalance
+	current, previous := c.owners(key)
+	err := c.deleteKey(ctx, current, key, &DeleteKeyRequest{})
+	if previous != "" && (err == nil || err == ErrNotFound) {
+		prevErr := c.deleteKey(ctx, previous, key, &DeleteKeyRequest{})
+		if err == ErrNotFound {
+			err = prevErr
+		}
+	}
+	return err
+}
 
-	reqBody, err := json.Marshal(&req)
+// DeleteKeyIf deletes the value only if it has expectedVersion, otherwise
+// it fails with ErrConflict
+func (c *Client) DeleteKeyIf(ctx context.Context, key string, expectedVersion uint64) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	req := &DeleteKeyRequest{CompareVersion: true, ExpectedVersion: expectedVersion}
+	return c.deleteKey(ctx, c.GetShardFor(key), key, req)
+}
+
+func (c *Client) deleteKey(ctx context.Context, endpoint string, key string, req *DeleteKeyRequest) error {
+	if req.RequestId == "" {
+		req.RequestId = c.newRequestId()
+	}
+	if req.Durability == "" {
+		req.Durability = c.durability
+	}
+
+	reqBody, err := json.Marshal(req)
 	if err != nil {
 		return err
 	}
 
-	httpResp, err := c.httpClient.Post(c.endpoint+"/delete/"+key, "application/json", bytes.NewBuffer(reqBody))
+	httpReq, err := http.NewRequest("POST", endpoint+"/delete/"+key, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return err
 	}
-	defer httpResp.Body.Close()
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("X-Request-Id", req.RequestId)
 
-	err = httpStatusToError(httpResp.StatusCode)
+	httpResp, err := c.do(ctx, httpReq, !req.CompareVersion)
+	if err != nil {
+		return err
+	}
+	defer closeBody(httpResp)
+
+	err = responseToError(httpResp)
 	if err != nil {
 		return err
 	}
@@ -187,3 +596,84 @@ func (c *Client) DeleteKey(key string) error {
 
 	return nil
 }
+
+// GetKeyRaw fetches the value as a raw response body, skipping json
+// encoding which matters for large values
+func (c *Client) GetKeyRaw(ctx context.Context, key string) (string, error) {
+	value, err := c.GetKeyBytes(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// ScanKeys returns up to limit pairs with keys in [startKey, endKey) in key
+// order, empty endKey means no upper bound and limit <= 0 the server maximum.
+// Every endpoint is scanned and the pages are merged.
+func (c *Client) ScanKeys(ctx context.Context, startKey string, endKey string, limit int) ([]KeyValue, error) {
+	if limit <= 0 || limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	c.ringLock.RLock()
+	endpoints := append([]string(nil), c.ring.endpoints...)
+	if c.prevRing != nil {
+		endpoints = append(endpoints, c.prevRing.endpoints...)
+	}
+	c.ringLock.RUnlock()
+
+	scanned := make(map[string]bool)
+	values := make(map[string]string)
+	// keys past the end of a full page may be missing from the merge
+	bound := ""
+	for _, endpoint := range endpoints {
+		if scanned[endpoint] {
+			continue
+		}
+		scanned[endpoint] = true
+
+		page, err := c.scanKeysAt(ctx, endpoint, startKey, endKey, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == limit && (bound == "" || page[len(page)-1].Key < bound) {
+			bound = page[len(page)-1].Key
+		}
+
+		// the current owner wins over a copy not yet moved away from the
+		// previous one, other copies are leftovers of a rebalance
+		for _, item := range page {
+			current, previous := c.owners(item.Key)
+			_, found := values[item.Key]
+			if endpoint == current || (endpoint == previous && !found) {
+				values[item.Key] = item.Value
+			}
+		}
+	}
+
+	result := make([]KeyValue, 0, len(values))
+	for key, value := range values {
+		if bound == "" || key <= bound {
+			result = append(result, KeyValue{Key: key, Value: value})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	return result, nil
+}
+
+func (c *Client) scanKeysAt(ctx context.Context, endpoint string, startKey string, endKey string, limit int) ([]KeyValue, error) {
+	query := url.Values{}
+	query.Set("start", startKey)
+	query.Set("end", endKey)
+	query.Set("limit", strconv.Itoa(limit))
+
+	var resp ScanResponse
+	err := c.getJsonTo(ctx, endpoint, "/scan?"+query.Encode(), &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Items, nil
+}
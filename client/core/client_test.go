@@ -1,10 +1,24 @@
 package client
 
 import (
+	"context"
+	"ddb/lib/common/auth"
+	"ddb/lib/common/clock"
 	"ddb/lib/common/random"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func testSetGetDeleteThread(t *testing.T, c *Client, wg *sync.WaitGroup) {
@@ -15,12 +29,12 @@ func testSetGetDeleteThread(t *testing.T, c *Client, wg *sync.WaitGroup) {
 		key := random.GenerateRandomHexString(8)
 		value := random.GenerateRandomHexString(16)
 
-		err := c.SetKey(key, value)
+		err := c.SetKey(context.Background(), key, value)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		rvalue, err := c.GetKey(key)
+		rvalue, err := c.GetKey(context.Background(), key)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -31,12 +45,12 @@ func testSetGetDeleteThread(t *testing.T, c *Client, wg *sync.WaitGroup) {
 
 		}
 
-		err = c.DeleteKey(key)
+		err = c.DeleteKey(context.Background(), key)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		_, err = c.GetKey(key)
+		_, err = c.GetKey(context.Background(), key)
 		if err != ErrNotFound {
 			t.Fatal(fmt.Errorf("Unexpected get deleted key error %v", err))
 		}
@@ -61,7 +75,7 @@ func testSetThread(t *testing.T, c *Client, wg *sync.WaitGroup) {
 		key := random.GenerateRandomHexString(8)
 		value := random.GenerateRandomHexString(16)
 
-		err := c.SetKey(key, value)
+		err := c.SetKey(context.Background(), key, value)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -77,3 +91,747 @@ func TestSet(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+func TestShardRing(t *testing.T) {
+	endpoints := []string{"http://a:8080", "http://b:8080", "http://c:8080"}
+	c := NewClient(endpoints...)
+
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 30000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owner := c.GetShardFor(key)
+		if owner != c.GetShardFor(key) {
+			t.Fatalf("key %s owner isn't stable", key)
+		}
+		counts[owner]++
+		owners[key] = owner
+	}
+	for _, endpoint := range endpoints {
+		if counts[endpoint] < 7000 || counts[endpoint] > 13000 {
+			t.Fatalf("unbalanced shards %v", counts)
+		}
+	}
+
+	// a new endpoint takes keys only from the others
+	c.SetEndpoints(append(endpoints, "http://d:8080")...)
+	moved := 0
+	for key, owner := range owners {
+		current, previous := c.owners(key)
+		if current == owner {
+			if previous != "" {
+				t.Fatalf("key %s didn't move but has previous owner %s", key, previous)
+			}
+			continue
+		}
+		if current != "http://d:8080" || previous != owner {
+			t.Fatalf("key %s moved from %s to %s previous %s", key, owner, current, previous)
+		}
+		moved++
+	}
+	if moved < 4000 || moved > 11000 {
+		t.Fatalf("unexpected moved keys %d", moved)
+	}
+
+	c.FinishRebalance()
+	if _, previous := c.owners("key1"); previous != "" {
+		t.Fatalf("previous owner %s after rebalance", previous)
+	}
+}
+
+func TestRequestSigning(t *testing.T) {
+	const secret = "secret"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		scheme, param, err := auth.ParseAuthorization(r.Header.Get("Authorization"))
+		if err != nil || scheme != auth.SchemeHmac {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		keyId, signature, err := auth.ParseSigned(param)
+		date := r.Header.Get(auth.DateHeader)
+		contentHash := r.Header.Get(auth.ContentHashHeader)
+		if err != nil || keyId != "app1" || contentHash != auth.ContentHash(body) ||
+			signature != auth.Signature(secret, r.Method, r.Host, r.URL.RequestURI(), date, r.Header.Get(auth.RequestIdHeader), contentHash) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version": 1}`)
+	}))
+	defer server.Close()
+
+	c := NewClientWithOptions(server.URL, &ClientOptions{Credentials: &Credentials{KeyId: "app1", Secret: secret}})
+	err := c.SetKey(context.Background(), "app1/key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = NewClientWithOptions(server.URL, &ClientOptions{Credentials: &Credentials{KeyId: "app1", Secret: "wrong"}})
+	err = c.SetKey(context.Background(), "app1/key", "value")
+	if err != ErrUnauthorized {
+		t.Fatalf("wrong secret error %v", err)
+	}
+
+	c = NewClient(server.URL)
+	_, err = c.SetKeyStream(context.Background(), "app1/key", strings.NewReader("value"), 5, nil)
+	if err != ErrUnauthorized {
+		t.Fatalf("unsigned error %v", err)
+	}
+}
+
+func TestReport(t *testing.T) {
+	var report NodeReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/report" || json.NewDecoder(r.Body).Decode(&report) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if report.Version < 10 {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		fmt.Fprint(w, `{"config": {"maxValueSize": 1024}}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	config, err := c.Report(context.Background(), &NodeReport{Id: "node1", Version: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config != nil || report.Id != "node1" || report.RequestId == "" {
+		t.Fatalf("report %+v config %+v", report, config)
+	}
+
+	config, err = c.Report(context.Background(), &NodeReport{Id: "node1", Version: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config == nil || config.MaxValueSize != 1024 || config.MergeTimeoutMs != 0 {
+		t.Fatalf("pushed config %+v", config)
+	}
+}
+
+func TestTls(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version": 1}`)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ddb-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = ioutil.WriteFile(caFile, ca, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(server.URL)
+	err = c.SetKey(context.Background(), "key", "value")
+	if err == nil {
+		t.Fatal("untrusted server accepted")
+	}
+
+	tlsConfig, err := NewTlsConfig(caFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = NewClientWithOptions(server.URL, &ClientOptions{TlsConfig: tlsConfig})
+	err = c.SetKey(context.Background(), "key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/get/slowHeaders":
+			select {
+			case <-time.After(time.Second):
+			case <-done:
+			}
+		case "/get/slowBody":
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprint(w, `{"value": `)
+			w.(http.Flusher).Flush()
+			select {
+			case <-time.After(time.Second):
+			case <-done:
+			}
+		}
+		fmt.Fprint(w, `{"value": "value"}`)
+	}))
+	defer server.Close()
+	defer close(done)
+
+	opts := &ClientOptions{RequestTimeout: 100 * time.Millisecond, OperationTimeout: 300 * time.Millisecond,
+		MaxRetries: -1, BreakerThreshold: -1}
+	c := NewClientWithOptions(server.URL, opts)
+	expected := []struct {
+		key string
+		min time.Duration
+		max time.Duration
+	}{
+		// headers not sent within the request timeout
+		{"slowHeaders", opts.RequestTimeout, opts.OperationTimeout},
+		// headers in time but the body not read within the operation
+		// timeout
+		{"slowBody", opts.OperationTimeout, time.Second},
+	}
+	for _, e := range expected {
+		start := time.Now()
+		_, err := c.GetKey(context.Background(), e.key)
+		elapsed := time.Since(start)
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Fatalf("get %s error %v", e.key, err)
+		}
+		if elapsed < e.min || elapsed >= e.max {
+			t.Fatalf("get %s timed out after %v expected %v-%v", e.key, elapsed, e.min, e.max)
+		}
+	}
+
+	value, err := c.GetKey(context.Background(), "fast")
+	if err != nil || value != "value" {
+		t.Fatalf("get value %s error %v", value, err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var lock sync.Mutex
+	ids := make([]string, 0)
+	failures := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		ids = append(ids, r.Header.Get("X-Request-Id"))
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version": 1}`)
+	}))
+	defer server.Close()
+
+	c := NewClientWithOptions(server.URL, &ClientOptions{RetryBackoff: time.Millisecond})
+	failures = 2
+	err := c.SetKey(context.Background(), "key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 || ids[0] == "" || ids[1] != ids[0] || ids[2] != ids[0] {
+		t.Fatalf("retried request ids %v", ids)
+	}
+
+	// creates aren't idempotent
+	ids = ids[:0]
+	failures = 1
+	err = c.CreateKey(context.Background(), "key", "value")
+	if err != ErrClosed || len(ids) != 1 {
+		t.Fatalf("create error %v attempts %d", err, len(ids))
+	}
+
+	failures = 10
+	err = c.SetKey(context.Background(), "key", "value")
+	if err != ErrClosed || failures != 6 {
+		t.Fatalf("exhausted retries error %v failures left %d", err, failures)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = c.GetKey(ctx, "key")
+	if err != context.Canceled {
+		t.Fatalf("canceled get error %v", err)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	retryAfter := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"value": "value"}`)
+	}))
+	defer server.Close()
+
+	c := NewClientWithOptions(server.URL, &ClientOptions{RetryBackoff: time.Millisecond, MaxRetryAfter: 2 * time.Second})
+	retryAfter = "1"
+	start := time.Now()
+	if _, err := c.GetKey(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 || time.Since(start) < time.Second {
+		t.Fatalf("attempts %d after %v", attempts, time.Since(start))
+	}
+
+	// a longer wait than MaxRetryAfter fails at once
+	attempts = 0
+	retryAfter = "60"
+	if _, err := c.GetKey(context.Background(), "key"); err != ErrBusy || attempts != 1 {
+		t.Fatalf("error %v attempts %d", err, attempts)
+	}
+}
+
+func TestRetryJitter(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"value": "value"}`)
+	}))
+	defer server.Close()
+
+	clk := clock.NewManual(time.Unix(1000, 0))
+	opts := &ClientOptions{Clock: clk, Random: random.NewSource(7), RetryBackoff: time.Second, MaxRetryBackoff: 10 * time.Second}
+	c := NewClientWithOptions(server.URL, opts)
+
+	// a client of the same seed draws the same waits
+	expected := NewClientWithOptions(server.URL, &ClientOptions{Random: random.NewSource(7), RetryBackoff: time.Second, MaxRetryBackoff: 10 * time.Second})
+	waits := []time.Duration{expected.backoff(1), expected.backoff(2)}
+	for i, wait := range waits {
+		full := time.Second << uint(i)
+		if wait < full/2 || wait > full {
+			t.Fatalf("wait %v of retry %d not within half of %v", wait, i+1, full)
+		}
+	}
+	if waits[0] == time.Second && waits[1] == 2*time.Second {
+		t.Fatalf("waits %v without jitter", waits)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := c.GetKey(context.Background(), "key")
+		done <- err
+	}()
+	for _, wait := range waits {
+		for clk.Waiting() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		// the retry waits exactly the drawn time
+		clk.Advance(wait - time.Nanosecond)
+		if clk.Waiting() != 1 {
+			t.Fatalf("retry before its wait %v", wait)
+		}
+		clk.Advance(time.Nanosecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Fatalf("attempts %d", attempts)
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	var lock sync.Mutex
+	attempts := 0
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		attempts++
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"value": "value"}`)
+	}))
+	defer server.Close()
+
+	mc := clock.NewManual(time.Now())
+	c := NewClientWithOptions(server.URL, &ClientOptions{Clock: mc, MaxRetries: -1,
+		BreakerThreshold: 3, BreakerCooldown: time.Second})
+	for i := 0; i < 3; i++ {
+		if _, err := c.GetKey(context.Background(), "key"); err != ErrInternal {
+			t.Fatalf("failing get error %v", err)
+		}
+	}
+	if _, err := c.GetKey(context.Background(), "key"); err != ErrCircuitOpen || attempts != 3 {
+		t.Fatalf("open breaker error %v attempts %d", err, attempts)
+	}
+	if c.BreakerState(server.URL) != BreakerOpen {
+		t.Fatalf("breaker state %s", c.BreakerState(server.URL))
+	}
+
+	// a failed probe opens the breaker again
+	mc.Advance(time.Second)
+	if _, err := c.GetKey(context.Background(), "key"); err != ErrInternal || attempts != 4 {
+		t.Fatalf("probe error %v attempts %d", err, attempts)
+	}
+	if _, err := c.GetKey(context.Background(), "key"); err != ErrCircuitOpen {
+		t.Fatalf("reopened breaker error %v", err)
+	}
+
+	failing = false
+	mc.Advance(time.Second)
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetKey(context.Background(), "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.BreakerState(server.URL) != BreakerClosed {
+		t.Fatalf("breaker state %s", c.BreakerState(server.URL))
+	}
+}
+
+func TestSplitErrors(t *testing.T) {
+	c := NewClient("http://127.0.0.1:1")
+	if _, err := c.Split(context.Background(), "b", "a", "http://127.0.0.1:2"); err != ErrBadRequest {
+		t.Fatalf("error %v", err)
+	}
+	if _, err := c.Split(context.Background(), "a", "", ""); err != ErrBadRequest {
+		t.Fatalf("error %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusMisdirectedRequest)
+		fmt.Fprint(w, `{"error": "Moved"}`)
+	}))
+	defer server.Close()
+
+	c = NewClient(server.URL)
+	if _, err := c.GetKey(context.Background(), "key"); err != ErrMoved {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestParallelBatch(t *testing.T) {
+	handler := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			var req BatchRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			time.Sleep(200 * time.Millisecond)
+
+			var resp BatchResponse
+			for _, op := range req.Operations {
+				resp.Results = append(resp.Results, BatchResult{Key: op.Key, Value: name})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(&resp)
+		}
+	}
+	a := httptest.NewServer(handler("a"))
+	defer a.Close()
+	b := httptest.NewServer(handler("b"))
+	defer b.Close()
+
+	c := NewClient(a.URL, b.URL)
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%d", i)
+	}
+
+	start := time.Now()
+	kv, err := c.BatchGet(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Fatalf("endpoints queried one by one in %v", elapsed)
+	}
+	for _, key := range keys {
+		owner := "a"
+		if c.GetShardFor(key) == b.URL {
+			owner = "b"
+		}
+		if kv[key] != owner {
+			t.Fatalf("key %s value %q owner %s", key, kv[key], owner)
+		}
+	}
+}
+
+func TestLeaderRedirect(t *testing.T) {
+	var lock sync.Mutex
+	value := ""
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req SetKeyRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		lock.Lock()
+		value = req.Value
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"version": 7}`)
+	}))
+	defer leader.Close()
+
+	// a deposed leader names the new one in the error payload
+	deposed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, `{"error": "Not leader", "retryAfter": 1, "leader": %q}`, leader.URL)
+	}))
+	defer deposed.Close()
+
+	c := NewClient(deposed.URL)
+	start := time.Now()
+	// creates aren't retried but still follow the leader
+	if err := c.CreateKey(context.Background(), "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if value != "value" || time.Since(start) >= time.Second {
+		t.Fatalf("leader got %q after %v", value, time.Since(start))
+	}
+}
+
+func TestJournal(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestJournal_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	var lock sync.Mutex
+	failing := true
+	ids := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var req SetKeyRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		ids[r.Header.Get("X-Request-Id")] = req.Value
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	c := NewClientWithOptions(server.URL, &ClientOptions{MaxRetries: -1, BreakerThreshold: -1})
+	path := filepath.Join(rootPath, "journal")
+	j, err := OpenJournal(c, path, &JournalOptions{RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := j.Set(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if j.Pending() != 3 {
+		t.Fatalf("pending %d while the server fails", j.Pending())
+	}
+	j.Close()
+
+	// a restarted process delivers the writes journaled before
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	j, err = OpenJournal(c, path, &JournalOptions{RetryInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := j.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(ids) != 3 {
+		t.Fatalf("delivered %v", ids)
+	}
+}
+
+func TestJournalExpired(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestJournalExpired_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	var lock sync.Mutex
+	failing := true
+	requests := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	clk := clock.NewManual(time.Unix(1000, 0))
+	c := NewClientWithOptions(server.URL, &ClientOptions{Clock: clk, MaxRetries: -1, BreakerThreshold: -1})
+	path := filepath.Join(rootPath, "journal")
+	j, err := OpenJournal(c, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.SetTTL("a", "1", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Set("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	// the set of a expired while the journal was closed, it's neither
+	// sent nor turned into a delete
+	clk.Advance(2 * time.Second)
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	j, err = OpenJournal(c, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := j.Wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(requests) != 1 || requests[0] != "POST /set/b" {
+		t.Fatalf("requests %v", requests)
+	}
+}
+
+func TestFake(t *testing.T) {
+	ctx := context.Background()
+	clk := clock.NewManual(time.Unix(1000, 0))
+	var kv KVClient = NewFake(clk)
+
+	if err := kv.CreateKey(ctx, "a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := kv.CreateKey(ctx, "a", "2"); err != ErrConflict {
+		t.Fatalf("error %v", err)
+	}
+	_, version, err := kv.GetKeyVersion(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kv.SetKeyIf(ctx, "a", "3", version+1); err != ErrConflict {
+		t.Fatalf("error %v", err)
+	}
+	if err := kv.SetKeyTTL(ctx, "b", "2", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Second)
+	if _, err := kv.GetKey(ctx, "b"); err != ErrNotFound {
+		t.Fatalf("error %v", err)
+	}
+
+	txn := kv.Begin()
+	txn.Set("c", "3")
+	txn.Delete("a")
+	if err := txn.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pairs, err := kv.ScanKeys(ctx, "", "", 0)
+	if err != nil || len(pairs) != 1 || pairs[0].Key != "c" {
+		t.Fatalf("pairs %v error %v", pairs, err)
+	}
+
+	mock := &KVClientMock{GetKeyFunc: func(ctx context.Context, key string) (string, error) {
+		return "", ErrBusy
+	}}
+	kv = mock
+	if _, err := kv.GetKey(ctx, "d"); err != ErrBusy || len(mock.GetKeyCalls()) != 1 {
+		t.Fatalf("error %v calls %d", err, len(mock.GetKeyCalls()))
+	}
+}
+
+func TestTypedValues(t *testing.T) {
+	type point struct {
+		X int `json:"x"`
+		Y int `json:"y"`
+	}
+
+	ctx := context.Background()
+	kv := NewFake(nil)
+	if _, err := SetJson(ctx, kv, "p", point{1, 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	p, err := GetJson[point](ctx, kv, "p")
+	if err != nil || p.X != 1 || p.Y != 2 {
+		t.Fatalf("point %v error %v", p, err)
+	}
+
+	// untagged json reads fine, tagged values of another type don't
+	if err := kv.SetKey(ctx, "q", `{"x": 3}`); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = GetJson[point](ctx, kv, "q"); err != nil || p.X != 3 {
+		t.Fatalf("point %v error %v", p, err)
+	}
+	if err := kv.SetKey(ctx, "r", contentTagPrefix+ContentTypeProto+"\x00data"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetJson[point](ctx, kv, "r"); err != ErrContentType {
+		t.Fatalf("error %v", err)
+	}
+
+	if _, err := SetJson(ctx, kv, "s", strings.Repeat("a", 100), &RawSetOptions{MaxValueSize: 64}); err != ErrValueTooLarge {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestGetOrSet(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req TxnRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || r.URL.Path != "/txn" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if len(req.Compare) != 1 || req.Compare[0].Version != 0 || req.Success[0].Value != "default" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"succeeded": false, "results": [{"key": "key", "value": "existing"}]}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL)
+	value, created, err := c.GetOrSet(context.Background(), "key", "default")
+	if err != nil || created || value != "existing" {
+		t.Fatalf("value %s created %v error %v", value, created, err)
+	}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"context"
+)
+
+// NodeConfig holds the settings of a server which can be changed while it
+// runs, zero fields of a pushed config leave the setting unchanged
+type NodeConfig struct {
+	// Largest accepted value in bytes
+	MaxValueSize int64 `json:"maxValueSize,omitempty"`
+	// Interval between sstable merges in milliseconds
+	MergeTimeoutMs int `json:"mergeTimeoutMs,omitempty"`
+	// Log verbosity from -2 (errors only) to 1 (debug), nil leaves it
+	// unchanged as 0 is the info level
+	LogLevel *int `json:"logLevel,omitempty"`
+	// Fraction of api requests captured into /admin/samples, nil leaves it
+	// unchanged
+	RequestSampleRate *float64 `json:"requestSampleRate,omitempty"`
+}
+
+// NodeStats are the request counts and storage stats of a server
+type NodeStats struct {
+	SetKeys    int `json:"setKeys"`
+	GetKeys    int `json:"getKeys"`
+	DeleteKeys int `json:"deleteKeys"`
+	Batches    int `json:"batches"`
+	Scans      int `json:"scans"`
+
+	CacheHits   int64 `json:"cacheHits"`
+	CacheMisses int64 `json:"cacheMisses"`
+	CacheSize   int64 `json:"cacheSize"`
+
+	Tables       int   `json:"tables"`
+	PendingBytes int64 `json:"pendingBytes"`
+	Merges       int64 `json:"merges"`
+
+	PrefixCounts map[string]int64 `json:"prefixCounts,omitempty"`
+}
+
+// NodeReport is what a server periodically tells its controller about
+// itself
+type NodeReport struct {
+	BaseRequest
+	Id         string `json:"id"`
+	ApiAddress string `json:"apiAddress"`
+	// primary, follower or the raft role of the node
+	Role string `json:"role"`
+	// Version of the latest write
+	Version uint64 `json:"version"`
+	// Unix nanoseconds
+	StartedAt  int64      `json:"startedAt"`
+	ReportedAt int64      `json:"reportedAt"`
+	Stats      NodeStats  `json:"stats"`
+	Config     NodeConfig `json:"config"`
+}
+
+// ReportResponse may carry a config the controller pushes to the server
+type ReportResponse struct {
+	BaseResponse
+	Config *NodeConfig `json:"config,omitempty"`
+}
+
+// ReadyResponse tells whether the server serves requests, warnings name
+// conditions which degrade it without stopping it
+type ReadyResponse struct {
+	BaseResponse
+	Ready    bool     `json:"ready"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+type ConfigRequest struct {
+	BaseRequest
+	Config NodeConfig `json:"config"`
+}
+
+type ConfigResponse struct {
+	BaseResponse
+	Config NodeConfig `json:"config"`
+}
+
+// Report sends a node report to a controller, the client has to be created
+// with the controller url as its endpoint. It returns the config pushed in
+// the response, nil if there is none.
+func (c *Client) Report(ctx context.Context, report *NodeReport) (*NodeConfig, error) {
+	report.RequestId = c.newRequestId()
+
+	var resp ReportResponse
+	err := c.postJson(ctx, "/report", report, &resp, true)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Config, nil
+}
+
+// GetConfig returns the live config of the server, it is an admin request
+func (c *Client) GetConfig(ctx context.Context) (*NodeConfig, error) {
+	var resp ConfigResponse
+	err := c.getJson(ctx, "/admin/config", &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Config, nil
+}
+
+// SetConfig changes the live config of the server and returns the config
+// in effect, it is an admin request
+func (c *Client) SetConfig(ctx context.Context, config *NodeConfig) (*NodeConfig, error) {
+	var req ConfigRequest
+	req.RequestId = c.newRequestId()
+	req.Config = *config
+
+	var resp ConfigResponse
+	err := c.postJson(ctx, "/admin/config", &req, &resp, true)
+	if err != nil {
+		return nil, err
+	}
+	return &resp.Config, nil
+}
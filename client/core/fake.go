@@ -0,0 +1,442 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"ddb/lib/common/clock"
+)
+
+// Fake is an in-memory KVClient for unit tests, it follows the server
+// semantics of versions, expiration, conditional writes and transactions
+type Fake struct {
+	lock    sync.Mutex
+	clock   clock.Clock
+	values  map[string]fakeValue
+	version uint64
+}
+
+type fakeValue struct {
+	value   []byte
+	version uint64
+	// Zero means never
+	expiresAt time.Time
+}
+
+var _ KVClient = (*Fake)(nil)
+
+// NewFake returns an empty fake, expiration follows clk or the system
+// clock if it's nil
+func NewFake(clk clock.Clock) *Fake {
+	return &Fake{clock: clock.OrReal(clk), values: make(map[string]fakeValue)}
+}
+
+// get returns the live value of key, caller must hold lock
+func (f *Fake) get(key string) (fakeValue, bool) {
+	v, ok := f.values[key]
+	if !ok {
+		return fakeValue{}, false
+	}
+	if !v.expiresAt.IsZero() && !f.clock.Now().Before(v.expiresAt) {
+		delete(f.values, key)
+		return fakeValue{}, false
+	}
+	return v, true
+}
+
+// set stores a copy of value and returns its version, caller must hold lock
+func (f *Fake) set(key string, value []byte, opts *RawSetOptions) (uint64, error) {
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+	if len(value) == 0 {
+		return 0, ErrEmptyValue
+	}
+
+	o := RawSetOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.MaxValueSize > 0 && int64(len(value)) > o.MaxValueSize {
+		return 0, ErrValueTooLarge
+	}
+	current, ok := f.get(key)
+	if o.Create && ok {
+		return 0, ErrConflict
+	}
+	if o.CompareVersion && current.version != o.ExpectedVersion {
+		return 0, ErrConflict
+	}
+
+	f.version++
+	v := fakeValue{value: append([]byte(nil), value...), version: f.version}
+	if o.Ttl > 0 {
+		v.expiresAt = f.clock.Now().Add((o.Ttl + time.Second - 1) / time.Second * time.Second)
+	}
+	f.values[key] = v
+	return v.version, nil
+}
+
+// del deletes key, caller must hold lock
+func (f *Fake) del(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	if _, ok := f.get(key); !ok {
+		return ErrNotFound
+	}
+	delete(f.values, key)
+	return nil
+}
+
+// apply runs a batch operation, caller must hold lock
+func (f *Fake) apply(op BatchOperation) BatchResult {
+	result := BatchResult{Key: op.Key}
+	var err error
+	switch {
+	case op.Key == "":
+		err = ErrBadRequest
+	case op.Op == BatchOpSet:
+		if op.Value == "" {
+			err = ErrBadRequest
+		} else {
+			result.Version, err = f.set(op.Key, []byte(op.Value), nil)
+		}
+	case op.Op == BatchOpGet:
+		v, ok := f.get(op.Key)
+		if ok {
+			result.Value = string(v.value)
+			result.Version = v.version
+		} else {
+			err = ErrNotFound
+		}
+	case op.Op == BatchOpDelete:
+		err = f.del(op.Key)
+	default:
+		err = ErrBadRequest
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (f *Fake) GetKey(ctx context.Context, key string) (string, error) {
+	value, _, err := f.GetKeyVersion(ctx, key)
+	return value, err
+}
+
+func (f *Fake) GetKeyVersion(ctx context.Context, key string) (string, uint64, error) {
+	value, version, err := f.getKey(key)
+	return string(value), version, err
+}
+
+func (f *Fake) getKey(key string) ([]byte, uint64, error) {
+	if key == "" {
+		return nil, 0, ErrEmptyKey
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	v, ok := f.get(key)
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	return append([]byte(nil), v.value...), v.version, nil
+}
+
+func (f *Fake) GetKeyRaw(ctx context.Context, key string) (string, error) {
+	return f.GetKey(ctx, key)
+}
+
+func (f *Fake) GetKeyBytes(ctx context.Context, key string) ([]byte, error) {
+	value, _, err := f.getKey(key)
+	return value, err
+}
+
+func (f *Fake) GetKeyStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	value, _, err := f.getKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(value)), nil
+}
+
+func (f *Fake) SetKey(ctx context.Context, key string, value string) error {
+	_, err := f.SetKeyBytes(ctx, key, []byte(value), nil)
+	return err
+}
+
+func (f *Fake) CreateKey(ctx context.Context, key string, value string) error {
+	_, err := f.SetKeyBytes(ctx, key, []byte(value), &RawSetOptions{Create: true})
+	return err
+}
+
+func (f *Fake) SetKeyTTL(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrBadRequest
+	}
+	_, err := f.SetKeyBytes(ctx, key, []byte(value), &RawSetOptions{Ttl: ttl})
+	return err
+}
+
+func (f *Fake) SetKeyIf(ctx context.Context, key string, value string, expectedVersion uint64) (uint64, error) {
+	return f.SetKeyBytes(ctx, key, []byte(value), &RawSetOptions{CompareVersion: true, ExpectedVersion: expectedVersion})
+}
+
+func (f *Fake) SetKeyBytes(ctx context.Context, key string, value []byte, opts *RawSetOptions) (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.set(key, value, opts)
+}
+
+func (f *Fake) SetKeyStream(ctx context.Context, key string, r io.Reader, size int64, opts *RawSetOptions) (uint64, error) {
+	if size <= 0 {
+		return 0, ErrEmptyValue
+	}
+
+	value := make([]byte, size)
+	_, err := io.ReadFull(r, value)
+	if err != nil {
+		return 0, err
+	}
+	return f.SetKeyBytes(ctx, key, value, opts)
+}
+
+func (f *Fake) DeleteKey(ctx context.Context, key string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	return f.del(key)
+}
+
+func (f *Fake) DeleteKeyIf(ctx context.Context, key string, expectedVersion uint64) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	v, ok := f.get(key)
+	if v.version != expectedVersion {
+		return ErrConflict
+	}
+	if !ok {
+		return ErrNotFound
+	}
+	delete(f.values, key)
+	return nil
+}
+
+func (f *Fake) DeleteKeys(ctx context.Context, keys []string) ([]error, error) {
+	if len(keys) > MaxBatchOperations {
+		return nil, ErrBadRequest
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, key := range keys {
+		if key == "" {
+			return nil, ErrBadRequest
+		}
+	}
+	errs := make([]error, len(keys))
+	for i, key := range keys {
+		errs[i] = f.del(key)
+	}
+	return errs, nil
+}
+
+func (f *Fake) ScanKeys(ctx context.Context, startKey string, endKey string, limit int) ([]KeyValue, error) {
+	if limit <= 0 || limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		if key >= startKey && (endKey == "" || key < endKey) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	pairs := make([]KeyValue, 0)
+	for _, key := range keys {
+		if len(pairs) == limit {
+			break
+		}
+		if v, ok := f.get(key); ok {
+			pairs = append(pairs, KeyValue{Key: key, Value: string(v.value)})
+		}
+	}
+	return pairs, nil
+}
+
+func (f *Fake) Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	if len(ops) > MaxBatchOperations {
+		return nil, ErrBadRequest
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = f.apply(op)
+	}
+	return results, nil
+}
+
+func (f *Fake) BatchSet(ctx context.Context, kv map[string]string) error {
+	ops := make([]BatchOperation, 0, len(kv))
+	for key, value := range kv {
+		if key == "" {
+			return ErrEmptyKey
+		}
+		if value == "" {
+			return ErrEmptyValue
+		}
+		ops = append(ops, BatchOperation{Op: BatchOpSet, Key: key, Value: value})
+	}
+	return f.batchErr(ctx, ops)
+}
+
+func (f *Fake) BatchGet(ctx context.Context, keys []string) (map[string]string, error) {
+	ops := make([]BatchOperation, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			return nil, ErrEmptyKey
+		}
+		ops = append(ops, BatchOperation{Op: BatchOpGet, Key: key})
+	}
+
+	results, err := f.Batch(ctx, ops)
+	if err != nil {
+		return nil, err
+	}
+	kv := make(map[string]string, len(results))
+	for _, result := range results {
+		if result.Error == "" {
+			kv[result.Key] = result.Value
+		}
+	}
+	return kv, nil
+}
+
+func (f *Fake) BatchDelete(ctx context.Context, keys []string) error {
+	ops := make([]BatchOperation, 0, len(keys))
+	for _, key := range keys {
+		if key == "" {
+			return ErrEmptyKey
+		}
+		ops = append(ops, BatchOperation{Op: BatchOpDelete, Key: key})
+	}
+	return f.batchErr(ctx, ops)
+}
+
+// batchErr runs ops and returns the first operation error
+func (f *Fake) batchErr(ctx context.Context, ops []BatchOperation) error {
+	results, err := f.Batch(ctx, ops)
+	if err != nil {
+		return err
+	}
+	for _, result := range results {
+		err = resultError(result.Error)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Fake) Txn(ctx context.Context, compares []TxnCompare, success []BatchOperation, failure []BatchOperation) (bool, []BatchResult, error) {
+	if len(compares)+len(success)+len(failure) > MaxBatchOperations {
+		return false, nil, ErrBadRequest
+	}
+	for _, cmp := range compares {
+		if cmp.Key == "" {
+			return false, nil, ErrEmptyKey
+		}
+		if cmp.Target != TxnCompareVersion && cmp.Target != TxnCompareValue {
+			return false, nil, ErrBadRequest
+		}
+	}
+	for _, ops := range [][]BatchOperation{success, failure} {
+		for _, op := range ops {
+			if op.Key == "" {
+				return false, nil, ErrEmptyKey
+			}
+			switch op.Op {
+			case BatchOpSet, BatchOpGet, BatchOpDelete:
+			default:
+				return false, nil, ErrBadRequest
+			}
+			if op.Op == BatchOpSet && op.Value == "" {
+				return false, nil, ErrBadRequest
+			}
+		}
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	succeeded := true
+	for _, cmp := range compares {
+		v, ok := f.get(cmp.Key)
+		if cmp.Target == TxnCompareVersion {
+			succeeded = succeeded && v.version == cmp.Version
+		} else {
+			succeeded = succeeded && ok && string(v.value) == cmp.Value
+		}
+	}
+
+	ops := success
+	if !succeeded {
+		ops = failure
+	}
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = f.apply(op)
+	}
+	return succeeded, results, nil
+}
+
+func (f *Fake) GetOrSet(ctx context.Context, key string, value string) (string, bool, error) {
+	if key == "" {
+		return "", false, ErrEmptyKey
+	}
+	if value == "" {
+		return "", false, ErrEmptyValue
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if v, ok := f.get(key); ok {
+		return string(v.value), false, nil
+	}
+	_, err := f.set(key, []byte(value), nil)
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (f *Fake) Begin() *ClientTxn {
+	return &ClientTxn{c: f}
+}
@@ -0,0 +1,414 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A journal gives at least once delivery of writes over an intermittent
+// connection: every write is appended to a local file and synced before
+// the call returns, a background loop sends the pending writes in order
+// and records their acknowledgements, and writes still pending when the
+// process exits are sent after the journal is opened again. A write keeps
+// its request id across resends so the server applies it once as long as
+// it still remembers the id, see mds -dedupTtlMs.
+
+const (
+	defaultJournalRetryInterval = time.Second
+	// Time one delivery attempt may take
+	journalSendTimeout = 30 * time.Second
+)
+
+var ErrJournalClosed = fmt.Errorf("Journal closed")
+
+// JournalEntry is a journaled write, an entry with Done acknowledges the
+// write with the same Id
+type JournalEntry struct {
+	// Request id of every delivery attempt
+	Id    string `json:"id"`
+	Op    string `json:"op,omitempty"`
+	Key   string `json:"key,omitempty"`
+	Value string `json:"value,omitempty"`
+	// Expiration in unix nanoseconds, zero means never. A set not delivered
+	// before it is dropped since the value would have expired.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	Done      bool  `json:"done,omitempty"`
+}
+
+// JournalOptions configures a journal, zero values mean defaults
+type JournalOptions struct {
+	// Wait after a failed delivery attempt
+	RetryInterval time.Duration
+	// Called with writes the server rejected for good, like a too large
+	// value, they are dropped from the journal
+	OnReject func(entry JournalEntry, err error)
+}
+
+// Journal delivers journaled writes with a client, it's safe for
+// concurrent use
+type Journal struct {
+	c             *Client
+	path          string
+	retryInterval time.Duration
+	onReject      func(entry JournalEntry, err error)
+
+	lock    sync.Mutex
+	file    *os.File
+	pending []JournalEntry
+	closed  bool
+	// Closed and replaced when the pending writes change
+	changed chan struct{}
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// OpenJournal opens or creates the journal file at path and starts
+// delivering its pending writes with c
+func OpenJournal(c *Client, path string, opts *JournalOptions) (*Journal, error) {
+	o := JournalOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.RetryInterval <= 0 {
+		o.RetryInterval = defaultJournalRetryInterval
+	}
+
+	pending, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	now := c.clock.Now()
+	unexpired := pending[:0]
+	for _, e := range pending {
+		if !e.expired(now) {
+			unexpired = append(unexpired, e)
+		}
+	}
+	pending = unexpired
+
+	j := &Journal{c: c, path: path, retryInterval: o.RetryInterval, onReject: o.OnReject,
+		pending: pending, changed: make(chan struct{}), stop: make(chan struct{})}
+	// rewriting keeps only the pending writes which didn't expire
+	err = j.rewrite()
+	if err != nil {
+		return nil, err
+	}
+
+	j.wg.Add(1)
+	go j.deliver()
+	return j, nil
+}
+
+// readJournal returns the writes of the journal at path which weren't
+// acknowledged, a torn last line of a crash is ignored
+func readJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make([]JournalEntry, 0)
+	done := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var e JournalEntry
+		if json.Unmarshal(scanner.Bytes(), &e) != nil {
+			break
+		}
+		if e.Done {
+			done[e.Id] = true
+		} else {
+			entries = append(entries, e)
+		}
+	}
+	if scanner.Err() != nil {
+		return nil, scanner.Err()
+	}
+
+	pending := make([]JournalEntry, 0, len(entries))
+	for _, e := range entries {
+		if !done[e.Id] {
+			pending = append(pending, e)
+		}
+	}
+	return pending, nil
+}
+
+// rewrite replaces the file with the pending writes, caller must hold lock
+// or own the journal
+func (j *Journal) rewrite() error {
+	tmpPath := j.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range j.pending {
+		err = enc.Encode(&j.pending[i])
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, j.path)
+	if err != nil {
+		return err
+	}
+
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+// append makes e durable in the file, caller must hold lock
+func (j *Journal) append(e *JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *Journal) notify() {
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+func (j *Journal) add(e JournalEntry) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.closed {
+		return ErrJournalClosed
+	}
+	e.Id = j.c.newRequestId()
+	err := j.append(&e)
+	if err != nil {
+		return err
+	}
+	j.pending = append(j.pending, e)
+	j.notify()
+	return nil
+}
+
+// Set journals a set of key, it returns once the write is durable locally
+func (j *Journal) Set(key string, value string) error {
+	return j.SetTTL(key, value, 0)
+}
+
+// SetTTL journals a set of a value expiring once ttl passed from now, zero
+// ttl means never
+func (j *Journal) SetTTL(key string, value string, ttl time.Duration) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	if value == "" {
+		return ErrEmptyValue
+	}
+
+	e := JournalEntry{Op: BatchOpSet, Key: key, Value: value}
+	if ttl > 0 {
+		e.ExpiresAt = j.c.clock.Now().Add(ttl).UnixNano()
+	}
+	return j.add(e)
+}
+
+// Delete journals a delete of key
+func (j *Journal) Delete(key string) error {
+	if key == "" {
+		return ErrEmptyKey
+	}
+	return j.add(JournalEntry{Op: BatchOpDelete, Key: key})
+}
+
+// Pending returns the number of writes not delivered yet
+func (j *Journal) Pending() int {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return len(j.pending)
+}
+
+// Wait waits until every write journaled so far was delivered
+func (j *Journal) Wait(ctx context.Context) error {
+	for {
+		j.lock.Lock()
+		pending := len(j.pending)
+		changed := j.changed
+		closed := j.closed
+		j.lock.Unlock()
+
+		if pending == 0 {
+			return nil
+		}
+		if closed {
+			return ErrJournalClosed
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// expired reports whether e is a set whose value expired by now
+func (e *JournalEntry) expired(now time.Time) bool {
+	return e.Op == BatchOpSet && e.ExpiresAt != 0 && e.ExpiresAt <= now.UnixNano()
+}
+
+// send delivers e, a set past its expiration is dropped without sending it
+func (j *Journal) send(ctx context.Context, e *JournalEntry) error {
+	if e.Op == BatchOpSet {
+		now := j.c.clock.Now()
+		if e.expired(now) {
+			return nil
+		}
+		req := &SetKeyRequest{Value: e.Value}
+		req.RequestId = e.Id
+		if e.ExpiresAt != 0 {
+			ttl := time.Unix(0, e.ExpiresAt).Sub(now)
+			req.TtlSeconds = int64((ttl + time.Second - 1) / time.Second)
+		}
+		_, err := j.c.setKey(ctx, e.Key, "", req)
+		return err
+	}
+
+	req := &DeleteKeyRequest{}
+	req.RequestId = e.Id
+	err := j.c.deleteKey(ctx, j.c.GetShardFor(e.Key), e.Key, req)
+	if err == ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// rejected reports whether err tells the server won't ever apply the write
+func rejected(err error) bool {
+	switch err {
+	case ErrBadRequest, ErrEmptyKey, ErrEmptyValue, ErrValueTooLarge, ErrConflict:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver sends the pending writes in journal order until closed
+func (j *Journal) deliver() {
+	defer j.wg.Done()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		default:
+		}
+
+		j.lock.Lock()
+		var e JournalEntry
+		ok := len(j.pending) > 0
+		if ok {
+			e = j.pending[0]
+		}
+		changed := j.changed
+		j.lock.Unlock()
+
+		if !ok {
+			select {
+			case <-changed:
+				continue
+			case <-j.stop:
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), journalSendTimeout)
+		go func() {
+			select {
+			case <-j.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		err := j.send(ctx, &e)
+		cancel()
+
+		if err != nil && !rejected(err) {
+			select {
+			case <-j.c.clock.After(j.retryInterval):
+				continue
+			case <-j.stop:
+				return
+			}
+		}
+		if err != nil && j.onReject != nil {
+			j.onReject(e, err)
+		}
+		j.acknowledge(e.Id)
+	}
+}
+
+// acknowledge records the delivery of the oldest pending write, the file
+// is rewritten once nothing is pending so it doesn't grow
+func (j *Journal) acknowledge(id string) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.closed {
+		return
+	}
+	// a lost acknowledgement only resends the write after a restart, the
+	// server deduplicates it
+	j.append(&JournalEntry{Id: id, Done: true})
+	j.pending = j.pending[1:]
+	if len(j.pending) == 0 {
+		j.rewrite()
+	}
+	j.notify()
+}
+
+// Close stops delivering, pending writes are kept in the file
+func (j *Journal) Close() error {
+	j.lock.Lock()
+	if j.closed {
+		j.lock.Unlock()
+		return nil
+	}
+	j.closed = true
+	j.notify()
+	j.lock.Unlock()
+
+	close(j.stop)
+	j.wg.Wait()
+	return j.file.Close()
+}
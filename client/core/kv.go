@@ -0,0 +1,39 @@
+package client
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+//go:generate moq -out mock.go . KVClient:KVClientMock
+
+// KVClient is the key value api of Client, applications can depend on it
+// and use KVClientMock or Fake in unit tests instead of a server. Admin,
+// replication and sharding methods aren't part of it.
+type KVClient interface {
+	GetKey(ctx context.Context, key string) (string, error)
+	GetKeyVersion(ctx context.Context, key string) (string, uint64, error)
+	GetKeyRaw(ctx context.Context, key string) (string, error)
+	GetKeyBytes(ctx context.Context, key string) ([]byte, error)
+	GetKeyStream(ctx context.Context, key string) (io.ReadCloser, error)
+	SetKey(ctx context.Context, key string, value string) error
+	CreateKey(ctx context.Context, key string, value string) error
+	SetKeyTTL(ctx context.Context, key string, value string, ttl time.Duration) error
+	SetKeyIf(ctx context.Context, key string, value string, expectedVersion uint64) (uint64, error)
+	SetKeyBytes(ctx context.Context, key string, value []byte, opts *RawSetOptions) (uint64, error)
+	SetKeyStream(ctx context.Context, key string, r io.Reader, size int64, opts *RawSetOptions) (uint64, error)
+	DeleteKey(ctx context.Context, key string) error
+	DeleteKeyIf(ctx context.Context, key string, expectedVersion uint64) error
+	DeleteKeys(ctx context.Context, keys []string) ([]error, error)
+	ScanKeys(ctx context.Context, startKey string, endKey string, limit int) ([]KeyValue, error)
+	Batch(ctx context.Context, ops []BatchOperation) ([]BatchResult, error)
+	BatchSet(ctx context.Context, kv map[string]string) error
+	BatchGet(ctx context.Context, keys []string) (map[string]string, error)
+	BatchDelete(ctx context.Context, keys []string) error
+	GetOrSet(ctx context.Context, key string, value string) (string, bool, error)
+	Txn(ctx context.Context, compares []TxnCompare, success []BatchOperation, failure []BatchOperation) (bool, []BatchResult, error)
+	Begin() *ClientTxn
+}
+
+var _ KVClient = (*Client)(nil)
@@ -0,0 +1,158 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Raw requests carry the value as the request or response body with
+// Content-Type application/octet-stream, so values are binary safe and
+// aren't inflated by json encoding.
+
+// RawSetOptions makes a raw write expiring or conditional, zero values mean
+// no expiration and no condition
+type RawSetOptions struct {
+	// Expire the value after ttl, rounded up to whole seconds
+	Ttl time.Duration
+	// Fail with ErrConflict if the key exists
+	Create bool
+	// Fail with ErrConflict unless the current value has ExpectedVersion
+	CompareVersion  bool
+	ExpectedVersion uint64
+	// Durability of the write, empty means the client default
+	Durability string
+	// Fail with ErrValueTooLarge before sending a value above it, zero
+	// leaves the check to the server
+	MaxValueSize int64
+}
+
+// query encodes the options, durability applies unless opts sets one
+func (opts *RawSetOptions) query(durability string) string {
+	o := RawSetOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Durability == "" {
+		o.Durability = durability
+	}
+
+	query := url.Values{}
+	if o.Ttl > 0 {
+		query.Set("ttlSeconds", strconv.FormatInt(int64((o.Ttl+time.Second-1)/time.Second), 10))
+	}
+	if o.Create {
+		query.Set("mode", "create")
+	}
+	if o.CompareVersion {
+		query.Set("expectedVersion", strconv.FormatUint(o.ExpectedVersion, 10))
+	}
+	if o.Durability != "" {
+		query.Set("durability", o.Durability)
+	}
+	if len(query) == 0 {
+		return ""
+	}
+	return "?" + query.Encode()
+}
+
+// SetKeyBytes sets a binary value and returns its version
+func (c *Client) SetKeyBytes(ctx context.Context, key string, value []byte, opts *RawSetOptions) (uint64, error) {
+	return c.SetKeyStream(ctx, key, bytes.NewReader(value), int64(len(value)), opts)
+}
+
+// SetKeyStream sets the value to size bytes read from r without buffering
+// them, the server rejects values above its limit with ErrValueTooLarge
+// before reading them. It returns the version of the value. The write is
+// retried only if r is a *bytes.Reader, *bytes.Buffer or *strings.Reader.
+func (c *Client) SetKeyStream(ctx context.Context, key string, r io.Reader, size int64, opts *RawSetOptions) (uint64, error) {
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+
+	if size <= 0 {
+		return 0, ErrEmptyValue
+	}
+
+	if opts != nil && opts.MaxValueSize > 0 && size > opts.MaxValueSize {
+		return 0, ErrValueTooLarge
+	}
+
+	httpReq, err := http.NewRequest("POST", c.GetShardFor(key)+"/set/"+key+opts.query(c.durability), r)
+	if err != nil {
+		return 0, err
+	}
+	httpReq.ContentLength = size
+	httpReq.Header.Set("Content-Type", "application/octet-stream")
+	httpReq.Header.Set("X-Request-Id", c.newRequestId())
+
+	httpResp, err := c.do(ctx, httpReq, opts == nil || !(opts.Create || opts.CompareVersion))
+	if err != nil {
+		return 0, err
+	}
+	defer closeBody(httpResp)
+
+	err = responseToError(httpResp)
+	if err != nil {
+		return 0, err
+	}
+
+	var resp SetKeyResponse
+	err = json.NewDecoder(httpResp.Body).Decode(&resp)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Version, nil
+}
+
+// GetKeyBytes returns a binary value
+func (c *Client) GetKeyBytes(ctx context.Context, key string) ([]byte, error) {
+	body, err := c.GetKeyStream(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+// GetKeyStream returns a reader of the value which streams it from the
+// server, the caller must close it
+func (c *Client) GetKeyStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	if key == "" {
+		return nil, ErrEmptyKey
+	}
+
+	current, previous := c.owners(key)
+	body, err := c.getKeyStreamFrom(ctx, current, key)
+	if err == ErrNotFound && previous != "" {
+		return c.getKeyStreamFrom(ctx, previous, key)
+	}
+	return body, err
+}
+
+func (c *Client) getKeyStreamFrom(ctx context.Context, endpoint string, key string) (io.ReadCloser, error) {
+	httpReq, err := http.NewRequest("GET", endpoint+"/get/"+key+"?raw=true", nil)
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("X-Request-Id", c.newRequestId())
+
+	httpResp, err := c.do(ctx, httpReq, true)
+	if err != nil {
+		return nil, err
+	}
+
+	err = responseToError(httpResp)
+	if err != nil {
+		closeBody(httpResp)
+		return nil, err
+	}
+	return httpResp.Body, nil
+}
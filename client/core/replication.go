@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Change is a write of the primary as followers apply it, the value is
+// base64 encoded in json so binary values survive
+type Change struct {
+	Key       string `json:"key"`
+	Value     []byte `json:"value,omitempty"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	ExpiresAt int64  `json:"expiresAt,omitempty"`
+	Version   uint64 `json:"version"`
+	// Time the primary wrote the change in unix nanoseconds
+	WrittenAt int64 `json:"writtenAt,omitempty"`
+}
+
+type ChangesResponse struct {
+	BaseResponse
+	Changes []Change `json:"changes"`
+	// Version of the latest write on the primary
+	Version uint64 `json:"version"`
+	// Set when the primary no longer has the changes requested, the
+	// follower has to copy the whole storage with SnapshotPage
+	Reset bool `json:"reset,omitempty"`
+	// Hybrid clock time of the primary in unix nanoseconds, followers
+	// evaluate expiration with it
+	Time int64 `json:"time,omitempty"`
+}
+
+type SnapshotPageResponse struct {
+	BaseResponse
+	// Live values in key order
+	Changes []Change `json:"changes"`
+	// Version of the primary before the page was read, changes after it
+	// bring the page up to date
+	Version uint64 `json:"version"`
+	// Start key of the next page, empty after the last page
+	Next string `json:"next,omitempty"`
+	// Hybrid clock time of the primary in unix nanoseconds
+	Time int64 `json:"time,omitempty"`
+}
+
+// Changes returns up to limit writes with versions above from in version
+// order, the primary waits up to wait for writes if there are none
+func (c *Client) Changes(ctx context.Context, from uint64, limit int, wait time.Duration) (*ChangesResponse, error) {
+	query := url.Values{}
+	query.Set("from", strconv.FormatUint(from, 10))
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("waitMs", strconv.FormatInt(int64(wait/time.Millisecond), 10))
+
+	var resp ChangesResponse
+	err := c.getJson(ctx, "/replication/changes?"+query.Encode(), &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// SnapshotPage returns up to limit live values with keys from start
+func (c *Client) SnapshotPage(ctx context.Context, start string, limit int) (*SnapshotPageResponse, error) {
+	query := url.Values{}
+	query.Set("start", start)
+	query.Set("limit", strconv.Itoa(limit))
+
+	var resp SnapshotPageResponse
+	err := c.getJson(ctx, "/replication/snapshot?"+query.Encode(), &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
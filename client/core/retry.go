@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Requests are retried when they are idempotent and failed with a
+// connection error or a status telling the server may succeed later. A
+// retry resends the same request id so the server can recognize it and
+// waits at least as long as the Retry-After header of the failure asks.
+// A write rejected by a raft node which isn't the leader is sent to the
+// leader named in the error payload at once, besides the 307 redirects the
+// http client follows.
+
+// Leader redirects followed by one request
+const maxLeaderRedirects = 3
+
+// retryableStatus reports whether a response with status may succeed if
+// the request is sent again
+func retryableStatus(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented:
+		return false
+	default:
+		return status >= http.StatusInternalServerError
+	}
+}
+
+// backoff returns the wait before retry attempt, starting at 1, between
+// half and all of the exponential backoff
+func (c *Client) backoff(attempt int) time.Duration {
+	wait := c.retryBackoff
+	for i := 1; i < attempt && wait < c.maxRetryBackoff; i++ {
+		wait *= 2
+	}
+	if wait > c.maxRetryBackoff {
+		wait = c.maxRetryBackoff
+	}
+	if half := int64(wait / 2); half > 0 {
+		wait -= time.Duration(c.random.Int63n(half + 1))
+	}
+	return wait
+}
+
+// retryAfter returns the wait the Retry-After header of httpResp asks for
+// in seconds or as an http date, zero if there is none
+func (c *Client) retryAfter(httpResp *http.Response) time.Duration {
+	value := httpResp.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(c.clock.Now()) {
+		return t.Sub(c.clock.Now())
+	}
+	return 0
+}
+
+// leaderOf returns the leader named by a 503 response of a raft node which
+// isn't the leader, the body is kept for the caller
+func leaderOf(httpResp *http.Response) string {
+	if httpResp.StatusCode != http.StatusServiceUnavailable {
+		return ""
+	}
+
+	body, err := ioutil.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	httpResp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return ""
+	}
+
+	var resp BaseResponse
+	if json.Unmarshal(body, &resp) != nil {
+		return ""
+	}
+	return resp.Leader
+}
+
+// redirect returns httpReq sent to leader instead of its endpoint
+func redirect(httpReq *http.Request, leader string) (*http.Request, error) {
+	target, err := url.Parse(leader + httpReq.URL.RequestURI())
+	if err != nil {
+		return nil, err
+	}
+
+	req := httpReq.Clone(httpReq.Context())
+	req.URL = target
+	req.Host = target.Host
+	return req, nil
+}
+
+// do sends httpReq with ctx, an idempotent request is retried with backoff
+// if its body can be read again through GetBody. The response of the last
+// attempt is returned, the caller closes it with closeBody. Attempts fail
+// with ErrCircuitOpen while the breaker of the endpoint is open.
+func (c *Client) do(ctx context.Context, httpReq *http.Request, idempotent bool) (*http.Response, error) {
+	resendable := httpReq.Body == nil || httpReq.Body == http.NoBody || httpReq.GetBody != nil
+	if !resendable {
+		idempotent = false
+	}
+
+	b := c.breakerFor(httpReq.URL.Host)
+	redirects := 0
+	for attempt := 0; ; attempt++ {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !b.allow() {
+			return nil, ErrCircuitOpen
+		}
+
+		req := httpReq.Clone(ctx)
+		if (attempt > 0 || redirects > 0) && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				b.abandon()
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		httpResp, err := c.httpClient.Do(req)
+		if err != nil && ctx.Err() != nil {
+			b.abandon()
+			return nil, ctx.Err()
+		}
+		if err == nil && !retryableStatus(httpResp.StatusCode) {
+			b.success()
+			return httpResp, nil
+		}
+		if err == nil && resendable && redirects < maxLeaderRedirects {
+			if leader := leaderOf(httpResp); leader != "" {
+				next, rerr := redirect(httpReq, leader)
+				if rerr == nil {
+					b.success()
+					closeBody(httpResp)
+					httpReq = next
+					b = c.breakerFor(httpReq.URL.Host)
+					redirects++
+					attempt--
+					continue
+				}
+			}
+		}
+		b.failure()
+		if !idempotent || attempt >= c.maxRetries {
+			return httpResp, err
+		}
+		wait := c.backoff(attempt + 1)
+		if httpResp != nil {
+			hint := c.retryAfter(httpResp)
+			if hint > c.maxRetryAfter {
+				return httpResp, nil
+			}
+			if hint > wait {
+				wait = hint
+			}
+			closeBody(httpResp)
+		}
+
+		select {
+		case <-c.clock.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// closeBody reads the rest of the response before closing it so the
+// connection is reused
+func closeBody(httpResp *http.Response) {
+	io.Copy(ioutil.Discard, httpResp.Body)
+	httpResp.Body.Close()
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// Points of an endpoint on the hash ring, more points spread keys
+	// more evenly
+	shardRingPoints = 128
+)
+
+// shardRing maps keys to endpoints by consistent hashing, adding or
+// removing an endpoint moves only the keys of the ring ranges it owns
+type shardRing struct {
+	endpoints []string
+	hashes    []uint64
+	owners    []string
+}
+
+func shardHash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	// fnv of similar strings differs in the low bits, mix them up so
+	// neighbouring keys land on different ring ranges
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func newShardRing(endpoints []string) *shardRing {
+	ring := &shardRing{endpoints: endpoints}
+	if len(endpoints) < 2 {
+		return ring
+	}
+
+	type point struct {
+		hash  uint64
+		owner string
+	}
+
+	points := make([]point, 0, len(endpoints)*shardRingPoints)
+	for _, endpoint := range endpoints {
+		for i := 0; i < shardRingPoints; i++ {
+			points = append(points, point{hash: shardHash(endpoint + "#" + strconv.Itoa(i)), owner: endpoint})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+		return points[i].owner < points[j].owner
+	})
+
+	ring.hashes = make([]uint64, len(points))
+	ring.owners = make([]string, len(points))
+	for i, p := range points {
+		ring.hashes[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+	return ring
+}
+
+// owner returns the endpoint of the first ring point at or after the key
+func (ring *shardRing) owner(key string) string {
+	if len(ring.hashes) == 0 {
+		return ring.endpoints[0]
+	}
+
+	h := shardHash(key)
+	i := sort.Search(len(ring.hashes), func(i int) bool { return ring.hashes[i] >= h })
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.owners[i]
+}
+
+// GetShardFor returns the endpoint which owns key
+func (c *Client) GetShardFor(key string) string {
+	c.ringLock.RLock()
+	defer c.ringLock.RUnlock()
+	return c.ring.owner(key)
+}
+
+// Endpoints returns the endpoints keys are currently distributed over
+func (c *Client) Endpoints() []string {
+	c.ringLock.RLock()
+	defer c.ringLock.RUnlock()
+	return append([]string(nil), c.ring.endpoints...)
+}
+
+// SetEndpoints redistributes keys over endpoints. Until FinishRebalance is
+// called keys not found at their new endpoint are read from the endpoint
+// which owned them before and deletes are sent to both, so keys can be
+// moved in the background. Conditional writes only consult the new owner.
+func (c *Client) SetEndpoints(endpoints ...string) error {
+	if len(endpoints) == 0 {
+		return ErrBadRequest
+	}
+
+	ring := newShardRing(append([]string(nil), endpoints...))
+
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+
+	if c.prevRing == nil {
+		c.prevRing = c.ring
+	}
+	c.ring = ring
+	return nil
+}
+
+// FinishRebalance stops consulting the endpoints which owned keys before
+// the last SetEndpoints, call it once the keys were moved
+func (c *Client) FinishRebalance() {
+	c.ringLock.Lock()
+	defer c.ringLock.Unlock()
+	c.prevRing = nil
+}
+
+// owners returns the endpoint of key and the endpoint which owned it before
+// a rebalance in progress, previous is empty unless it differs
+func (c *Client) owners(key string) (current string, previous string) {
+	c.ringLock.RLock()
+	defer c.ringLock.RUnlock()
+
+	current = c.ring.owner(key)
+	if c.prevRing != nil {
+		if owner := c.prevRing.owner(key); owner != current {
+			previous = owner
+		}
+	}
+	return current, previous
+}
+
+// groupByOwner splits key indexes by the endpoint owning the key, previous
+// selects the owners before a rebalance and skips keys which didn't move
+func (c *Client) groupByOwner(keys []string, previous bool) map[string][]int {
+	groups := make(map[string][]int)
+	for i, key := range keys {
+		current, prev := c.owners(key)
+		endpoint := current
+		if previous {
+			if prev == "" {
+				continue
+			}
+			endpoint = prev
+		}
+		groups[endpoint] = append(groups[endpoint], i)
+	}
+	return groups
+}
+
+// eachGroup calls fn for the groups of groupByOwner in parallel so a batch
+// over several endpoints takes as long as the slowest of them, the first
+// error cancels the other calls and is returned
+func eachGroup(ctx context.Context, groups map[string][]int, fn func(ctx context.Context, endpoint string, indexes []int) error) error {
+	if len(groups) == 1 {
+		for endpoint, indexes := range groups {
+			return fn(ctx, endpoint, indexes)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var first error
+	for endpoint, indexes := range groups {
+		wg.Add(1)
+		go func(endpoint string, indexes []int) {
+			defer wg.Done()
+			err := fn(ctx, endpoint, indexes)
+			if err == nil {
+				return
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if first == nil {
+				first = err
+				cancel()
+			}
+		}(endpoint, indexes)
+	}
+	wg.Wait()
+	return first
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+var (
+	ErrTxnDone = fmt.Errorf("Transaction already committed or rolled back")
+)
+
+// Targets of a transaction compare
+const (
+	TxnCompareVersion = "version"
+	TxnCompareValue   = "value"
+)
+
+// TxnCompare is a condition on the live value of Key, Version zero matches
+// a key without live value
+type TxnCompare struct {
+	Key     string `json:"key"`
+	Target  string `json:"target"`
+	Version uint64 `json:"version,omitempty"`
+	Value   string `json:"value,omitempty"`
+}
+
+// TxnRequest runs Success if all compares hold and Failure otherwise, the
+// compares and the operations happen atomically
+type TxnRequest struct {
+	BaseRequest
+	Compare    []TxnCompare     `json:"compare"`
+	Success    []BatchOperation `json:"success"`
+	Failure    []BatchOperation `json:"failure,omitempty"`
+	Durability string           `json:"durability,omitempty"`
+}
+
+type TxnResponse struct {
+	BaseResponse
+	Succeeded bool          `json:"succeeded"`
+	Results   []BatchResult `json:"results"`
+}
+
+// Txn checks compares and runs success if they all hold or failure
+// otherwise in one atomic step, gets observe earlier writes of the same
+// transaction. It returns which branch ran and the results of its
+// operations. All keys must belong to the same endpoint.
+func (c *Client) Txn(ctx context.Context, compares []TxnCompare, success []BatchOperation, failure []BatchOperation) (bool, []BatchResult, error) {
+	if len(compares)+len(success)+len(failure) > MaxBatchOperations {
+		return false, nil, ErrBadRequest
+	}
+
+	endpoint := ""
+	keys := make([]string, 0, len(compares)+len(success)+len(failure))
+	for _, cmp := range compares {
+		keys = append(keys, cmp.Key)
+	}
+	for _, ops := range [][]BatchOperation{success, failure} {
+		for _, op := range ops {
+			keys = append(keys, op.Key)
+		}
+	}
+	for _, key := range keys {
+		if key == "" {
+			return false, nil, ErrEmptyKey
+		}
+		owner := c.GetShardFor(key)
+		if endpoint != "" && owner != endpoint {
+			return false, nil, ErrBadRequest
+		}
+		endpoint = owner
+	}
+	if endpoint == "" {
+		return false, nil, ErrBadRequest
+	}
+
+	req := &TxnRequest{Compare: compares, Success: success, Failure: failure, Durability: c.durability}
+	req.RequestId = c.newRequestId()
+
+	var resp TxnResponse
+	err := c.postJsonTo(ctx, endpoint, "/txn", req, &resp, false)
+	if err != nil {
+		return false, nil, err
+	}
+	return resp.Succeeded, resp.Results, nil
+}
+
+// GetOrSet atomically returns the value of key if it has one, otherwise it
+// sets value and returns it. created tells whether value was set. All
+// clients racing to initialize a key see the same value.
+func (c *Client) GetOrSet(ctx context.Context, key string, value string) (string, bool, error) {
+	if key == "" {
+		return "", false, ErrEmptyKey
+	}
+	if value == "" {
+		return "", false, ErrEmptyValue
+	}
+
+	compares := []TxnCompare{{Key: key, Target: TxnCompareVersion, Version: 0}}
+	success := []BatchOperation{{Op: BatchOpSet, Key: key, Value: value}}
+	failure := []BatchOperation{{Op: BatchOpGet, Key: key}}
+	created, results, err := c.Txn(ctx, compares, success, failure)
+	if err != nil {
+		return "", false, err
+	}
+	if len(results) != 1 {
+		return "", false, ErrInternal
+	}
+	err = resultError(results[0].Error)
+	if err != nil {
+		return "", false, err
+	}
+	if created {
+		return value, true, nil
+	}
+	return results[0].Value, false, nil
+}
+
+// ClientTxn buffers writes which Commit applies atomically: the server logs
+// them as one record and applies all of them or none. All keys must belong
+// to the same endpoint.
+type ClientTxn struct {
+	c    KVClient
+	ops  []BatchOperation
+	done bool
+}
+
+// Begin starts a transaction, nothing is sent before Commit
+func (c *Client) Begin() *ClientTxn {
+	return &ClientTxn{c: c}
+}
+
+func (t *ClientTxn) Set(key string, value string) {
+	t.ops = append(t.ops, BatchOperation{Op: BatchOpSet, Key: key, Value: value})
+}
+
+func (t *ClientTxn) Delete(key string) {
+	t.ops = append(t.ops, BatchOperation{Op: BatchOpDelete, Key: key})
+}
+
+// Commit applies the buffered writes, on error none of them is applied.
+// A transaction is committed once, later calls fail with ErrTxnDone.
+func (t *ClientTxn) Commit(ctx context.Context) error {
+	if t.done {
+		return ErrTxnDone
+	}
+	t.done = true
+	if len(t.ops) == 0 {
+		return nil
+	}
+
+	_, _, err := t.c.Txn(ctx, nil, t.ops, nil)
+	return err
+}
+
+// Rollback drops the buffered writes
+func (t *ClientTxn) Rollback() {
+	t.done = true
+	t.ops = nil
+}
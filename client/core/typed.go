@@ -0,0 +1,104 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+var (
+	ErrContentType = fmt.Errorf("Content type mismatch")
+)
+
+// Content types of values written by the typed helpers
+const (
+	ContentTypeJson  = "application/json"
+	ContentTypeProto = "application/x-protobuf"
+)
+
+// Typed values start with contentTagPrefix, the content type and a zero
+// byte. Values without the tag are decoded as they are, so values written
+// with SetKey read fine with GetJson.
+const contentTagPrefix = "\x00ct="
+
+// ProtoMessage is a protobuf message with generated Marshal and Unmarshal
+// methods, as gogo/protobuf generates them, so the client doesn't depend
+// on a protobuf library
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+func tagValue(contentType string, payload []byte) []byte {
+	value := make([]byte, 0, len(contentTagPrefix)+len(contentType)+1+len(payload))
+	value = append(value, contentTagPrefix...)
+	value = append(value, contentType...)
+	value = append(value, 0)
+	return append(value, payload...)
+}
+
+// untagValue returns the payload of value, it fails with ErrContentType if
+// value is tagged with another content type
+func untagValue(contentType string, value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(contentTagPrefix)) {
+		return value, nil
+	}
+
+	rest := value[len(contentTagPrefix):]
+	end := bytes.IndexByte(rest, 0)
+	if end < 0 || string(rest[:end]) != contentType {
+		return nil, ErrContentType
+	}
+	return rest[end+1:], nil
+}
+
+// SetJson stores v encoded as json and returns the version of the value,
+// opts.MaxValueSize rejects large values before sending them
+func SetJson[T any](ctx context.Context, c KVClient, key string, v T, opts *RawSetOptions) (uint64, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	return c.SetKeyBytes(ctx, key, tagValue(ContentTypeJson, payload), opts)
+}
+
+// GetJson decodes the json value of key into a T
+func GetJson[T any](ctx context.Context, c KVClient, key string) (T, error) {
+	var v T
+	value, err := c.GetKeyBytes(ctx, key)
+	if err != nil {
+		return v, err
+	}
+
+	payload, err := untagValue(ContentTypeJson, value)
+	if err != nil {
+		return v, err
+	}
+	err = json.Unmarshal(payload, &v)
+	return v, err
+}
+
+// SetProto stores m encoded as protobuf and returns the version of the
+// value, opts.MaxValueSize rejects large values before sending them
+func SetProto(ctx context.Context, c KVClient, key string, m ProtoMessage, opts *RawSetOptions) (uint64, error) {
+	payload, err := m.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	return c.SetKeyBytes(ctx, key, tagValue(ContentTypeProto, payload), opts)
+}
+
+// GetProto decodes the protobuf value of key into m
+func GetProto(ctx context.Context, c KVClient, key string, m ProtoMessage) error {
+	value, err := c.GetKeyBytes(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	payload, err := untagValue(ContentTypeProto, value)
+	if err != nil {
+		return err
+	}
+	return m.Unmarshal(payload)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	client "ddb/client/core"
+	"ddb/lib/common/random"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	doctorTtl           = time.Second
+	doctorLatencyProbes = 20
+)
+
+// doctor runs functional checks against a deployment, the checks write keys
+// under a random prefix and delete them afterwards
+type doctor struct {
+	ctx        context.Context
+	c          *client.Client
+	endpoints  []string
+	opts       *client.ClientOptions
+	prefix     string
+	maxLatency time.Duration
+}
+
+type doctorCheck struct {
+	name string
+	run  func() (string, error)
+}
+
+func newDoctor(c *client.Client, endpoints []string, opts *client.ClientOptions, maxLatency time.Duration) *doctor {
+	return &doctor{
+		ctx:        context.Background(),
+		c:          c,
+		endpoints:  endpoints,
+		opts:       opts,
+		prefix:     "ddb-doctor/" + random.GenerateRandomHexString(8) + "/",
+		maxLatency: maxLatency,
+	}
+}
+
+func (d *doctor) key(name string) string {
+	return d.prefix + name
+}
+
+// expect returns an error unless err is expected
+func expect(op string, err error, expected error) error {
+	if err != expected {
+		return fmt.Errorf("%s error %v expected %v", op, err, expected)
+	}
+	return nil
+}
+
+func (d *doctor) checkSetGetDelete() (string, error) {
+	key := d.key("basic")
+	err := d.c.SetKey(d.ctx, key, "value")
+	if err != nil {
+		return "", fmt.Errorf("set error %v", err)
+	}
+
+	value, err := d.c.GetKey(d.ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("get error %v", err)
+	}
+	if value != "value" {
+		return "", fmt.Errorf("get returned %q", value)
+	}
+
+	err = d.c.DeleteKey(d.ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("delete error %v", err)
+	}
+
+	_, err = d.c.GetKey(d.ctx, key)
+	return "", expect("get deleted", err, client.ErrNotFound)
+}
+
+func (d *doctor) checkCas() (string, error) {
+	key := d.key("cas")
+	defer d.c.DeleteKey(d.ctx, key)
+
+	err := d.c.CreateKey(d.ctx, key, "v1")
+	if err != nil {
+		return "", fmt.Errorf("create error %v", err)
+	}
+	err = expect("create existing", d.c.CreateKey(d.ctx, key, "v1"), client.ErrConflict)
+	if err != nil {
+		return "", err
+	}
+
+	_, version, err := d.c.GetKeyVersion(d.ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("get version error %v", err)
+	}
+
+	newVersion, err := d.c.SetKeyIf(d.ctx, key, "v2", version)
+	if err != nil {
+		return "", fmt.Errorf("set if version error %v", err)
+	}
+	_, err = d.c.SetKeyIf(d.ctx, key, "v3", version)
+	err = expect("set if stale version", err, client.ErrConflict)
+	if err != nil {
+		return "", err
+	}
+
+	err = expect("delete if stale version", d.c.DeleteKeyIf(d.ctx, key, version), client.ErrConflict)
+	if err != nil {
+		return "", err
+	}
+	err = d.c.DeleteKeyIf(d.ctx, key, newVersion)
+	if err != nil {
+		return "", fmt.Errorf("delete if version error %v", err)
+	}
+	return "", nil
+}
+
+func (d *doctor) checkBatch() (string, error) {
+	kv := make(map[string]string)
+	keys := make([]string, 0)
+	for i := 0; i < 3; i++ {
+		key := d.key(fmt.Sprintf("batch/%d", i))
+		kv[key] = fmt.Sprintf("value%d", i)
+		keys = append(keys, key)
+	}
+
+	err := d.c.BatchSet(d.ctx, kv)
+	if err != nil {
+		return "", fmt.Errorf("batch set error %v", err)
+	}
+	defer d.c.BatchDelete(d.ctx, keys)
+
+	values, err := d.c.BatchGet(d.ctx, keys)
+	if err != nil {
+		return "", fmt.Errorf("batch get error %v", err)
+	}
+	for key, value := range kv {
+		if values[key] != value {
+			return "", fmt.Errorf("batch get %s returned %q", key, values[key])
+		}
+	}
+
+	err = d.c.BatchDelete(d.ctx, keys)
+	if err != nil {
+		return "", fmt.Errorf("batch delete error %v", err)
+	}
+	return "", nil
+}
+
+func (d *doctor) checkScan() (string, error) {
+	start := d.key("scan/")
+	end := d.key("scan0")
+	keys := make([]string, 0)
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("%s%d", start, i)
+		err := d.c.SetKey(d.ctx, key, key)
+		if err != nil {
+			return "", fmt.Errorf("set error %v", err)
+		}
+		keys = append(keys, key)
+	}
+	defer d.c.BatchDelete(d.ctx, keys)
+
+	items, err := d.c.ScanKeys(d.ctx, start, end, 0)
+	if err != nil {
+		return "", fmt.Errorf("scan error %v", err)
+	}
+	if len(items) != len(keys) {
+		return "", fmt.Errorf("scan returned %d keys expected %d", len(items), len(keys))
+	}
+	for i, item := range items {
+		if item.Key != keys[i] || item.Value != keys[i] {
+			return "", fmt.Errorf("scan returned %s at %d expected %s", item.Key, i, keys[i])
+		}
+	}
+
+	items, err = d.c.ScanKeys(d.ctx, start, end, 2)
+	if err != nil {
+		return "", fmt.Errorf("scan with limit error %v", err)
+	}
+	if len(items) != 2 {
+		return "", fmt.Errorf("scan with limit 2 returned %d keys", len(items))
+	}
+	return "", nil
+}
+
+func (d *doctor) checkTtl() (string, error) {
+	key := d.key("ttl")
+	defer d.c.DeleteKey(d.ctx, key)
+
+	err := d.c.SetKeyTTL(d.ctx, key, "value", doctorTtl)
+	if err != nil {
+		return "", fmt.Errorf("set ttl error %v", err)
+	}
+	_, err = d.c.GetKey(d.ctx, key)
+	if err != nil {
+		return "", fmt.Errorf("get before expiry error %v", err)
+	}
+
+	time.Sleep(2 * doctorTtl)
+	_, err = d.c.GetKey(d.ctx, key)
+	return "", expect("get after expiry", err, client.ErrNotFound)
+}
+
+// checkAuth expects requests without or with wrong credentials to be
+// rejected, it's skipped if the doctor runs without credentials
+func (d *doctor) checkAuth() (string, error) {
+	if d.opts.Credentials == nil {
+		return "skipped, no credentials", nil
+	}
+
+	key := d.key("auth")
+	opts := *d.opts
+	opts.Credentials = nil
+	anonymous := client.NewShardedClientWithOptions(d.endpoints, &opts)
+	_, err := anonymous.GetKey(d.ctx, key)
+	err = expect("get without credentials", err, client.ErrUnauthorized)
+	if err != nil {
+		return "", err
+	}
+
+	wrong := *d.opts.Credentials
+	if wrong.Token != "" {
+		wrong.Token += "x"
+	}
+	wrong.Secret += "x"
+	opts.Credentials = &wrong
+	impostor := client.NewShardedClientWithOptions(d.endpoints, &opts)
+	_, err = impostor.GetKey(d.ctx, key)
+	return "", expect("get with wrong credentials", err, client.ErrUnauthorized)
+}
+
+// checkLatency measures gets of a present key, it fails if the 99th
+// percentile exceeds the maximum latency
+func (d *doctor) checkLatency() (string, error) {
+	key := d.key("latency")
+	err := d.c.SetKey(d.ctx, key, "value")
+	if err != nil {
+		return "", fmt.Errorf("set error %v", err)
+	}
+	defer d.c.DeleteKey(d.ctx, key)
+
+	latencies := make([]time.Duration, 0, doctorLatencyProbes)
+	for i := 0; i < doctorLatencyProbes; i++ {
+		start := time.Now()
+		_, err = d.c.GetKey(d.ctx, key)
+		if err != nil {
+			return "", fmt.Errorf("get error %v", err)
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	p50 := latencies[len(latencies)/2]
+	p99 := latencies[(len(latencies)*99)/100]
+	report := fmt.Sprintf("p50 %v p99 %v", p50, p99)
+	if p99 > d.maxLatency {
+		return report, fmt.Errorf("p99 %v above %v", p99, d.maxLatency)
+	}
+	return report, nil
+}
+
+// run prints a line per check and returns the number of failed checks
+func (d *doctor) run() int {
+	checks := []doctorCheck{
+		{"set/get/delete", d.checkSetGetDelete},
+		{"cas", d.checkCas},
+		{"batch", d.checkBatch},
+		{"scan", d.checkScan},
+		{"ttl", d.checkTtl},
+		{"auth", d.checkAuth},
+		{"latency", d.checkLatency},
+	}
+
+	failed := 0
+	for _, check := range checks {
+		start := time.Now()
+		detail, err := check.run()
+		elapsed := time.Since(start).Round(time.Millisecond)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %-16s %8v %v\n", check.name, elapsed, err)
+			continue
+		}
+		fmt.Printf("ok   %-16s %8v %s\n", check.name, elapsed, detail)
+	}
+	fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+	return failed
+}
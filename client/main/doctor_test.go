@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	client "ddb/client/core"
+)
+
+// testStore serves sets, gets and deletes from memory, it takes any
+// credentials and answers gets after delay. With keepDeleted it is broken
+// and acknowledges deletes without deleting.
+type testStore struct {
+	lock        sync.Mutex
+	values      map[string]string
+	delay       time.Duration
+	keepDeleted bool
+}
+
+func (s *testStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&client.BaseResponse{Error: "Not found"})
+		return
+	}
+	switch op, key := parts[0], parts[1]; op {
+	case "set":
+		var req client.SetKeyRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		s.values[key] = req.Value
+		json.NewEncoder(w).Encode(&client.SetKeyResponse{Version: 1})
+	case "get":
+		time.Sleep(s.delay)
+		value, ok := s.values[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&client.BaseResponse{Error: "Not found"})
+			return
+		}
+		json.NewEncoder(w).Encode(&client.GetKeyResponse{Value: value, Version: 1})
+	case "delete":
+		if _, ok := s.values[key]; !ok && !s.keepDeleted {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(&client.BaseResponse{Error: "Not found"})
+			return
+		}
+		if !s.keepDeleted {
+			delete(s.values, key)
+		}
+		json.NewEncoder(w).Encode(&client.BaseResponse{})
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+		json.NewEncoder(w).Encode(&client.BaseResponse{Error: "Not implemented"})
+	}
+}
+
+func TestDoctor(t *testing.T) {
+	store := &testStore{values: make(map[string]string), keepDeleted: true}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	newTestDoctor := func(opts *client.ClientOptions, maxLatency time.Duration) *doctor {
+		opts.MaxRetries = -1
+		c := client.NewClientWithOptions(server.URL, opts)
+		return newDoctor(c, []string{server.URL}, opts, maxLatency)
+	}
+
+	// the deleted key is still there
+	d := newTestDoctor(&client.ClientOptions{}, time.Second)
+	_, err := d.checkSetGetDelete()
+	if err == nil || !strings.Contains(err.Error(), "get deleted") {
+		t.Fatalf("set/get/delete error %v", err)
+	}
+	store.lock.Lock()
+	_, ok := store.values[d.key("basic")]
+	store.lock.Unlock()
+	if !ok {
+		t.Fatalf("deleted key %s gone", d.key("basic"))
+	}
+
+	// a request without credentials isn't rejected
+	detail, err := d.checkAuth()
+	if err != nil || !strings.Contains(detail, "skipped") {
+		t.Fatalf("auth without credentials detail %q error %v", detail, err)
+	}
+	d = newTestDoctor(&client.ClientOptions{Credentials: &client.Credentials{Token: "token"}}, time.Second)
+	_, err = d.checkAuth()
+	if err == nil || !strings.Contains(err.Error(), "get without credentials") {
+		t.Fatalf("auth error %v", err)
+	}
+
+	// slow gets fail the latency check and are reported
+	store.lock.Lock()
+	store.delay = 10 * time.Millisecond
+	store.lock.Unlock()
+	d = newTestDoctor(&client.ClientOptions{}, 5*time.Millisecond)
+	detail, err = d.checkLatency()
+	if err == nil || !strings.Contains(err.Error(), "above 5ms") || !strings.HasPrefix(detail, "p50 ") {
+		t.Fatalf("latency detail %q error %v", detail, err)
+	}
+	d = newTestDoctor(&client.ClientOptions{}, time.Second)
+	if _, err = d.checkLatency(); err != nil {
+		t.Fatalf("latency within the maximum error %v", err)
+	}
+
+	// missing operations fail their checks
+	for name, check := range map[string]func() (string, error){"cas": d.checkCas, "batch": d.checkBatch, "scan": d.checkScan} {
+		if _, err = check(); err == nil {
+			t.Fatalf("%s passed", name)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	client "ddb/client/core"
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -12,26 +15,90 @@ func main() {
 	var operation string
 	var key string
 	var value string
+	var token string
+	var keyId string
+	var secret string
+	var caFile string
+	var certFile string
+	var keyFile string
+	var maxLatencyMs int
+	var durability string
+	var replay replayParams
+	var gen generateParams
 	var err error
 
-	flag.StringVar(&endpoint, "endpoint", "http://127.0.0.1:8080", "endpoint address")
-	flag.StringVar(&operation, "operation", "", "operation")
+	flag.StringVar(&endpoint, "endpoint", "http://127.0.0.1:8080", "endpoint addresses separated by commas")
+	flag.StringVar(&operation, "operation", "", "operation: set, get, delete, doctor, replay or generate")
 	flag.StringVar(&key, "key", "", "key")
 	flag.StringVar(&value, "value", "", "value")
+	flag.StringVar(&token, "token", "", "bearer token")
+	flag.StringVar(&keyId, "keyId", "", "credential id to sign requests with")
+	flag.StringVar(&secret, "secret", "", "credential secret to sign requests with")
+	flag.StringVar(&caFile, "caFile", "", "pem ca certificates trusted for https endpoints")
+	flag.StringVar(&certFile, "certFile", "", "pem client certificate for https endpoints")
+	flag.StringVar(&keyFile, "keyFile", "", "pem key of the client certificate")
+	flag.StringVar(&durability, "durability", "", "write durability: fsync, batched or none, empty means the server default")
+	flag.IntVar(&maxLatencyMs, "maxLatencyMs", 500, "doctor fails if the 99th percentile get latency exceeds this")
+	flag.StringVar(&replay.input, "input", "-", "replay workload file of json lines, - reads stdin")
+	flag.StringVar(&replay.changes, "changes", "", "replay the change stream of this primary api address instead of a workload file")
+	flag.Uint64Var(&replay.from, "from", 0, "version the change stream is replayed from")
+	flag.Float64Var(&replay.speed, "speed", 1, "replay pace relative to the recorded times, 0 means as fast as possible")
+	flag.Float64Var(&replay.rate, "rate", 0, "replay at most this many operations per second, 0 means no limit")
+	flag.IntVar(&replay.concurrency, "concurrency", 16, "replay workers, operations of a key are sent in order")
+	flag.IntVar(&gen.ops, "ops", 100000, "operations generated")
+	flag.IntVar(&gen.keys, "keys", 10000, "distinct keys generated")
+	flag.Float64Var(&gen.reads, "reads", 0.8, "fraction of generated gets")
+	flag.Float64Var(&gen.deletes, "deletes", 0.05, "fraction of generated deletes")
+	flag.IntVar(&gen.valueSize, "valueSize", 100, "size of generated values")
+	flag.Float64Var(&gen.skew, "skew", 0, "zipf skew of generated key popularity above 1, uniform otherwise")
+	flag.Float64Var(&gen.rate, "generateRate", 1000, "operations per second the generated times are spaced at")
+	flag.StringVar(&gen.output, "output", "-", "generated workload file, - writes stdout")
 
-	flag.Parse()
+	// "doctor -endpoint ..." is the same as "-operation doctor -endpoint ..."
+	if len(os.Args) > 1 && (os.Args[1] == "doctor" || os.Args[1] == "replay" || os.Args[1] == "generate") {
+		operation = os.Args[1]
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
-	c := client.NewClient(endpoint)
+	opts := &client.ClientOptions{Durability: durability}
+	if token != "" || keyId != "" {
+		opts.Credentials = &client.Credentials{Token: token, KeyId: keyId, Secret: secret}
+	}
+	if caFile != "" || certFile != "" {
+		opts.TlsConfig, err = client.NewTlsConfig(caFile, certFile, keyFile)
+		if err != nil {
+			fmt.Printf("tls error %v\n", err)
+			os.Exit(1)
+		}
+	}
+	endpoints := strings.Split(endpoint, ",")
+	c := client.NewShardedClientWithOptions(endpoints, opts)
+	ctx := context.Background()
 	switch operation {
 	case "set":
-		err = c.SetKey(key, value)
+		err = c.SetKey(ctx, key, value)
 	case "get":
-		value, err = c.GetKey(key)
+		value, err = c.GetKey(ctx, key)
 		if err == nil {
 			fmt.Printf("%s\n", value)
 		}
 	case "delete":
-		err = c.DeleteKey(key)
+		err = c.DeleteKey(ctx, key)
+	case "doctor":
+		d := newDoctor(c, endpoints, opts, time.Duration(maxLatencyMs)*time.Millisecond)
+		if d.run() > 0 {
+			os.Exit(1)
+		}
+	case "replay":
+		var failed int
+		failed, err = newReplayer(c, opts, replay).run()
+		if err == nil && failed > 0 {
+			os.Exit(1)
+		}
+	case "generate":
+		err = generate(gen)
 	default:
 		err = fmt.Errorf("Unknown operation %s", operation)
 	}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	client "ddb/client/core"
+	"ddb/lib/common/random"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Changes requested from the primary at once
+	replayChangesLimit = 1000
+	// Operations queued per replay worker
+	replayQueueSize = 1024
+)
+
+// replayOp is a line of a workload file
+type replayOp struct {
+	// Unix nanoseconds the operation was issued at, zero replays it right
+	// after the previous one
+	Time  int64  `json:"time,omitempty"`
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	// Expiration of a set in unix nanoseconds, zero means never
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+type replayParams struct {
+	// Workload file, "-" reads stdin
+	input string
+	// Api address of a primary whose change stream is replayed from
+	// version from instead of a file
+	changes string
+	from    uint64
+	// Pace relative to the recorded times, 2 replays twice as fast and 0
+	// as fast as possible
+	speed float64
+	// Upper bound of operations per second, 0 means none
+	rate        float64
+	concurrency int
+}
+
+type replayResult struct {
+	op      string
+	latency time.Duration
+	err     error
+}
+
+// replayer sends the operations of a workload to a cluster at the recorded
+// pace, operations of the same key are sent in order by the same worker
+type replayer struct {
+	ctx     context.Context
+	c       *client.Client
+	opts    *client.ClientOptions
+	params  replayParams
+	queues  []chan replayOp
+	results chan replayResult
+}
+
+func newReplayer(c *client.Client, opts *client.ClientOptions, params replayParams) *replayer {
+	if params.concurrency <= 0 {
+		params.concurrency = 1
+	}
+	return &replayer{
+		ctx:     context.Background(),
+		c:       c,
+		opts:    opts,
+		params:  params,
+		results: make(chan replayResult, replayQueueSize),
+	}
+}
+
+// source calls send with every operation of the input or change stream
+func (r *replayer) source(send func(op replayOp) error) error {
+	if r.params.changes != "" {
+		return r.sourceChanges(send)
+	}
+
+	f := os.Stdin
+	if r.params.input != "-" {
+		var err error
+		f, err = os.Open(r.params.input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		var op replayOp
+		err := dec.Decode(&op)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = send(op)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sourceChanges reads the change stream of the primary until it reaches
+// the version the primary had when the replay started, changes carry no
+// times so they are replayed as fast as the rate allows
+func (r *replayer) sourceChanges(send func(op replayOp) error) error {
+	primary := client.NewClientWithOptions(r.params.changes, r.opts)
+	from := r.params.from
+	var last uint64
+	for {
+		resp, err := primary.Changes(r.ctx, from, replayChangesLimit, 0)
+		if err != nil {
+			return err
+		}
+		if resp.Reset {
+			return fmt.Errorf("changes from version %d are no longer kept by the primary", from)
+		}
+		if last == 0 {
+			last = resp.Version
+		}
+
+		for _, change := range resp.Changes {
+			op := replayOp{Op: "set", Key: change.Key, Value: string(change.Value), ExpiresAt: change.ExpiresAt}
+			if change.Deleted {
+				op = replayOp{Op: "delete", Key: change.Key}
+			}
+			err = send(op)
+			if err != nil {
+				return err
+			}
+			from = change.Version
+		}
+		if len(resp.Changes) == 0 || from >= last {
+			return nil
+		}
+	}
+}
+
+func (r *replayer) apply(op replayOp) error {
+	switch op.Op {
+	case "set":
+		if op.ExpiresAt != 0 {
+			ttl := time.Until(time.Unix(0, op.ExpiresAt))
+			if ttl <= 0 {
+				// the value is gone either way
+				err := r.c.DeleteKey(r.ctx, op.Key)
+				if err == client.ErrNotFound {
+					return nil
+				}
+				return err
+			}
+			return r.c.SetKeyTTL(r.ctx, op.Key, op.Value, ttl)
+		}
+		return r.c.SetKey(r.ctx, op.Key, op.Value)
+	case "get":
+		_, err := r.c.GetKey(r.ctx, op.Key)
+		if err == client.ErrNotFound {
+			return nil
+		}
+		return err
+	case "delete":
+		err := r.c.DeleteKey(r.ctx, op.Key)
+		if err == client.ErrNotFound {
+			return nil
+		}
+		return err
+	default:
+		return fmt.Errorf("Unknown operation %s", op.Op)
+	}
+}
+
+func (r *replayer) worker(queue chan replayOp, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	for op := range queue {
+		start := time.Now()
+		err := r.apply(op)
+		r.results <- replayResult{op: op.Op, latency: time.Since(start), err: err}
+	}
+}
+
+func (r *replayer) queueFor(key string) chan replayOp {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return r.queues[h.Sum32()%uint32(len(r.queues))]
+}
+
+// run replays the workload and prints a summary per operation, it returns
+// the number of failed operations
+func (r *replayer) run() (int, error) {
+	var workers sync.WaitGroup
+	for i := 0; i < r.params.concurrency; i++ {
+		queue := make(chan replayOp, replayQueueSize)
+		r.queues = append(r.queues, queue)
+		workers.Add(1)
+		go r.worker(queue, &workers)
+	}
+
+	latencies := make(map[string][]time.Duration)
+	errors := make(map[string]int)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for result := range r.results {
+			latencies[result.op] = append(latencies[result.op], result.latency)
+			if result.err != nil {
+				errors[result.op]++
+			}
+		}
+	}()
+
+	start := time.Now()
+	var first int64
+	var lag time.Duration
+	next := start
+	err := r.source(func(op replayOp) error {
+		// Zero due means right away
+		var due time.Time
+		if op.Time != 0 && r.params.speed > 0 {
+			if first == 0 {
+				first = op.Time
+			}
+			due = start.Add(time.Duration(float64(op.Time-first) / r.params.speed))
+		}
+		if r.params.rate > 0 {
+			if due.Before(next) {
+				due = next
+			}
+			next = due.Add(time.Duration(float64(time.Second) / r.params.rate))
+		}
+
+		now := time.Now()
+		if due.After(now) {
+			time.Sleep(due.Sub(now))
+		} else if !due.IsZero() && now.Sub(due) > lag {
+			lag = now.Sub(due)
+		}
+
+		r.queueFor(op.Key) <- op
+		return nil
+	})
+
+	for _, queue := range r.queues {
+		close(queue)
+	}
+	workers.Wait()
+	close(r.results)
+	<-collected
+	elapsed := time.Since(start)
+
+	ops := make([]string, 0, len(latencies))
+	for op := range latencies {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	failed, total := 0, 0
+	for _, op := range ops {
+		l := latencies[op]
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Printf("%-8s %8d ops %6d errors p50 %v p99 %v\n", op, len(l), errors[op],
+			l[len(l)/2], l[(len(l)*99)/100])
+		failed += errors[op]
+		total += len(l)
+	}
+	fmt.Printf("%d ops in %v, %.0f ops/s, max lag behind schedule %v\n", total,
+		elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), lag.Round(time.Millisecond))
+	return failed, err
+}
+
+type generateParams struct {
+	ops  int
+	keys int
+	// Fractions of gets and deletes, the rest are sets
+	reads     float64
+	deletes   float64
+	valueSize int
+	// Zipf skew of key popularity above 1, uniform otherwise
+	skew float64
+	// Operations per second the recorded times are spaced at
+	rate   float64
+	output string
+}
+
+// generate writes a synthetic workload file for replay
+func generate(params generateParams) error {
+	if params.keys <= 0 || params.rate <= 0 || params.valueSize <= 0 {
+		return fmt.Errorf("keys, rate and value size must be positive")
+	}
+
+	w := os.Stdout
+	if params.output != "-" {
+		f, err := os.Create(params.output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var zipf *rand.Zipf
+	if params.skew > 1 {
+		zipf = rand.NewZipf(rnd, params.skew, 1, uint64(params.keys-1))
+	}
+	start := time.Now().UnixNano()
+	interval := float64(time.Second) / params.rate
+	for i := 0; i < params.ops; i++ {
+		var n uint64
+		if zipf != nil {
+			n = zipf.Uint64()
+		} else {
+			n = uint64(rnd.Intn(params.keys))
+		}
+		op := replayOp{Time: start + int64(float64(i)*interval), Key: fmt.Sprintf("key%08d", n)}
+		switch p := rnd.Float64(); {
+		case p < params.reads:
+			op.Op = "get"
+		case p < params.reads+params.deletes:
+			op.Op = "delete"
+		default:
+			op.Op = "set"
+			op.Value = random.GenerateRandomHexString((params.valueSize + 1) / 2)[:params.valueSize]
+		}
+		err := enc.Encode(&op)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/random"
+)
+
+func TestReplay(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestReplay_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+	}
+	defer os.RemoveAll(rootPath)
+
+	// a recorded workload of a few hot keys, the state after it is the
+	// last write of every key
+	start := time.Now().UnixNano()
+	ops := make([]replayOp, 0)
+	expected := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		op := replayOp{Time: start + int64(i)*int64(time.Microsecond), Key: fmt.Sprintf("key%d", i%7)}
+		switch {
+		case i%11 == 0:
+			op.Op = "delete"
+			delete(expected, op.Key)
+		case i%5 == 0:
+			op.Op = "get"
+		case i%13 == 0:
+			// expired before the replay
+			op.Op = "set"
+			op.Value = "expired"
+			op.ExpiresAt = start
+			delete(expected, op.Key)
+		default:
+			op.Op = "set"
+			op.Value = fmt.Sprintf("value%d", i)
+			expected[op.Key] = op.Value
+		}
+		ops = append(ops, op)
+	}
+	input := filepath.Join(rootPath, "workload.json")
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatalf("can't create workload error %v", err)
+	}
+	enc := json.NewEncoder(f)
+	for _, op := range ops {
+		enc.Encode(&op)
+	}
+	f.Close()
+
+	store := &testStore{values: make(map[string]string)}
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	opts := &client.ClientOptions{MaxRetries: -1}
+	c := client.NewClientWithOptions(server.URL, opts)
+	failed, err := newReplayer(c, opts, replayParams{input: input, speed: 1, concurrency: 4}).run()
+	if err != nil || failed != 0 {
+		t.Fatalf("replay failed %d error %v", failed, err)
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	if !reflect.DeepEqual(store.values, expected) {
+		t.Fatalf("state %v expected %v", store.values, expected)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"ddb/lib/common/filelog"
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ddbctl inspects and repairs the storage directory of a stopped mds:
+//
+//	ddbctl tables -storagePath DIR
+//	ddbctl dump -table FILE [-values]
+//	ddbctl verify -storagePath DIR
+//	ddbctl compact -storagePath DIR [-compression none|snappy|zstd] [-keepTombstones] [-keepExpired]
+//	ddbctl salvage -log FILE [-replace]
+//	ddbctl catalog -backup DIR
+func main() {
+	var storagePath string
+	var table string
+	var logPath string
+	var values bool
+	var replace bool
+	var compression string
+	var backup string
+	var keepTombstones bool
+	var keepExpired bool
+	var err error
+
+	flag.StringVar(&storagePath, "storagePath", "", "storage directory of the mds")
+	flag.StringVar(&table, "table", "", "table file to dump")
+	flag.BoolVar(&values, "values", false, "dump values too")
+	flag.StringVar(&logPath, "log", "", "log file to salvage")
+	flag.BoolVar(&replace, "replace", false, "replace the log by the salvaged one, the original is kept with suffix .corrupt")
+	flag.StringVar(&compression, "compression", "none", "compression of the compacted table: none, snappy or zstd")
+	flag.StringVar(&backup, "backup", "", "backup directory")
+	flag.BoolVar(&keepTombstones, "keepTombstones", false, "keep tombstones in the compacted table")
+	flag.BoolVar(&keepExpired, "keepExpired", false, "keep expired values in the compacted table")
+
+	if len(os.Args) < 2 {
+		fmt.Printf("usage: ddbctl tables|dump|verify|compact|salvage|catalog [flags]\n")
+		os.Exit(2)
+	}
+	command := os.Args[1]
+	flag.CommandLine.Parse(os.Args[2:])
+
+	switch command {
+	case "tables":
+		err = tables(storagePath)
+	case "dump":
+		err = dump(table, values)
+	case "verify":
+		var corrupt int
+		corrupt, err = verify(storagePath)
+		if err == nil && corrupt > 0 {
+			fmt.Printf("%d corrupt files\n", corrupt)
+			os.Exit(1)
+		}
+	case "compact":
+		err = compact(storagePath, compression, lsm.CompactOptions{KeepTombstones: keepTombstones, KeepExpired: keepExpired, Rewrite: true})
+	case "salvage":
+		err = salvage(logPath, replace)
+	case "catalog":
+		err = catalog(backup)
+	default:
+		err = fmt.Errorf("Unknown command %s", command)
+	}
+
+	if err != nil {
+		fmt.Printf("error %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func tables(storagePath string) error {
+	infos, err := lsm.InspectTables(storagePath)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		state := "live"
+		if !info.Live {
+			state = "leftover"
+		}
+		fmt.Printf("%s %s ids %d-%d size %d nodes %d keys %q-%q maxVersion %d checksum %d compression %s\n",
+			filepath.Base(info.Path), state, info.MinId, info.MaxId, info.Size, info.Nodes,
+			info.MinKey, info.MaxKey, info.MaxVersion, info.Checksum, info.Compression)
+		if info.WrittenNodes != 0 {
+			fmt.Printf("  written %s-%s mean %s nodes %d\n",
+				time.Unix(0, info.MinWrittenAt).Format(time.RFC3339), time.Unix(0, info.MaxWrittenAt).Format(time.RFC3339),
+				time.Unix(0, info.MeanWrittenAt).Format(time.RFC3339), info.WrittenNodes)
+		}
+		if info.Err != nil {
+			fmt.Printf("  error %v\n", info.Err)
+		}
+	}
+	return nil
+}
+
+func catalog(backup string) error {
+	c, err := lsm.ReadCatalog(backup)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("created %s formatVersion %d maxVersion %d logSeq %d manifest %d tables %d size %d\n",
+		time.Unix(0, c.CreatedAt).Format(time.RFC3339), c.FormatVersion, c.MaxVersion, c.LogSeq,
+		c.ManifestNumber, c.Tables, c.Size)
+	for _, f := range c.Files {
+		fmt.Printf("%s size %d crc32c %s\n", f.Name, f.Size, f.Checksum)
+	}
+
+	_, problems, err := lsm.CheckSnapshot(backup)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		fmt.Printf("problem %s\n", problem)
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("backup has %d problems", len(problems))
+	}
+	return nil
+}
+
+func dump(table string, values bool) error {
+	info, err := lsm.ScanTable(table, func(offset int64, c lsm.Change) error {
+		fmt.Printf("%d %q version %d deleted %v expiresAt %d writtenAt %d size %d", offset, c.Key, c.Version, c.Deleted, c.ExpiresAt, c.WrittenAt, len(c.Value))
+		if values {
+			fmt.Printf(" value %q", c.Value)
+		}
+		fmt.Printf("\n")
+		return nil
+	})
+	fmt.Printf("%d nodes\n", info.Nodes)
+	return err
+}
+
+// verify reads every node of the tables and logs of storagePath and returns
+// the number of files with corrupt nodes
+func verify(storagePath string) (int, error) {
+	infos, err := lsm.InspectTables(storagePath)
+	if err != nil {
+		return 0, err
+	}
+
+	corrupt := 0
+	for _, info := range infos {
+		if info.Err != nil {
+			fmt.Printf("table %v\n", info.Err)
+			corrupt++
+			continue
+		}
+		fmt.Printf("table %s ok nodes %d\n", filepath.Base(info.Path), info.Nodes)
+	}
+
+	logs, err := lsm.LogFiles(storagePath)
+	if err != nil {
+		return corrupt, err
+	}
+	for _, logPath := range logs {
+		records, err := lsm.ScanLog(logPath, nil)
+		if err != nil {
+			fmt.Printf("log %v after %d records\n", err, records)
+			corrupt++
+			continue
+		}
+		fmt.Printf("log %s ok records %d\n", filepath.Base(logPath), records)
+	}
+	return corrupt, nil
+}
+
+// dirSize returns the total size of the files under path
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// compact replays the log and rewrites all tables into one with the given
+// compression, the mds must not run on storagePath
+func compact(storagePath string, compression string, opts lsm.CompactOptions) error {
+	params := new(lsm.LsmParameters)
+	var err error
+	params.Compression, err = lsm.ParseCompressionType(compression)
+	if err != nil {
+		return err
+	}
+
+	before, err := dirSize(storagePath)
+	if err != nil {
+		return err
+	}
+
+	l, err := lsm.OpenLsm(log.NewLog(filelog.NewFileLogWithFile(os.Stderr)), storagePath, params)
+	if err != nil {
+		return err
+	}
+
+	err = l.CompactWith(context.Background(), opts)
+	stats := l.CompactionStats()
+	l.Close()
+	if err != nil {
+		return err
+	}
+
+	after, err := dirSize(storagePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("size before %d after %d tables %d dropped tombstones %d purged expired %d\n",
+		before, after, stats.Tables, stats.DroppedTombstones, stats.PurgedExpired)
+	return nil
+}
+
+// salvage copies the readable records of a log next to it, with replace
+// the salvaged log takes the place of the original
+func salvage(logPath string, replace bool) error {
+	salvagedPath := logPath + ".salvaged"
+	report, err := lsm.SalvageLog(logPath, salvagedPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("salvaged %d records %d writes, skipped %d regions %d bytes into %s\n",
+		report.Records, report.Nodes, report.Regions, report.SkippedBytes, salvagedPath)
+	if !replace {
+		return nil
+	}
+
+	err = os.Rename(logPath, logPath+".corrupt")
+	if err != nil {
+		return err
+	}
+	return os.Rename(salvagedPath, logPath)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"ddb/lib/common/filelog"
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+	"ddb/lib/common/random"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// liveTable returns the only live table of storagePath and its changes
+func liveTable(t *testing.T, storagePath string) (lsm.TableInfo, map[string]lsm.Change) {
+	infos, err := lsm.InspectTables(storagePath)
+	if err != nil {
+		t.Fatalf("can't inspect tables error %v", err)
+	}
+	live := make([]lsm.TableInfo, 0)
+	for _, info := range infos {
+		if info.Live {
+			live = append(live, info)
+		}
+	}
+	if len(live) != 1 || live[0].Err != nil {
+		t.Fatalf("live tables %+v", live)
+	}
+
+	changes := make(map[string]lsm.Change)
+	_, err = lsm.ScanTable(live[0].Path, func(offset int64, c lsm.Change) error {
+		changes[c.Key] = c
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("can't scan table error %v", err)
+	}
+	return live[0], changes
+}
+
+func TestCompact(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestCompact_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	// the storage of a stopped mds with several tables, tombstones and an
+	// expired value
+	storagePath := filepath.Join(rootPath, "storage")
+	params := &lsm.LsmParameters{MaxMemoryNodeCount: 10}
+	l, err := lsm.NewLsm(log, storagePath, params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		l.Set(fmt.Sprintf("k%03d", i), strings.Repeat("v", 100))
+	}
+	for i := 0; i < 10; i++ {
+		l.Delete(fmt.Sprintf("k%03d", i))
+	}
+	_, err = l.SetWithOptions("e1", "v", &lsm.WriteOptions{Ttl: time.Millisecond})
+	if err != nil {
+		t.Fatalf("can't set expiring key error %v", err)
+		return
+	}
+	l.Flush()
+	l.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	// an unknown compression leaves the storage alone
+	if err = compact(storagePath, "lz4", lsm.CompactOptions{Rewrite: true}); err == nil {
+		t.Fatalf("compaction with unknown compression")
+		return
+	}
+
+	err = compact(storagePath, "none", lsm.CompactOptions{KeepTombstones: true, KeepExpired: true, Rewrite: true})
+	if err != nil {
+		t.Fatalf("compact keeping tombstones and expired values error %v", err)
+		return
+	}
+	_, changes := liveTable(t, storagePath)
+	if len(changes) != 101 || !changes["k000"].Deleted || changes["e1"].Deleted {
+		t.Fatalf("kept %d changes k000 %+v e1 %+v", len(changes), changes["k000"], changes["e1"])
+		return
+	}
+
+	before, err := dirSize(storagePath)
+	if err != nil {
+		t.Fatalf("can't size storage error %v", err)
+		return
+	}
+	err = compact(storagePath, "snappy", lsm.CompactOptions{Rewrite: true})
+	if err != nil {
+		t.Fatalf("compact error %v", err)
+		return
+	}
+	info, changes := liveTable(t, storagePath)
+	if len(changes) != 90 || info.Compression != lsm.CompressionSnappy {
+		t.Fatalf("compacted table %+v changes %d", info, len(changes))
+		return
+	}
+	after, err := dirSize(storagePath)
+	if err != nil || after >= before {
+		t.Fatalf("storage size %d before %d error %v", after, before, err)
+		return
+	}
+
+	// the mds opens the compacted storage
+	l, err = lsm.OpenLsm(log, storagePath, params)
+	if err != nil {
+		t.Fatalf("can't open compacted storage error %v", err)
+		return
+	}
+	defer l.Close()
+	for _, key := range []string{"k000", "k009", "e1"} {
+		if _, err = l.Get(key); err != lsm.ErrNotFound {
+			t.Fatalf("get %s error %v", key, err)
+			return
+		}
+	}
+	value, err := l.Get("k010")
+	if err != nil || value != strings.Repeat("v", 100) {
+		t.Fatalf("get k010 value %s error %v", value, err)
+		return
+	}
+}
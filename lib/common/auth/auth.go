@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"ddb/lib/common/clock"
+)
+
+// Authorization schemes, a bearer request carries the secret itself while
+// a signed request carries the key id and a hmac of the request made with
+// the secret
+const (
+	SchemeBearer = "Bearer"
+	SchemeHmac   = "DDB-HMAC-SHA256"
+)
+
+const (
+	// Unix seconds the request was signed at
+	DateHeader = "X-Ddb-Date"
+	// Hex sha256 of the request body or UnsignedPayload
+	ContentHashHeader = "X-Ddb-Content-Sha256"
+	// Id of the request, signed so a replayed write is deduplicated
+	RequestIdHeader = "X-Request-Id"
+	// Content hash of streamed values which can't be read twice, accepted
+	// for application/octet-stream bodies only
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+	// Largest accepted difference between the signing and the receiving time
+	MaxClockSkew = 5 * time.Minute
+)
+
+var (
+	ErrBadAuthorization = fmt.Errorf("Bad authorization")
+)
+
+// Credentials identify a client, Token selects bearer authentication and
+// KeyId with Secret select signed requests
+type Credentials struct {
+	Token  string
+	KeyId  string
+	Secret string
+}
+
+// Signature returns the hex hmac-sha256 of the request fields with secret,
+// the host binds the request to its server
+func Signature(secret string, method string, host string, uri string, date string, requestId string, contentHash string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(mac, method+"\n"+host+"\n"+uri+"\n"+date+"\n"+requestId+"\n"+contentHash)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ContentHash returns the hex sha256 of body
+func ContentHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign sets the authorization headers of req, the body is hashed if it can
+// be read again through GetBody
+func Sign(req *http.Request, creds *Credentials, now time.Time) error {
+	if creds.Token != "" {
+		req.Header.Set("Authorization", SchemeBearer+" "+creds.Token)
+		return nil
+	}
+
+	contentHash := ContentHash(nil)
+	if req.Body != nil && req.Body != http.NoBody {
+		contentHash = UnsignedPayload
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			var buf bytes.Buffer
+			_, err = io.Copy(&buf, body)
+			body.Close()
+			if err != nil {
+				return err
+			}
+			contentHash = ContentHash(buf.Bytes())
+		}
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	date := strconv.FormatInt(now.Unix(), 10)
+	signature := Signature(creds.Secret, req.Method, host, req.URL.RequestURI(), date, req.Header.Get(RequestIdHeader), contentHash)
+	req.Header.Set(DateHeader, date)
+	req.Header.Set(ContentHashHeader, contentHash)
+	req.Header.Set("Authorization", SchemeHmac+" "+creds.KeyId+":"+signature)
+	return nil
+}
+
+// ParseAuthorization splits the authorization header into the scheme and
+// its parameter
+func ParseAuthorization(header string) (scheme string, param string, err error) {
+	i := strings.IndexByte(header, ' ')
+	if i <= 0 || i == len(header)-1 {
+		return "", "", ErrBadAuthorization
+	}
+	return header[:i], header[i+1:], nil
+}
+
+// ParseSigned splits the parameter of a signed authorization header into
+// the key id and the signature
+func ParseSigned(param string) (keyId string, signature string, err error) {
+	i := strings.LastIndexByte(param, ':')
+	if i <= 0 || i == len(param)-1 {
+		return "", "", ErrBadAuthorization
+	}
+	return param[:i], param[i+1:], nil
+}
+
+// CheckDate fails unless date was made within MaxClockSkew of now
+func CheckDate(date string, now time.Time) error {
+	secs, err := strconv.ParseInt(date, 10, 64)
+	if err != nil {
+		return ErrBadAuthorization
+	}
+	skew := now.Sub(time.Unix(secs, 0))
+	if skew > MaxClockSkew || skew < -MaxClockSkew {
+		return ErrBadAuthorization
+	}
+	return nil
+}
+
+// Transport signs each request with the credentials before passing it to
+// Base, redirected requests are signed again for their new target
+type Transport struct {
+	Base        http.RoundTripper
+	Credentials *Credentials
+	Clock       clock.Clock
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	signed := req.Clone(req.Context())
+	err := Sign(signed, t.Credentials, clock.OrReal(t.Clock).Now())
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.Base.RoundTrip(signed)
+}
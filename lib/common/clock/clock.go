@@ -0,0 +1,100 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it to pass, components take a Clock so
+// tests can drive time based behavior without sleeping
+type Clock interface {
+	Now() time.Time
+	// After delivers the time on the returned channel once d passed
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Real returns the system clock
+func Real() Clock {
+	return realClock{}
+}
+
+// OrReal returns c or the system clock if c is nil
+func OrReal(c Clock) Clock {
+	if c == nil {
+		return Real()
+	}
+	return c
+}
+
+// Sleep waits for d to pass on c
+func Sleep(c Clock, d time.Duration) {
+	<-c.After(d)
+}
+
+type manualWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+// Manual is a clock which only moves when it's advanced
+type Manual struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []manualWaiter
+}
+
+func NewManual(now time.Time) *Manual {
+	return &Manual{now: now}
+}
+
+func (m *Manual) Now() time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.now
+}
+
+func (m *Manual) After(d time.Duration) <-chan time.Time {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- m.now
+		return ch
+	}
+	m.waiters = append(m.waiters, manualWaiter{deadline: m.now.Add(d), ch: ch})
+	return ch
+}
+
+// Waiting returns the number of waits which didn't fire yet, a test can
+// wait for a component to block on the clock before advancing it
+func (m *Manual) Waiting() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return len(m.waiters)
+}
+
+// Advance moves the clock forward by d and fires the waits which passed
+func (m *Manual) Advance(d time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.now = m.now.Add(d)
+	sort.Slice(m.waiters, func(i, j int) bool { return m.waiters[i].deadline.Before(m.waiters[j].deadline) })
+	i := 0
+	for ; i < len(m.waiters) && !m.waiters[i].deadline.After(m.now); i++ {
+		m.waiters[i].ch <- m.now
+	}
+	m.waiters = m.waiters[i:]
+}
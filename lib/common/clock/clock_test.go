@@ -0,0 +1,108 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func fired(ch <-chan time.Time) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestManual(t *testing.T) {
+	start := time.Unix(1000, 0)
+	m := NewManual(start)
+
+	if !fired(m.After(0)) {
+		t.Fatalf("wait of zero didn't fire at once")
+		return
+	}
+
+	short := m.After(time.Second)
+	long := m.After(3 * time.Second)
+	if m.Waiting() != 2 {
+		t.Fatalf("waiting %d", m.Waiting())
+		return
+	}
+
+	// a wait fires once the clock reaches its deadline
+	m.Advance(999 * time.Millisecond)
+	if fired(short) || fired(long) {
+		t.Fatalf("wait fired before its deadline")
+		return
+	}
+	m.Advance(time.Millisecond)
+	select {
+	case now := <-short:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Fatalf("wait fired with %v", now)
+			return
+		}
+	default:
+		t.Fatalf("wait didn't fire at its deadline")
+		return
+	}
+	if fired(long) || m.Waiting() != 1 {
+		t.Fatalf("later wait fired or waiting %d", m.Waiting())
+		return
+	}
+
+	m.Advance(time.Hour)
+	if !fired(long) || m.Waiting() != 0 {
+		t.Fatalf("wait didn't fire or waiting %d", m.Waiting())
+		return
+	}
+	if !m.Now().Equal(start.Add(time.Hour + time.Second)) {
+		t.Fatalf("now %v", m.Now())
+		return
+	}
+}
+
+func TestHybrid(t *testing.T) {
+	m := NewManual(time.Unix(1000, 0))
+	h := NewHybrid(m)
+
+	if _, ok := h.Skew(); ok {
+		t.Fatalf("skew before an observation")
+		return
+	}
+	if !h.Now().Equal(time.Unix(1000, 0)) {
+		t.Fatalf("now %v", h.Now())
+		return
+	}
+
+	// the first observation may move the clock back
+	h.Observe(time.Unix(990, 0))
+	if !h.Now().Equal(time.Unix(990, 0)) {
+		t.Fatalf("now after observing a peer behind %v", h.Now())
+		return
+	}
+	if skew, _ := h.Skew(); skew != 10*time.Second {
+		t.Fatalf("skew %v", skew)
+		return
+	}
+
+	// the clock runs with the physical clock from the observation on
+	m.Advance(5 * time.Second)
+	if !h.Now().Equal(time.Unix(995, 0)) {
+		t.Fatalf("now after advancing %v", h.Now())
+		return
+	}
+
+	// later observations never move it back
+	h.Observe(time.Unix(980, 0))
+	if h.Now().Before(time.Unix(995, 0)) {
+		t.Fatalf("now went back to %v", h.Now())
+		return
+	}
+	h.Observe(time.Unix(2000, 0))
+	if !h.Now().Equal(time.Unix(2000, 0)) {
+		t.Fatalf("now after observing a peer ahead %v", h.Now())
+		return
+	}
+}
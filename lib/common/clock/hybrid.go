@@ -0,0 +1,69 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Hybrid is a hybrid logical clock: it runs with a physical clock but
+// follows the time observed from a peer, a follower observes its primary,
+// and never goes back. Expiration evaluated with it on a follower agrees with
+// the primary however far the follower's clock is off, a clock ahead doesn't
+// expire values early and a clock behind doesn't resurrect them.
+type Hybrid struct {
+	physical Clock
+
+	lock sync.Mutex
+	// Latest time returned or observed, in unix nanoseconds
+	last int64
+	// Peer time minus physical time at the latest observation
+	offset   int64
+	observed bool
+}
+
+// NewHybrid returns a hybrid clock of physical, nil means the system clock
+func NewHybrid(physical Clock) *Hybrid {
+	return &Hybrid{physical: OrReal(physical)}
+}
+
+func (h *Hybrid) Now() time.Time {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := h.physical.Now().UnixNano() + h.offset
+	if now < h.last {
+		now = h.last
+	}
+	h.last = now
+	return time.Unix(0, now)
+}
+
+func (h *Hybrid) After(d time.Duration) <-chan time.Time {
+	return h.physical.After(d)
+}
+
+// Observe moves the clock to the time of a peer, the clock runs with the
+// physical clock from it on until the next observation. Only the first
+// observation may move the clock back, the time returned before it came
+// from the physical clock alone.
+func (h *Hybrid) Observe(peer time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	t := peer.UnixNano()
+	h.offset = t - h.physical.Now().UnixNano()
+	if !h.observed || t > h.last {
+		h.last = t
+	}
+	h.observed = true
+}
+
+// Skew returns how far the physical clock is ahead of the peer at the
+// latest observation, negative if it's behind, ok is false if nothing was
+// observed
+func (h *Hybrid) Skew() (time.Duration, bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return time.Duration(-h.offset), h.observed
+}
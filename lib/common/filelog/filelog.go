@@ -4,7 +4,11 @@ import (
 	"ddb/lib/common/logbackend"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -16,6 +20,26 @@ type FileLog struct {
 	file     *os.File
 	filepath string
 	lock     sync.RWMutex
+
+	// Rotation limits, zero means unlimited, and rotated files kept
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+	// Size of the current file and its creation time in unix nanoseconds
+	size   int64
+	opened int64
+}
+
+// RotationParameters make a file log switch to a new file once the current
+// one is big or old enough, rotated files are renamed with a timestamp
+// suffix
+type RotationParameters struct {
+	// Size in bytes and age after which the file is rotated, zero means
+	// no limit
+	MaxSize int64
+	MaxAge  time.Duration
+	// Rotated files kept, zero keeps all
+	Keep int
 }
 
 func (lb *FileLog) Shutdown() {
@@ -28,11 +52,101 @@ func (lb *FileLog) Shutdown() {
 	lb.file = nil
 }
 
+// Reopen switches to a new file at the log path, e.g. after the old file was
+// rotated away
+func (lb *FileLog) Reopen() error {
+	if lb.filepath == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(lb.filepath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+
+	if lb.file == nil {
+		file.Close()
+		return ErrFileClosed
+	}
+	lb.file.Close()
+	lb.setFile(file)
+	return nil
+}
+
+// setFile starts writing file, caller must hold the write lock
+func (lb *FileLog) setFile(file *os.File) {
+	lb.file = file
+	atomic.StoreInt64(&lb.opened, time.Now().UnixNano())
+	atomic.StoreInt64(&lb.size, 0)
+	if info, err := file.Stat(); err == nil {
+		atomic.StoreInt64(&lb.size, info.Size())
+	}
+}
+
+func (lb *FileLog) rotationDue() bool {
+	if lb.filepath == "" {
+		return false
+	}
+	if lb.maxSize > 0 && atomic.LoadInt64(&lb.size) >= lb.maxSize {
+		return true
+	}
+	return lb.maxAge > 0 && time.Now().UnixNano()-atomic.LoadInt64(&lb.opened) >= int64(lb.maxAge)
+}
+
+// rotate renames the current file aside, starts a new one and removes the
+// oldest rotated files beyond the kept number
+func (lb *FileLog) rotate() error {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+
+	if lb.file == nil {
+		return ErrFileClosed
+	}
+	if !lb.rotationDue() {
+		return nil
+	}
+
+	rotatedPath := lb.filepath + "." + time.Now().UTC().Format("20060102-150405.000000")
+	err := os.Rename(lb.filepath, rotatedPath)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(lb.filepath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	lb.file.Close()
+	lb.setFile(file)
+
+	if lb.keep > 0 {
+		rotated, err := filepath.Glob(lb.filepath + ".*")
+		if err == nil && len(rotated) > lb.keep {
+			// timestamp suffixes sort in rotation order
+			sort.Strings(rotated)
+			for _, path := range rotated[:len(rotated)-lb.keep] {
+				os.Remove(path)
+			}
+		}
+	}
+	return nil
+}
+
 func (lb *FileLog) Sync() error {
 	return lb.file.Sync()
 }
 
 func (lb *FileLog) Println(timestamp int64, message string) error {
+	if lb.rotationDue() {
+		err := lb.rotate()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "log rotation error %v\n", err)
+		}
+	}
+
 	lb.lock.RLock()
 	defer lb.lock.RUnlock()
 
@@ -50,19 +164,31 @@ func (lb *FileLog) Println(timestamp int64, message string) error {
 		return err
 	}
 
+	atomic.AddInt64(&lb.size, int64(len(message)+1))
 	return nil
 }
 
 func NewFileLog(filepath string) (logbackend.LogBackend, error) {
+	return NewRotatingFileLog(filepath, nil)
+}
+
+// NewRotatingFileLog is NewFileLog rotating the file by params, nil params
+// never rotate
+func NewRotatingFileLog(filepath string, params *RotationParameters) (logbackend.LogBackend, error) {
 	lb := new(FileLog)
 	lb.filepath = filepath
+	if params != nil {
+		lb.maxSize = params.MaxSize
+		lb.maxAge = params.MaxAge
+		lb.keep = params.Keep
+	}
 
 	file, err := os.OpenFile(lb.filepath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		return nil, err
 	}
 
-	lb.file = file
+	lb.setFile(file)
 	return lb, nil
 }
 
@@ -0,0 +1,88 @@
+package filelog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"ddb/lib/common/random"
+)
+
+func TestRotation(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestRotation_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	logPath := filepath.Join(rootPath, "test.log")
+	lb, err := NewRotatingFileLog(logPath, &RotationParameters{MaxSize: 100, Keep: 2})
+	if err != nil {
+		t.Fatalf("can't create log error %v", err)
+		return
+	}
+	defer lb.Shutdown()
+
+	// lines of 60 bytes with the newline, a file takes two of them before
+	// it reaches the size limit
+	line := func(i int) string {
+		s := fmt.Sprintf("line%d", i)
+		return s + strings.Repeat(".", 59-len(s))
+	}
+	read := func(path string) string {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("can't read %s error %v", path, err)
+		}
+		return string(data)
+	}
+	rotated := func() []string {
+		paths, err := filepath.Glob(logPath + ".*")
+		if err != nil {
+			t.Fatalf("can't list rotated error %v", err)
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	for i := 1; i <= 2; i++ {
+		if err = lb.Println(0, line(i)); err != nil {
+			t.Fatalf("println error %v", err)
+			return
+		}
+	}
+	if paths := rotated(); len(paths) != 0 || read(logPath) != line(1)+"\n"+line(2)+"\n" {
+		t.Fatalf("rotated %v below the limit", paths)
+		return
+	}
+
+	// the line past the limit goes to a new file, the oldest rotated files
+	// beyond the kept two are removed
+	for i := 3; i <= 9; i++ {
+		if err = lb.Println(0, line(i)); err != nil {
+			t.Fatalf("println error %v", err)
+			return
+		}
+	}
+	paths := rotated()
+	if len(paths) != 2 {
+		t.Fatalf("rotated files %v", paths)
+		return
+	}
+	expected := []string{line(5) + "\n" + line(6) + "\n", line(7) + "\n" + line(8) + "\n"}
+	for i, path := range paths {
+		if read(path) != expected[i] {
+			t.Fatalf("rotated file %s content %q expected %q", path, read(path), expected[i])
+			return
+		}
+	}
+	if read(logPath) != line(9)+"\n" {
+		t.Fatalf("current file content %q", read(logPath))
+		return
+	}
+}
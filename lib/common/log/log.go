@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"ddb/lib/common/logbackend"
 	"ddb/lib/common/timestamp"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
@@ -11,6 +12,28 @@ import (
 	"sync/atomic"
 )
 
+var (
+	ErrUnknownFormat = fmt.Errorf("Unknown log format")
+)
+
+// Severity levels, a message is logged if its level is at most the log
+// level. Messages logged with Pf(0, ...) are info.
+const (
+	LevelError = -2
+	LevelWarn  = -1
+	LevelInfo  = 0
+	LevelDebug = 1
+)
+
+type Format int32
+
+const (
+	// level source message key=value...
+	FormatText Format = iota
+	// a json object per line with time, level, source, msg and the fields
+	FormatJson
+)
+
 type LogInterface interface {
 	Init(b logbackend.LogBackend)
 
@@ -22,6 +45,11 @@ type LogInterface interface {
 
 	SetLevel(level int)
 
+	Level() int
+
+	// With returns a log adding key value pairs to every message
+	With(kv ...interface{}) LogInterface
+
 	Pf(level int, format string, v ...interface{})
 
 	PfSync(level int, format string, v ...interface{})
@@ -36,7 +64,8 @@ type logMsg struct {
 type Log struct {
 	LogInterface
 
-	level          int
+	level          int32
+	format         int32
 	framesToIgnore int
 	msgChan        chan *logMsg
 	source         bool
@@ -54,12 +83,72 @@ var logMsgPool = sync.Pool{
 	},
 }
 
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "", "text":
+		return FormatText, nil
+	case "json":
+		return FormatJson, nil
+	default:
+		return 0, ErrUnknownFormat
+	}
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatJson:
+		return "json"
+	default:
+		return "text"
+	}
+}
+
+func LevelName(level int) string {
+	switch {
+	case level <= LevelError:
+		return "error"
+	case level == LevelWarn:
+		return "warn"
+	case level == LevelInfo:
+		return "info"
+	default:
+		return "debug"
+	}
+}
+
+// syslogPriority maps a level to the priority of the systemd prefix
+func syslogPriority(level int) int {
+	switch {
+	case level <= LevelError:
+		return 3
+	case level == LevelWarn:
+		return 4
+	case level == LevelInfo:
+		return 6
+	default:
+		return 7
+	}
+}
+
 func (log *Log) SetFramesToIgnore(framesToIgnore int) {
 	log.framesToIgnore = framesToIgnore
 }
 
+// SetLevel changes the verbosity, it is safe while messages are logged
 func (log *Log) SetLevel(level int) {
-	log.level = level
+	atomic.StoreInt32(&log.level, int32(level))
+}
+
+func (log *Log) Level() int {
+	return int(atomic.LoadInt32(&log.level))
+}
+
+func (log *Log) SetFormat(format Format) {
+	atomic.StoreInt32(&log.format, int32(format))
+}
+
+func (log *Log) Format() Format {
+	return Format(atomic.LoadInt32(&log.format))
 }
 
 func NewLog(b logbackend.LogBackend) *Log {
@@ -69,7 +158,7 @@ func NewLog(b logbackend.LogBackend) *Log {
 	log.time = true
 	log.systemd = true
 	log.msgChan = make(chan *logMsg, 100)
-	log.level = 0
+	log.level = LevelInfo
 	log.framesToIgnore = 3
 	atomic.StoreInt64(&log.active, 1)
 
@@ -133,51 +222,128 @@ func (log *Log) Shutdown() {
 	log.msgChan = nil
 }
 
-func (log *Log) println(level int, s string) {
-	if atomic.LoadInt64(&log.active) == 0 || level > log.level {
+func (log *Log) println(level int, kv []interface{}, s string) {
+	if atomic.LoadInt64(&log.active) == 0 || level > log.Level() {
 		return
 	}
 
 	msg := allocMsg()
+	if log.time {
+		msg.timestamp = timestamp.GetTimestamp()
+	}
+	var source string
+	if log.source {
+		source = timestamp.GetSource(log.framesToIgnore)
+	}
+	s = strings.TrimRight(s, "\n")
 
+	if log.Format() == FormatJson {
+		log.formatJson(msg, level, source, kv, s)
+	} else {
+		log.formatText(msg, level, source, kv, s)
+	}
+
+	log.shutdownLock.RLock()
+	if log.msgChan != nil {
+		log.msgChan <- msg
+		log.shutdownLock.RUnlock()
+	} else {
+		log.shutdownLock.RUnlock()
+		freeMsg(msg)
+	}
+}
+
+func (log *Log) formatText(msg *logMsg, level int, source string, kv []interface{}, s string) {
 	if log.systemd {
 		msg.payload.WriteByte('<')
-		msg.payload.WriteString(strconv.FormatUint((uint64)(level), 10))
+		msg.payload.WriteString(strconv.Itoa(syslogPriority(level)))
 		msg.payload.WriteByte('>')
 	}
 
 	if log.time {
-		msg.timestamp = timestamp.GetTimestamp()
 		msg.payload.WriteByte(' ')
 		msg.payload.WriteString(timestamp.GetTimestampString(msg.timestamp))
 	}
 
 	if log.source {
 		msg.payload.WriteByte(' ')
-		msg.payload.WriteString(timestamp.GetSource(log.framesToIgnore))
+		msg.payload.WriteString(source)
 	}
 
 	if log.systemd || log.time || log.source {
 		msg.payload.WriteByte(' ')
 	}
 
-	msg.payload.WriteString(strings.TrimRight(s, "\n"))
+	msg.payload.WriteString(s)
+	for i := 0; i+1 < len(kv); i += 2 {
+		msg.payload.WriteByte(' ')
+		msg.payload.WriteString(fmt.Sprint(kv[i]))
+		msg.payload.WriteByte('=')
+		value := fmt.Sprint(kv[i+1])
+		if strings.ContainsAny(value, " \"=") {
+			value = strconv.Quote(value)
+		}
+		msg.payload.WriteString(value)
+	}
+}
 
-	log.shutdownLock.RLock()
-	if log.msgChan != nil {
-		log.msgChan <- msg
-		log.shutdownLock.RUnlock()
-	} else {
-		log.shutdownLock.RUnlock()
-		freeMsg(msg)
+func (log *Log) formatJson(msg *logMsg, level int, source string, kv []interface{}, s string) {
+	field := func(key string, value string) {
+		if msg.payload.Len() == 0 {
+			msg.payload.WriteByte('{')
+		} else {
+			msg.payload.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(value)
+		msg.payload.Write(k)
+		msg.payload.WriteByte(':')
+		msg.payload.Write(v)
+	}
+
+	if log.time {
+		field("time", timestamp.GetTimestampString(msg.timestamp))
 	}
+	field("level", LevelName(level))
+	if log.source {
+		field("source", strings.TrimSuffix(source, ":"))
+	}
+	field("msg", s)
+	for i := 0; i+1 < len(kv); i += 2 {
+		field(fmt.Sprint(kv[i]), fmt.Sprint(kv[i+1]))
+	}
+	msg.payload.WriteByte('}')
 }
 
 func (log *Log) Pf(level int, format string, v ...interface{}) {
-	log.println(level, fmt.Sprintf(format, v...))
+	log.println(level, nil, fmt.Sprintf(format, v...))
 }
 
 func (log *Log) PfSync(level int, format string, v ...interface{}) {
-	log.println(level, fmt.Sprintf(format, v...))
+	log.println(level, nil, fmt.Sprintf(format, v...))
 	log.Sync()
 }
+
+func (log *Log) With(kv ...interface{}) LogInterface {
+	return &fieldLog{Log: log, kv: kv}
+}
+
+// fieldLog is a Log adding key value pairs to its messages, it shares the
+// output and settings of the log it was made from
+type fieldLog struct {
+	*Log
+	kv []interface{}
+}
+
+func (fl *fieldLog) With(kv ...interface{}) LogInterface {
+	return &fieldLog{Log: fl.Log, kv: append(append([]interface{}(nil), fl.kv...), kv...)}
+}
+
+func (fl *fieldLog) Pf(level int, format string, v ...interface{}) {
+	fl.println(level, fl.kv, fmt.Sprintf(format, v...))
+}
+
+func (fl *fieldLog) PfSync(level int, format string, v ...interface{}) {
+	fl.println(level, fl.kv, fmt.Sprintf(format, v...))
+	fl.Sync()
+}
@@ -0,0 +1,95 @@
+package lsm
+
+import (
+	"encoding/binary"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+const (
+	bloomBitsPerKey = 10
+	bloomHashCount  = 7
+)
+
+// bloomFilter answers whether a table may contain a key, false positives are
+// possible but a negative answer is always right
+type bloomFilter struct {
+	bits      []byte
+	hashCount uint32
+}
+
+func bloomHash(key string) uint64 {
+	return xxhash.Checksum64([]byte(key))
+}
+
+func newBloomFilter(hashes []uint64) *bloomFilter {
+	nbits := len(hashes) * bloomBitsPerKey
+	if nbits < 64 {
+		nbits = 64
+	}
+
+	bf := new(bloomFilter)
+	bf.bits = make([]byte, (nbits+7)/8)
+	bf.hashCount = bloomHashCount
+	for _, h := range hashes {
+		bf.add(h)
+	}
+	return bf
+}
+
+// Double hashing as in "Less Hashing, Same Performance" by Kirsch and
+// Mitzenmacher, both hashes are taken from the single 64 bit key hash
+func (bf *bloomFilter) add(h uint64) {
+	nbits := uint64(len(bf.bits) * 8)
+	h1 := h & 0xffffffff
+	h2 := h >> 32
+	for i := uint64(0); i < uint64(bf.hashCount); i++ {
+		bit := (h1 + i*h2) % nbits
+		bf.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (bf *bloomFilter) mayContain(key string) bool {
+	if bf == nil || len(bf.bits) == 0 {
+		return true
+	}
+
+	h := bloomHash(key)
+	nbits := uint64(len(bf.bits) * 8)
+	h1 := h & 0xffffffff
+	h2 := h >> 32
+	for i := uint64(0); i < uint64(bf.hashCount); i++ {
+		bit := (h1 + i*h2) % nbits
+		if bf.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// marshal encodes the filter as hashCount(4) length(4) bits
+func (bf *bloomFilter) marshal() []byte {
+	data := make([]byte, 8+len(bf.bits))
+	binary.LittleEndian.PutUint32(data[0:], bf.hashCount)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(bf.bits)))
+	copy(data[8:], bf.bits)
+	return data
+}
+
+// unmarshalBloomFilter decodes a marshaled filter, nil is returned for
+// malformed data which makes every lookup consult the table
+func unmarshalBloomFilter(data []byte) *bloomFilter {
+	if len(data) < 8 {
+		return nil
+	}
+
+	length := binary.LittleEndian.Uint32(data[4:])
+	if uint32(len(data)-8) != length {
+		return nil
+	}
+
+	bf := new(bloomFilter)
+	bf.hashCount = binary.LittleEndian.Uint32(data[0:])
+	bf.bits = data[8:]
+	return bf
+}
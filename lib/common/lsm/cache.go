@@ -0,0 +1,210 @@
+package lsm
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"sync/atomic"
+
+	"ddb/lib/common/random"
+)
+
+const (
+	defaultBlockCacheSize = 32 * 1024 * 1024
+	// Approximate per node memory overhead on top of key and value
+	blockCacheNodeOverhead = 64
+	// Resolution of the verify rate sampling
+	blockCacheVerifyScale = 1 << 20
+)
+
+type blockCacheKey struct {
+	filePath string
+	offset   int64
+}
+
+type blockCacheEntry struct {
+	key   blockCacheKey
+	nodes []*LsmNode
+	size  int64
+}
+
+// blockCache is a LRU of decoded sstable blocks shared by all tables of a
+// Lsm, cached nodes are shared between readers and must not be modified.
+// A nil cache is valid and caches nothing.
+type blockCache struct {
+	lock     sync.Mutex
+	capacity int64
+	size     int64
+	items    map[blockCacheKey]*list.Element
+	lru      *list.List
+	hits     int64
+	misses   int64
+	// Fraction of hits re-read from the table file and compared
+	verifyRate float64
+	random     random.Source
+	verified   int64
+	stale      int64
+}
+
+func newBlockCache(capacity int64, verifyRate float64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+
+	c := new(blockCache)
+	c.capacity = capacity
+	c.verifyRate = verifyRate
+	if verifyRate > 0 && verifyRate < 1 {
+		c.random = random.NewTimeSource()
+	}
+	c.items = make(map[blockCacheKey]*list.Element)
+	c.lru = list.New()
+	return c
+}
+
+func (c *blockCache) get(key blockCacheKey) ([]*LsmNode, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddInt64(&c.hits, 1)
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*blockCacheEntry).nodes, true
+}
+
+func (c *blockCache) put(key blockCacheKey, nodes []*LsmNode) {
+	if c == nil {
+		return
+	}
+
+	size := int64(0)
+	for _, node := range nodes {
+		size += int64(len(node.key)+len(node.value)) + blockCacheNodeOverhead
+	}
+
+	if size > c.capacity {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.lru.PushFront(&blockCacheEntry{key: key, nodes: nodes, size: size})
+	c.size += size
+
+	for c.size > c.capacity {
+		elem := c.lru.Back()
+		entry := elem.Value.(*blockCacheEntry)
+		c.lru.Remove(elem)
+		delete(c.items, entry.key)
+		c.size -= entry.size
+	}
+}
+
+// sample reports whether a hit should be verified against the table file
+func (c *blockCache) sample() bool {
+	if c == nil || c.verifyRate <= 0 {
+		return false
+	}
+	if c.verifyRate >= 1 {
+		return true
+	}
+	return c.random.Int63n(blockCacheVerifyScale) < int64(c.verifyRate*blockCacheVerifyScale)
+}
+
+// verify compares cached nodes of key with nodes read from the file, on a
+// mismatch the entry is replaced and false returned
+func (c *blockCache) verify(key blockCacheKey, cached []*LsmNode, nodes []*LsmNode) bool {
+	atomic.AddInt64(&c.verified, 1)
+	if sameNodes(cached, nodes) {
+		return true
+	}
+	atomic.AddInt64(&c.stale, 1)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		entry := elem.Value.(*blockCacheEntry)
+		c.lru.Remove(elem)
+		delete(c.items, key)
+		c.size -= entry.size
+	}
+	return false
+}
+
+func sameNodes(a []*LsmNode, b []*LsmNode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].key != b[i].key || !bytes.Equal(a[i].value, b[i].value) ||
+			a[i].deleted != b[i].deleted || a[i].expiresAt != b[i].expiresAt ||
+			a[i].version != b[i].version {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyStats returns the number of verified hits and of those stale
+func (c *blockCache) verifyStats() (int64, int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&c.verified), atomic.LoadInt64(&c.stale)
+}
+
+// stats returns cache hits, misses and the current size in bytes
+func (c *blockCache) stats() (int64, int64, int64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return atomic.LoadInt64(&c.hits), atomic.LoadInt64(&c.misses), c.size
+}
+
+// keys returns the keys of cached blocks from the most recently used
+func (c *blockCache) keys() []blockCacheKey {
+	if c == nil {
+		return nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	keys := make([]blockCacheKey, 0, c.lru.Len())
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*blockCacheEntry).key)
+	}
+	return keys
+}
+
+// full reports whether another block would evict a cached one
+func (c *blockCache) full() bool {
+	if c == nil {
+		return true
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.size >= c.capacity
+}
@@ -0,0 +1,207 @@
+package lsm
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CatalogFileName is the catalog a snapshot directory carries next to the
+// engine files, it isn't a storage file so Restore doesn't copy it
+const CatalogFileName = "catalog.json"
+
+// CatalogFile is an engine file of a snapshot
+type CatalogFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Hex crc32c of the file content
+	Checksum string `json:"checksum"`
+}
+
+// Catalog describes the contents of a snapshot
+type Catalog struct {
+	// Newest file format version the engine writes
+	FormatVersion uint32 `json:"formatVersion"`
+	// Unix nanoseconds
+	CreatedAt int64 `json:"createdAt"`
+	// Version of the latest write, the last log segment and the manifest
+	// version held by the snapshot
+	MaxVersion     uint64        `json:"maxVersion"`
+	LogSeq         int64         `json:"logSeq"`
+	ManifestNumber uint64        `json:"manifestNumber"`
+	Tables         int           `json:"tables"`
+	Size           int64         `json:"size"`
+	Files          []CatalogFile `json:"files"`
+}
+
+func fileChecksum(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := crc32.New(crc32cTable)
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// writeCatalog checksums the engine files of the snapshot in dir and
+// writes the catalog, the files are immutable so writers aren't blocked
+func writeCatalog(dir string, catalog *Catalog) error {
+	names, err := StorageFiles(dir)
+	if err != nil {
+		return err
+	}
+	sort.Strings(names)
+
+	catalog.Files = make([]CatalogFile, 0, len(names))
+	for _, name := range names {
+		checksum, size, err := fileChecksum(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		catalog.Files = append(catalog.Files, CatalogFile{Name: name, Size: size, Checksum: checksum})
+		catalog.Size += size
+		if ssTableFileNamePattern.MatchString(name) {
+			catalog.Tables++
+		}
+	}
+
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := filepath.Join(dir, CatalogFileName+".tmp")
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, filepath.Join(dir, CatalogFileName))
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// ReadCatalog returns the catalog of the snapshot in dir, snapshots taken
+// before catalogs existed fail with an os.IsNotExist error
+func ReadCatalog(dir string) (*Catalog, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, CatalogFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	catalog := &Catalog{}
+	err = json.Unmarshal(data, catalog)
+	if err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+func newCatalog(v *version, maxVersion uint64, logSeq int64) *Catalog {
+	return &Catalog{
+		FormatVersion:  lsmFileVersionCompressed,
+		CreatedAt:      time.Now().UnixNano(),
+		MaxVersion:     maxVersion,
+		LogSeq:         logSeq,
+		ManifestNumber: v.number,
+	}
+}
+
+// Compatible reports whether the engine reads files of the catalog format
+// version
+func (c *Catalog) Compatible() bool {
+	return c.FormatVersion <= lsmFileVersionCompressed
+}
+
+// CheckSnapshot verifies the snapshot in dir without opening it: files are
+// compared with the catalog or, for snapshots taken before catalogs, every
+// node of the tables and logs is read. It returns the catalog, nil without
+// one, and the problems found.
+func CheckSnapshot(dir string) (*Catalog, []string, error) {
+	exists, err := hasLog(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !exists {
+		return nil, nil, os.ErrNotExist
+	}
+
+	problems := make([]string, 0)
+	catalog, err := ReadCatalog(dir)
+	if os.IsNotExist(err) {
+		problems, err = checkNodes(dir, problems)
+		return nil, problems, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !catalog.Compatible() {
+		problems = append(problems, fmt.Sprintf("format version %d is newer than %d", catalog.FormatVersion, lsmFileVersionCompressed))
+	}
+
+	listed := make(map[string]bool)
+	for _, f := range catalog.Files {
+		listed[f.Name] = true
+		checksum, size, err := fileChecksum(filepath.Join(dir, f.Name))
+		switch {
+		case os.IsNotExist(err):
+			problems = append(problems, fmt.Sprintf("%s missing", f.Name))
+		case err != nil:
+			return nil, nil, err
+		case size != f.Size:
+			problems = append(problems, fmt.Sprintf("%s size %d expected %d", f.Name, size, f.Size))
+		case checksum != f.Checksum:
+			problems = append(problems, fmt.Sprintf("%s checksum %s expected %s", f.Name, checksum, f.Checksum))
+		}
+	}
+
+	names, err := StorageFiles(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, name := range names {
+		if !listed[name] {
+			problems = append(problems, fmt.Sprintf("%s not in catalog", name))
+		}
+	}
+	return catalog, problems, nil
+}
+
+// checkNodes reads every node of the tables and logs of dir
+func checkNodes(dir string, problems []string) ([]string, error) {
+	infos, err := InspectTables(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		if info.Live && info.Err != nil {
+			problems = append(problems, info.Err.Error())
+		}
+	}
+
+	logs, err := LogFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, logPath := range logs {
+		_, err = ScanLog(logPath, nil)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,78 @@
+package lsm
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+var (
+	ErrUnknownChecksum = fmt.Errorf("Unknown checksum type")
+)
+
+type ChecksumType uint32
+
+const (
+	ChecksumXxHash64 ChecksumType = iota
+	ChecksumCrc32c
+	ChecksumSha256
+)
+
+// hash/crc32 uses the SSE4.2/ARMv8 crc32 instructions for the Castagnoli
+// polynomial when available
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func ParseChecksumType(name string) (ChecksumType, error) {
+	switch name {
+	case "", "xxhash64":
+		return ChecksumXxHash64, nil
+	case "crc32c":
+		return ChecksumCrc32c, nil
+	case "sha256":
+		return ChecksumSha256, nil
+	default:
+		return 0, ErrUnknownChecksum
+	}
+}
+
+func (t ChecksumType) String() string {
+	switch t {
+	case ChecksumXxHash64:
+		return "xxhash64"
+	case ChecksumCrc32c:
+		return "crc32c"
+	case ChecksumSha256:
+		return "sha256"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint32(t))
+	}
+}
+
+func (t ChecksumType) valid() bool {
+	return t <= ChecksumSha256
+}
+
+func (t ChecksumType) size() int {
+	switch t {
+	case ChecksumCrc32c:
+		return crc32.Size
+	case ChecksumSha256:
+		return sha256.Size
+	default:
+		return 8
+	}
+}
+
+func (t ChecksumType) newHash() hash.Hash {
+	switch t {
+	case ChecksumCrc32c:
+		return crc32.New(crc32cTable)
+	case ChecksumSha256:
+		return sha256.New()
+	default:
+		return xxhash.New64()
+	}
+}
@@ -0,0 +1,200 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	coalesceWindowMs = 5
+	// Interval over which writes of a key are counted to detect hot keys
+	coalesceRateInterval = int64(time.Second)
+)
+
+// coalesceWindow collects the writes to hot keys between two flushes,
+// writers of sync durability wait for done
+type coalesceWindow struct {
+	// Strongest durability requested by a writer of the window
+	durability Durability
+	done       chan struct{}
+	err        error
+}
+
+// coalescer delays logging of writes to hot keys so only the latest value
+// of a key within a window is logged. Coalesced writes are applied to the
+// memtable at once. It isn't synchronized, callers hold nodeMapLock.
+type coalescer struct {
+	// Writes per second that make a key hot
+	threshold int
+	window    time.Duration
+	// Start of the current counting interval in unix nanoseconds, writes per
+	// key within it and keys found hot in the previous interval
+	start   int64
+	counts  map[string]int
+	hot     map[string]bool
+	pending map[string]*LsmNode
+	current *coalesceWindow
+
+	coalesced int64
+	hotKeys   int64
+}
+
+// newCoalescer returns nil if coalescing is disabled
+func newCoalescer(params *LsmParameters) *coalescer {
+	if params.CoalesceThreshold <= 0 {
+		return nil
+	}
+
+	c := new(coalescer)
+	c.threshold = params.CoalesceThreshold
+	c.window = time.Duration(params.CoalesceWindowMs) * time.Millisecond
+	if c.window <= 0 {
+		c.window = coalesceWindowMs * time.Millisecond
+	}
+	c.counts = make(map[string]int)
+	c.hot = make(map[string]bool)
+	c.pending = make(map[string]*LsmNode)
+	return c
+}
+
+// isHot counts a write of key and reports whether it should be coalesced.
+// A key stays hot while a coalesced write of it is pending so its writes
+// are logged in order.
+func (c *coalescer) isHot(key string, now int64) bool {
+	if c == nil {
+		return false
+	}
+
+	if now-c.start >= coalesceRateInterval {
+		hot := make(map[string]bool)
+		for k, count := range c.counts {
+			if count >= c.threshold {
+				hot[k] = true
+			}
+		}
+		c.hot = hot
+		c.counts = make(map[string]int)
+		c.start = now
+		atomic.StoreInt64(&c.hotKeys, int64(len(hot)))
+	}
+
+	c.counts[key]++
+	if _, ok := c.pending[key]; ok {
+		return true
+	}
+	return c.hot[key] || c.counts[key] >= c.threshold
+}
+
+// add makes n the pending write of its key and returns the window to wait
+// for, nil if the writer doesn't wait for a sync
+func (c *coalescer) add(n *LsmNode, durability Durability) *coalesceWindow {
+	if _, ok := c.pending[n.key]; ok {
+		atomic.AddInt64(&c.coalesced, 1)
+	}
+	c.pending[n.key] = n
+
+	if c.current == nil {
+		c.current = &coalesceWindow{durability: DurabilityNone, done: make(chan struct{})}
+	}
+	if durability < c.current.durability {
+		c.current.durability = durability
+	}
+	if durability != DurabilitySync {
+		return nil
+	}
+	return c.current
+}
+
+// logged drops the pending write of key superseded by a logged write, the
+// writers of the window are acknowledged once the log is durable past it
+func (c *coalescer) logged(key string) {
+	if c == nil || len(c.pending) == 0 {
+		return
+	}
+	if _, ok := c.pending[key]; ok {
+		delete(c.pending, key)
+		atomic.AddInt64(&c.coalesced, 1)
+	}
+}
+
+// take returns the pending writes and their window and starts a new one
+func (c *coalescer) take() ([]*LsmNode, *coalesceWindow) {
+	if c == nil || c.current == nil {
+		return nil, nil
+	}
+	window := c.current
+
+	nodes := make([]*LsmNode, 0, len(c.pending))
+	for _, n := range c.pending {
+		nodes = append(nodes, n)
+	}
+	c.pending = make(map[string]*LsmNode)
+	c.current = nil
+	return nodes, window
+}
+
+// stats returns the number of coalesced writes and of hot keys in the last
+// counting interval
+func (c *coalescer) stats() (int64, int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return atomic.LoadInt64(&c.coalesced), atomic.LoadInt64(&c.hotKeys)
+}
+
+// flushCoalesced logs the pending writes of hot keys with a single write and
+// acknowledges the writers of their window
+func (lsm *Lsm) flushCoalesced() {
+	lsm.nodeMapLock.Lock()
+	nodes, window := lsm.coalescer.take()
+	if window == nil {
+		lsm.nodeMapLock.Unlock()
+		return
+	}
+
+	var err error
+	if len(nodes) > 0 {
+		err = lsm.appendLogNodes(nodes)
+	}
+	target := int64(0)
+	if err == nil {
+		// the target also covers writes which superseded pending ones
+		target = lsm.commitLog(window.durability)
+	}
+	lsm.nodeMapLock.Unlock()
+
+	if err == nil {
+		err = lsm.waitLog(target)
+	}
+	if err != nil {
+		lsm.log.Pf(0, "coalesced log write error %v", err)
+		window.err = lsm.translateError(err)
+	}
+	close(window.done)
+}
+
+// coalesce flushes coalesced writes every window until the engine stops
+func (lsm *Lsm) coalesce() {
+	defer lsm.wg.Done()
+
+	ticker := time.NewTicker(lsm.coalescer.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			lsm.flushCoalesced()
+		case <-lsm.syncStop:
+			return
+		}
+	}
+}
+
+// waitCoalesced returns once the writes of window are durable, window may
+// be nil
+func waitCoalesced(window *coalesceWindow) error {
+	if window == nil {
+		return nil
+	}
+	<-window.done
+	return window.err
+}
@@ -0,0 +1,564 @@
+package lsm
+
+import (
+	"context"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	compactionMinTables   = 4
+	compactionMaxTables   = 32
+	compactionSizeRatio   = 4.0
+	compactionMinTierSize = 1024 * 1024
+	compactionTableLimit  = 64
+	ssTableMergeTmpSuffix = ".tmp"
+	// Nodes merged between checks whether the merge was canceled
+	mergeCancelCheckNodes = 1024
+)
+
+// Size tiered compaction: tables are ordered by id and a run of adjacent
+// tables with similar sizes is merged into a single table once it grows to
+// CompactionMinTables. Only adjacent tables are merged so a merged table
+// can take the newest id of the run without shadowing tables in between.
+// A merged table file is named lsm_<minId>_<maxId>.sstable after the ids it
+// covers, tables covered by another table are leftovers of an interrupted
+// merge and removed on open.
+
+// CompactionStats describes merge activity and the outstanding compaction
+// debt, which is the work pending merges would do
+type CompactionStats struct {
+	Tables int
+	// Tables and bytes in runs eligible for merging
+	PendingTables int
+	PendingBytes  int64
+	Merges        int64
+	// Merges of tables not similarly sized because the table count was
+	// above TableLimit, zero limit means none
+	ForcedMerges int64
+	TableLimit   int
+	// Bytes written by merges
+	MergedBytes       int64
+	DroppedTombstones int64
+	// Expired values turned into tombstones or dropped by merges
+	PurgedExpired int64
+	// Total time spent merging and flushing the memtable into tables
+	MergeDuration time.Duration
+	Flushes       int64
+	FlushDuration time.Duration
+	// Bytes of all tables and memory held by their indexes
+	TableBytes int64
+	IndexBytes int64
+	// Nodes and approximate bytes in the memtable and bytes of log
+	// segments not yet flushed
+	MemtableNodes int
+	MemtableBytes int64
+	WalBytes      int64
+	// Log syncs of group commits, each covers all writes logged before it
+	LogSyncs int64
+	// Writes to hot keys replaced by a later write before being logged and
+	// keys found hot in the last second
+	CoalescedWrites int64
+	HotKeys         int64
+	// Writers queued for a flush of the busy memtable now, queued in total
+	// and rejected with ErrBusy after the stall timeout
+	StalledWriters int64
+	WriteStalls    int64
+	StallRejects   int64
+	// Writes delayed by a slowdown trigger, time writers spent delayed and
+	// queued and the write state: running, slowed or stopped
+	WriteSlowdowns   int64
+	SlowdownDuration time.Duration
+	StallDuration    time.Duration
+	WriteState       string
+	// Time merges waited for a slot of the coordinator and were throttled
+	// by its budget
+	MergeWaitDuration     time.Duration
+	MergeThrottleDuration time.Duration
+	// Background flushes and merges are suspended, see Lsm.Suspend
+	Suspended bool
+}
+
+type compactionPolicy struct {
+	minTables   int
+	maxTables   int
+	sizeRatio   float64
+	minTierSize int64
+	// Table count above which runs are forced, 0 means no limit
+	tableLimit int
+}
+
+func newCompactionPolicy(params *LsmParameters) compactionPolicy {
+	p := compactionPolicy{
+		minTables:   params.CompactionMinTables,
+		maxTables:   params.CompactionMaxTables,
+		sizeRatio:   params.CompactionSizeRatio,
+		minTierSize: params.CompactionMinTierSize,
+		tableLimit:  params.MaxTables,
+	}
+	if p.minTables < 2 {
+		p.minTables = compactionMinTables
+	}
+	if p.maxTables < p.minTables {
+		p.maxTables = compactionMaxTables
+		if p.maxTables < p.minTables {
+			p.maxTables = p.minTables
+		}
+	}
+	if p.sizeRatio < 1 {
+		p.sizeRatio = compactionSizeRatio
+	}
+	if p.minTierSize <= 0 {
+		p.minTierSize = compactionMinTierSize
+	}
+	if p.tableLimit == 0 {
+		p.tableLimit = compactionTableLimit
+	} else if p.tableLimit < 0 {
+		p.tableLimit = 0
+	}
+	return p
+}
+
+func (p compactionPolicy) tierSize(size int64) float64 {
+	if size < p.minTierSize {
+		size = p.minTierSize
+	}
+	return float64(size)
+}
+
+// runs returns disjoint [start, end) ranges of sizes, ordered by table id,
+// which should be merged
+func (p compactionPolicy) runs(sizes []int64) [][2]int {
+	runs := make([][2]int, 0)
+	for i := 0; i < len(sizes); {
+		lo := p.tierSize(sizes[i])
+		hi := lo
+		j := i + 1
+		for ; j < len(sizes) && j-i < p.maxTables; j++ {
+			size := p.tierSize(sizes[j])
+			if size < lo {
+				lo = size
+			}
+			if size > hi {
+				hi = size
+			}
+			if hi > lo*p.sizeRatio {
+				break
+			}
+		}
+
+		if j-i >= p.minTables {
+			runs = append(runs, [2]int{i, j})
+			i = j
+		} else {
+			i++
+		}
+	}
+	return runs
+}
+
+// forcedRun returns the adjacent tables with the least bytes to merge once
+// there are more than the table limit, sizes are ignored otherwise since
+// reads degrade with every table they have to consult
+func (p compactionPolicy) forcedRun(sizes []int64) ([2]int, bool) {
+	if p.tableLimit <= 0 || len(sizes) <= p.tableLimit {
+		return [2]int{}, false
+	}
+
+	n := p.maxTables
+	if n > len(sizes) {
+		n = len(sizes)
+	}
+	best := [2]int{0, n}
+	bestBytes := int64(-1)
+	bytes := int64(0)
+	for i, size := range sizes {
+		bytes += size
+		if i >= n {
+			bytes -= sizes[i-n]
+		}
+		if i >= n-1 && (bestBytes < 0 || bytes < bestBytes) {
+			best = [2]int{i - n + 1, i + 1}
+			bestBytes = bytes
+		}
+	}
+	return best, true
+}
+
+// sortedSsTables returns the current tables ordered by id, only merges
+// holding mergeLock remove tables
+func (lsm *Lsm) sortedSsTables() []*SsTable {
+	v := lsm.versions.acquire()
+	defer v.release()
+	return v.ascending()
+}
+
+// TableProperties returns properties of the tables of the current version
+// from the oldest to the newest
+func (lsm *Lsm) TableProperties() []TableProperties {
+	v := lsm.versions.acquire()
+	defer v.release()
+
+	tables := v.ascending()
+	props := make([]TableProperties, len(tables))
+	for i, st := range tables {
+		props[i] = st.properties()
+	}
+	return props
+}
+
+func ssTableSizes(tables []*SsTable) []int64 {
+	sizes := make([]int64, len(tables))
+	for i, st := range tables {
+		sizes[i] = st.fileSize
+	}
+	return sizes
+}
+
+func (lsm *Lsm) CompactionStats() CompactionStats {
+	tables := lsm.sortedSsTables()
+
+	var stats CompactionStats
+	stats.Tables = len(tables)
+	sizes := ssTableSizes(tables)
+	for _, run := range lsm.policy.runs(sizes) {
+		stats.PendingTables += run[1] - run[0]
+		for _, size := range sizes[run[0]:run[1]] {
+			stats.PendingBytes += size
+		}
+	}
+	stats.Merges = atomic.LoadInt64(&lsm.merges)
+	stats.ForcedMerges = atomic.LoadInt64(&lsm.forcedMerges)
+	stats.StalledWriters = atomic.LoadInt64(&lsm.stalledWriters)
+	stats.WriteStalls = atomic.LoadInt64(&lsm.writeStalls)
+	stats.StallRejects = atomic.LoadInt64(&lsm.stallRejects)
+	stats.WriteSlowdowns = atomic.LoadInt64(&lsm.writeSlowdowns)
+	stats.SlowdownDuration = time.Duration(atomic.LoadInt64(&lsm.slowdownNanos))
+	stats.StallDuration = time.Duration(atomic.LoadInt64(&lsm.stallNanos))
+	stats.WriteState = writeStateNames[atomic.LoadInt32(&lsm.writeState)]
+	stats.MergeWaitDuration = time.Duration(atomic.LoadInt64(&lsm.mergeWait))
+	stats.MergeThrottleDuration = time.Duration(atomic.LoadInt64(&lsm.mergeThrottle))
+	stats.Suspended = lsm.Suspended()
+	stats.TableLimit = lsm.policy.tableLimit
+	stats.MergedBytes = atomic.LoadInt64(&lsm.mergedBytes)
+	stats.DroppedTombstones = atomic.LoadInt64(&lsm.droppedTombstones)
+	stats.PurgedExpired = atomic.LoadInt64(&lsm.purgedExpired)
+	stats.MergeDuration = time.Duration(atomic.LoadInt64(&lsm.mergeNanos))
+	stats.Flushes = atomic.LoadInt64(&lsm.flushes)
+	stats.FlushDuration = time.Duration(atomic.LoadInt64(&lsm.flushNanos))
+	stats.LogSyncs = atomic.LoadInt64(&lsm.logSyncs)
+	stats.CoalescedWrites, stats.HotKeys = lsm.coalescer.stats()
+	for _, size := range sizes {
+		stats.TableBytes += size
+	}
+	for _, st := range tables {
+		stats.IndexBytes += st.sparse.bytes()
+	}
+
+	lsm.nodeMapLock.RLock()
+	stats.MemtableNodes = lsm.memtable.len()
+	stats.MemtableBytes = lsm.memtable.bytes()
+	lsm.nodeMapLock.RUnlock()
+	stats.WalBytes = walBytes(lsm.rootPath)
+	return stats
+}
+
+func (lsm *Lsm) getMergedSsTablePath(minId int64, maxId int64) string {
+	return path.Join(lsm.rootPath, "lsm_"+strconv.FormatInt(minId, 10)+"_"+strconv.FormatInt(maxId, 10)+".sstable")
+}
+
+func (lsm *Lsm) mergeSsTables() error {
+	for {
+		lsm.nodeMapLock.RLock()
+		open := lsm.state == lsmStateOpen
+		lsm.nodeMapLock.RUnlock()
+		if !open || lsm.Suspended() {
+			return nil
+		}
+
+		done, err := lsm.mergeNextRun()
+		if err != nil {
+			lsm.log.Pf(0, "merge error %v", err)
+			lsm.event(EventError, 0, "merge error %v", err)
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// mergeNextRun merges the first eligible run, or a forced run if there are
+// more tables than the limit, and reports whether there was none
+func (lsm *Lsm) mergeNextRun() (bool, error) {
+	lsm.mergeLock.Lock()
+	defer lsm.mergeLock.Unlock()
+
+	tables := lsm.sortedSsTables()
+
+	sizes := ssTableSizes(tables)
+	runs := lsm.policy.runs(sizes)
+	if len(runs) == 0 {
+		run, forced := lsm.policy.forcedRun(sizes)
+		if !forced {
+			return true, nil
+		}
+		lsm.log.Pf(0, "%d tables above limit %d, forcing merge", len(tables), lsm.policy.tableLimit)
+		atomic.AddInt64(&lsm.forcedMerges, 1)
+		runs = append(runs, run)
+	}
+
+	// tombstones are only needed to shadow older versions, there are
+	// none once the run includes the oldest table
+	run := runs[0]
+	return false, lsm.mergeRun(context.Background(), tables[run[0]:run[1]], run[0] == 0)
+}
+
+// CompactOptions changes what a major compaction drops, the zero value
+// drops tombstones and expired values
+type CompactOptions struct {
+	// Keep tombstones instead of dropping them
+	KeepTombstones bool
+	// Keep expired values instead of purging them
+	KeepExpired bool
+	// Rewrite a single table too, e.g. to change its compression
+	Rewrite bool
+}
+
+// MajorCompact checkpoints the memtable and merges all tables into one
+// dropping tombstones and expired values. A canceled merge leaves the
+// tables as they were and returns the ctx error.
+func (lsm *Lsm) MajorCompact(ctx context.Context) error {
+	return lsm.CompactWith(ctx, CompactOptions{})
+}
+
+// CompactWith is MajorCompact with options
+func (lsm *Lsm) CompactWith(ctx context.Context, opts CompactOptions) error {
+	lsm.nodeMapLock.RLock()
+	open := lsm.state == lsmStateOpen
+	lsm.nodeMapLock.RUnlock()
+	if !open {
+		return ErrClosed
+	}
+
+	err := lsm.compact(true)
+	if err != nil {
+		return lsm.translateError(err)
+	}
+
+	lsm.mergeLock.Lock()
+	defer lsm.mergeLock.Unlock()
+
+	lsm.nodeMapLock.RLock()
+	open = lsm.state == lsmStateOpen
+	lsm.nodeMapLock.RUnlock()
+	if !open {
+		return ErrClosed
+	}
+
+	tables := lsm.sortedSsTables()
+
+	if len(tables) == 0 || (len(tables) == 1 && !opts.Rewrite) {
+		return nil
+	}
+
+	now := lsm.now()
+	if opts.KeepExpired {
+		// nothing expires before time zero
+		now = 0
+	}
+	err = lsm.mergeRunAt(ctx, tables, !opts.KeepTombstones, now)
+	if err != nil && err != ctx.Err() {
+		lsm.log.Pf(0, "major compaction error %v", err)
+		lsm.event(EventError, 0, "major compaction error %v", err)
+		return lsm.translateError(err)
+	}
+	return err
+}
+
+// mergeRun replaces tables with their merge, caller must hold mergeLock
+func (lsm *Lsm) mergeRun(ctx context.Context, tables []*SsTable, dropTombstones bool) error {
+	return lsm.mergeRunAt(ctx, tables, dropTombstones, lsm.now())
+}
+
+// mergeRunAt is mergeRun purging values expired at now
+func (lsm *Lsm) mergeRunAt(ctx context.Context, tables []*SsTable, dropTombstones bool, now int64) error {
+	minId := tables[0].minId
+	maxId := tables[len(tables)-1].maxId
+	if len(tables) == 1 {
+		// a rewritten table needs a path of its own, a new id makes it cover
+		// the old one like a merged table
+		maxId = atomic.AddInt64(&lsm.time, 1)
+	}
+	filePath := lsm.getMergedSsTablePath(minId, maxId)
+
+	waited, err := lsm.coordinator.acquire(ctx)
+	atomic.AddInt64(&lsm.mergeWait, int64(waited))
+	if err != nil {
+		return err
+	}
+	defer lsm.coordinator.release()
+
+	lsm.log.Pf(0, "merge %d tables %d-%d drop tombstones %v", len(tables), minId, maxId, dropTombstones)
+	start := time.Now()
+
+	throttle := func(n int64) error {
+		slept, err := lsm.coordinator.throttle(ctx, n)
+		atomic.AddInt64(&lsm.mergeThrottle, int64(slept))
+		return err
+	}
+	dropped, purged, err := mergeSsTableFiles(ctx, tables, filePath, lsm.checksum, lsm.compression, dropTombstones, now, throttle)
+	if err != nil {
+		return err
+	}
+
+	newSt, err := openSsTable(lsm.log, filePath, lsm.cache)
+	if err != nil {
+		os.Remove(filePath)
+		os.Remove(ssTableIndexPath(filePath))
+		return err
+	}
+	newSt.minId = minId
+	newSt.maxId = maxId
+
+	// readers holding older versions keep reading the merged tables
+	err = lsm.versions.apply(&versionEdit{added: []*SsTable{newSt}, removed: tables})
+	if err != nil {
+		newSt.Erase()
+		return err
+	}
+
+	lsm.nodeMapLock.RLock()
+	lsm.signalWritable()
+	lsm.nodeMapLock.RUnlock()
+
+	atomic.AddInt64(&lsm.merges, 1)
+	atomic.AddInt64(&lsm.mergedBytes, newSt.fileSize)
+	atomic.AddInt64(&lsm.droppedTombstones, dropped)
+	atomic.AddInt64(&lsm.purgedExpired, purged)
+	atomic.AddInt64(&lsm.mergeNanos, int64(time.Since(start)))
+
+	lsm.log.Pf(0, "merge %d-%d done size %d", minId, maxId, newSt.fileSize)
+	lsm.event(EventMerge, time.Since(start), "merged %d tables %d-%d size %d dropped tombstones %d purged expired %d",
+		len(tables), minId, maxId, newSt.fileSize, dropped, purged)
+	return nil
+}
+
+// mergeSsTableFiles writes the newest version of every key of tables,
+// ordered by id, into filePath and returns the number of dropped tombstones
+// and purged expired values. The data is written to a temporary file which
+// is renamed once complete, throttle is charged the written bytes.
+func mergeSsTableFiles(ctx context.Context, tables []*SsTable, filePath string, checksum ChecksumType, compression CompressionType, dropTombstones bool, now int64, throttle func(n int64) error) (int64, int64, error) {
+	// duplicates and dropped tombstones make the merged table smaller, the
+	// sum of the tables is close enough to choose the index density
+	var nodes, size int64
+	for _, st := range tables {
+		nodes += st.nodes
+		size += st.fileSize - st.dataOffset
+	}
+
+	items := make([]*mergeItem, 0, len(tables))
+	for _, st := range tables {
+		it, err := st.newIterator("", "")
+		if err != nil {
+			for _, item := range items {
+				item.it.close()
+			}
+			return 0, 0, err
+		}
+		items = append(items, &mergeItem{it: it, priority: st.maxId})
+	}
+
+	mi, err := newMergeIterator(items)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer mi.close()
+
+	tmpFilePath := filePath + ssTableMergeTmpSuffix
+	os.Remove(tmpFilePath)
+	tmpFile, err := os.OpenFile(tmpFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	dropped, purged, err := writeMergedSsTable(ctx, mi, tmpFile, filePath, checksum, compression, chooseKeysPerIndex(nodes, size), dropTombstones, now, throttle)
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpFilePath)
+		os.Remove(ssTableIndexPath(filePath))
+		return 0, 0, err
+	}
+
+	err = os.Rename(tmpFilePath, filePath)
+	if err != nil {
+		os.Remove(tmpFilePath)
+		os.Remove(ssTableIndexPath(filePath))
+		return 0, 0, err
+	}
+	return dropped, purged, nil
+}
+
+func writeMergedSsTable(ctx context.Context, mi *mergeIterator, file *os.File, filePath string, checksum ChecksumType, compression CompressionType, keysPerIndex int, dropTombstones bool, now int64, throttle func(n int64) error) (int64, int64, error) {
+	w, err := newSsTableWriter(file, checksum, compression, keysPerIndex)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	dropped := int64(0)
+	purged := int64(0)
+	charged := w.offset
+	count := 0
+	for node := mi.current(); node != nil; node = mi.current() {
+		count++
+		if count%mergeCancelCheckNodes == 0 {
+			if err := ctx.Err(); err != nil {
+				return 0, 0, err
+			}
+			if err := throttle(w.offset - charged); err != nil {
+				return 0, 0, err
+			}
+			charged = w.offset
+		}
+
+		// an expired value still shadows older versions like a tombstone
+		if !node.deleted && node.expired(now) {
+			purged++
+			writtenAt := node.writtenAt
+			node = newLsmNode(node.key, nil)
+			node.deleted = true
+			node.writtenAt = writtenAt
+		}
+
+		if node.deleted && dropTombstones {
+			dropped++
+		} else {
+			err = w.add(node)
+			if err != nil {
+				return 0, 0, err
+			}
+		}
+
+		err = mi.next()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	err = throttle(w.offset - charged)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	err = w.finish()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mergedSt := &SsTable{filePath: filePath}
+	mergedSt.setIndex(w)
+	return dropped, purged, mergedSt.writeIndex()
+}
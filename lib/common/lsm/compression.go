@@ -0,0 +1,179 @@
+package lsm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	ErrUnknownCompression = fmt.Errorf("Unknown compression type")
+	ErrCorruptBlock       = fmt.Errorf("Corrupt compressed block")
+)
+
+type CompressionType uint32
+
+const (
+	CompressionNone CompressionType = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+// Tables of a compression other than none store every index block as a
+// frame: rawLength(4) length(4) compressed block. Offsets of the sparse
+// index point at frames and nodes keep their checksums inside the block.
+const blockFrameHeaderSize = 8
+
+// zstd encoders and decoders are safe for concurrent EncodeAll and
+// DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func ParseCompressionType(name string) (CompressionType, error) {
+	switch name {
+	case "", "none":
+		return CompressionNone, nil
+	case "snappy":
+		return CompressionSnappy, nil
+	case "zstd":
+		return CompressionZstd, nil
+	default:
+		return 0, ErrUnknownCompression
+	}
+}
+
+func (c CompressionType) valid() bool {
+	return c <= CompressionZstd
+}
+
+func (c CompressionType) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionSnappy:
+		return "snappy"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+func (c CompressionType) compress(block []byte) []byte {
+	switch c {
+	case CompressionSnappy:
+		return snappy.Encode(nil, block)
+	case CompressionZstd:
+		return zstdEncoder.EncodeAll(block, nil)
+	default:
+		return block
+	}
+}
+
+func (c CompressionType) decompress(data []byte, rawLength int) ([]byte, error) {
+	var block []byte
+	var err error
+	switch c {
+	case CompressionSnappy:
+		block, err = snappy.Decode(make([]byte, rawLength), data)
+	case CompressionZstd:
+		block, err = zstdDecoder.DecodeAll(data, make([]byte, 0, rawLength))
+	default:
+		return data, nil
+	}
+	if err != nil || len(block) != rawLength {
+		return nil, ErrCorruptBlock
+	}
+	return block, nil
+}
+
+// writeBlockFrame compresses block and writes it as a frame, it returns the
+// frame size
+func writeBlockFrame(w io.Writer, block []byte, compression CompressionType) (int64, error) {
+	data := compression.compress(block)
+	header := make([]byte, blockFrameHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], uint32(len(block)))
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(data)))
+
+	_, err := w.Write(header)
+	if err != nil {
+		return 0, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return 0, err
+	}
+	return int64(blockFrameHeaderSize + len(data)), nil
+}
+
+// readBlockFrame reads and decompresses the frame at the reader position,
+// it returns io.EOF at the end of the data
+func readBlockFrame(r io.Reader, compression CompressionType) ([]byte, int64, error) {
+	header := make([]byte, blockFrameHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, ErrCorruptBlock
+		}
+		return nil, 0, err
+	}
+
+	rawLength := int(binary.LittleEndian.Uint32(header[0:]))
+	data := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, 0, ErrCorruptBlock
+	}
+
+	block, err := compression.decompress(data, rawLength)
+	if err != nil {
+		return nil, 0, err
+	}
+	return block, int64(blockFrameHeaderSize + len(data)), nil
+}
+
+// blockReader reads the node stream of compressed table data frame by
+// frame, offset is the file offset of the frame being read
+type blockReader struct {
+	reader      *bufio.Reader
+	compression CompressionType
+	block       []byte
+	offset      int64
+	next        int64
+}
+
+func newBlockReader(r io.Reader, compression CompressionType, offset int64) *blockReader {
+	return &blockReader{reader: bufio.NewReader(r), compression: compression, offset: offset, next: offset}
+}
+
+func (br *blockReader) Read(p []byte) (int, error) {
+	if len(br.block) == 0 {
+		block, size, err := readBlockFrame(br.reader, br.compression)
+		if err != nil {
+			return 0, err
+		}
+		br.block = block
+		br.offset = br.next
+		br.next += size
+	}
+
+	n := copy(p, br.block)
+	br.block = br.block[n:]
+	return n, nil
+}
+
+// atFrameStart reports whether the next read starts a new frame
+func (br *blockReader) atFrameStart() bool {
+	return len(br.block) == 0
+}
+
+// nextOffset returns the file offset of the next frame
+func (br *blockReader) nextOffset() int64 {
+	return br.next
+}
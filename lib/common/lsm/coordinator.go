@@ -0,0 +1,123 @@
+package lsm
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CompactionCoordinator is shared by the engines on one disk through
+// LsmParameters.Coordinator so their merges don't run at the same time and
+// blow the latency of every engine: at most concurrency merges run at once
+// and merges write at most bytesPerSec bytes per second together. Flushes
+// bypass it, delaying them would stall writers. A nil coordinator imposes
+// no limits.
+type CompactionCoordinator struct {
+	slots       chan struct{}
+	bytesPerSec int64
+
+	lock sync.Mutex
+	// Time the budget allows the next write, writes reserve budget ahead
+	next time.Time
+
+	waitNanos     int64
+	throttleNanos int64
+}
+
+// NewCompactionCoordinator lets concurrency merges run at once, zero or
+// negative means one, and limits their writes to bytesPerSec, zero or
+// negative means no limit
+func NewCompactionCoordinator(concurrency int, bytesPerSec int64) *CompactionCoordinator {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &CompactionCoordinator{
+		slots:       make(chan struct{}, concurrency),
+		bytesPerSec: bytesPerSec,
+	}
+}
+
+// acquire waits for a merge slot and returns the time waited
+func (c *CompactionCoordinator) acquire(ctx context.Context) (time.Duration, error) {
+	if c == nil {
+		return 0, nil
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+		return 0, nil
+	default:
+	}
+
+	start := time.Now()
+	select {
+	case c.slots <- struct{}{}:
+		waited := time.Since(start)
+		atomic.AddInt64(&c.waitNanos, int64(waited))
+		return waited, nil
+	case <-ctx.Done():
+		return time.Since(start), ctx.Err()
+	}
+}
+
+func (c *CompactionCoordinator) release() {
+	if c == nil {
+		return
+	}
+	<-c.slots
+}
+
+// throttle charges n written bytes to the budget and sleeps until the
+// budget allows them, it returns the time slept
+func (c *CompactionCoordinator) throttle(ctx context.Context, n int64) (time.Duration, error) {
+	if c == nil || c.bytesPerSec <= 0 || n <= 0 {
+		return 0, nil
+	}
+
+	c.lock.Lock()
+	now := time.Now()
+	if c.next.Before(now) {
+		c.next = now
+	}
+	c.next = c.next.Add(time.Duration(float64(n) / float64(c.bytesPerSec) * float64(time.Second)))
+	delay := c.next.Sub(now)
+	c.lock.Unlock()
+
+	// a burst of a second of budget passes without sleeping
+	delay -= time.Second
+	if delay <= 0 {
+		return 0, nil
+	}
+
+	atomic.AddInt64(&c.throttleNanos, int64(delay))
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return delay, ctx.Err()
+	}
+}
+
+// CoordinatorStats describes the merges of all engines of a coordinator
+type CoordinatorStats struct {
+	// Merges running now and allowed at once
+	Running     int
+	Concurrency int
+	BytesPerSec int64
+	// Time merges waited for a slot and were throttled
+	WaitDuration     time.Duration
+	ThrottleDuration time.Duration
+}
+
+func (c *CompactionCoordinator) Stats() CoordinatorStats {
+	return CoordinatorStats{
+		Running:          len(c.slots),
+		Concurrency:      cap(c.slots),
+		BytesPerSec:      c.bytesPerSec,
+		WaitDuration:     time.Duration(atomic.LoadInt64(&c.waitNanos)),
+		ThrottleDuration: time.Duration(atomic.LoadInt64(&c.throttleNanos)),
+	}
+}
@@ -0,0 +1,113 @@
+package lsm
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	countersFileName    = "lsm.counters"
+	countersTmpFileName = "lsm.counters.tmp"
+)
+
+// prefixCounters keeps approximate live key counts for a configured set of
+// key prefixes. Counts are adjusted on every set/delete and persisted on
+// compaction, so they survive restarts without scanning the tables.
+type prefixCounters struct {
+	lock     sync.Mutex
+	prefixes []string
+	counts   map[string]int64
+}
+
+func newPrefixCounters(prefixes []string) *prefixCounters {
+	pc := new(prefixCounters)
+	pc.prefixes = make([]string, 0, len(prefixes))
+	pc.counts = make(map[string]int64)
+	for _, prefix := range prefixes {
+		if _, ok := pc.counts[prefix]; ok {
+			continue
+		}
+		pc.prefixes = append(pc.prefixes, prefix)
+		pc.counts[prefix] = 0
+	}
+	return pc
+}
+
+func (pc *prefixCounters) matches(key string) bool {
+	for _, prefix := range pc.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pc *prefixCounters) add(key string, delta int64) {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	for _, prefix := range pc.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			pc.counts[prefix] += delta
+			if pc.counts[prefix] < 0 {
+				pc.counts[prefix] = 0
+			}
+		}
+	}
+}
+
+func (pc *prefixCounters) snapshot() map[string]int64 {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	counts := make(map[string]int64, len(pc.counts))
+	for prefix, count := range pc.counts {
+		counts[prefix] = count
+	}
+	return counts
+}
+
+func (pc *prefixCounters) load(rootPath string) error {
+	data, err := ioutil.ReadFile(filepath.Join(rootPath, countersFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	counts := make(map[string]int64)
+	err = json.Unmarshal(data, &counts)
+	if err != nil {
+		return err
+	}
+
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+
+	for prefix, count := range counts {
+		if _, ok := pc.counts[prefix]; ok {
+			pc.counts[prefix] = count
+		}
+	}
+	return nil
+}
+
+func (pc *prefixCounters) save(rootPath string) error {
+	data, err := json.Marshal(pc.snapshot())
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(rootPath, countersTmpFileName)
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(rootPath, countersFileName))
+}
@@ -0,0 +1,53 @@
+package lsm
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// Engine level errors returned through the storage interface, callers use
+// them to decide whether and when a failed request may be retried.
+var (
+	ErrDiskFull  = fmt.Errorf("Disk full")
+	ErrCorrupted = fmt.Errorf("Data corrupted")
+	ErrBusy      = fmt.Errorf("Busy")
+	ErrClosed    = fmt.Errorf("Closed")
+	ErrExists    = fmt.Errorf("Exists")
+	// The live value of a key has a different version than expected
+	ErrVersionMismatch = fmt.Errorf("Version mismatch")
+	ErrValueTooLarge   = fmt.Errorf("Value too large")
+	ErrUnknownTxnOp    = fmt.Errorf("Unknown transaction operation")
+)
+
+func isCorruptionError(err error) bool {
+	switch err {
+	case ErrLsmNodeBadMagic, ErrLsmNodeBadCheckSum, ErrLsmFileBadVersion, ErrUnknownChecksum:
+		return true
+	default:
+		return false
+	}
+}
+
+// translateError maps low level failures onto the engine error taxonomy,
+// the original error is logged since it is lost for the caller
+func (lsm *Lsm) translateError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrNotFound, err == ErrEmptyKey, err == ErrEmptyValue, err == ErrExists, err == ErrVersionMismatch, err == ErrValueTooLarge:
+		return err
+	case err == ErrDiskFull, err == ErrCorrupted, err == ErrBusy, err == ErrClosed:
+		return err
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		lsm.log.Pf(0, "disk full error %v", err)
+		lsm.event(EventError, 0, "disk full error %v", err)
+		return ErrDiskFull
+	case isCorruptionError(err):
+		lsm.log.Pf(0, "corruption error %v", err)
+		lsm.event(EventError, 0, "corruption error %v", err)
+		return ErrCorrupted
+	default:
+		return err
+	}
+}
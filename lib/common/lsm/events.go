@@ -0,0 +1,85 @@
+package lsm
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Events kept by the event log, older ones are dropped
+	eventLogSize = 256
+)
+
+// Engine event types
+const (
+	EventOpen     = "open"
+	EventRecovery = "recovery"
+	EventFlush    = "flush"
+	EventMerge    = "merge"
+	EventError    = "error"
+	EventClose    = "close"
+	EventSuspend  = "suspend"
+	EventResume   = "resume"
+)
+
+// Event is a state transition of the engine
+type Event struct {
+	// Increases by one with every event, a gap in a listing means events
+	// were dropped
+	Seq uint64
+	// Unix nanoseconds
+	Time    int64
+	Type    string
+	Message string
+	// Time the transition took, zero for instant events
+	Duration time.Duration
+}
+
+// eventLog keeps the latest events in a ring buffer
+type eventLog struct {
+	lock   sync.Mutex
+	events []Event
+	seq    uint64
+}
+
+func newEventLog() *eventLog {
+	return &eventLog{events: make([]Event, 0, eventLogSize)}
+}
+
+func (el *eventLog) add(event Event) {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	el.seq++
+	event.Seq = el.seq
+	if len(el.events) < eventLogSize {
+		el.events = append(el.events, event)
+	} else {
+		el.events[(el.seq-1)%eventLogSize] = event
+	}
+}
+
+// list returns the events in order
+func (el *eventLog) list() []Event {
+	el.lock.Lock()
+	defer el.lock.Unlock()
+
+	events := make([]Event, 0, len(el.events))
+	start := 0
+	if len(el.events) == eventLogSize {
+		start = int(el.seq % eventLogSize)
+	}
+	events = append(events, el.events[start:]...)
+	return append(events, el.events[:start]...)
+}
+
+// event records an engine event which took duration
+func (lsm *Lsm) event(eventType string, duration time.Duration, format string, v ...interface{}) {
+	lsm.events.add(Event{Time: lsm.now(), Type: eventType, Message: fmt.Sprintf(format, v...), Duration: duration})
+}
+
+// Events returns the latest engine events from the oldest
+func (lsm *Lsm) Events() []Event {
+	return lsm.events.list()
+}
@@ -0,0 +1,74 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	ErrLsmFileBadVersion = fmt.Errorf("Lsm file unsupported version")
+)
+
+const (
+	LsmFileMagic   = uint32(0x4CBDF11E)
+	lsmFileVersion = uint32(1)
+	// Version of files with compressed data, the reserved field holds the
+	// compression
+	lsmFileVersionCompressed = uint32(2)
+	fileHeaderSize           = 16
+)
+
+// Sstable and log files start with a header recording the format version
+// and the checksum algorithm used for every node in the file:
+// magic(4) version(4) checksum(4) compression(4)
+// Files without compression keep version 1 with a zero reserved field.
+func writeFileHeader(f io.Writer, checksum ChecksumType, compression CompressionType) error {
+	header := make([]byte, fileHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], LsmFileMagic)
+	binary.LittleEndian.PutUint32(header[4:], lsmFileVersion)
+	binary.LittleEndian.PutUint32(header[8:], uint32(checksum))
+	if compression != CompressionNone {
+		binary.LittleEndian.PutUint32(header[4:], lsmFileVersionCompressed)
+		binary.LittleEndian.PutUint32(header[12:], uint32(compression))
+	}
+
+	_, err := f.Write(header)
+	return err
+}
+
+// readFileHeader positions the file at its first node and returns the
+// checksum algorithm, the compression and offset of the data. Files written
+// before headers existed start with a node directly and always use xxhash64.
+func readFileHeader(f *os.File) (ChecksumType, CompressionType, int64, error) {
+	header := make([]byte, fileHeaderSize)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, 0, 0, err
+	}
+
+	if n < fileHeaderSize || binary.LittleEndian.Uint32(header[0:]) != LsmFileMagic {
+		_, err = f.Seek(0, os.SEEK_SET)
+		return ChecksumXxHash64, CompressionNone, 0, err
+	}
+
+	compression := CompressionNone
+	switch binary.LittleEndian.Uint32(header[4:]) {
+	case lsmFileVersion:
+	case lsmFileVersionCompressed:
+		compression = CompressionType(binary.LittleEndian.Uint32(header[12:]))
+		if !compression.valid() {
+			return 0, 0, 0, ErrUnknownCompression
+		}
+	default:
+		return 0, 0, 0, ErrLsmFileBadVersion
+	}
+
+	checksum := ChecksumType(binary.LittleEndian.Uint32(header[8:]))
+	if !checksum.valid() {
+		return 0, 0, 0, ErrUnknownChecksum
+	}
+
+	return checksum, compression, fileHeaderSize, nil
+}
@@ -0,0 +1,272 @@
+package lsm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/OneOfOne/xxhash"
+)
+
+var (
+	ErrLsmIndexBadMagic    = fmt.Errorf("Lsm index bad magic")
+	ErrLsmIndexBadCheckSum = fmt.Errorf("Lsm index bad checksum")
+	ErrLsmIndexStale       = fmt.Errorf("Lsm index stale")
+)
+
+const (
+	LsmIndexMagic   = uint32(0x4CBD1DE0)
+	lsmIndexVersion = uint32(6)
+	indexHeaderSize = 88
+)
+
+// Index density bounds, densities are powers of two so a rebuilt index can
+// thin out entries taken every minKeysPerIndex nodes
+const (
+	minKeysPerIndex = 64
+	maxKeysPerIndex = 8192
+	// Data bytes of an index block are about a 256th of the table within
+	// these bounds, small tables get dense indexes
+	indexBlocksPerTable = 256
+	minIndexBlockSize   = 4 * 1024
+	maxIndexBlockSize   = 64 * 1024
+	// Index entries of a huge table stay under this unless its blocks
+	// would exceed maxKeysPerIndex nodes
+	maxIndexEntries = 16 * 1024
+)
+
+// chooseKeysPerIndex returns the index density of a table of about nodes
+// nodes and size data bytes: the smallest power of two giving blocks of the
+// target size while keeping the index under maxIndexEntries entries
+func chooseKeysPerIndex(nodes int64, size int64) int {
+	if nodes <= 0 {
+		return minKeysPerIndex
+	}
+
+	blockSize := size / indexBlocksPerTable
+	if blockSize < minIndexBlockSize {
+		blockSize = minIndexBlockSize
+	}
+	if blockSize > maxIndexBlockSize {
+		blockSize = maxIndexBlockSize
+	}
+	nodeSize := size / nodes
+	if nodeSize < 1 {
+		nodeSize = 1
+	}
+
+	density := minKeysPerIndex
+	for density < maxKeysPerIndex &&
+		(int64(density)*nodeSize < blockSize || nodes/int64(density) > maxIndexEntries) {
+		density *= 2
+	}
+	return density
+}
+
+// The sparse index of a sstable is persisted next to it so opening a table
+// doesn't need to read the whole data file:
+// magic(4) version(4) checksum(4) count(4) dataOffset(8) fileSize(8)
+// maxVersion(8) compression(4) keysPerIndex(4) nodes(8) minWrittenAt(8)
+// maxWrittenAt(8) meanWrittenAt(8) writtenNodes(8) maxKeyLength(4) maxKey
+// bloomLength(4) bloom count*(keyLength(4) key offset(8))
+// xxhash64(8)
+func ssTableIndexPath(filePath string) string {
+	return strings.TrimSuffix(filePath, ".sstable") + ".index"
+}
+
+func putIndexString(buf *bytes.Buffer, s string) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, uint32(len(s)))
+	buf.Write(b)
+	buf.WriteString(s)
+}
+
+func getIndexString(r *bytes.Reader) (string, error) {
+	b := make([]byte, 4)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return "", err
+	}
+
+	s := make([]byte, binary.LittleEndian.Uint32(b))
+	_, err = io.ReadFull(r, s)
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+func (st *SsTable) writeIndex() error {
+	var buf bytes.Buffer
+
+	header := make([]byte, indexHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:], LsmIndexMagic)
+	binary.LittleEndian.PutUint32(header[4:], lsmIndexVersion)
+	binary.LittleEndian.PutUint32(header[8:], uint32(st.checksum))
+	binary.LittleEndian.PutUint32(header[12:], uint32(st.sparse.len()))
+	binary.LittleEndian.PutUint64(header[16:], uint64(st.dataOffset))
+	binary.LittleEndian.PutUint64(header[24:], uint64(st.fileSize))
+	binary.LittleEndian.PutUint64(header[32:], st.maxVersion)
+	binary.LittleEndian.PutUint32(header[40:], uint32(st.compression))
+	binary.LittleEndian.PutUint32(header[44:], uint32(st.keysPerIndex))
+	binary.LittleEndian.PutUint64(header[48:], uint64(st.nodes))
+	binary.LittleEndian.PutUint64(header[56:], uint64(st.written.min))
+	binary.LittleEndian.PutUint64(header[64:], uint64(st.written.max))
+	binary.LittleEndian.PutUint64(header[72:], uint64(st.written.mean))
+	binary.LittleEndian.PutUint64(header[80:], uint64(st.written.nodes))
+	buf.Write(header)
+
+	maxKey := ""
+	if st.maxKey != nil {
+		maxKey = *st.maxKey
+	}
+	putIndexString(&buf, maxKey)
+
+	bloom := []byte{}
+	if st.bloom != nil {
+		bloom = st.bloom.marshal()
+	}
+	putIndexString(&buf, string(bloom))
+
+	offset := make([]byte, 8)
+	for i := 0; i < st.sparse.len(); i++ {
+		putIndexString(&buf, st.sparse.key(i))
+		binary.LittleEndian.PutUint64(offset, uint64(st.sparse.offset(i)))
+		buf.Write(offset)
+	}
+
+	h := xxhash.New64()
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+
+	indexPath := ssTableIndexPath(st.filePath)
+	tmpPath := indexPath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(buf.Bytes())
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, indexPath)
+}
+
+// loadIndex reads the persisted sparse index, it fails if the index is
+// missing, damaged or doesn't match the data file size
+func (st *SsTable) loadIndex() error {
+	data, err := ioutil.ReadFile(ssTableIndexPath(st.filePath))
+	if err != nil {
+		return err
+	}
+
+	if len(data) < indexHeaderSize+4+8 {
+		return ErrLsmIndexBadMagic
+	}
+
+	h := xxhash.New64()
+	h.Write(data[:len(data)-8])
+	if !bytes.Equal(data[len(data)-8:], h.Sum(nil)) {
+		return ErrLsmIndexBadCheckSum
+	}
+
+	if binary.LittleEndian.Uint32(data[0:]) != LsmIndexMagic {
+		return ErrLsmIndexBadMagic
+	}
+
+	if binary.LittleEndian.Uint32(data[4:]) != lsmIndexVersion {
+		return ErrLsmFileBadVersion
+	}
+
+	checksum := ChecksumType(binary.LittleEndian.Uint32(data[8:]))
+	if !checksum.valid() {
+		return ErrUnknownChecksum
+	}
+
+	count := int(binary.LittleEndian.Uint32(data[12:]))
+	dataOffset := int64(binary.LittleEndian.Uint64(data[16:]))
+	fileSize := int64(binary.LittleEndian.Uint64(data[24:]))
+	maxVersion := binary.LittleEndian.Uint64(data[32:])
+	compression := CompressionType(binary.LittleEndian.Uint32(data[40:]))
+	if !compression.valid() {
+		return ErrUnknownCompression
+	}
+	keysPerIndex := int(binary.LittleEndian.Uint32(data[44:]))
+	nodes := int64(binary.LittleEndian.Uint64(data[48:]))
+	written := writeTimes{
+		min:   int64(binary.LittleEndian.Uint64(data[56:])),
+		max:   int64(binary.LittleEndian.Uint64(data[64:])),
+		mean:  int64(binary.LittleEndian.Uint64(data[72:])),
+		nodes: int64(binary.LittleEndian.Uint64(data[80:])),
+	}
+	if keysPerIndex <= 0 {
+		return ErrLsmIndexBadMagic
+	}
+
+	info, err := os.Stat(st.filePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != fileSize {
+		return ErrLsmIndexStale
+	}
+
+	r := bytes.NewReader(data[indexHeaderSize : len(data)-8])
+	maxKey, err := getIndexString(r)
+	if err != nil {
+		return err
+	}
+
+	bloomData, err := getIndexString(r)
+	if err != nil {
+		return err
+	}
+	bloom := unmarshalBloomFilter([]byte(bloomData))
+
+	sparse := newSparseIndex()
+	offset := make([]byte, 8)
+	for i := 0; i < count; i++ {
+		key, err := getIndexString(r)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.ReadFull(r, offset)
+		if err != nil {
+			return err
+		}
+
+		sparse.add(key, int64(binary.LittleEndian.Uint64(offset)))
+	}
+	sparse.finish()
+
+	st.checksum = checksum
+	st.compression = compression
+	st.keysPerIndex = keysPerIndex
+	st.nodes = nodes
+	st.dataOffset = dataOffset
+	st.fileSize = fileSize
+	st.maxVersion = maxVersion
+	st.written = written
+	st.sparse = sparse
+	st.bloom = bloom
+	st.minKey = nil
+	st.maxKey = nil
+	if count > 0 {
+		minKey := sparse.key(0)
+		st.minKey = &minKey
+		st.maxKey = &maxKey
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package lsm
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"os"
+)
+
+// nodeIterator walks nodes of a table in ascending key order
+type nodeIterator interface {
+	// current returns the node the iterator is positioned at or nil when
+	// the iterator is exhausted
+	current() *LsmNode
+	next() error
+	close()
+}
+
+type memIterator struct {
+	nodes []*LsmNode
+	pos   int
+}
+
+// newMemIterator snapshots memtable nodes with keys in [startKey, endKey),
+// caller must hold nodeMapLock
+func newMemIterator(mem *memtable, startKey string, endKey string) *memIterator {
+	it := new(memIterator)
+	it.nodes = make([]*LsmNode, 0)
+	for e := mem.first(startKey); e != nil; e = e.next[0] {
+		if endKey != "" && e.node.key >= endKey {
+			break
+		}
+		n := *e.node
+		it.nodes = append(it.nodes, &n)
+	}
+	return it
+}
+
+func (it *memIterator) current() *LsmNode {
+	if it.pos >= len(it.nodes) {
+		return nil
+	}
+	return it.nodes[it.pos]
+}
+
+func (it *memIterator) next() error {
+	it.pos++
+	return nil
+}
+
+func (it *memIterator) close() {
+}
+
+type ssTableIterator struct {
+	file     *os.File
+	reader   io.Reader
+	checksum ChecksumType
+	endKey   string
+	node     *LsmNode
+}
+
+// newIterator positions an iterator at the first node with key >= startKey,
+// endKey bounds the iteration exclusively, empty endKey means no bound
+func (st *SsTable) newIterator(startKey string, endKey string) (*ssTableIterator, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	file, err := os.OpenFile(st.filePath, os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := st.dataOffset
+	if block := st.blockFor(startKey); block > 0 {
+		offset = st.sparse.offset(block)
+	}
+
+	_, err = file.Seek(offset, os.SEEK_SET)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	it := new(ssTableIterator)
+	it.file = file
+	it.reader = bufio.NewReader(file)
+	if st.compression != CompressionNone {
+		it.reader = newBlockReader(file, st.compression, offset)
+	}
+	it.checksum = st.checksum
+	it.endKey = endKey
+
+	for {
+		err = it.next()
+		if err != nil {
+			it.close()
+			return nil, err
+		}
+		if it.node == nil || it.node.key >= startKey {
+			break
+		}
+	}
+	return it, nil
+}
+
+func (it *ssTableIterator) current() *LsmNode {
+	return it.node
+}
+
+func (it *ssTableIterator) next() error {
+	if it.file == nil {
+		it.node = nil
+		return nil
+	}
+
+	node := new(LsmNode)
+	err := node.decode(it.reader, it.checksum)
+	if err != nil {
+		it.node = nil
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	if it.endKey != "" && node.key >= it.endKey {
+		it.node = nil
+		return nil
+	}
+
+	it.node = node
+	return nil
+}
+
+func (it *ssTableIterator) close() {
+	if it.file != nil {
+		it.file.Close()
+		it.file = nil
+	}
+	it.node = nil
+}
+
+// mergeItem is an iterator with its priority, newer tables have higher
+// priority and win when several tables hold the same key
+type mergeItem struct {
+	it       nodeIterator
+	priority int64
+}
+
+type mergeHeap []*mergeItem
+
+func (h mergeHeap) Len() int { return len(h) }
+
+func (h mergeHeap) Less(i, j int) bool {
+	ki := h[i].it.current().key
+	kj := h[j].it.current().key
+	if ki == kj {
+		return h[i].priority > h[j].priority
+	}
+	return ki < kj
+}
+
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeItem)) }
+
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// mergeIterator yields the newest version of every key across iterators,
+// including deleted nodes which callers have to skip
+type mergeIterator struct {
+	h     mergeHeap
+	items []*mergeItem
+	node  *LsmNode
+}
+
+func newMergeIterator(items []*mergeItem) (*mergeIterator, error) {
+	mi := new(mergeIterator)
+	mi.items = items
+	mi.h = make(mergeHeap, 0, len(items))
+	for _, item := range items {
+		if item.it.current() != nil {
+			mi.h = append(mi.h, item)
+		}
+	}
+	heap.Init(&mi.h)
+
+	err := mi.next()
+	if err != nil {
+		mi.close()
+		return nil, err
+	}
+	return mi, nil
+}
+
+func (mi *mergeIterator) current() *LsmNode {
+	return mi.node
+}
+
+func (mi *mergeIterator) next() error {
+	if len(mi.h) == 0 {
+		mi.node = nil
+		return nil
+	}
+
+	top := mi.h[0]
+	mi.node = top.it.current()
+	key := mi.node.key
+
+	for len(mi.h) > 0 && mi.h[0].it.current().key == key {
+		item := mi.h[0]
+		err := item.it.next()
+		if err != nil {
+			return err
+		}
+		if item.it.current() == nil {
+			heap.Pop(&mi.h)
+		} else {
+			heap.Fix(&mi.h, 0)
+		}
+	}
+	return nil
+}
+
+func (mi *mergeIterator) close() {
+	for _, item := range mi.items {
+		item.it.close()
+	}
+	mi.h = nil
+	mi.node = nil
+}
@@ -1,60 +1,300 @@
 package lsm
 
 import (
+	"ddb/lib/common/clock"
 	log "ddb/lib/common/log"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
-	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	// Largest value accepted unless configured otherwise
+	DefaultMaxValueSize = 64 << 20
+)
+
 var (
 	ErrNotFound            = fmt.Errorf("Not found")
 	ErrEmptyKey            = fmt.Errorf("Empty key")
 	ErrEmptyValue          = fmt.Errorf("Empty value")
-	ssTableFileNamePattern = regexp.MustCompile(`^lsm\_([0-9]+)\.sstable$`)
+	ssTableFileNamePattern = regexp.MustCompile(`^lsm\_([0-9]+)(?:\_([0-9]+))?\.sstable$`)
+)
+
+const (
+	mergeTimeoutMs   = 100
+	compactTimeoutMs = 100
+	syncIntervalMs   = 10
 )
 
+// Engine states, transitions are open -> closing -> closed and happen
+// under nodeMapLock
 const (
-	logFileName        = "lsm.log"
-	maxMemoryNodeCount = 1000
-	mergeTimeoutMs     = 100
-	compactTimeoutMs   = 100
+	lsmStateOpen = iota
+	lsmStateClosing
+	lsmStateClosed
 )
 
+type LsmParameters struct {
+	// Key prefixes to maintain approximate live key counts for
+	CountPrefixes []string
+	// Checksum algorithm for newly written tables and log
+	Checksum ChecksumType
+	// Block compression of newly written tables, existing tables keep
+	// theirs until merged
+	Compression CompressionType
+	// Memtable node count that triggers compaction, 0 means no limit
+	MaxMemoryNodeCount int
+	// Approximate memtable size in bytes that triggers compaction, 0 means
+	// default
+	MemtableSize int64
+	// Interval between merge passes in milliseconds, 0 means default
+	MergeTimeoutMs int
+	// Size of the sstable block cache in bytes, 0 means default and
+	// negative disables the cache
+	BlockCacheSize int64
+	// Fraction of block cache hits re-read from the table file to detect
+	// stale cached blocks, 0 disables verification
+	CacheVerifyRate float64
+	// Number of similarly sized tables merged at once, 0 means default
+	CompactionMinTables int
+	CompactionMaxTables int
+	// Maximum size ratio of tables merged together, 0 means default
+	CompactionSizeRatio float64
+	// Tables smaller than this are merged as if equally sized, 0 means default
+	CompactionMinTierSize int64
+	// Table count above which adjacent tables are merged regardless of their
+	// sizes, 0 means default and negative no limit
+	MaxTables int
+	// Log segment size in bytes after which writes go to a new segment,
+	// 0 means default
+	WalSegmentSize int64
+	// Largest accepted value in bytes, 0 means default
+	MaxValueSize int64
+	// Time source of expiration, nil means the system clock
+	Clock clock.Clock
+	// Interval of log syncs for writes of batched durability in
+	// milliseconds, 0 means default
+	SyncIntervalMs int
+	// Writes per second that make a key hot, only the latest value of a
+	// hot key within a coalescing window is logged. 0 disables coalescing.
+	CoalesceThreshold int
+	// Coalescing window in milliseconds, 0 means default
+	CoalesceWindowMs int
+	// Time writers wait for a flush while the memtable is far beyond the
+	// compaction threshold before failing with ErrBusy in milliseconds, 0
+	// means default and negative fails them at once
+	WriteStallTimeoutMs int
+	// Memtable size relative to the compaction threshold and table counts
+	// at which every write is delayed, 0 disables them
+	WriteSlowdownFactor int
+	WriteSlowdownTables int
+	// Delay of slowed down writes in milliseconds, 0 means default
+	WriteSlowdownDelayMs int
+	// Memtable size relative to the compaction threshold at which writers
+	// queue, 0 means default
+	WriteStopFactor int
+	// Table count at which writers queue for a merge, 0 disables it
+	WriteStopTables int
+	// Shared by the engines on one disk to limit their merges, nil means
+	// no limits
+	Coordinator *CompactionCoordinator
+}
+
+// Durability tells when a write is acknowledged relative to syncing the log
+type Durability int
+
+const (
+	// Acknowledge once the log is synced, concurrent writes share a sync
+	DurabilitySync Durability = iota
+	// Acknowledge once logged, the log is synced within the sync interval
+	DurabilityBatched
+	// Acknowledge once logged, the log is synced with other writes, on
+	// segment rotation and on close
+	DurabilityNone
+)
+
+// WriteOptions makes a write expiring or conditional
+type WriteOptions struct {
+	// Expire the value after ttl, zero means never
+	Ttl time.Duration
+	// Expiration time in unix nanoseconds, overrides Ttl if set
+	ExpiresAt int64
+	// Fail with ErrExists if the key has a live value
+	Create bool
+	// Fail with ErrVersionMismatch unless the key has a live value with
+	// ExpectedVersion
+	CompareVersion  bool
+	ExpectedVersion uint64
+	// When the write is acknowledged, a write is visible to readers as soon
+	// as it is logged
+	Durability Durability
+	// Version of the write, zero means the one after the engine version.
+	// Writes replicated through a log pass one derived from their log
+	// position so every replica assigns the same, also when it applies a
+	// write again after a crash.
+	Version uint64
+}
+
+// version returns the version of the write given the engine version
+func (opts *WriteOptions) version(current uint64) uint64 {
+	if opts.Version != 0 {
+		return opts.Version
+	}
+	return current + 1
+}
+
+// check verifies write conditions against the live node of the key, nil
+// if the key has no live value
+func (opts *WriteOptions) check(current *LsmNode) error {
+	if opts.Create && current != nil {
+		return ErrExists
+	}
+	if opts.CompareVersion && (current == nil || current.version != opts.ExpectedVersion) {
+		return ErrVersionMismatch
+	}
+	return nil
+}
+
+// ValueMeta describes a stored value
+type ValueMeta struct {
+	// Expiration time in unix nanoseconds, zero means never
+	ExpiresAt int64
+	// Every write gets a higher version than all previous writes, values
+	// written before versions existed have version zero
+	Version uint64
+}
+
 type Lsm struct {
-	nodeMap        map[string]*LsmNode
+	memtable       *memtable
 	nodeMapLock    sync.RWMutex
 	rootPath       string
 	logFile        *os.File
-	ssTableMap     map[int64]*SsTable
-	ssTableMapLock sync.RWMutex
+	logSeq         int64
+	logSize        int64
+	walSegmentSize int64
+	maxValueSize   int64
+	clock          clock.Clock
+	// Table membership, flushes and merges install new versions
+	versions *versionSet
+	// Serializes merges, Close waits for a merge in progress
+	mergeLock      sync.Mutex
 	time           int64
+	version        uint64
 	mergeTimer     *time.Ticker
 	compactTimer   *time.Ticker
 	compactChan    chan bool
 	stopChan       chan bool
-	closing        bool
+	state          int
 	wg             sync.WaitGroup
 	log            log.LogInterface
+	counters       *prefixCounters
+	checksum       ChecksumType
+	maxNodeCount   int
+	memtableSize   int64
+	cache          *blockCache
+	bloomNegatives int64
+	policy         compactionPolicy
+	changeHook     ChangeHook
+
+	merges            int64
+	forcedMerges      int64
+	mergedBytes       int64
+	droppedTombstones int64
+	purgedExpired     int64
+	mergeNanos        int64
+	flushes           int64
+	flushNanos        int64
+	// Merges are limited by coordinator, time they waited for a slot and
+	// were throttled
+	coordinator   *CompactionCoordinator
+	mergeWait     int64
+	mergeThrottle int64
+
+	// Guards logFile against a swap while a group commit syncs it
+	walLock sync.Mutex
+	// Bytes appended to the log since open, the position synced by group
+	// commits and the highest position of batched writes, see waitLog
+	logWritten   int64
+	logSynced    int64
+	logBatched   int64
+	logSyncs     int64
+	syncing      bool
+	syncLock     sync.Mutex
+	syncCond     *sync.Cond
+	syncInterval time.Duration
+	syncStop     chan bool
+	// Writes to hot keys waiting to be logged, nil if disabled
+	coalescer *coalescer
+	// Block compression of newly written tables
+	compression CompressionType
+	// Latest state transitions
+	events *eventLog
+
+	// Write state, writers queue for a flush or merge closing flushed up
+	// to writeStallTimeout while writes are stopped, see stall.go
+	writeState        int32
+	flushed           chan struct{}
+	flushedLock       sync.Mutex
+	writeStallTimeout time.Duration
+	// Writers queued now, queued in total and rejected after the timeout
+	stalledWriters int64
+	writeStalls    int64
+	stallRejects   int64
+
+	// Write triggers and the table count they compare, see stall.go
+	writeSlowdownFactor int
+	writeSlowdownTables int
+	writeSlowdownDelay  time.Duration
+	writeStopFactor     int
+	writeStopTables     int
+	tables              int32
+	mergeChan           chan bool
+	// Slowed down writes and nanoseconds writers spent slowed down and
+	// queued
+	writeSlowdowns int64
+	slowdownNanos  int64
+	stallNanos     int64
+
+	// Background flushes and merges are skipped while suspended, the
+	// background loop receives from suspendChan between passes, see
+	// suspend.go
+	suspended   int32
+	suspendChan chan struct{}
+}
+
+// now returns the engine time in unix nanoseconds
+func (lsm *Lsm) now() int64 {
+	return lsm.clock.Now().UnixNano()
+}
+
+// memtableOver reports whether the memtable exceeds factor times the
+// compaction threshold, caller must hold nodeMapLock
+func (lsm *Lsm) memtableOver(factor int) bool {
+	if lsm.maxNodeCount > 0 && lsm.memtable.len() > factor*lsm.maxNodeCount {
+		return true
+	}
+	return lsm.memtable.bytes() > int64(factor)*lsm.memtableSize
 }
 
 func (lsm *Lsm) shouldCompact(force bool) bool {
-	if force || (!lsm.closing && len(lsm.nodeMap) > maxMemoryNodeCount) {
+	if force || (lsm.state == lsmStateOpen && lsm.memtableOver(1)) {
 		return true
 	}
 	return false
 }
 
-func (lsm *Lsm) compact(force bool, logTruncate bool) error {
+// compact checkpoints the memtable into a table, writes continue in a new
+// log segment and the segments holding the memtable are deleted once the
+// table is durable
+func (lsm *Lsm) compact(force bool) error {
 	lsm.nodeMapLock.RLock()
 	if !lsm.shouldCompact(force) {
 		lsm.nodeMapLock.RUnlock()
@@ -65,246 +305,527 @@ func (lsm *Lsm) compact(force bool, logTruncate bool) error {
 	lsm.nodeMapLock.Lock()
 	defer lsm.nodeMapLock.Unlock()
 	if !lsm.shouldCompact(force) {
-		lsm.nodeMapLock.RUnlock()
 		return nil
 	}
 
-	time := atomic.AddInt64(&lsm.time, 1)
-	lsm.log.Pf(0, "compacting %d size %d", time, len(lsm.nodeMap))
-	st, err := newSsTable(lsm.log, lsm.getSsTablePath(time), lsm.nodeMap)
+	seq := lsm.logSeq
+	err := lsm.rotateLog()
 	if err != nil {
 		return err
 	}
 
-	lsm.ssTableMapLock.Lock()
-	lsm.ssTableMap[time] = st
-	lsm.ssTableMapLock.Unlock()
+	if lsm.memtable.len() > 0 {
+		id := atomic.AddInt64(&lsm.time, 1)
+		nodes, memBytes := lsm.memtable.len(), lsm.memtable.bytes()
+		lsm.log.Pf(0, "compacting %d size %d bytes %d", id, nodes, memBytes)
+		start := time.Now()
+		st, err := newSsTable(lsm.log, lsm.getSsTablePath(id), lsm.memtable, lsm.checksum, lsm.compression, lsm.cache)
+		if err != nil {
+			lsm.event(EventError, 0, "flush table %d error %v", id, err)
+			return err
+		}
+		st.minId = id
+		st.maxId = id
 
-	lsm.nodeMap = make(map[string]*LsmNode)
+		err = lsm.versions.apply(&versionEdit{added: []*SsTable{st}})
+		if err != nil {
+			lsm.event(EventError, 0, "flush table %d error %v", id, err)
+			st.Erase()
+			return err
+		}
 
-	if logTruncate {
-		err = lsm.logFile.Truncate(0)
+		lsm.memtable = newMemtable()
+		lsm.signalWritable()
+		atomic.AddInt64(&lsm.flushes, 1)
+		atomic.AddInt64(&lsm.flushNanos, int64(time.Since(start)))
+		lsm.event(EventFlush, time.Since(start), "flushed table %d nodes %d memtable bytes %d size %d", id, nodes, memBytes, st.fileSize)
+
+		err = lsm.counters.save(lsm.rootPath)
+		if err != nil {
+			lsm.log.Pf(0, "save counters error %v", err)
+		}
+
+		err = syncDir(lsm.rootPath)
+		if err != nil {
+			return err
+		}
 	}
 
+	return lsm.removeLogSegments(seq)
+}
+
+func (lsm *Lsm) Set(key string, value string) error {
+	_, err := lsm.SetWithOptions(key, value, nil)
 	return err
 }
 
-func (lsm *Lsm) mergeSsTables() error {
-	lsm.ssTableMapLock.RLock()
-	if len(lsm.ssTableMap) <= 8 {
-		lsm.ssTableMapLock.RUnlock()
-		return nil
+// Create sets the value only if key has no live value and fails with
+// ErrExists otherwise, the check and the write are atomic
+func (lsm *Lsm) Create(key string, value string) error {
+	_, err := lsm.SetWithOptions(key, value, &WriteOptions{Create: true})
+	return err
+}
+
+// SetWithOptions sets the value, conditions of opts are checked atomically
+// with the write. It returns the meta of the written value.
+func (lsm *Lsm) SetWithOptions(key string, value string, opts *WriteOptions) (ValueMeta, error) {
+	return lsm.SetBytes(key, []byte(value), opts)
+}
+
+// SetBytes is SetWithOptions for arbitrary binary values, the engine keeps
+// value so the caller must not modify it afterwards
+func (lsm *Lsm) SetBytes(key string, value []byte, opts *WriteOptions) (ValueMeta, error) {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+
+	meta, target, window, err := lsm.setBytes(key, value, opts)
+	if err != nil {
+		return ValueMeta{}, err
+	}
+
+	err = waitCoalesced(window)
+	if err != nil {
+		return ValueMeta{}, err
+	}
+	err = lsm.waitLog(target)
+	if err != nil {
+		return ValueMeta{}, lsm.translateError(err)
+	}
+	return meta, nil
+}
+
+// setBytes logs and applies a write, it returns the log position to wait
+// for or the coalescing window of a write to a hot key
+func (lsm *Lsm) setBytes(key string, value []byte, opts *WriteOptions) (ValueMeta, int64, *coalesceWindow, error) {
+	if key == "" {
+		return ValueMeta{}, 0, nil, ErrEmptyKey
+	}
+	if len(value) == 0 {
+		return ValueMeta{}, 0, nil, ErrEmptyValue
+	}
+	if int64(len(value)) > atomic.LoadInt64(&lsm.maxValueSize) {
+		return ValueMeta{}, 0, nil, ErrValueTooLarge
+	}
+	err := lsm.waitWritable()
+	if err != nil {
+		return ValueMeta{}, 0, nil, err
 	}
 
-	ids := make([]int64, len(lsm.ssTableMap))
-	i := 0
-	for id := range lsm.ssTableMap {
-		ids[i] = id
-		i++
+	lsm.nodeMapLock.Lock()
+	defer lsm.unlockWrite()
+
+	err = lsm.checkWritable()
+	if err != nil {
+		return ValueMeta{}, 0, nil, err
 	}
 
-	lsm.ssTableMapLock.RUnlock()
+	counted := lsm.counters.matches(key)
+	existed := false
+	if counted || opts.Create || opts.CompareVersion {
+		current, err := lsm.current(key)
+		if err != nil {
+			return ValueMeta{}, 0, nil, lsm.translateError(err)
+		}
+		existed = current != nil
 
-	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		err = opts.check(current)
+		if err != nil {
+			return ValueMeta{}, 0, nil, err
+		}
+	}
 
-	for i := 0; i < len(ids); i += 2 {
-		j := i + 1
-		if j >= len(ids) {
-			return nil
+	n := newLsmNode(key, value)
+	if opts.ExpiresAt != 0 {
+		n.expiresAt = opts.ExpiresAt
+	} else if opts.Ttl > 0 {
+		n.expiresAt = lsm.now() + int64(opts.Ttl)
+	}
+	n.version = opts.version(lsm.version)
+	n.writtenAt = lsm.now()
+	var window *coalesceWindow
+	target := int64(0)
+	if lsm.coalescer.isHot(key, lsm.now()) {
+		window = lsm.coalescer.add(n, opts.Durability)
+	} else {
+		err = lsm.appendLog(n)
+		if err != nil {
+			return ValueMeta{}, 0, nil, lsm.translateError(err)
 		}
+		target = lsm.commitLog(opts.Durability)
+	}
+	lsm.advanceVersion(n.version)
+	lsm.memtable.put(n)
 
-		prevStId := ids[i]
-		currStId := ids[j]
+	if counted && !existed {
+		lsm.counters.add(key, 1)
+	}
+	lsm.notify(n)
 
-		lsm.ssTableMapLock.RLock()
-		prevSt := lsm.ssTableMap[prevStId]
-		currSt := lsm.ssTableMap[currStId]
-		lsm.ssTableMapLock.RUnlock()
+	return ValueMeta{ExpiresAt: n.expiresAt, Version: n.version}, target, window, nil
+}
+
+func (lsm *Lsm) lookupSsTables(key string) (*LsmNode, error) {
+	v := lsm.versions.acquire()
+	defer v.release()
 
-		if prevSt == nil || currSt == nil {
-			return nil
+	now := lsm.now()
+	for _, st := range v.tables {
+		if !st.MayContain(key) {
+			atomic.AddInt64(&lsm.bloomNegatives, 1)
+			continue
 		}
 
-		lsm.log.Pf(0, "merge %d %d -> %d", prevStId, currStId, currStId)
+		node, err := st.getNode(key, now)
+		if err == nil {
+			return node, nil
+		}
 
-		tmpFilePath := lsm.getSsTablePath(atomic.AddInt64(&lsm.time, 1))
-		err := currSt.Merge(prevSt, tmpFilePath)
-		if err != nil {
-			return err
+		if err == ErrDeleted {
+			return nil, ErrNotFound
 		}
 
-		newSt, err := openSsTable(lsm.log, tmpFilePath)
-		if err != nil {
-			os.Remove(tmpFilePath)
-			return err
+		if err != ErrNotFound {
+			return nil, err
 		}
+	}
 
-		lsm.ssTableMapLock.Lock()
-		lsm.ssTableMap[currStId] = newSt
-		delete(lsm.ssTableMap, prevStId)
-		lsm.ssTableMapLock.Unlock()
+	return nil, ErrNotFound
+}
 
-		currSt.Erase()
-		prevSt.Erase()
+func (lsm *Lsm) Get(key string) (string, error) {
+	value, _, err := lsm.GetMeta(key)
+	return value, err
+}
 
-		lsm.log.Pf(0, "merge %d %d -> %d done", prevStId, currStId, currStId)
+// GetMeta returns the value with its expiration time and version
+func (lsm *Lsm) GetMeta(key string) (string, ValueMeta, error) {
+	value, meta, err := lsm.GetBytes(key)
+	if err != nil {
+		return "", ValueMeta{}, err
 	}
-	return nil
+	return string(value), meta, nil
 }
 
-func (lsm *Lsm) logSet(key string, value string) error {
-	n := newLsmNode(key, value)
-	err := n.WriteTo(lsm.logFile)
+// GetBytes is GetMeta for binary values, the returned value is shared with
+// the engine and must not be modified
+func (lsm *Lsm) GetBytes(key string) ([]byte, ValueMeta, error) {
+	if key == "" {
+		return nil, ValueMeta{}, ErrEmptyKey
+	}
+
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	if lsm.state != lsmStateOpen {
+		return nil, ValueMeta{}, ErrClosed
+	}
+
+	node, err := lsm.current(key)
 	if err != nil {
-		return err
+		return nil, ValueMeta{}, lsm.translateError(err)
 	}
-	return lsm.logFile.Sync()
+	if node == nil {
+		return nil, ValueMeta{}, ErrNotFound
+	}
+	return node.value, ValueMeta{ExpiresAt: node.expiresAt, Version: node.version}, nil
 }
 
-func (lsm *Lsm) logDelete(key string) error {
-	n := newLsmNode(key, "")
-	n.deleted = true
-	err := n.WriteTo(lsm.logFile)
+func (lsm *Lsm) Delete(key string) error {
+	return lsm.DeleteWithOptions(key, nil)
+}
+
+// DeleteWithOptions deletes the value, only the version condition of opts
+// applies to deletes
+func (lsm *Lsm) DeleteWithOptions(key string, opts *WriteOptions) error {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+
+	target, err := lsm.delete(key, opts)
 	if err != nil {
 		return err
 	}
-	return lsm.logFile.Sync()
+
+	err = lsm.waitLog(target)
+	if err != nil {
+		return lsm.translateError(err)
+	}
+	return nil
 }
 
-func (lsm *Lsm) Set(key string, value string) error {
+// delete logs and applies a tombstone, it returns the log position to wait
+// for
+func (lsm *Lsm) delete(key string, opts *WriteOptions) (int64, error) {
 	if key == "" {
-		return ErrEmptyKey
+		return 0, ErrEmptyKey
 	}
-	if value == "" {
-		return ErrEmptyValue
+
+	err := lsm.waitWritable()
+	if err != nil {
+		return 0, err
 	}
 
 	lsm.nodeMapLock.Lock()
-	defer func() {
-		compact := lsm.shouldCompact(false)
-		lsm.nodeMapLock.Unlock()
-		if compact {
-			lsm.compactChan <- true
+	defer lsm.unlockWrite()
+
+	err = lsm.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+
+	compareVersion := opts.CompareVersion
+	counted := lsm.counters.matches(key)
+	existed := false
+	if counted || compareVersion {
+		current, err := lsm.current(key)
+		if err != nil {
+			return 0, lsm.translateError(err)
 		}
-	}()
+		existed = current != nil
 
-	err := lsm.logSet(key, value)
+		if compareVersion {
+			err = (&WriteOptions{CompareVersion: true, ExpectedVersion: opts.ExpectedVersion}).check(current)
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	n := lsm.newTombstone(key)
+	n.version = opts.version(lsm.version)
+	err = lsm.appendLog(n)
 	if err != nil {
-		return err
+		return 0, lsm.translateError(err)
 	}
+	target := lsm.commitLog(opts.Durability)
+	lsm.advanceVersion(n.version)
+	lsm.memtable.put(n)
 
-	node, ok := lsm.nodeMap[key]
-	if ok {
-		node.value = value
-	} else {
-		lsm.nodeMap[key] = newLsmNode(key, value)
+	if counted && existed {
+		lsm.counters.add(key, -1)
 	}
+	lsm.notify(n)
 
-	return nil
+	return target, nil
 }
 
-func (lsm *Lsm) lookupSsTables(key string) (string, error) {
-	lsm.ssTableMapLock.RLock()
-	defer lsm.ssTableMapLock.RUnlock()
+// newTombstone returns a deletion node with the next version, caller must
+// hold nodeMapLock and advance lsm.version once the node is logged
+func (lsm *Lsm) newTombstone(key string) *LsmNode {
+	n := newLsmNode(key, nil)
+	n.deleted = true
+	n.version = lsm.version + 1
+	n.writtenAt = lsm.now()
+	return n
+}
 
-	ids := make([]int64, len(lsm.ssTableMap))
-	i := 0
-	for id := range lsm.ssTableMap {
-		ids[i] = id
-		i++
+// advanceVersion makes version the engine version unless it is older,
+// caller must hold nodeMapLock
+func (lsm *Lsm) advanceVersion(version uint64) {
+	if version > lsm.version {
+		lsm.version = version
 	}
+}
 
-	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+func (lsm *Lsm) DeleteKeys(keys []string) ([]error, error) {
+	return lsm.DeleteKeysWithOptions(keys, nil)
+}
 
-	for _, id := range ids {
-		st := lsm.ssTableMap[id]
+// DeleteKeysWithOptions deletes keys, only the version of opts applies and
+// is the version of the first key, the following keys get the next ones.
+// The deletes are always synced.
+func (lsm *Lsm) DeleteKeysWithOptions(keys []string, opts *WriteOptions) ([]error, error) {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
 
-		value, err := st.Get(key)
-		if err == nil {
-			return value, nil
+	errs, target, err := lsm.deleteKeys(keys, opts.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lsm.waitLog(target)
+	if err != nil {
+		return nil, lsm.translateError(err)
+	}
+	return errs, nil
+}
+
+// deleteKeys logs and applies tombstones of keys starting at version, zero
+// means after the engine version. It returns per key errors and the log
+// position to wait for.
+func (lsm *Lsm) deleteKeys(keys []string, version uint64) ([]error, int64, error) {
+	errs := make([]error, len(keys))
+
+	err := lsm.waitWritable()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.unlockWrite()
+
+	err = lsm.checkWritable()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	existed := make([]bool, len(keys))
+	nodes := make([]*LsmNode, len(keys))
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		if key == "" {
+			errs[i] = ErrEmptyKey
+			continue
 		}
 
-		if err == ErrDeleted {
-			return "", ErrNotFound
+		if lsm.counters.matches(key) && !seen[key] {
+			existed[i], err = lsm.exists(key)
+			if err != nil {
+				return nil, 0, lsm.translateError(err)
+			}
 		}
+		seen[key] = true
 
-		if err != ErrNotFound {
-			return "", err
+		n := lsm.newTombstone(key)
+		if version != 0 {
+			n.version = version
+			version++
 		}
+		err = lsm.appendLog(n)
+		if err != nil {
+			return nil, 0, lsm.translateError(err)
+		}
+		lsm.advanceVersion(n.version)
+		nodes[i] = n
 	}
 
-	return "", ErrNotFound
-}
+	target := lsm.commitLog(DurabilitySync)
 
-func (lsm *Lsm) Get(key string) (string, error) {
-	if key == "" {
-		return "", ErrEmptyKey
-	}
+	for i, key := range keys {
+		if errs[i] != nil {
+			continue
+		}
 
-	lsm.nodeMapLock.RLock()
-	defer lsm.nodeMapLock.RUnlock()
+		lsm.memtable.put(nodes[i])
 
-	node, ok := lsm.nodeMap[key]
-	if ok {
-		if node.deleted {
-			return "", ErrNotFound
+		if existed[i] {
+			lsm.counters.add(key, -1)
 		}
-		return node.value, nil
 	}
+	lsm.notify(nodes...)
 
-	return lsm.lookupSsTables(key)
+	return errs, target, nil
 }
 
-func (lsm *Lsm) Delete(key string) error {
-	if key == "" {
-		return ErrEmptyKey
+// checkWritable rejects writes to a closing engine or when the memtable
+// grew far beyond the compaction threshold, caller must hold nodeMapLock
+func (lsm *Lsm) checkWritable() error {
+	if lsm.state != lsmStateOpen {
+		return ErrClosed
+	}
+	if lsm.stallState() == writeStopped {
+		return ErrBusy
 	}
+	return nil
+}
 
-	lsm.nodeMapLock.Lock()
-	defer func() {
-		compact := lsm.shouldCompact(false)
-		lsm.nodeMapLock.Unlock()
-		if compact {
-			lsm.compactChan <- true
+// current returns the live node of key or nil if the key has no live
+// value, caller must hold nodeMapLock
+func (lsm *Lsm) current(key string) (*LsmNode, error) {
+	node, ok := lsm.memtable.get(key)
+	if ok {
+		if node.deleted || node.expired(lsm.now()) {
+			return nil, nil
 		}
-	}()
-
-	err := lsm.logDelete(key)
-	if err != nil {
-		return err
+		return node, nil
 	}
 
-	node, ok := lsm.nodeMap[key]
-	if ok {
-		node.deleted = true
-	} else {
-		n := newLsmNode(key, "")
-		n.deleted = true
-		lsm.nodeMap[key] = n
+	node, err := lsm.lookupSsTables(key)
+	if err == nil {
+		return node, nil
+	}
+	if err == ErrNotFound {
+		return nil, nil
 	}
+	return nil, err
+}
 
-	return nil
+// exists reports whether key currently has a live value, caller must hold
+// nodeMapLock
+func (lsm *Lsm) exists(key string) (bool, error) {
+	node, err := lsm.current(key)
+	return node != nil, err
+}
+
+// CacheStats returns block cache hits, misses and size in bytes
+func (lsm *Lsm) CacheStats() (int64, int64, int64) {
+	return lsm.cache.stats()
+}
+
+// CacheVerifyStats returns the number of verified block cache hits and of
+// those found stale
+func (lsm *Lsm) CacheVerifyStats() (int64, int64) {
+	return lsm.cache.verifyStats()
+}
+
+// BloomNegatives returns the number of table lookups skipped by bloom filters
+func (lsm *Lsm) BloomNegatives() int64 {
+	return atomic.LoadInt64(&lsm.bloomNegatives)
+}
+
+// PrefixCounts returns approximate live key counts for the configured prefixes
+func (lsm *Lsm) PrefixCounts() map[string]int64 {
+	return lsm.counters.snapshot()
+}
+
+// Flush checkpoints the memtable into a table so a following open doesn't
+// replay the log
+func (lsm *Lsm) Flush() error {
+	lsm.nodeMapLock.RLock()
+	open := lsm.state == lsmStateOpen
+	lsm.nodeMapLock.RUnlock()
+	if !open {
+		return ErrClosed
+	}
+	return lsm.compact(true)
 }
 
 func (lsm *Lsm) Close() {
 	lsm.log.Pf(0, "close")
+	start := time.Now()
 
 	lsm.nodeMapLock.Lock()
-	lsm.closing = true
+	if lsm.state != lsmStateOpen {
+		lsm.nodeMapLock.Unlock()
+		return
+	}
+	lsm.state = lsmStateClosing
 	lsm.nodeMapLock.Unlock()
 
 	lsm.stopChan <- true
+	close(lsm.syncStop)
 
 	lsm.mergeTimer.Stop()
 	lsm.compactTimer.Stop()
 
 	lsm.wg.Wait()
+	lsm.flushCoalesced()
+	err := lsm.saveAccessProfile()
+	if err != nil {
+		lsm.log.Pf(0, "save access profile error %v", err)
+	}
+	lsm.mergeLock.Lock()
+	defer lsm.mergeLock.Unlock()
 
 	lsm.nodeMapLock.Lock()
 	defer lsm.nodeMapLock.Unlock()
 
 	lsm.closeSsTables()
-	lsm.logFile.Close()
+	lsm.closeLog()
+	lsm.state = lsmStateClosed
+	lsm.event(EventClose, time.Since(start), "closed version %d", lsm.version)
 }
 
 func (lsm *Lsm) Background() {
@@ -313,39 +834,128 @@ func (lsm *Lsm) Background() {
 	for {
 		select {
 		case <-lsm.mergeTimer.C:
-			lsm.mergeSsTables()
+			if !lsm.Suspended() {
+				lsm.mergeSsTables()
+			}
 		case <-lsm.compactTimer.C:
-			//lsm.compact(false, true)
+			//lsm.compact(false)
 			//lsm.mergeSsTables()
 		case <-lsm.compactChan:
-			lsm.compact(false, true)
+			if !lsm.Suspended() {
+				lsm.compact(false)
+			}
 			//lsm.mergeSsTables()
+		case <-lsm.mergeChan:
+			if !lsm.Suspended() {
+				lsm.mergeSsTables()
+			}
+		case <-lsm.suspendChan:
 		case <-lsm.stopChan:
 			return
 		}
 	}
 }
 
-func newLsm(log log.LogInterface, rootPath string, logFile *os.File) *Lsm {
+func newLsm(log log.LogInterface, rootPath string, params *LsmParameters) *Lsm {
+	if params == nil {
+		params = new(LsmParameters)
+	}
+
 	lsm := new(Lsm)
-	lsm.nodeMap = make(map[string]*LsmNode)
-	lsm.ssTableMap = make(map[int64]*SsTable)
+	lsm.memtable = newMemtable()
 	lsm.rootPath = rootPath
-	lsm.logFile = logFile
+	lsm.versions = newVersionSet(rootPath)
 	lsm.stopChan = make(chan bool)
 	lsm.compactChan = make(chan bool, 1)
-	lsm.mergeTimer = time.NewTicker(mergeTimeoutMs * time.Millisecond)
+	lsm.mergeChan = make(chan bool, 1)
+	lsm.suspendChan = make(chan struct{})
+	lsm.flushed = make(chan struct{})
+	lsm.writeStallTimeout = time.Duration(params.WriteStallTimeoutMs) * time.Millisecond
+	if params.WriteStallTimeoutMs == 0 {
+		lsm.writeStallTimeout = defaultWriteStallTimeout
+	}
+	lsm.writeSlowdownFactor = params.WriteSlowdownFactor
+	lsm.writeSlowdownTables = params.WriteSlowdownTables
+	lsm.writeSlowdownDelay = time.Duration(params.WriteSlowdownDelayMs) * time.Millisecond
+	if lsm.writeSlowdownDelay <= 0 {
+		lsm.writeSlowdownDelay = defaultWriteSlowdownDelay
+	}
+	lsm.writeStopFactor = params.WriteStopFactor
+	if lsm.writeStopFactor <= 0 {
+		lsm.writeStopFactor = defaultWriteStopFactor
+	}
+	lsm.writeStopTables = params.WriteStopTables
+	lsm.coordinator = params.Coordinator
+	lsm.syncCond = sync.NewCond(&lsm.syncLock)
+	lsm.syncStop = make(chan bool)
+	lsm.syncInterval = time.Duration(params.SyncIntervalMs) * time.Millisecond
+	if lsm.syncInterval <= 0 {
+		lsm.syncInterval = syncIntervalMs * time.Millisecond
+	}
+	mergeTimeout := time.Duration(params.MergeTimeoutMs) * time.Millisecond
+	if mergeTimeout <= 0 {
+		mergeTimeout = mergeTimeoutMs * time.Millisecond
+	}
+	lsm.mergeTimer = time.NewTicker(mergeTimeout)
 	lsm.compactTimer = time.NewTicker(compactTimeoutMs * time.Millisecond)
 	lsm.log = log
+	lsm.counters = newPrefixCounters(params.CountPrefixes)
+	lsm.checksum = params.Checksum
+	lsm.compression = params.Compression
+	cacheSize := params.BlockCacheSize
+	if cacheSize == 0 {
+		cacheSize = defaultBlockCacheSize
+	}
+	lsm.cache = newBlockCache(cacheSize, params.CacheVerifyRate)
+	lsm.maxNodeCount = params.MaxMemoryNodeCount
+	lsm.memtableSize = params.MemtableSize
+	if lsm.memtableSize <= 0 {
+		lsm.memtableSize = defaultMemtableSize
+	}
+	lsm.policy = newCompactionPolicy(params)
+	lsm.walSegmentSize = params.WalSegmentSize
+	if lsm.walSegmentSize <= 0 {
+		lsm.walSegmentSize = defaultWalSegmentSize
+	}
+	lsm.clock = clock.OrReal(params.Clock)
+	lsm.maxValueSize = params.MaxValueSize
+	if lsm.maxValueSize <= 0 {
+		lsm.maxValueSize = DefaultMaxValueSize
+	}
+	lsm.coalescer = newCoalescer(params)
+	lsm.events = newEventLog()
 	return lsm
 }
 
+// SetMaxValueSize changes the largest accepted value, 0 means default
+func (lsm *Lsm) SetMaxValueSize(size int64) {
+	if size <= 0 {
+		size = DefaultMaxValueSize
+	}
+	atomic.StoreInt64(&lsm.maxValueSize, size)
+}
+
+// SetMergeTimeout changes the interval between merge passes, 0 means
+// default
+func (lsm *Lsm) SetMergeTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = mergeTimeoutMs * time.Millisecond
+	}
+	lsm.mergeTimer.Reset(timeout)
+}
+
 func (lsm *Lsm) start() {
-	lsm.wg.Add(1)
+	lsm.wg.Add(3)
 	go lsm.Background()
+	go lsm.syncBatched()
+	go lsm.saveAccessProfiles()
+	if lsm.coalescer != nil {
+		lsm.wg.Add(1)
+		go lsm.coalesce()
+	}
 }
 
-func NewLsm(log log.LogInterface, rootPath string) (*Lsm, error) {
+func NewLsm(log log.LogInterface, rootPath string, params *LsmParameters) (*Lsm, error) {
 	log.Pf(0, "new")
 	rootPath, err := filepath.Abs(rootPath)
 	if err != nil {
@@ -357,12 +967,28 @@ func NewLsm(log log.LogInterface, rootPath string) (*Lsm, error) {
 		return nil, err
 	}
 
-	logFile, err := os.OpenFile(filepath.Join(rootPath, logFileName), os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if params != nil && !params.Checksum.valid() {
+		return nil, ErrUnknownChecksum
+	}
+	if params != nil && !params.Compression.valid() {
+		return nil, ErrUnknownCompression
+	}
+
+	exists, err := hasLog(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		return nil, os.ErrExist
+	}
+
+	lsm := newLsm(log, rootPath, params)
+	err = lsm.rotateLog()
 	if err != nil {
 		return nil, err
 	}
 
-	lsm := newLsm(log, rootPath, logFile)
+	lsm.event(EventOpen, 0, "created %s", rootPath)
 	lsm.start()
 	return lsm, nil
 }
@@ -371,75 +997,168 @@ func (lsm *Lsm) getSsTablePath(index int64) string {
 	return path.Join(lsm.rootPath, "lsm_"+strconv.FormatInt(index, 10)+".sstable")
 }
 
+// closeSsTables closes the tables and the manifest
 func (lsm *Lsm) closeSsTables() {
-	for _, st := range lsm.ssTableMap {
+	for _, st := range lsm.versions.current.tables {
 		st.Close()
 	}
+	lsm.versions.closeManifest()
 }
 
+// openSsTables opens the tables listed in the manifest, other tables and
+// temporary files are leftovers of an interrupted flush or merge and
+// removed. A missing table of the manifest is ErrCorrupted. Without a
+// manifest tables whose id range is covered by a merged table are the
+// leftovers.
 func (lsm *Lsm) openSsTables() error {
+	m, err := readManifest(lsm.rootPath)
+	if err != nil {
+		return err
+	}
+
 	files, err := ioutil.ReadDir(lsm.rootPath)
 	if err != nil {
 		return err
 	}
 
+	live := make(map[string]bool)
+	if m != nil {
+		for _, name := range m.Tables {
+			live[name] = true
+		}
+	}
+
+	type tableFile struct {
+		name  string
+		minId int64
+		maxId int64
+	}
+
+	tableFiles := make([]tableFile, 0)
+	names := make(map[string]bool)
 	for _, file := range files {
 		if file.IsDir() {
 			continue
 		}
+		names[file.Name()] = true
+
+		if strings.HasSuffix(file.Name(), ".sstable"+ssTableMergeTmpSuffix) {
+			lsm.log.Pf(0, "remove %s", file.Name())
+			os.Remove(filepath.Join(lsm.rootPath, file.Name()))
+			continue
+		}
 
 		match := ssTableFileNamePattern.FindStringSubmatch(file.Name())
 		if match == nil || len(match) == 1 {
 			continue
 		}
 
-		index, err := strconv.ParseInt(match[1], 10, 64)
+		minId, err := strconv.ParseInt(match[1], 10, 64)
 		if err != nil {
 			continue
 		}
 
-		st, err := openSsTable(lsm.log, lsm.getSsTablePath(index))
-		if err != nil {
-			if os.IsNotExist(err) {
-				return nil
+		maxId := minId
+		if match[2] != "" {
+			maxId, err = strconv.ParseInt(match[2], 10, 64)
+			if err != nil || maxId < minId {
+				continue
 			}
-			return err
 		}
-		lsm.ssTableMap[index] = st
-		if index > lsm.time {
-			lsm.time = index
+
+		tableFiles = append(tableFiles, tableFile{name: file.Name(), minId: minId, maxId: maxId})
+	}
+
+	// a table of the manifest can't be missing, nothing is removed then
+	for name := range live {
+		if !names[name] {
+			lsm.log.Pf(0, "table %s of the manifest is missing", name)
+			return ErrCorrupted
 		}
 	}
 
-	return nil
-}
+	for name := range names {
+		if strings.HasSuffix(name, ".index") && !names[strings.TrimSuffix(name, ".index")+".sstable"] {
+			os.Remove(filepath.Join(lsm.rootPath, name))
+		}
+	}
 
-func (lsm *Lsm) restoreFromLog(logFile *os.File) error {
-	for {
-		n := new(LsmNode)
-		err := n.ReadFrom(logFile)
-		if err != nil {
-			if err == io.EOF {
+	opened := make([]*SsTable, 0, len(tableFiles))
+	for _, tf := range tableFiles {
+		covered := m != nil && !live[tf.name]
+		for _, other := range tableFiles {
+			if m == nil && other.name != tf.name && other.minId <= tf.minId && tf.maxId <= other.maxId {
+				covered = true
 				break
 			}
-			return err
 		}
 
-		lsm.nodeMap[n.key] = n
+		filePath := filepath.Join(lsm.rootPath, tf.name)
+		if covered {
+			lsm.log.Pf(0, "remove merged %s", tf.name)
+			os.Remove(filePath)
+			os.Remove(ssTableIndexPath(filePath))
+			continue
+		}
+
+		st, err := openSsTable(lsm.log, filePath, lsm.cache)
+		if err != nil {
+			for _, st := range opened {
+				st.Close()
+			}
+			if os.IsNotExist(err) {
+				return ErrCorrupted
+			}
+			return err
+		}
+		st.minId = tf.minId
+		st.maxId = tf.maxId
+		if st.maxVersion > lsm.version {
+			lsm.version = st.maxVersion
+		}
+		opened = append(opened, st)
+		if tf.maxId > lsm.time {
+			lsm.time = tf.maxId
+		}
 	}
 
-	return lsm.compact(true, false)
+	err = lsm.versions.apply(&versionEdit{added: opened})
+	if err != nil {
+		for _, st := range opened {
+			st.Close()
+		}
+		return err
+	}
+	lsm.countTables()
+	return nil
 }
 
-func OpenLsm(log log.LogInterface, rootPath string) (*Lsm, error) {
+func OpenLsm(log log.LogInterface, rootPath string, params *LsmParameters) (*Lsm, error) {
 	log.Pf(0, "open")
-	logFile, err := os.OpenFile(filepath.Join(rootPath, logFileName), os.O_RDONLY, 0600)
+	start := time.Now()
+	if params != nil && !params.Checksum.valid() {
+		return nil, ErrUnknownChecksum
+	}
+	if params != nil && !params.Compression.valid() {
+		return nil, ErrUnknownCompression
+	}
+
+	exists, err := hasLog(rootPath)
 	if err != nil {
 		log.Pf(0, "open log error %v", err)
 		return nil, err
 	}
+	if !exists {
+		log.Pf(0, "open log not found")
+		return nil, os.ErrNotExist
+	}
+
+	rootPath, err = filepath.Abs(rootPath)
+	if err != nil {
+		return nil, err
+	}
 
-	lsm := newLsm(log, rootPath, logFile)
+	lsm := newLsm(log, rootPath, params)
 
 	err = lsm.openSsTables()
 	if err != nil {
@@ -447,22 +1166,26 @@ func OpenLsm(log log.LogInterface, rootPath string) (*Lsm, error) {
 		return nil, err
 	}
 
-	err = lsm.restoreFromLog(logFile)
+	err = lsm.counters.load(rootPath)
 	if err != nil {
-		log.Pf(0, "restore error %v", err)
+		log.Pf(0, "load counters error %v", err)
 		lsm.closeSsTables()
-		logFile.Close()
 		return nil, err
 	}
-	logFile.Close()
 
-	logFile, err = os.OpenFile(filepath.Join(rootPath, logFileName), os.O_APPEND|os.O_WRONLY|os.O_TRUNC, 0600)
+	err = lsm.restoreFromLog()
 	if err != nil {
-		log.Pf(0, "open log error %v", err)
+		log.Pf(0, "restore error %v", err)
 		lsm.closeSsTables()
+		if lsm.logFile != nil {
+			lsm.logFile.Close()
+		}
 		return nil, err
 	}
-	lsm.logFile = logFile
+
+	v := lsm.versions.acquire()
+	lsm.event(EventOpen, time.Since(start), "opened %s tables %d version %d", rootPath, len(v.tables), lsm.version)
+	v.release()
 	lsm.start()
 	return lsm, nil
 }
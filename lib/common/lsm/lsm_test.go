@@ -1,12 +1,23 @@
 package lsm
 
 import (
+	"bytes"
+	"context"
+	"ddb/lib/common/clock"
 	"ddb/lib/common/filelog"
 	"ddb/lib/common/log"
 	"ddb/lib/common/random"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestLsmNodeReadWrite(t *testing.T) {
@@ -19,7 +30,10 @@ func TestLsmNodeReadWrite(t *testing.T) {
 	defer os.Remove(f.Name())
 	defer f.Close()
 
-	n := newLsmNode(random.GenerateRandomHexString(64), random.GenerateRandomHexString(128))
+	// values are binary, zero and invalid utf-8 bytes included
+	value := []byte(random.GenerateRandomHexString(128))
+	value[0], value[1] = 0, 0xff
+	n := newLsmNode(random.GenerateRandomHexString(64), value)
 	err = n.WriteTo(f)
 	if err != nil {
 		t.Fatalf("can't write node error %v", err)
@@ -32,7 +46,7 @@ func TestLsmNodeReadWrite(t *testing.T) {
 		return
 	}
 
-	rn := newLsmNode("", "")
+	rn := newLsmNode("", nil)
 	err = rn.ReadFrom(f)
 	if err != nil {
 		t.Fatalf("can't read node error %v", err)
@@ -44,7 +58,7 @@ func TestLsmNodeReadWrite(t *testing.T) {
 		return
 	}
 
-	if n.value != rn.value {
+	if !bytes.Equal(n.value, rn.value) {
 		t.Fatalf("inconsistent value")
 		return
 	}
@@ -61,7 +75,7 @@ func TestLsmCreateOpen(t *testing.T) {
 	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
 	defer log.Sync()
 
-	lsm, err := NewLsm(log, rootPath)
+	lsm, err := NewLsm(log, rootPath, nil)
 	if err != nil {
 		t.Fatalf("can't create lsm error %v", err)
 		return
@@ -87,7 +101,7 @@ func TestLsmCreateOpen(t *testing.T) {
 	}
 	lsm.Close()
 
-	lsm, err = OpenLsm(log, rootPath)
+	lsm, err = OpenLsm(log, rootPath, nil)
 	if err != nil {
 		t.Fatalf("can't open lsm error %v", err)
 		return
@@ -148,3 +162,2763 @@ func TestLsmCreateOpen(t *testing.T) {
 		}
 	}
 }
+
+func TestLsmPrefixCounts(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmPrefixCounts_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	params := &LsmParameters{CountPrefixes: []string{"a/", "b/"}}
+	lsm, err := NewLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < 10; i++ {
+		lsm.Set("a/"+random.GenerateRandomHexString(8), "value")
+	}
+	lsm.Set("b/key", "value")
+	lsm.Set("b/key", "value2")
+	lsm.Delete("b/key")
+	lsm.Delete("b/missing")
+	lsm.Set("c/key", "value")
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	counts := lsm.PrefixCounts()
+	if counts["a/"] != 10 || counts["b/"] != 0 || len(counts) != 2 {
+		t.Fatalf("unexpected counts %v", counts)
+		return
+	}
+}
+
+func TestLsmClosed(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmClosed_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	lsm.Close()
+	lsm.Close()
+
+	if err = lsm.Set("key", "value"); err != ErrClosed {
+		t.Fatalf("unexpected set error %v", err)
+		return
+	}
+
+	if _, err = lsm.Get("key"); err != ErrClosed {
+		t.Fatalf("unexpected get error %v", err)
+		return
+	}
+}
+
+func TestLsmChecksumTypes(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	for _, checksum := range []ChecksumType{ChecksumXxHash64, ChecksumCrc32c, ChecksumSha256} {
+		rootPath, err := ioutil.TempDir("", "TestLsmChecksumTypes_"+random.GenerateRandomHexString(5))
+		if err != nil {
+			t.Fatalf("can't create tmp dir error %v", err)
+			return
+		}
+		defer os.RemoveAll(rootPath)
+
+		params := &LsmParameters{Checksum: checksum}
+		lsm, err := NewLsm(log, rootPath, params)
+		if err != nil {
+			t.Fatalf("can't create lsm error %v", err)
+			return
+		}
+
+		kv := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			key := random.GenerateRandomHexString(8)
+			kv[key] = random.GenerateRandomHexString(16)
+			lsm.Set(key, kv[key])
+		}
+		lsm.Close()
+
+		lsm, err = OpenLsm(log, rootPath, params)
+		if err != nil {
+			t.Fatalf("can't open lsm %s error %v", checksum, err)
+			return
+		}
+
+		for key, value := range kv {
+			evalue, err := lsm.Get(key)
+			if err != nil || evalue != value {
+				t.Fatalf("can't get lsm %s key %s error %v", checksum, key, err)
+				return
+			}
+		}
+		lsm.Close()
+	}
+}
+
+func TestLsmScan(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmScan_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{MaxMemoryNodeCount: 10})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 100; i++ {
+		lsm.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%d", i))
+	}
+	for i := 0; i < 100; i += 10 {
+		lsm.Set(fmt.Sprintf("key%03d", i), "updated")
+		lsm.Delete(fmt.Sprintf("key%03d", i+1))
+	}
+
+	kvs, err := lsm.Scan("key010", "key030", 0)
+	if err != nil {
+		t.Fatalf("can't scan error %v", err)
+		return
+	}
+
+	if len(kvs) != 18 {
+		t.Fatalf("unexpected scan size %d", len(kvs))
+		return
+	}
+
+	for i := 1; i < len(kvs); i++ {
+		if kvs[i-1].Key >= kvs[i].Key {
+			t.Fatalf("scan out of order %s %s", kvs[i-1].Key, kvs[i].Key)
+			return
+		}
+	}
+
+	if kvs[0].Key != "key010" || kvs[0].Value != "updated" || kvs[1].Key != "key012" {
+		t.Fatalf("unexpected scan result %v", kvs[:2])
+		return
+	}
+
+	kvs, err = lsm.Scan("", "", 5)
+	if err != nil || len(kvs) != 5 || kvs[0].Key != "key000" {
+		t.Fatalf("unexpected limited scan %v error %v", kvs, err)
+		return
+	}
+}
+
+func TestMemtable(t *testing.T) {
+	mem := newMemtable()
+	for _, i := range []int{5, 1, 9, 3, 7, 0, 8, 2, 6, 4} {
+		key := fmt.Sprintf("key%d", i)
+		mem.put(newLsmNode(key, []byte(key)))
+	}
+	mem.put(newLsmNode("key3", []byte("value")))
+
+	if mem.len() != 10 {
+		t.Fatalf("unexpected len %d", mem.len())
+		return
+	}
+	if mem.bytes() != 9*(4+4+memtableNodeOverhead)+(4+5+memtableNodeOverhead) {
+		t.Fatalf("unexpected bytes %d", mem.bytes())
+		return
+	}
+
+	node, ok := mem.get("key3")
+	if !ok || string(node.value) != "value" {
+		t.Fatalf("unexpected get key3 %v", node)
+		return
+	}
+	_, ok = mem.get("key")
+	if ok {
+		t.Fatalf("unexpected get key")
+		return
+	}
+
+	i := 4
+	for e := mem.first("key35"); e != nil; e = e.next[0] {
+		if e.node.key != fmt.Sprintf("key%d", i) {
+			t.Fatalf("unexpected key %s expected key%d", e.node.key, i)
+			return
+		}
+		i++
+	}
+	if i != 10 {
+		t.Fatalf("iterated up to %d", i)
+		return
+	}
+}
+
+func TestSsTableIndexAndCache(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestSsTableIndexAndCache_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	nodeMap := make(map[string]*LsmNode)
+	for i := 0; i < 24*minKeysPerIndex+7; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		nodeMap[key] = newLsmNode(key, []byte(random.GenerateRandomHexString(8)))
+	}
+
+	filePath := rootPath + "/lsm_1.sstable"
+	cache := newBlockCache(defaultBlockCacheSize, 0)
+	mem := newMemtable()
+	for _, node := range nodeMap {
+		mem.put(node)
+	}
+	st, err := newSsTable(log, filePath, mem, ChecksumXxHash64, CompressionNone, cache)
+	if err != nil {
+		t.Fatalf("can't create table error %v", err)
+		return
+	}
+	st.Close()
+
+	for pass := 0; pass < 2; pass++ {
+		if pass == 1 {
+			os.Remove(ssTableIndexPath(filePath))
+		}
+
+		st, err = openSsTable(log, filePath, cache)
+		if err != nil {
+			t.Fatalf("can't open table error %v", err)
+			return
+		}
+
+		for key, node := range nodeMap {
+			value, err := st.Get(key)
+			if err != nil || value != string(node.value) {
+				t.Fatalf("can't get key %s pass %d error %v", key, pass, err)
+				return
+			}
+		}
+
+		for _, key := range []string{"key", "key000000a", "zzz"} {
+			_, err = st.Get(key)
+			if err != ErrNotFound {
+				t.Fatalf("unexpected get %s error %v", key, err)
+				return
+			}
+		}
+		st.Close()
+	}
+
+	hits, misses, _ := cache.stats()
+	if hits == 0 || misses == 0 {
+		t.Fatalf("unexpected cache hits %d misses %d", hits, misses)
+		return
+	}
+}
+
+func TestBlockCacheVerify(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestBlockCacheVerify_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	mem := newMemtable()
+	for i := 0; i < minKeysPerIndex; i++ {
+		key := fmt.Sprintf("key%06d", i)
+		mem.put(newLsmNode(key, []byte(key)))
+	}
+
+	cache := newBlockCache(defaultBlockCacheSize, 1)
+	st, err := newSsTable(log, rootPath+"/lsm_1.sstable", mem, ChecksumXxHash64, CompressionNone, cache)
+	if err != nil {
+		t.Fatalf("can't create table error %v", err)
+		return
+	}
+	defer st.Close()
+
+	nodes, err := st.readBlock(0)
+	if err != nil {
+		t.Fatalf("can't read block error %v", err)
+		return
+	}
+	// cached nodes are never modified outside of tests, this simulates a
+	// stale entry
+	nodes[0].value = []byte("stale")
+
+	value, err := st.Get("key000000")
+	if err != nil || value != "key000000" {
+		t.Fatalf("unexpected get value %s error %v", value, err)
+		return
+	}
+
+	verified, stale := cache.verifyStats()
+	if verified != 1 || stale != 1 {
+		t.Fatalf("unexpected verified %d stale %d", verified, stale)
+		return
+	}
+}
+
+func TestSsTableIndexBoundaries(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestSsTableIndexBoundaries_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	// odd keys only so every index key has absent neighbours
+	count := 16*minKeysPerIndex + 3
+	keys := make([]string, count)
+	mem := newMemtable()
+	for i := 0; i < count; i++ {
+		keys[i] = fmt.Sprintf("key%06d", 2*i+1)
+		mem.put(newLsmNode(keys[i], []byte(keys[i])))
+	}
+
+	st, err := newSsTable(log, rootPath+"/lsm_1.sstable", mem, ChecksumXxHash64, CompressionNone, newBlockCache(-1, 0))
+	if err != nil {
+		t.Fatalf("can't create table error %v", err)
+		return
+	}
+	defer st.Close()
+
+	keysPerIndex := st.keysPerIndex
+	if 2*keysPerIndex >= count || st.sparse.len() != (count+keysPerIndex-1)/keysPerIndex {
+		t.Fatalf("unexpected index density %d entries %d", keysPerIndex, st.sparse.len())
+		return
+	}
+
+	check := func(name string) {
+		for _, i := range []int{0, 1, keysPerIndex - 1, keysPerIndex, keysPerIndex + 1, 2 * keysPerIndex, count - 1} {
+			if value, err := st.Get(keys[i]); err != nil || value != keys[i] {
+				t.Fatalf("%s get %s value %s error %v", name, keys[i], value, err)
+			}
+
+			before := fmt.Sprintf("key%06d", 2*i)
+			if _, err := st.Get(before); err != ErrNotFound {
+				t.Fatalf("%s get absent %s error %v", name, before, err)
+			}
+
+			for _, start := range []string{before, keys[i]} {
+				it, err := st.newIterator(start, "")
+				if err != nil {
+					t.Fatalf("%s seek %s error %v", name, start, err)
+				}
+				node := it.current()
+				it.close()
+				if node == nil || node.key != keys[i] {
+					t.Fatalf("%s seek %s found %v", name, start, node)
+				}
+			}
+		}
+
+		after := fmt.Sprintf("key%06d", 2*count)
+		if _, err := st.Get(after); err != ErrNotFound {
+			t.Fatalf("%s get %s error %v", name, after, err)
+		}
+		it, err := st.newIterator(after, "")
+		if err != nil || it.current() != nil {
+			t.Fatalf("%s seek past the last key error %v", name, err)
+		}
+		it.close()
+	}
+	check("full index")
+
+	// keys before the first index entry are found in the first block
+	sparse := newSparseIndex()
+	for i := 1; i < st.sparse.len(); i++ {
+		sparse.add(st.sparse.key(i), st.sparse.offset(i))
+	}
+	st.sparse = sparse
+	check("index without first entry")
+}
+
+func TestSparseIndex(t *testing.T) {
+	keys := make([]string, 0)
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("prefix/%03d/%s", i/7, random.GenerateRandomHexString(4)))
+	}
+	keys = append(keys, "a", "prefix", "zz")
+	sort.Strings(keys)
+
+	si := newSparseIndex()
+	for i, key := range keys {
+		si.add(key, int64(i*100))
+	}
+	si.finish()
+
+	if si.len() != len(keys) {
+		t.Fatalf("index has %d entries expected %d", si.len(), len(keys))
+		return
+	}
+	for i, key := range keys {
+		if si.key(i) != key || si.offset(i) != int64(i*100) {
+			t.Fatalf("entry %d key %s offset %d expected %s", i, si.key(i), si.offset(i), key)
+			return
+		}
+	}
+
+	probes := append([]string{"", "0", "a0", "prefix/", "prefix/500", "zzz"}, keys...)
+	for _, key := range keys {
+		probes = append(probes, key+"0", key[:len(key)-1])
+	}
+	for _, probe := range probes {
+		expected := sort.Search(len(keys), func(i int) bool { return keys[i] > probe })
+		if found := si.search(probe); found != expected {
+			t.Fatalf("search %s returned %d expected %d", probe, found, expected)
+			return
+		}
+	}
+
+	var size int
+	for _, key := range keys {
+		size += len(key)
+	}
+	if si.bytes() >= int64(size+8*len(keys)) {
+		t.Fatalf("index of %d key bytes takes %d bytes", size, si.bytes())
+		return
+	}
+
+	if newSparseIndex().search("key") != 0 {
+		t.Fatalf("search of an empty index found an entry")
+		return
+	}
+}
+
+func TestChooseKeysPerIndex(t *testing.T) {
+	// small tables get denser indexes than large ones of the same values
+	small := chooseKeysPerIndex(1000, 1000*40)
+	large := chooseKeysPerIndex(1000000, 1000000*40)
+	if small >= large {
+		t.Fatalf("density %d for a small table, %d for a large one", small, large)
+		return
+	}
+
+	// large values get fewer keys per block than small ones
+	largeValues := chooseKeysPerIndex(1000000, 1000000*4096)
+	smallValues := chooseKeysPerIndex(1000000, 1000000*40)
+	if largeValues >= smallValues {
+		t.Fatalf("density %d for large values, %d for small values", largeValues, smallValues)
+		return
+	}
+
+	huge := int64(1) << 30
+	density := chooseKeysPerIndex(huge, huge*40)
+	if density != maxKeysPerIndex && huge/int64(density) > maxIndexEntries {
+		t.Fatalf("huge table density %d gives %d index entries", density, huge/int64(density))
+		return
+	}
+
+	if chooseKeysPerIndex(0, 0) != minKeysPerIndex {
+		t.Fatalf("empty table density %d", chooseKeysPerIndex(0, 0))
+		return
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	hashes := make([]uint64, 0)
+	keys := make([]string, 0)
+	for i := 0; i < 10000; i++ {
+		key := random.GenerateRandomHexString(16)
+		keys = append(keys, key)
+		hashes = append(hashes, bloomHash(key))
+	}
+
+	bf := unmarshalBloomFilter(newBloomFilter(hashes).marshal())
+	for _, key := range keys {
+		if !bf.mayContain(key) {
+			t.Fatalf("false negative for key %s", key)
+			return
+		}
+	}
+
+	positives := 0
+	for i := 0; i < 10000; i++ {
+		if bf.mayContain(random.GenerateRandomHexString(16)) {
+			positives++
+		}
+	}
+
+	if positives > 300 {
+		t.Fatalf("too many false positives %d", positives)
+		return
+	}
+}
+
+func TestLsmDeleteKeys(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmDeleteKeys_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{CountPrefixes: []string{"k"}})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	lsm.Set("k1", "v1")
+	lsm.Set("k2", "v2")
+	lsm.Set("k3", "v3")
+
+	errs, err := lsm.DeleteKeys([]string{"k1", "", "k2", "k2", "missing"})
+	if err != nil {
+		t.Fatalf("can't delete keys error %v", err)
+		return
+	}
+
+	if errs[0] != nil || errs[1] != ErrEmptyKey || errs[2] != nil || errs[4] != nil {
+		t.Fatalf("unexpected per key errors %v", errs)
+		return
+	}
+
+	if _, err = lsm.Get("k1"); err != ErrNotFound {
+		t.Fatalf("key k1 not deleted error %v", err)
+		return
+	}
+
+	if value, err := lsm.Get("k3"); err != nil || value != "v3" {
+		t.Fatalf("key k3 lost error %v", err)
+		return
+	}
+
+	if counts := lsm.PrefixCounts(); counts["k"] != 1 {
+		t.Fatalf("unexpected counts %v", counts)
+		return
+	}
+}
+
+func TestLsmCompaction(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmCompaction_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	params := &LsmParameters{MaxMemoryNodeCount: 50, MergeTimeoutMs: 10}
+	lsm, err := NewLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < 1000; i++ {
+		lsm.Set(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+	for i := 0; i < 1000; i += 2 {
+		lsm.Delete(fmt.Sprintf("k%04d", i))
+	}
+
+	for i := 0; i < 500; i++ {
+		stats := lsm.CompactionStats()
+		if stats.Merges > 0 && stats.PendingTables == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := lsm.CompactionStats()
+	if stats.Merges == 0 || stats.PendingTables != 0 || stats.Tables >= 20 ||
+		stats.Flushes == 0 || stats.MergeDuration <= 0 || stats.TableBytes <= 0 {
+		t.Fatalf("unexpected compaction stats %+v", stats)
+		return
+	}
+	lsm.Close()
+
+	// a table covered by a merged table is a leftover of an interrupted merge
+	merged, err := filepath.Glob(filepath.Join(rootPath, "lsm_1_*.sstable"))
+	if err != nil || len(merged) != 1 {
+		t.Fatalf("merged table not found %v error %v", merged, err)
+		return
+	}
+	leftover := filepath.Join(rootPath, "lsm_1.sstable")
+	err = ioutil.WriteFile(leftover, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatalf("can't write leftover error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	if _, err = os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("leftover table not removed error %v", err)
+		return
+	}
+
+	check := func() {
+		for i := 0; i < 1000; i++ {
+			value, err := lsm.Get(fmt.Sprintf("k%04d", i))
+			if i%2 == 0 {
+				if err != ErrNotFound {
+					t.Fatalf("deleted key %d found error %v", i, err)
+				}
+				continue
+			}
+			if err != nil || value != fmt.Sprintf("v%d", i) {
+				t.Fatalf("key %d value %s error %v", i, value, err)
+			}
+		}
+	}
+	check()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = lsm.MajorCompact(ctx); err != nil && err != context.Canceled {
+		t.Fatalf("canceled major compaction error %v", err)
+		return
+	}
+	check()
+
+	err = lsm.MajorCompact(context.Background())
+	if err != nil {
+		t.Fatalf("major compaction error %v", err)
+		return
+	}
+	if stats := lsm.CompactionStats(); stats.Tables != 1 {
+		t.Fatalf("unexpected stats after major compaction %+v", stats)
+		return
+	}
+	check()
+
+	// kept tombstones still hide the deleted key, a single table is
+	// rewritten on request
+	lsm.Delete("k0001")
+	dropped := lsm.CompactionStats().DroppedTombstones
+	for i := 0; i < 2; i++ {
+		err = lsm.CompactWith(context.Background(), CompactOptions{KeepTombstones: true, Rewrite: true})
+		if err != nil {
+			t.Fatalf("compaction keeping tombstones error %v", err)
+			return
+		}
+	}
+	if stats := lsm.CompactionStats(); stats.Tables != 1 || stats.DroppedTombstones != dropped {
+		t.Fatalf("unexpected stats after compaction keeping tombstones %+v", stats)
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't reopen lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	if _, err = lsm.Get("k0001"); err != ErrNotFound {
+		t.Fatalf("deleted key found error %v", err)
+		return
+	}
+	lsm.Set("k0001", "v1")
+	check()
+}
+
+func TestLsmVersionSet(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmVersionSet_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{MaxMemoryNodeCount: 50, MergeTimeoutMs: 10})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < 1000; i++ {
+		lsm.Set(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+
+	// scans running during merges see every key
+	done := make(chan error)
+	go func() {
+		for n := 0; n < 50; n++ {
+			pairs, err := lsm.Scan("", "", 0)
+			if err == nil && len(pairs) != 1000 {
+				err = fmt.Errorf("scan returned %d keys", len(pairs))
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for i := 0; i < 1000; i += 10 {
+		lsm.Set(fmt.Sprintf("k%04d", i), fmt.Sprintf("v%d", i))
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("concurrent scan error %v", err)
+		return
+	}
+
+	// tables of a pinned version outlive their merge
+	v := lsm.versions.acquire()
+	err = lsm.MajorCompact(context.Background())
+	if err != nil {
+		v.release()
+		t.Fatalf("major compaction error %v", err)
+		return
+	}
+	for _, st := range v.tables {
+		if _, err := st.getNode("k0001", time.Now().UnixNano()); err != nil && err != ErrNotFound {
+			v.release()
+			t.Fatalf("pinned table read error %v", err)
+			return
+		}
+	}
+	pinned := v.tables[0].filePath
+	v.release()
+
+	if _, err = os.Stat(pinned); !os.IsNotExist(err) {
+		lsm.Close()
+		t.Fatalf("merged table %s not erased error %v", pinned, err)
+		return
+	}
+	lsm.Close()
+
+	// a table missing from the manifest is a leftover of a flush or merge
+	leftover := filepath.Join(rootPath, "lsm_5000.sstable")
+	err = ioutil.WriteFile(leftover, []byte("garbage"), 0600)
+	if err != nil {
+		t.Fatalf("can't write leftover error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+
+	if _, err = os.Stat(leftover); !os.IsNotExist(err) {
+		lsm.Close()
+		t.Fatalf("leftover table not removed error %v", err)
+		return
+	}
+	pairs, err := lsm.Scan("", "", 0)
+	if err != nil || len(pairs) != 1000 {
+		lsm.Close()
+		t.Fatalf("reopened scan returned %d keys error %v", len(pairs), err)
+		return
+	}
+	live := lsm.versions.current.tables[0].filePath
+	lsm.Close()
+
+	// a table of the manifest that is missing fails the open and the other
+	// tables are kept
+	aside := filepath.Join(rootPath, "aside")
+	err = os.Rename(live, aside)
+	if err != nil {
+		t.Fatalf("can't move table error %v", err)
+		return
+	}
+	_, err = OpenLsm(log, rootPath, nil)
+	if err != ErrCorrupted {
+		t.Fatalf("open without a table error %v", err)
+		return
+	}
+	os.Rename(aside, live)
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	pairs, err = lsm.Scan("", "", 0)
+	if err != nil || len(pairs) != 1000 {
+		t.Fatalf("scan after a failed open returned %d keys error %v", len(pairs), err)
+		return
+	}
+}
+
+func TestLsmWalSegments(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmWalSegments_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	params := &LsmParameters{WalSegmentSize: 256}
+	lsm, err := NewLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		lsm.Set(fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i))
+	}
+	lsm.Close()
+
+	seqs, err := listWalSegments(rootPath)
+	if err != nil || len(seqs) < 2 {
+		t.Fatalf("log not segmented %v error %v", seqs, err)
+		return
+	}
+
+	_, err = NewLsm(log, rootPath, params)
+	if err != os.ErrExist {
+		t.Fatalf("lsm created over existing log error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	seqs, err = listWalSegments(rootPath)
+	if err != nil || len(seqs) != 1 {
+		t.Fatalf("replayed segments not removed %v error %v", seqs, err)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		value, err := lsm.Get(fmt.Sprintf("k%d", i))
+		if err != nil || value != fmt.Sprintf("v%d", i) {
+			t.Fatalf("key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmCreate(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmCreate_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{MaxMemoryNodeCount: 1})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	if err = lsm.Create("k1", "v1"); err != nil {
+		t.Fatalf("can't create key error %v", err)
+		return
+	}
+
+	lsm.Set("k2", "v2")
+	lsm.Delete("k2")
+	lsm.Set("k3", "v3")
+	lsm.compact(true)
+
+	if err = lsm.Create("k1", "v2"); err != ErrExists {
+		t.Fatalf("existing key created error %v", err)
+		return
+	}
+
+	if err = lsm.Create("k2", "v2"); err != nil {
+		t.Fatalf("can't create deleted key error %v", err)
+		return
+	}
+
+	if value, err := lsm.Get("k1"); err != nil || value != "v1" {
+		t.Fatalf("key k1 value %s error %v", value, err)
+		return
+	}
+}
+
+func TestLsmSnapshot(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmSnapshot_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	params := &LsmParameters{MaxMemoryNodeCount: 10}
+	lsm, err := NewLsm(log, filepath.Join(rootPath, "data"), params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 50; i++ {
+		lsm.Set(fmt.Sprintf("k%d", i), "v1")
+	}
+
+	snapshotPath := filepath.Join(rootPath, "snapshot")
+	err = lsm.Snapshot(snapshotPath)
+	if err != nil {
+		t.Fatalf("can't snapshot error %v", err)
+		return
+	}
+
+	if err = lsm.Snapshot(snapshotPath); !os.IsExist(err) {
+		t.Fatalf("snapshot overwritten error %v", err)
+		return
+	}
+
+	catalog, err := ReadCatalog(snapshotPath)
+	if err != nil || catalog.MaxVersion != 50 || len(catalog.Files) == 0 {
+		t.Fatalf("catalog %+v error %v", catalog, err)
+		return
+	}
+	for _, f := range catalog.Files {
+		checksum, size, err := fileChecksum(filepath.Join(snapshotPath, f.Name))
+		if err != nil || checksum != f.Checksum || size != f.Size {
+			t.Fatalf("catalog file %+v checksum %s size %d error %v", f, checksum, size, err)
+			return
+		}
+	}
+	if _, problems, err := CheckSnapshot(snapshotPath); err != nil || len(problems) != 0 {
+		t.Fatalf("check problems %v error %v", problems, err)
+		return
+	}
+
+	// a tampered catalog is reported, the files are links to the storage
+	catalog.Files[0].Checksum = "0"
+	catalog.FormatVersion++
+	data, _ := json.Marshal(catalog)
+	if err = ioutil.WriteFile(filepath.Join(snapshotPath, CatalogFileName), data, 0600); err != nil {
+		t.Fatalf("can't write catalog error %v", err)
+		return
+	}
+	if _, problems, err := CheckSnapshot(snapshotPath); err != nil || len(problems) != 2 {
+		t.Fatalf("check problems %v error %v", problems, err)
+		return
+	}
+
+	for i := 0; i < 50; i++ {
+		lsm.Set(fmt.Sprintf("k%d", i), "v2")
+	}
+
+	restorePath := filepath.Join(rootPath, "restore")
+	err = Restore(snapshotPath, restorePath)
+	if err != nil {
+		t.Fatalf("can't restore error %v", err)
+		return
+	}
+
+	restored, err := OpenLsm(log, restorePath, params)
+	if err != nil {
+		t.Fatalf("can't open restored lsm error %v", err)
+		return
+	}
+	defer restored.Close()
+
+	for i := 0; i < 50; i++ {
+		value, err := restored.Get(fmt.Sprintf("k%d", i))
+		if err != nil || value != "v1" {
+			t.Fatalf("key %d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestCatalog(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestCatalog_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	storagePath := filepath.Join(rootPath, "data")
+	lsm, err := NewLsm(log, storagePath, &LsmParameters{MaxMemoryNodeCount: 10})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 50; i++ {
+		lsm.Set(fmt.Sprintf("k%d", i), "v1")
+	}
+	lsm.Flush()
+
+	snapshotPath := filepath.Join(rootPath, "snapshot")
+	err = lsm.Snapshot(snapshotPath)
+	if err != nil {
+		t.Fatalf("can't snapshot error %v", err)
+		return
+	}
+
+	// the catalog lists every engine file of the snapshot in name order
+	catalog, err := ReadCatalog(snapshotPath)
+	if err != nil {
+		t.Fatalf("can't read catalog error %v", err)
+		return
+	}
+	names, err := StorageFiles(snapshotPath)
+	if err != nil {
+		t.Fatalf("can't list snapshot error %v", err)
+		return
+	}
+	sort.Strings(names)
+	listed := make([]string, 0, len(catalog.Files))
+	tables := 0
+	var size int64
+	for _, f := range catalog.Files {
+		listed = append(listed, f.Name)
+		if ssTableFileNamePattern.MatchString(f.Name) {
+			tables++
+		}
+		size += f.Size
+	}
+	if fmt.Sprint(listed) != fmt.Sprint(names) || tables == 0 || catalog.Tables != tables || catalog.Size != size {
+		t.Fatalf("catalog files %v tables %d size %d expected %v tables %d size %d",
+			listed, catalog.Tables, catalog.Size, names, tables, size)
+		return
+	}
+	if !catalog.Compatible() || catalog.ManifestNumber == 0 || catalog.CreatedAt == 0 {
+		t.Fatalf("catalog %+v", catalog)
+		return
+	}
+
+	// a directory without a catalog has its nodes read instead
+	if _, err = ReadCatalog(storagePath); !os.IsNotExist(err) {
+		t.Fatalf("catalog of storage error %v", err)
+		return
+	}
+	c, problems, err := CheckSnapshot(storagePath)
+	if err != nil || c != nil || len(problems) != 0 {
+		t.Fatalf("check storage catalog %+v problems %v error %v", c, problems, err)
+		return
+	}
+	emptyPath := filepath.Join(rootPath, "empty")
+	os.Mkdir(emptyPath, 0700)
+	if _, _, err = CheckSnapshot(emptyPath); err != os.ErrNotExist {
+		t.Fatalf("check empty directory error %v", err)
+		return
+	}
+
+	// a table moved to a name the catalog doesn't know is missing under
+	// its name and unexpected under the new one, the files are links to
+	// the storage so they are only renamed
+	var table string
+	for _, f := range catalog.Files {
+		if ssTableFileNamePattern.MatchString(f.Name) {
+			table = f.Name
+			break
+		}
+	}
+	err = os.Rename(filepath.Join(snapshotPath, table), filepath.Join(snapshotPath, "lsm_999999.sstable"))
+	if err != nil {
+		t.Fatalf("can't rename table error %v", err)
+		return
+	}
+	_, problems, err = CheckSnapshot(snapshotPath)
+	expected := []string{table + " missing", "lsm_999999.sstable not in catalog"}
+	if err != nil || fmt.Sprint(problems) != fmt.Sprint(expected) {
+		t.Fatalf("check problems %v expected %v error %v", problems, expected, err)
+		return
+	}
+
+	// a malformed catalog fails the lookup
+	err = ioutil.WriteFile(filepath.Join(snapshotPath, CatalogFileName), []byte("{"), 0600)
+	if err != nil {
+		t.Fatalf("can't write catalog error %v", err)
+		return
+	}
+	if _, err = ReadCatalog(snapshotPath); err == nil {
+		t.Fatalf("malformed catalog read")
+		return
+	}
+	if _, _, err = CheckSnapshot(snapshotPath); err == nil {
+		t.Fatalf("malformed catalog checked")
+		return
+	}
+}
+
+func TestLsmBinaryValues(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmBinaryValues_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	params := &LsmParameters{MaxValueSize: 1024}
+	lsm, err := NewLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	value := make([]byte, 1024)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	_, err = lsm.SetBytes("key", value, nil)
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+	if _, err = lsm.SetBytes("large", make([]byte, 1025), nil); err != ErrValueTooLarge {
+		t.Fatalf("unexpected large value error %v", err)
+		return
+	}
+
+	err = lsm.compact(true)
+	if err != nil {
+		t.Fatalf("compact error %v", err)
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	stored, _, err := lsm.GetBytes("key")
+	if err != nil || !bytes.Equal(stored, value) {
+		t.Fatalf("binary value not preserved error %v", err)
+		return
+	}
+}
+
+func TestLsmTtl(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmTtl_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	// expiration follows the engine clock, no sleeping needed
+	manual := clock.NewManual(time.Now())
+	params := &LsmParameters{CompactionMinTables: 2, Clock: manual}
+	lsm, err := NewLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	lsm.Set("k0", "v0")
+	written, err := lsm.SetWithOptions("k1", "v1", &WriteOptions{Ttl: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("can't set ttl error %v", err)
+		return
+	}
+
+	value, meta, err := lsm.GetMeta("k1")
+	if err != nil || value != "v1" || meta.ExpiresAt != written.ExpiresAt {
+		t.Fatalf("key k1 value %s meta %+v error %v", value, meta, err)
+		return
+	}
+
+	lsm.compact(true)
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	manual.Advance(300 * time.Millisecond)
+
+	if _, err = lsm.Get("k1"); err != ErrNotFound {
+		t.Fatalf("expired key found error %v", err)
+		return
+	}
+
+	if kvs, err := lsm.Scan("", "", 0); err != nil || len(kvs) != 1 {
+		t.Fatalf("unexpected scan result %v error %v", kvs, err)
+		return
+	}
+
+	if err = lsm.Create("k1", "v2"); err != nil {
+		t.Fatalf("can't create expired key error %v", err)
+		return
+	}
+}
+
+func TestLsmVersions(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmVersions_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	lsm.Set("k1", "v1")
+	_, meta, err := lsm.GetMeta("k1")
+	if err != nil || meta.Version == 0 {
+		t.Fatalf("unexpected meta %+v error %v", meta, err)
+		return
+	}
+
+	written, err := lsm.SetWithOptions("k1", "v2", &WriteOptions{CompareVersion: true, ExpectedVersion: meta.Version})
+	if err != nil || written.Version <= meta.Version {
+		t.Fatalf("can't set matching version %+v error %v", written, err)
+		return
+	}
+
+	if _, err = lsm.SetWithOptions("k1", "v3", &WriteOptions{CompareVersion: true, ExpectedVersion: meta.Version}); err != ErrVersionMismatch {
+		t.Fatalf("stale version accepted error %v", err)
+		return
+	}
+
+	if err = lsm.DeleteWithOptions("k1", &WriteOptions{CompareVersion: true, ExpectedVersion: meta.Version}); err != ErrVersionMismatch {
+		t.Fatalf("stale version delete accepted error %v", err)
+		return
+	}
+
+	if _, err = lsm.SetWithOptions("missing", "v", &WriteOptions{CompareVersion: true}); err != ErrVersionMismatch {
+		t.Fatalf("missing key version matched error %v", err)
+		return
+	}
+
+	lsm.compact(true)
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	value, meta, err := lsm.GetMeta("k1")
+	if err != nil || value != "v2" || meta.Version != written.Version {
+		t.Fatalf("key k1 value %s meta %+v error %v", value, meta, err)
+		return
+	}
+
+	lsm.Set("k2", "v1")
+	if _, meta, err = lsm.GetMeta("k2"); err != nil || meta.Version <= written.Version {
+		t.Fatalf("version not advanced after reopen %+v error %v", meta, err)
+		return
+	}
+}
+
+func TestLsmReplication(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmReplication_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	primary, err := NewLsm(log, filepath.Join(rootPath, "primary"), nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer primary.Close()
+
+	follower, err := NewLsm(log, filepath.Join(rootPath, "follower"), nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	changes := make([]Change, 0)
+	primary.SetChangeHook(func(c []Change) {
+		changes = append(changes, c...)
+	})
+
+	for i := 0; i < 100; i++ {
+		primary.Set(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+	}
+	primary.Delete("k005")
+	primary.DeleteKeys([]string{"k006", "k007"})
+
+	if len(changes) != 103 || changes[len(changes)-1].Version != primary.Version() {
+		t.Fatalf("unexpected changes %d version %d", len(changes), primary.Version())
+		return
+	}
+
+	err = follower.Apply(changes)
+	if err != nil {
+		t.Fatalf("apply error %v", err)
+		return
+	}
+	follower.Close()
+
+	follower, err = OpenLsm(log, filepath.Join(rootPath, "follower"), nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer follower.Close()
+
+	if follower.Version() != primary.Version() {
+		t.Fatalf("follower version %d primary %d", follower.Version(), primary.Version())
+		return
+	}
+
+	expected, err := primary.ScanChanges("", "", 0)
+	if err != nil {
+		t.Fatalf("scan error %v", err)
+		return
+	}
+	actual, err := follower.ScanChanges("", "", 0)
+	if err != nil {
+		t.Fatalf("scan error %v", err)
+		return
+	}
+	if len(expected) != 97 || len(actual) != len(expected) {
+		t.Fatalf("scanned %d and %d changes", len(expected), len(actual))
+		return
+	}
+	for i := range expected {
+		e, a := expected[i], actual[i]
+		if e.Key != a.Key || !bytes.Equal(e.Value, a.Value) || e.Deleted != a.Deleted || e.ExpiresAt != a.ExpiresAt || e.Version != a.Version {
+			t.Fatalf("change %+v replicated as %+v", e, a)
+			return
+		}
+	}
+}
+
+func TestLsmFlush(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmFlush_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < 100; i++ {
+		lsm.Set(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+	}
+
+	err = lsm.Flush()
+	if err != nil {
+		t.Fatalf("flush error %v", err)
+		return
+	}
+	stats := lsm.CompactionStats()
+	if stats.MemtableNodes != 0 || stats.Flushes != 1 || stats.Tables != 1 {
+		t.Fatalf("unexpected stats after flush %+v", stats)
+		return
+	}
+	lsm.Close()
+
+	if lsm.Flush() != ErrClosed {
+		t.Fatalf("flush of closed lsm succeeded")
+		return
+	}
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 100; i++ {
+		value, err := lsm.Get(fmt.Sprintf("k%03d", i))
+		if err != nil || value != fmt.Sprintf("v%d", i) {
+			t.Fatalf("get k%03d value %s error %v", i, value, err)
+			return
+		}
+	}
+}
+
+func TestLsmDurability(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmDurability_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{SyncIntervalMs: 1})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	durabilities := []Durability{DurabilitySync, DurabilityBatched, DurabilityNone}
+	errs := make(chan error, 30*len(durabilities))
+	var wg sync.WaitGroup
+	for w := 0; w < 30; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for _, durability := range durabilities {
+				key := fmt.Sprintf("k%d_%d", durability, w)
+				_, err := lsm.SetWithOptions(key, key, &WriteOptions{Durability: durability})
+				errs <- err
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("set error %v", err)
+			return
+		}
+	}
+
+	if lsm.CompactionStats().LogSyncs == 0 {
+		t.Fatalf("writes acknowledged without log syncs")
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for w := 0; w < 30; w++ {
+		for _, durability := range durabilities {
+			key := fmt.Sprintf("k%d_%d", durability, w)
+			value, err := lsm.Get(key)
+			if err != nil || value != key {
+				t.Fatalf("get %s value %s error %v", key, value, err)
+				return
+			}
+		}
+	}
+}
+
+func TestLsmTxn(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmTxn_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{CountPrefixes: []string{"k"}})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	meta, err := lsm.SetWithOptions("lock", "a", nil)
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+
+	txn := &Txn{
+		Compares: []Compare{{Key: "lock", CompareVersion: true, Version: meta.Version}, {Key: "k1", CompareVersion: true}},
+		Success: []TxnOp{
+			{Op: TxnSet, Key: "lock", Value: []byte("b")},
+			{Op: TxnSet, Key: "k1", Value: []byte("v1")},
+			{Op: TxnGet, Key: "k1"},
+			{Op: TxnDelete, Key: "k1"},
+			{Op: TxnGet, Key: "k1"},
+			{Op: TxnSet, Key: "k2", Value: []byte("v2")},
+		},
+		Failure: []TxnOp{{Op: TxnGet, Key: "lock"}},
+	}
+	result, err := lsm.Txn(txn)
+	if err != nil || !result.Succeeded || len(result.Results) != 6 {
+		t.Fatalf("unexpected txn result %+v error %v", result, err)
+		return
+	}
+	if string(result.Results[2].Value) != "v1" || result.Results[4].Err != ErrNotFound {
+		t.Fatalf("gets don't observe earlier writes %+v", result.Results)
+		return
+	}
+	if lsm.PrefixCounts()["k"] != 1 {
+		t.Fatalf("unexpected prefix counts %v", lsm.PrefixCounts())
+		return
+	}
+
+	// the version of lock changed so the failure branch runs
+	result, err = lsm.Txn(txn)
+	if err != nil || result.Succeeded || len(result.Results) != 1 || string(result.Results[0].Value) != "b" {
+		t.Fatalf("unexpected failed txn result %+v error %v", result, err)
+		return
+	}
+
+	_, err = lsm.Txn(&Txn{Success: []TxnOp{{Op: TxnSet, Key: "k3"}}})
+	if err != ErrEmptyValue {
+		t.Fatalf("txn with empty value error %v", err)
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for key, expected := range map[string]string{"lock": "b", "k2": "v2"} {
+		value, err := lsm.Get(key)
+		if err != nil || value != expected {
+			t.Fatalf("get %s value %s error %v", key, value, err)
+			return
+		}
+	}
+	if _, err = lsm.Get("k1"); err != ErrNotFound {
+		t.Fatalf("get deleted k1 error %v", err)
+		return
+	}
+}
+
+func TestLsmCoalesce(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmCoalesce_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{CoalesceThreshold: 10, CoalesceWindowMs: 2})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	durabilities := []Durability{DurabilitySync, DurabilityBatched, DurabilityNone}
+	errs := make(chan error, 20*50)
+	var wg sync.WaitGroup
+	for w := 0; w < 20; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				opts := &WriteOptions{Durability: durabilities[i%len(durabilities)]}
+				_, err := lsm.SetWithOptions("hot", fmt.Sprintf("%d_%d", w, i), opts)
+				errs <- err
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("set error %v", err)
+			return
+		}
+	}
+
+	err = lsm.Set("hot", "last")
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+	value, err := lsm.Get("hot")
+	if err != nil || value != "last" {
+		t.Fatalf("get value %s error %v", value, err)
+		return
+	}
+	err = lsm.Delete("hot")
+	if err != nil {
+		t.Fatalf("delete error %v", err)
+		return
+	}
+	err = lsm.Set("cold", "value")
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+
+	if lsm.CompactionStats().CoalescedWrites == 0 {
+		t.Fatalf("no writes coalesced")
+		return
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	_, err = lsm.Get("hot")
+	if err != ErrNotFound {
+		t.Fatalf("get deleted error %v", err)
+		return
+	}
+	value, err = lsm.Get("cold")
+	if err != nil || value != "value" {
+		t.Fatalf("get value %s error %v", value, err)
+		return
+	}
+}
+
+func TestLsmCompression(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	for _, compression := range []CompressionType{CompressionSnappy, CompressionZstd} {
+		rootPath, err := ioutil.TempDir("", "TestLsmCompression_"+random.GenerateRandomHexString(5))
+		if err != nil {
+			t.Fatalf("can't create tmp dir error %v", err)
+			return
+		}
+		defer os.RemoveAll(rootPath)
+
+		// tables written without compression stay readable
+		lsm, err := NewLsm(log, rootPath, nil)
+		if err != nil {
+			t.Fatalf("can't create lsm error %v", err)
+			return
+		}
+		for i := 0; i < 1500; i++ {
+			lsm.Set(fmt.Sprintf("k%04d", i), fmt.Sprintf("old value %d", i))
+		}
+		lsm.Close()
+
+		params := &LsmParameters{Compression: compression}
+		lsm, err = OpenLsm(log, rootPath, params)
+		if err != nil {
+			t.Fatalf("can't open lsm %s error %v", compression, err)
+			return
+		}
+		for i := 1000; i < 3000; i++ {
+			lsm.Set(fmt.Sprintf("k%04d", i), fmt.Sprintf("new value %d", i))
+		}
+		err = lsm.Flush()
+		if err != nil {
+			t.Fatalf("flush error %v", err)
+			return
+		}
+
+		check := func(stage string) {
+			for i := 0; i < 3000; i++ {
+				expected := fmt.Sprintf("old value %d", i)
+				if i >= 1000 {
+					expected = fmt.Sprintf("new value %d", i)
+				}
+				value, err := lsm.Get(fmt.Sprintf("k%04d", i))
+				if err != nil || value != expected {
+					t.Fatalf("%s %s key %d value %s error %v", compression, stage, i, value, err)
+				}
+			}
+
+			items, err := lsm.Scan("k0990", "k2100", 0)
+			if err != nil || len(items) != 1110 || items[10].Key != "k1000" || items[10].Value != "new value 1000" {
+				t.Fatalf("%s %s scan returned %d items error %v", compression, stage, len(items), err)
+			}
+		}
+		check("flushed")
+
+		err = lsm.MajorCompact(context.Background())
+		if err != nil {
+			t.Fatalf("major compaction error %v", err)
+			return
+		}
+		check("merged")
+		lsm.Close()
+
+		// rebuilding the index reads the compressed frames
+		indexes, err := filepath.Glob(filepath.Join(rootPath, "*.index"))
+		if err != nil || len(indexes) != 1 {
+			t.Fatalf("index not found %v error %v", indexes, err)
+			return
+		}
+		os.Remove(indexes[0])
+
+		lsm, err = OpenLsm(log, rootPath, nil)
+		if err != nil {
+			t.Fatalf("can't open lsm %s error %v", compression, err)
+			return
+		}
+		check("reindexed")
+
+		tables := lsm.TableProperties()
+		if len(tables) != 1 || tables[0].Compression != compression || tables[0].Nodes != 3000 ||
+			tables[0].IndexEntries != (3000+tables[0].KeysPerIndex-1)/tables[0].KeysPerIndex {
+			t.Fatalf("unexpected tables %+v", tables)
+			return
+		}
+		lsm.Close()
+	}
+}
+
+func TestLsmTxnTornLog(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmTxnTornLog_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	txn := func(prefix string) {
+		ops := make([]TxnOp, 0)
+		for i := 0; i < 3; i++ {
+			key := fmt.Sprintf("%s%d", prefix, i)
+			ops = append(ops, TxnOp{Op: TxnSet, Key: key, Value: []byte(key)})
+		}
+		_, err := lsm.Txn(&Txn{Success: ops})
+		if err != nil {
+			t.Fatalf("txn error %v", err)
+		}
+	}
+	txn("first")
+	txn("second")
+	lsm.Close()
+
+	// a crash in the middle of the second transaction's log write
+	segments, err := filepath.Glob(filepath.Join(rootPath, "wal_*.log"))
+	if err != nil || len(segments) == 0 {
+		t.Fatalf("log segments not found error %v", err)
+		return
+	}
+	sort.Strings(segments)
+	info, err := os.Stat(segments[len(segments)-1])
+	if err != nil {
+		t.Fatalf("can't stat log error %v", err)
+		return
+	}
+	err = os.Truncate(segments[len(segments)-1], info.Size()-10)
+	if err != nil {
+		t.Fatalf("can't truncate log error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("first%d", i)
+		if value, err := lsm.Get(key); err != nil || value != key {
+			t.Fatalf("get %s value %s error %v", key, value, err)
+			return
+		}
+		key = fmt.Sprintf("second%d", i)
+		if _, err := lsm.Get(key); err != ErrNotFound {
+			t.Fatalf("get %s of a torn transaction error %v", key, err)
+			return
+		}
+	}
+}
+
+func TestLsmSalvageLog(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmSalvageLog_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	keys := 100
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		if err := lsm.Set(key, key); err != nil {
+			t.Fatalf("set error %v", err)
+			return
+		}
+	}
+	lsm.Close()
+
+	logs, err := LogFiles(rootPath)
+	if err != nil || len(logs) == 0 {
+		t.Fatalf("log files not found error %v", err)
+		return
+	}
+	logPath := logs[len(logs)-1]
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("can't read log error %v", err)
+		return
+	}
+	// damage a record in the middle of the log
+	middle := len(data) / 2
+	copy(data[middle:], []byte("garbage"))
+	err = ioutil.WriteFile(logPath, data, 0600)
+	if err != nil {
+		t.Fatalf("can't write log error %v", err)
+		return
+	}
+
+	_, err = ScanLog(logPath, nil)
+	if _, ok := err.(*CorruptionError); !ok {
+		t.Fatalf("scan of a damaged log error %v", err)
+		return
+	}
+
+	report, err := SalvageLog(logPath, logPath+".salvaged")
+	if err != nil {
+		t.Fatalf("salvage error %v", err)
+		return
+	}
+	if report.Regions != 1 || report.Nodes < int64(keys-2) || report.Nodes >= int64(keys) {
+		t.Fatalf("salvage report %+v", report)
+		return
+	}
+	if err = os.Rename(logPath+".salvaged", logPath); err != nil {
+		t.Fatalf("can't replace log error %v", err)
+		return
+	}
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open salvaged lsm error %v", err)
+		return
+	}
+	lsm.Close()
+
+	infos, err := InspectTables(rootPath)
+	if err != nil || len(infos) == 0 {
+		t.Fatalf("inspect tables error %v", err)
+		return
+	}
+	nodes := int64(0)
+	for _, info := range infos {
+		if info.Err != nil || !info.Live {
+			t.Fatalf("table %+v", info)
+			return
+		}
+		nodes += info.Nodes
+	}
+	if nodes != report.Nodes || infos[0].MinKey != "key000" || infos[len(infos)-1].MaxKey != fmt.Sprintf("key%03d", keys-1) {
+		t.Fatalf("tables %+v salvaged %d", infos, report.Nodes)
+		return
+	}
+}
+
+func TestLsmWarmup(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmWarmup_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	keys := 10000
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := lsm.Set(key, key); err != nil {
+			t.Fatalf("set error %v", err)
+			return
+		}
+	}
+	if err = lsm.Flush(); err != nil {
+		t.Fatalf("flush error %v", err)
+		return
+	}
+	// a few hot keys
+	hot := []string{"key00010", "key05000", "key09990"}
+	for _, key := range hot {
+		if _, err := lsm.Get(key); err != nil {
+			t.Fatalf("get %s error %v", key, err)
+			return
+		}
+	}
+	lsm.Close()
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	stats, err := lsm.Warmup(context.Background())
+	if err != nil {
+		t.Fatalf("warmup error %v", err)
+		return
+	}
+	if stats.Tables == 0 || stats.Blocks != int64(len(hot)) || stats.CacheSize == 0 {
+		t.Fatalf("warmup stats %+v", stats)
+		return
+	}
+
+	_, misses, _ := lsm.CacheStats()
+	for _, key := range hot {
+		if value, err := lsm.Get(key); err != nil || value != key {
+			t.Fatalf("get %s value %s error %v", key, value, err)
+			return
+		}
+	}
+	if _, after, _ := lsm.CacheStats(); after != misses {
+		t.Fatalf("hot keys missed the cache after warmup %d %d", misses, after)
+		return
+	}
+}
+
+var errManifestCrash = fmt.Errorf("Manifest crash")
+
+// applyUntilCrash applies the edit, a crash of the manifest write stops it
+// as if the process died and is returned as errManifestCrash
+func applyUntilCrash(vs *versionSet, edit *versionEdit) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if r != errManifestCrash {
+				panic(r)
+			}
+			err = errManifestCrash
+		}
+	}()
+	return vs.apply(edit)
+}
+
+func TestManifestCrash(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	defer func() { manifestCrash = nil }()
+
+	for _, point := range []string{"append", "sync", "rename", "rewritten", "failure"} {
+		dir, err := ioutil.TempDir("", "TestManifestCrash_"+random.GenerateRandomHexString(5))
+		if err != nil {
+			t.Fatalf("can't create tmp dir error %v", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		table := func(id int64) *SsTable {
+			return &SsTable{filePath: filepath.Join(dir, fmt.Sprintf("lsm_%d.sstable", id)), minId: id, maxId: id, log: log}
+		}
+		check := func(m *manifest, want ...string) {
+			if m == nil || fmt.Sprint(m.Tables) != fmt.Sprint(want) {
+				t.Fatalf("%s manifest %+v want %v", point, m, want)
+			}
+		}
+
+		// the first edit writes the manifest, later ones are appended
+		vs := newVersionSet(dir)
+		t1, t2 := table(1), table(2)
+		for _, st := range []*SsTable{t1, t2} {
+			if err = vs.apply(&versionEdit{added: []*SsTable{st}}); err != nil {
+				t.Fatalf("apply error %v", err)
+				return
+			}
+		}
+
+		// crash while a merge of both tables commits
+		if point == "rename" || point == "rewritten" {
+			vs.edits = manifestMaxEdits
+		}
+		if point == "failure" {
+			// appends fail and can't be truncated
+			vs.file.Close()
+			vs.file, _ = os.Open(filepath.Join(dir, manifestFileName))
+		} else {
+			manifestCrash = func(p string, file *os.File, data []byte) {
+				if p != point {
+					return
+				}
+				if p == "append" {
+					// a torn record
+					file.Write(data[:len(data)/2])
+				}
+				panic(errManifestCrash)
+			}
+		}
+		merged := &SsTable{filePath: filepath.Join(dir, "lsm_1_2.sstable"), minId: 1, maxId: 2, log: log}
+		err = applyUntilCrash(vs, &versionEdit{added: []*SsTable{merged}, removed: []*SsTable{t1, t2}})
+		manifestCrash = nil
+		if err == nil {
+			t.Fatalf("%s apply succeeded", point)
+			return
+		}
+
+		m, err := readManifest(dir)
+		if err != nil {
+			t.Fatalf("%s read manifest error %v", point, err)
+			return
+		}
+		switch point {
+		case "append", "rename", "failure":
+			check(m, "lsm_1.sstable", "lsm_2.sstable")
+		default:
+			check(m, "lsm_1_2.sstable")
+		}
+
+		if point == "failure" {
+			// the next edit rewrites the manifest
+			if err = vs.apply(&versionEdit{added: []*SsTable{table(3)}}); err != nil {
+				t.Fatalf("apply after a failed append error %v", err)
+				return
+			}
+			m, err = readManifest(dir)
+			if err != nil {
+				t.Fatalf("read manifest error %v", err)
+				return
+			}
+			check(m, "lsm_1.sstable", "lsm_2.sstable", "lsm_3.sstable")
+			vs.closeManifest()
+			continue
+		}
+
+		// a restart continues from the recovered version
+		vs.closeManifest()
+		vs = newVersionSet(dir)
+		tables := make([]*SsTable, 0)
+		for _, name := range m.Tables {
+			tables = append(tables, &SsTable{filePath: filepath.Join(dir, name), log: log})
+		}
+		if err = vs.apply(&versionEdit{added: tables}); err != nil {
+			t.Fatalf("%s apply after restart error %v", point, err)
+			return
+		}
+		if err = vs.apply(&versionEdit{added: []*SsTable{table(3)}}); err != nil {
+			t.Fatalf("%s apply after restart error %v", point, err)
+			return
+		}
+		vs.closeManifest()
+		recovered, err := readManifest(dir)
+		if err != nil {
+			t.Fatalf("%s read manifest after restart error %v", point, err)
+			return
+		}
+		if len(recovered.Tables) != len(m.Tables)+1 || recovered.Tables[len(recovered.Tables)-1] != "lsm_3.sstable" {
+			t.Fatalf("%s manifest after restart %+v", point, recovered)
+			return
+		}
+	}
+}
+
+func TestManifestDamaged(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	dir, err := ioutil.TempDir("", "TestManifestDamaged_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	vs := newVersionSet(dir)
+	for id := int64(1); id <= 3; id++ {
+		st := &SsTable{filePath: filepath.Join(dir, fmt.Sprintf("lsm_%d.sstable", id)), minId: id, maxId: id, log: log}
+		if err = vs.apply(&versionEdit{added: []*SsTable{st}}); err != nil {
+			t.Fatalf("apply error %v", err)
+			return
+		}
+	}
+	vs.closeManifest()
+
+	path := filepath.Join(dir, manifestFileName)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read error %v", err)
+		return
+	}
+	offsets := make([]int, 0)
+	for offset := 0; offset < len(data); {
+		offsets = append(offsets, offset)
+		offset += manifestRecordHeaderSize + int(binary.LittleEndian.Uint32(data[offset:]))
+	}
+	if len(offsets) != 3 {
+		t.Fatalf("manifest records %v", offsets)
+		return
+	}
+
+	// a damaged last record is an edit that was never applied
+	damaged := append([]byte(nil), data...)
+	damaged[offsets[2]+manifestRecordHeaderSize] ^= 0xff
+	ioutil.WriteFile(path, damaged, 0600)
+	m, err := readManifest(dir)
+	if err != nil || fmt.Sprint(m.Tables) != "[lsm_1.sstable lsm_2.sstable]" {
+		t.Fatalf("manifest with damaged last record %+v error %v", m, err)
+		return
+	}
+
+	// while dropping a damaged record followed by others would lose tables
+	damaged = append([]byte(nil), data...)
+	damaged[offsets[1]+manifestRecordHeaderSize] ^= 0xff
+	ioutil.WriteFile(path, damaged, 0600)
+	_, err = readManifest(dir)
+	if err != ErrCorrupted {
+		t.Fatalf("manifest with damaged record error %v", err)
+		return
+	}
+}
+
+func TestCompactionTableLimit(t *testing.T) {
+	p := newCompactionPolicy(&LsmParameters{CompactionMaxTables: 4, MaxTables: 6})
+
+	// every table is 4 times its successor, too few are similar for a run
+	sizes := []int64{1 << 40, 1 << 38, 1 << 36, 1 << 34, 1 << 32, 1 << 30}
+	if runs := p.runs(sizes); len(runs) != 0 {
+		t.Fatalf("unexpected runs %v", runs)
+	}
+	if _, forced := p.forcedRun(sizes); forced {
+		t.Fatal("forced run at the table limit")
+	}
+
+	sizes = append(sizes, 1<<28)
+	run, forced := p.forcedRun(sizes)
+	if !forced || run != [2]int{3, 7} {
+		t.Fatalf("forced run %v %v", run, forced)
+	}
+
+	p = newCompactionPolicy(&LsmParameters{MaxTables: -1})
+	if _, forced := p.forcedRun(make([]int64, 1000)); forced {
+		t.Fatal("forced run without table limit")
+	}
+}
+
+func TestLsmEvents(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmEvents_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	lsm.Set("key", "value")
+	err = lsm.Flush()
+	if err != nil {
+		t.Fatalf("flush error %v", err)
+		return
+	}
+	lsm.Close()
+
+	types := func(events []Event) string {
+		result := ""
+		for i, event := range events {
+			if event.Seq != uint64(i+1) || event.Time == 0 {
+				t.Fatalf("unexpected event %+v at %d", event, i)
+			}
+			result += " " + event.Type
+		}
+		return result
+	}
+	if got := types(lsm.Events()); got != " open flush close" {
+		t.Fatalf("unexpected events %v", got)
+		return
+	}
+
+	lsm, err = OpenLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+	if got := types(lsm.Events()); got != " recovery open" {
+		t.Fatalf("unexpected events after open %v", got)
+		return
+	}
+
+	// the ring keeps the latest events
+	for i := 0; i < eventLogSize+10; i++ {
+		lsm.event(EventError, 0, "error %d", i)
+	}
+	events := lsm.Events()
+	if len(events) != eventLogSize || events[0].Seq != 13 || events[len(events)-1].Message != fmt.Sprintf("error %d", eventLogSize+9) {
+		t.Fatalf("unexpected ring %d first %+v last %+v", len(events), events[0], events[len(events)-1])
+		return
+	}
+}
+
+func TestWriteStall(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestWriteStall_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{WriteStallTimeoutMs: 50})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	// pretend a flush can't keep up with the writers
+	atomic.StoreInt32(&lsm.writeState, writeStopped)
+	err = lsm.Set("key", "value")
+	if err != ErrBusy {
+		t.Fatalf("stalled set error %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		lsm.nodeMapLock.Lock()
+		lsm.signalWritable()
+		lsm.nodeMapLock.Unlock()
+	}()
+	atomic.StoreInt32(&lsm.writeState, writeStopped)
+	err = lsm.Set("key", "value")
+	if err != nil {
+		t.Fatalf("set after flush error %v", err)
+	}
+
+	stats := lsm.CompactionStats()
+	if stats.WriteStalls != 2 || stats.StallRejects != 1 || stats.StalledWriters != 0 ||
+		stats.StallDuration < 50*time.Millisecond || stats.WriteState != "running" {
+		t.Fatalf("unexpected stall stats %+v", stats)
+	}
+}
+
+func TestWriteTriggers(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestWriteTriggers_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	params := &LsmParameters{WriteStallTimeoutMs: 50, WriteSlowdownTables: 2, WriteStopTables: 3, WriteSlowdownDelayMs: 5, MaxTables: -1}
+	lsm, err := NewLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	state := func() string {
+		return lsm.CompactionStats().WriteState
+	}
+
+	for i := 0; i < 3; i++ {
+		if err = lsm.Set(fmt.Sprintf("k%d", i), "v"); err != nil {
+			t.Fatalf("set error %v", err)
+		}
+		lsm.Flush()
+		if i == 1 && state() != "slowed" {
+			t.Fatalf("state %s with 2 tables", state())
+		}
+	}
+	if state() != "stopped" {
+		t.Fatalf("state %s with 3 tables", state())
+	}
+
+	// the tables are too small to merge, queued writers give up
+	if err = lsm.Set("k", "v"); err != ErrBusy {
+		t.Fatalf("stopped set error %v", err)
+	}
+
+	err = lsm.MajorCompact(context.Background())
+	if err != nil {
+		t.Fatalf("major compaction error %v", err)
+	}
+	if state() != "running" {
+		t.Fatalf("state %s after merge", state())
+	}
+	if err = lsm.Set("k", "v"); err != nil {
+		t.Fatalf("set after merge error %v", err)
+	}
+
+	stats := lsm.CompactionStats()
+	if stats.WriteSlowdowns != 1 || stats.SlowdownDuration != 5*time.Millisecond || stats.StallRejects != 1 {
+		t.Fatalf("unexpected stall stats %+v", stats)
+	}
+}
+
+func TestLsmWriteTimes(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmWriteTimes_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	start := time.Now()
+	manual := clock.NewManual(start)
+	params := &LsmParameters{Clock: manual}
+	lsm, err := NewLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		lsm.Set(fmt.Sprintf("k%d", i), "v")
+		manual.Advance(time.Second)
+	}
+	lsm.Delete("k1")
+
+	check := func(stage string) string {
+		tables := lsm.TableProperties()
+		if len(tables) != 1 {
+			t.Fatalf("%s tables %d", stage, len(tables))
+		}
+		p := tables[0]
+		if p.WrittenNodes != 3 || p.MinWrittenAt != start.UnixNano() ||
+			p.MaxWrittenAt != start.Add(3*time.Second).UnixNano() ||
+			p.MeanWrittenAt != start.Add(5*time.Second/3).UnixNano() {
+			t.Fatalf("%s unexpected write times %+v", stage, p)
+		}
+		return p.Path
+	}
+
+	err = lsm.Flush()
+	if err != nil {
+		t.Fatalf("flush error %v", err)
+		return
+	}
+	check("flushed")
+
+	err = lsm.MajorCompact(context.Background())
+	if err != nil {
+		t.Fatalf("major compaction error %v", err)
+		return
+	}
+	path := check("merged")
+	lsm.Close()
+
+	info, err := ScanTable(path, nil)
+	if err != nil || info.WrittenNodes != 3 || info.MinWrittenAt != start.UnixNano() {
+		t.Fatalf("scan table info %+v error %v", info, err)
+		return
+	}
+
+	// a rebuilt index reads the write times of the nodes
+	os.Remove(ssTableIndexPath(path))
+	lsm, err = OpenLsm(log, rootPath, params)
+	if err != nil {
+		t.Fatalf("can't open lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+	check("reindexed")
+}
+
+func TestCompactionCoordinator(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	coordinator := NewCompactionCoordinator(1, 1000)
+	engines := make([]*Lsm, 2)
+	for i := range engines {
+		rootPath, err := ioutil.TempDir("", "TestCompactionCoordinator_"+random.GenerateRandomHexString(5))
+		if err != nil {
+			t.Fatalf("can't create tmp dir error %v", err)
+			return
+		}
+		defer os.RemoveAll(rootPath)
+
+		engines[i], err = NewLsm(log, rootPath, &LsmParameters{Coordinator: coordinator})
+		if err != nil {
+			t.Fatalf("can't create lsm error %v", err)
+			return
+		}
+		defer engines[i].Close()
+
+		for j := 0; j < 2; j++ {
+			engines[i].Set(fmt.Sprintf("k%d", j), "v")
+			engines[i].Flush()
+		}
+	}
+
+	// the merge of the second engine waits for the first one
+	coordinator.acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := engines[1].MajorCompact(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("merge without a slot error %v", err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		coordinator.release()
+	}()
+	err = engines[1].MajorCompact(context.Background())
+	if err != nil {
+		t.Fatalf("major compaction error %v", err)
+	}
+	stats := engines[1].CompactionStats()
+	if stats.Tables != 1 || stats.MergeWaitDuration < 30*time.Millisecond || coordinator.Stats().Running != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// a second of budget passes at once, more sleeps
+	coordinator = NewCompactionCoordinator(1, 1000)
+	slept, err := coordinator.throttle(context.Background(), 1000)
+	if err != nil || slept != 0 {
+		t.Fatalf("throttle slept %v error %v", slept, err)
+	}
+	slept, err = coordinator.throttle(context.Background(), 50)
+	if err != nil || slept < 30*time.Millisecond {
+		t.Fatalf("throttle slept %v error %v", slept, err)
+	}
+}
+
+func TestLsmReadOnly(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmReadOnly_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, filepath.Join(rootPath, "lsm"), nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	for i := 0; i < 100; i++ {
+		lsm.Set(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+	}
+	lsm.Flush()
+	lsm.Delete("k000")
+	lsm.Set("k100", "v100")
+
+	backup := filepath.Join(rootPath, "backup")
+	err = lsm.Snapshot(backup)
+	if err != nil {
+		t.Fatalf("snapshot error %v", err)
+		return
+	}
+
+	// a missing index is rebuilt in memory, nothing is written
+	indexes, _ := filepath.Glob(filepath.Join(backup, "*.index"))
+	for _, index := range indexes {
+		os.Remove(index)
+	}
+	before, _ := StorageFiles(backup)
+
+	for _, logs := range []bool{false, true} {
+		ro, err := OpenReadOnly(log, backup, &ReadOnlyOptions{Logs: logs})
+		if err != nil {
+			t.Fatalf("open read only error %v", err)
+			return
+		}
+
+		_, _, err = ro.Get("k000")
+		if (err == nil) == logs {
+			t.Fatalf("logs %v deleted key error %v", logs, err)
+		}
+		value, meta, err := ro.Get("k050")
+		if err != nil || string(value) != "v50" || meta.Version == 0 {
+			t.Fatalf("logs %v get %s meta %+v error %v", logs, value, meta, err)
+		}
+
+		keys := 0
+		err = ro.Iterate("k090", "", func(key string, value []byte, meta ValueMeta) error {
+			keys++
+			return nil
+		})
+		if err != nil || (logs && keys != 11) || (!logs && keys != 10) {
+			t.Fatalf("logs %v iterated %d keys error %v", logs, keys, err)
+		}
+		ro.Close()
+	}
+
+	after, _ := StorageFiles(backup)
+	if fmt.Sprint(before) != fmt.Sprint(after) {
+		t.Fatalf("read only open changed files %v to %v", before, after)
+	}
+}
+
+func TestLsmHybridClockExpiry(t *testing.T) {
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	primary := time.Now()
+	// a follower clock ahead and one behind the primary
+	for _, skew := range []time.Duration{10 * time.Second, -10 * time.Second} {
+		rootPath, err := ioutil.TempDir("", "TestLsmHybridClockExpiry_"+random.GenerateRandomHexString(5))
+		if err != nil {
+			t.Fatalf("can't create tmp dir error %v", err)
+			return
+		}
+		defer os.RemoveAll(rootPath)
+
+		manual := clock.NewManual(primary.Add(skew))
+		hybrid := clock.NewHybrid(manual)
+		lsm, err := NewLsm(log, rootPath, &LsmParameters{Clock: hybrid})
+		if err != nil {
+			t.Fatalf("can't create lsm error %v", err)
+			return
+		}
+		defer lsm.Close()
+
+		hybrid.Observe(primary)
+		if got, ok := hybrid.Skew(); !ok || got != skew {
+			t.Fatalf("unexpected skew %v %v expected %v", got, ok, skew)
+		}
+
+		change := Change{Key: "k", Value: []byte("v"), ExpiresAt: primary.Add(5 * time.Second).UnixNano(), Version: 1}
+		err = lsm.Apply([]Change{change})
+		if err != nil {
+			t.Fatalf("can't apply error %v", err)
+			return
+		}
+
+		manual.Advance(4 * time.Second)
+		_, err = lsm.Get("k")
+		if err != nil {
+			t.Fatalf("skew %v get before expiry error %v", skew, err)
+		}
+
+		manual.Advance(2 * time.Second)
+		_, err = lsm.Get("k")
+		if err != ErrNotFound {
+			t.Fatalf("skew %v get after expiry error %v", skew, err)
+		}
+	}
+}
+
+func TestLsmSuspend(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmSuspend_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, &LsmParameters{MaxMemoryNodeCount: 10, MergeTimeoutMs: 10})
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	err = lsm.Suspend()
+	if err != nil {
+		t.Fatalf("suspend error %v", err)
+		return
+	}
+	for i := 0; i < 100; i++ {
+		lsm.Set(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if stats := lsm.CompactionStats(); !stats.Suspended || stats.Flushes != 0 || stats.MemtableNodes != 100 {
+		t.Fatalf("unexpected stats while suspended %+v", stats)
+		return
+	}
+
+	// an explicit flush still runs
+	err = lsm.Flush()
+	if err != nil || lsm.CompactionStats().Flushes != 1 {
+		t.Fatalf("flush while suspended error %v stats %+v", err, lsm.CompactionStats())
+		return
+	}
+	for i := 0; i < 100; i++ {
+		lsm.Set(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+	}
+
+	lsm.Resume()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		stats := lsm.CompactionStats()
+		if !stats.Suspended && stats.Flushes == 2 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("no flush after resume %+v", stats)
+			return
+		}
+	}
+
+	events := lsm.Events()
+	if events[1].Type != EventSuspend || events[len(events)-1].Type == EventSuspend {
+		t.Fatalf("unexpected events %+v", events)
+		return
+	}
+	lsm.Close()
+	if err = lsm.Suspend(); err != ErrClosed {
+		t.Fatalf("suspend of closed lsm error %v", err)
+		return
+	}
+}
+
+func TestLsmExplicitVersions(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmExplicitVersions_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	lsm, err := NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer lsm.Close()
+
+	meta, err := lsm.SetWithOptions("k1", "v1", &WriteOptions{Version: 100})
+	if err != nil || meta.Version != 100 {
+		t.Fatalf("set meta %+v error %v", meta, err)
+		return
+	}
+	result, err := lsm.Txn(&Txn{Success: []TxnOp{{Op: TxnSet, Key: "k2", Value: []byte("v2")}, {Op: TxnSet, Key: "k3", Value: []byte("v3")}}, Version: 200})
+	if err != nil || result.Results[0].Version != 200 || result.Results[1].Version != 201 {
+		t.Fatalf("txn result %+v error %v", result, err)
+		return
+	}
+	errs, err := lsm.DeleteKeysWithOptions([]string{"k2", "k3"}, &WriteOptions{Version: 300})
+	if err != nil || errs[0] != nil || errs[1] != nil || lsm.Version() != 301 {
+		t.Fatalf("delete keys errors %v error %v version %d", errs, err, lsm.Version())
+		return
+	}
+
+	// writing a version again keeps the engine version, writes without one
+	// continue after it
+	meta, err = lsm.SetWithOptions("k1", "v1", &WriteOptions{Version: 100})
+	if err != nil || meta.Version != 100 || lsm.Version() != 301 {
+		t.Fatalf("set again meta %+v error %v version %d", meta, err, lsm.Version())
+		return
+	}
+	meta, err = lsm.SetWithOptions("k1", "v2", nil)
+	if err != nil || meta.Version != 302 {
+		t.Fatalf("set meta %+v error %v", meta, err)
+		return
+	}
+	err = lsm.DeleteWithOptions("k1", &WriteOptions{CompareVersion: true, ExpectedVersion: 302, Version: 400})
+	if err != nil || lsm.Version() != 400 {
+		t.Fatalf("delete error %v version %d", err, lsm.Version())
+		return
+	}
+}
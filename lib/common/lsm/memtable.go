@@ -0,0 +1,117 @@
+package lsm
+
+import (
+	mathrand "math/rand"
+	"time"
+)
+
+const (
+	// Default memtable size in bytes that triggers compaction
+	defaultMemtableSize = 4 * 1024 * 1024
+	// Approximate per node memory overhead on top of key and value
+	memtableNodeOverhead = 96
+	memtableMaxLevel     = 24
+)
+
+type memtableEntry struct {
+	node *LsmNode
+	next []*memtableEntry
+}
+
+// memtable is a skip list of the latest node of every written key in key
+// order. It isn't synchronized, readers hold nodeMapLock for reading and
+// writers for writing.
+type memtable struct {
+	head  *memtableEntry
+	level int
+	count int
+	size  int64
+	rand  *mathrand.Rand
+}
+
+func newMemtable() *memtable {
+	m := new(memtable)
+	m.head = &memtableEntry{next: make([]*memtableEntry, memtableMaxLevel)}
+	m.level = 1
+	m.rand = mathrand.New(mathrand.NewSource(time.Now().UnixNano()))
+	return m
+}
+
+func memtableNodeSize(n *LsmNode) int64 {
+	return int64(len(n.key)+len(n.value)) + memtableNodeOverhead
+}
+
+// randomLevel returns a level with probability 1/4 of each further level
+func (m *memtable) randomLevel() int {
+	level := 1
+	for level < memtableMaxLevel && m.rand.Int63()&3 == 0 {
+		level++
+	}
+	return level
+}
+
+// seek returns the first entry with a key >= key and fills prev with the
+// last entry before it on each level if prev isn't nil
+func (m *memtable) seek(key string, prev []*memtableEntry) *memtableEntry {
+	e := m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for e.next[i] != nil && e.next[i].node.key < key {
+			e = e.next[i]
+		}
+		if prev != nil {
+			prev[i] = e
+		}
+	}
+	return e.next[0]
+}
+
+func (m *memtable) get(key string) (*LsmNode, bool) {
+	e := m.seek(key, nil)
+	if e == nil || e.node.key != key {
+		return nil, false
+	}
+	return e.node, true
+}
+
+// put inserts n or replaces the node of the same key
+func (m *memtable) put(n *LsmNode) {
+	prev := make([]*memtableEntry, memtableMaxLevel)
+	e := m.seek(n.key, prev)
+	if e != nil && e.node.key == n.key {
+		m.size += memtableNodeSize(n) - memtableNodeSize(e.node)
+		e.node = n
+		return
+	}
+
+	level := m.randomLevel()
+	for i := m.level; i < level; i++ {
+		prev[i] = m.head
+	}
+	if level > m.level {
+		m.level = level
+	}
+
+	e = &memtableEntry{node: n, next: make([]*memtableEntry, level)}
+	for i := 0; i < level; i++ {
+		e.next[i] = prev[i].next[i]
+		prev[i].next[i] = e
+	}
+	m.count++
+	m.size += memtableNodeSize(n)
+}
+
+// len returns the number of keys
+func (m *memtable) len() int {
+	return m.count
+}
+
+// bytes returns the approximate memory used by the nodes
+func (m *memtable) bytes() int64 {
+	return m.size
+}
+
+// first returns the entry of the smallest key >= startKey, entries follow
+// in key order through next[0]
+func (m *memtable) first(startKey string) *memtableEntry {
+	return m.seek(startKey, nil)
+}
@@ -2,9 +2,6 @@ package lsm
 
 import (
 	"bytes"
-
-	"github.com/OneOfOne/xxhash"
-
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -19,13 +16,38 @@ const (
 	LsmNodeMagic = uint32(0x4CBDABDA)
 )
 
+// Node flags, nodes written before expiration support carry only the
+// deleted flag
+const (
+	lsmNodeFlagDeleted = uint32(1)
+	// The header is followed by the expiration time in unix nanoseconds(8)
+	lsmNodeFlagExpires = uint32(2)
+	// The header, or the expiration time if present, is followed by the
+	// version(8)
+	lsmNodeFlagVersion = uint32(4)
+	// A log record whose value holds encoded nodes of an atomic write, it
+	// never appears in tables
+	lsmNodeFlagBatch = uint32(8)
+	// The version, or the header if there's none, is followed by the write
+	// time in unix nanoseconds(8)
+	lsmNodeFlagWritten = uint32(16)
+)
+
 type LsmNode struct {
 	key     string
-	value   string
+	value   []byte
 	deleted bool
+	batch   bool
+	// Expiration time in unix nanoseconds, zero means never
+	expiresAt int64
+	// Sequence number of the write, zero for nodes written before versions
+	version uint64
+	// Time of the write in unix nanoseconds, zero for nodes written before
+	// write times were recorded
+	writtenAt int64
 }
 
-func newLsmNode(key string, value string) *LsmNode {
+func newLsmNode(key string, value []byte) *LsmNode {
 	node := new(LsmNode)
 	node.key = key
 	node.value = value
@@ -34,30 +56,106 @@ func newLsmNode(key string, value string) *LsmNode {
 }
 
 func (node *LsmNode) WriteTo(f io.Writer) error {
+	return node.encode(f, ChecksumXxHash64)
+}
+
+func (node *LsmNode) ReadFrom(f io.Reader) error {
+	return node.decode(f, ChecksumXxHash64)
+}
+
+// expired reports whether the value expired at now unix nanoseconds
+func (node *LsmNode) expired(now int64) bool {
+	return node.expiresAt != 0 && node.expiresAt <= now
+}
+
+// size returns the encoded size of the node
+func (node *LsmNode) size(checksum ChecksumType) int64 {
+	size := int64(16 + checksum.size() + len(node.key) + len(node.value))
+	if node.expiresAt != 0 {
+		size += 8
+	}
+	if node.version != 0 {
+		size += 8
+	}
+	if node.writtenAt != 0 {
+		size += 8
+	}
+	return size
+}
+
+func (node *LsmNode) encode(f io.Writer, checksum ChecksumType) error {
 	key := []byte(node.key)
-	value := []byte(node.value)
-	deleted := uint32(0)
+	value := node.value
+	flags := uint32(0)
 	if node.deleted {
-		deleted = 1
+		flags |= lsmNodeFlagDeleted
+	}
+	if node.batch {
+		flags |= lsmNodeFlagBatch
 	}
 
-	header := make([]byte, 16+8)
+	var expires []byte
+	if node.expiresAt != 0 {
+		flags |= lsmNodeFlagExpires
+		expires = make([]byte, 8)
+		binary.LittleEndian.PutUint64(expires, uint64(node.expiresAt))
+	}
+
+	var version []byte
+	if node.version != 0 {
+		flags |= lsmNodeFlagVersion
+		version = make([]byte, 8)
+		binary.LittleEndian.PutUint64(version, node.version)
+	}
+
+	var written []byte
+	if node.writtenAt != 0 {
+		flags |= lsmNodeFlagWritten
+		written = make([]byte, 8)
+		binary.LittleEndian.PutUint64(written, uint64(node.writtenAt))
+	}
+
+	header := make([]byte, 16+checksum.size())
 	binary.LittleEndian.PutUint32(header[0:], LsmNodeMagic)
-	binary.LittleEndian.PutUint32(header[4:], deleted)
+	binary.LittleEndian.PutUint32(header[4:], flags)
 	binary.LittleEndian.PutUint32(header[8:], uint32(len(key)))
 	binary.LittleEndian.PutUint32(header[12:], uint32(len(value)))
 
-	h := xxhash.New64()
+	h := checksum.newHash()
 	h.Write(header[0:16])
+	h.Write(expires)
+	h.Write(version)
+	h.Write(written)
 	h.Write(key)
 	h.Write(value)
-	copy(header[16:16+8], h.Sum(nil))
+	copy(header[16:], h.Sum(nil))
 
 	_, err := f.Write(header)
 	if err != nil {
 		return err
 	}
 
+	if expires != nil {
+		_, err = f.Write(expires)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version != nil {
+		_, err = f.Write(version)
+		if err != nil {
+			return err
+		}
+	}
+
+	if written != nil {
+		_, err = f.Write(written)
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err = f.Write(key)
 	if err != nil {
 		return err
@@ -66,9 +164,9 @@ func (node *LsmNode) WriteTo(f io.Writer) error {
 	return err
 }
 
-func (node *LsmNode) ReadFrom(f io.Reader) error {
-	header := make([]byte, 16+8)
-	_, err := f.Read(header)
+func (node *LsmNode) decode(f io.Reader, checksum ChecksumType) error {
+	header := make([]byte, 16+checksum.size())
+	_, err := io.ReadFull(f, header)
 	if err != nil {
 		return err
 	}
@@ -77,34 +175,75 @@ func (node *LsmNode) ReadFrom(f io.Reader) error {
 		return ErrLsmNodeBadMagic
 	}
 
+	flags := binary.LittleEndian.Uint32(header[4:])
 	keyLength := binary.LittleEndian.Uint32(header[8:])
 	valueLength := binary.LittleEndian.Uint32(header[12:])
 
+	var expires []byte
+	if flags&lsmNodeFlagExpires != 0 {
+		expires = make([]byte, 8)
+		_, err = io.ReadFull(f, expires)
+		if err != nil {
+			return err
+		}
+	}
+
+	var version []byte
+	if flags&lsmNodeFlagVersion != 0 {
+		version = make([]byte, 8)
+		_, err = io.ReadFull(f, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	var written []byte
+	if flags&lsmNodeFlagWritten != 0 {
+		written = make([]byte, 8)
+		_, err = io.ReadFull(f, written)
+		if err != nil {
+			return err
+		}
+	}
+
 	key := make([]byte, keyLength)
 	value := make([]byte, valueLength)
-	_, err = f.Read(key)
+	_, err = io.ReadFull(f, key)
 	if err != nil {
 		return err
 	}
-	_, err = f.Read(value)
+	_, err = io.ReadFull(f, value)
 	if err != nil {
 		return err
 	}
 
-	h := xxhash.New64()
+	h := checksum.newHash()
 	h.Write(header[0:16])
+	h.Write(expires)
+	h.Write(version)
+	h.Write(written)
 	h.Write(key)
 	h.Write(value)
 
-	if !bytes.Equal(header[16:16+8], h.Sum(nil)) {
+	if !bytes.Equal(header[16:], h.Sum(nil)) {
 		return ErrLsmNodeBadCheckSum
 	}
 
 	node.key = string(key)
-	node.value = string(value)
-	node.deleted = false
-	if binary.LittleEndian.Uint32(header[4:]) != 0 {
-		node.deleted = true
+	node.value = value
+	node.deleted = flags&lsmNodeFlagDeleted != 0
+	node.batch = flags&lsmNodeFlagBatch != 0
+	node.expiresAt = 0
+	if expires != nil {
+		node.expiresAt = int64(binary.LittleEndian.Uint64(expires))
+	}
+	node.version = 0
+	if version != nil {
+		node.version = binary.LittleEndian.Uint64(version)
+	}
+	node.writtenAt = 0
+	if written != nil {
+		node.writtenAt = int64(binary.LittleEndian.Uint64(written))
 	}
 
 	return nil
@@ -0,0 +1,110 @@
+// Package reader opens a storage, checkpoint or backup directory of ddb
+// read only for analytics jobs and verification tools running next to a
+// live server. Unlike lsm.OpenLsm it doesn't replay the log, start
+// background goroutines or write any file, so it can read a directory the
+// server or a backup job keeps using.
+package reader
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"ddb/lib/common/clock"
+	"ddb/lib/common/filelog"
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+)
+
+var (
+	ErrNotFound = lsm.ErrNotFound
+	ErrVerify   = fmt.Errorf("Backup verification failed")
+)
+
+// Options tunes Open, nil means the defaults
+type Options struct {
+	// Include writes of the log segments not yet flushed into tables, a
+	// checkpoint keeps the writes since the last flush only there
+	Logs bool
+	// Compare the files with the backup catalog before opening
+	Verify bool
+	// Time source of expiration, nil means the system clock
+	Clock clock.Clock
+	// Nil logs to stderr
+	Log log.LogInterface
+}
+
+// Reader reads the keys of a directory as of the time it was opened, it's
+// safe for concurrent use
+type Reader struct {
+	ro      *lsm.ReadOnly
+	catalog *lsm.Catalog
+}
+
+// Open opens dir read only, the catalog of a backup is read if present
+func Open(dir string, opts *Options) (*Reader, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	logger := opts.Log
+	if logger == nil {
+		logger = log.NewLog(filelog.NewFileLogWithFile(os.Stderr))
+	}
+
+	r := &Reader{}
+	if opts.Verify {
+		catalog, problems, err := lsm.CheckSnapshot(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(problems) != 0 {
+			logger.Pf(log.LevelError, "verify %s problems %s", dir, strings.Join(problems, ", "))
+			return nil, ErrVerify
+		}
+		r.catalog = catalog
+	} else {
+		catalog, err := lsm.ReadCatalog(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		r.catalog = catalog
+	}
+
+	ro, err := lsm.OpenReadOnly(logger, dir, &lsm.ReadOnlyOptions{Logs: opts.Logs, Clock: opts.Clock})
+	if err != nil {
+		return nil, err
+	}
+	r.ro = ro
+	return r, nil
+}
+
+// Get returns the live value of key
+func (r *Reader) Get(key string) ([]byte, error) {
+	value, _, err := r.ro.Get(key)
+	return value, err
+}
+
+// GetMeta returns the live value of key with its version and expiration
+func (r *Reader) GetMeta(key string) ([]byte, lsm.ValueMeta, error) {
+	return r.ro.Get(key)
+}
+
+// Scan calls fn with every live key in [startKey, endKey) in key order,
+// empty endKey means no upper bound, an error of fn stops the scan
+func (r *Reader) Scan(startKey string, endKey string, fn func(key string, value []byte, meta lsm.ValueMeta) error) error {
+	return r.ro.Iterate(startKey, endKey, fn)
+}
+
+// Catalog returns the backup catalog, nil for directories without one
+func (r *Reader) Catalog() *lsm.Catalog {
+	return r.catalog
+}
+
+// Tables returns properties of the tables from the oldest to the newest
+func (r *Reader) Tables() []lsm.TableProperties {
+	return r.ro.TableProperties()
+}
+
+func (r *Reader) Close() {
+	r.ro.Close()
+}
@@ -0,0 +1,121 @@
+package reader
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ddb/lib/common/filelog"
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+	"ddb/lib/common/random"
+)
+
+func TestReader(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestReader_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	storage := filepath.Join(rootPath, "lsm")
+	engine, err := lsm.NewLsm(log, storage, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	defer engine.Close()
+
+	for i := 0; i < 100; i++ {
+		engine.Set(fmt.Sprintf("k%03d", i), fmt.Sprintf("v%d", i))
+	}
+	engine.Flush()
+	engine.Set("k100", "v100")
+
+	backup := filepath.Join(rootPath, "backup")
+	err = engine.Snapshot(backup)
+	if err != nil {
+		t.Fatalf("snapshot error %v", err)
+		return
+	}
+
+	r, err := Open(backup, &Options{Verify: true, Logs: true, Log: log})
+	if err != nil {
+		t.Fatalf("open error %v", err)
+		return
+	}
+	if r.Catalog() == nil || len(r.Tables()) == 0 {
+		t.Fatalf("catalog %+v tables %+v", r.Catalog(), r.Tables())
+		return
+	}
+	value, meta, err := r.GetMeta("k100")
+	if err != nil || string(value) != "v100" || meta.Version == 0 {
+		t.Fatalf("get %s meta %+v error %v", value, meta, err)
+		return
+	}
+	_, err = r.Get("k101")
+	if err != ErrNotFound {
+		t.Fatalf("get missing key error %v", err)
+		return
+	}
+
+	// an error of the callback stops the scan
+	stop := fmt.Errorf("stop")
+	keys := make([]string, 0)
+	err = r.Scan("k050", "k060", func(key string, value []byte, meta lsm.ValueMeta) error {
+		keys = append(keys, key)
+		if len(keys) == 3 {
+			return stop
+		}
+		return nil
+	})
+	if err != stop || len(keys) != 3 || keys[0] != "k050" || keys[2] != "k052" {
+		t.Fatalf("scan keys %v error %v", keys, err)
+		return
+	}
+	r.Close()
+
+	// the live storage is read without disturbing the engine, the writes
+	// since the flush are only in the log
+	for _, logs := range []bool{false, true} {
+		r, err = Open(storage, &Options{Logs: logs, Log: log})
+		if err != nil {
+			t.Fatalf("open storage error %v", err)
+			return
+		}
+		_, err = r.Get("k100")
+		if (err == nil) != logs {
+			t.Fatalf("logs %v unflushed key error %v", logs, err)
+			return
+		}
+		r.Close()
+	}
+	err = engine.Set("k101", "v101")
+	if err != nil {
+		t.Fatalf("set after read error %v", err)
+		return
+	}
+
+	// a damaged backup fails the verification
+	tables, _ := filepath.Glob(filepath.Join(backup, "*.sstable"))
+	if len(tables) == 0 {
+		t.Fatalf("no tables in %s", backup)
+		return
+	}
+	err = ioutil.WriteFile(tables[0], []byte("damaged"), 0600)
+	if err != nil {
+		t.Fatalf("write error %v", err)
+		return
+	}
+	_, err = Open(backup, &Options{Verify: true, Log: log})
+	if err != ErrVerify {
+		t.Fatalf("open of damaged backup error %v", err)
+		return
+	}
+}
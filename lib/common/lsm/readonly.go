@@ -0,0 +1,270 @@
+package lsm
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"ddb/lib/common/clock"
+	"ddb/lib/common/log"
+)
+
+// ReadOnlyOptions tunes OpenReadOnly
+type ReadOnlyOptions struct {
+	// Read the log segments into memory so writes not yet flushed into
+	// tables are visible, a torn tail of the last segment is ignored
+	Logs bool
+	// Time source of expiration, nil means the system clock
+	Clock clock.Clock
+}
+
+// ReadOnly reads the tables of a storage, checkpoint or backup directory
+// without changing it: the log isn't replayed, no background goroutines run
+// and no file is written, a missing or stale table index is rebuilt in
+// memory. It's safe for concurrent readers.
+type ReadOnly struct {
+	log      log.LogInterface
+	rootPath string
+	clock    clock.Clock
+	// Tables from the newest to the oldest
+	tables []*SsTable
+	// Logged writes if ReadOnlyOptions.Logs, never changed after open
+	memtable *memtable
+}
+
+// OpenReadOnly opens the tables of the manifest of rootPath or, without a
+// manifest, the tables not covered by a merged table
+func OpenReadOnly(log log.LogInterface, rootPath string, opts *ReadOnlyOptions) (*ReadOnly, error) {
+	if opts == nil {
+		opts = &ReadOnlyOptions{}
+	}
+
+	ro := &ReadOnly{log: log, rootPath: rootPath, clock: clock.OrReal(opts.Clock), memtable: newMemtable()}
+	names, err := readOnlyTables(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range names {
+		st, err := openSsTableReadOnly(log, filepath.Join(rootPath, name))
+		if err != nil {
+			ro.Close()
+			return nil, err
+		}
+		ro.tables = append(ro.tables, st)
+	}
+	sort.Slice(ro.tables, func(i, j int) bool { return ro.tables[i].maxId > ro.tables[j].maxId })
+
+	if opts.Logs {
+		err = ro.readLogs()
+		if err != nil {
+			ro.Close()
+			return nil, err
+		}
+	}
+	return ro, nil
+}
+
+// readOnlyTables returns the names of the live tables of rootPath
+func readOnlyTables(rootPath string) ([]string, error) {
+	m, err := readManifest(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		return m.Tables, nil
+	}
+
+	files, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	type idRange struct {
+		name  string
+		minId int64
+		maxId int64
+	}
+	ranges := make([]idRange, 0)
+	for _, file := range files {
+		match := ssTableFileNamePattern.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+		minId, _ := strconv.ParseInt(match[1], 10, 64)
+		maxId := minId
+		if match[2] != "" {
+			maxId, _ = strconv.ParseInt(match[2], 10, 64)
+		}
+		ranges = append(ranges, idRange{name: file.Name(), minId: minId, maxId: maxId})
+	}
+
+	names := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		covered := false
+		for _, other := range ranges {
+			if other.name != r.name && other.minId <= r.minId && r.maxId <= other.maxId {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			names = append(names, r.name)
+		}
+	}
+	return names, nil
+}
+
+// openSsTableReadOnly opens a table without writing its index
+func openSsTableReadOnly(log log.LogInterface, filePath string) (*SsTable, error) {
+	st := &SsTable{filePath: filePath, log: log}
+	match := ssTableFileNamePattern.FindStringSubmatch(filepath.Base(filePath))
+	if match != nil {
+		st.minId, _ = strconv.ParseInt(match[1], 10, 64)
+		st.maxId = st.minId
+		if match[2] != "" {
+			st.maxId, _ = strconv.ParseInt(match[2], 10, 64)
+		}
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	st.file = file
+
+	err = st.loadIndex()
+	if err == nil {
+		return st, nil
+	}
+
+	err = st.index()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// readLogs puts the logged writes into the memtable in log order
+func (ro *ReadOnly) readLogs() error {
+	paths, err := LogFiles(ro.rootPath)
+	if err != nil {
+		return err
+	}
+
+	for i, path := range paths {
+		_, err = ScanLog(path, func(offset int64, c Change) error {
+			n := newLsmNode(c.Key, c.Value)
+			n.deleted = c.Deleted
+			n.expiresAt = c.ExpiresAt
+			n.version = c.Version
+			n.writtenAt = c.WrittenAt
+			ro.memtable.put(n)
+			return nil
+		})
+		if ce, ok := err.(*CorruptionError); ok && ce.Err == io.ErrUnexpectedEOF && i == len(paths)-1 {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the live value of key and its metadata
+func (ro *ReadOnly) Get(key string) ([]byte, ValueMeta, error) {
+	now := ro.clock.Now().UnixNano()
+	if node, ok := ro.memtable.get(key); ok {
+		if node.deleted || node.expired(now) {
+			return nil, ValueMeta{}, ErrNotFound
+		}
+		return node.value, ValueMeta{ExpiresAt: node.expiresAt, Version: node.version}, nil
+	}
+
+	for _, st := range ro.tables {
+		if !st.MayContain(key) {
+			continue
+		}
+		node, err := st.getNode(key, now)
+		switch err {
+		case nil:
+			return node.value, ValueMeta{ExpiresAt: node.expiresAt, Version: node.version}, nil
+		case ErrDeleted:
+			return nil, ValueMeta{}, ErrNotFound
+		case ErrNotFound:
+		default:
+			return nil, ValueMeta{}, err
+		}
+	}
+	return nil, ValueMeta{}, ErrNotFound
+}
+
+// Iterate calls fn with every live key in [startKey, endKey) in key order,
+// empty endKey means no upper bound, an error of fn stops the iteration
+func (ro *ReadOnly) Iterate(startKey string, endKey string, fn func(key string, value []byte, meta ValueMeta) error) error {
+	items := make([]*mergeItem, 0, len(ro.tables)+1)
+	items = append(items, &mergeItem{it: newMemIterator(ro.memtable, startKey, endKey), priority: ro.newestId() + 1})
+	for _, st := range ro.tables {
+		it, err := st.newIterator(startKey, endKey)
+		if err != nil {
+			for _, item := range items {
+				item.it.close()
+			}
+			return err
+		}
+		items = append(items, &mergeItem{it: it, priority: st.maxId})
+	}
+
+	mi, err := newMergeIterator(items)
+	if err != nil {
+		return err
+	}
+	defer mi.close()
+
+	now := ro.clock.Now().UnixNano()
+	for node := mi.current(); node != nil; node = mi.current() {
+		if !node.deleted && !node.expired(now) {
+			err = fn(node.key, node.value, ValueMeta{ExpiresAt: node.expiresAt, Version: node.version})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = mi.next()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newestId returns the highest table id, logged writes are newer
+func (ro *ReadOnly) newestId() int64 {
+	if len(ro.tables) == 0 {
+		return 0
+	}
+	return ro.tables[0].maxId
+}
+
+// TableProperties returns properties of the tables from the oldest to the
+// newest
+func (ro *ReadOnly) TableProperties() []TableProperties {
+	props := make([]TableProperties, len(ro.tables))
+	for i, st := range ro.tables {
+		props[len(ro.tables)-1-i] = st.properties()
+	}
+	return props
+}
+
+// Close closes the table files
+func (ro *ReadOnly) Close() {
+	for _, st := range ro.tables {
+		st.Close()
+	}
+	ro.tables = nil
+}
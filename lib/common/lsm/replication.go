@@ -0,0 +1,201 @@
+package lsm
+
+import (
+	"sync/atomic"
+)
+
+// Change is a write as the engine logged it, applying the changes of an
+// engine in version order to another engine reproduces its state
+type Change struct {
+	Key       string
+	Value     []byte
+	Deleted   bool
+	ExpiresAt int64
+	Version   uint64
+	// Write time in unix nanoseconds, zero if unknown
+	WrittenAt int64
+}
+
+// ChangeHook is called with every logged write in version order while
+// writes are blocked, it must be quick and must not call into the engine
+type ChangeHook func(changes []Change)
+
+func nodeToChange(n *LsmNode) Change {
+	return Change{Key: n.key, Value: n.value, Deleted: n.deleted, ExpiresAt: n.expiresAt, Version: n.version, WrittenAt: n.writtenAt}
+}
+
+// SetChangeHook installs hook to observe writes, nil removes it
+func (lsm *Lsm) SetChangeHook(hook ChangeHook) {
+	lsm.nodeMapLock.Lock()
+	defer lsm.nodeMapLock.Unlock()
+
+	lsm.changeHook = hook
+}
+
+// notify passes logged nodes to the change hook, caller must hold
+// nodeMapLock
+func (lsm *Lsm) notify(nodes ...*LsmNode) {
+	if lsm.changeHook == nil {
+		return
+	}
+
+	changes := make([]Change, 0, len(nodes))
+	for _, n := range nodes {
+		if n != nil {
+			changes = append(changes, nodeToChange(n))
+		}
+	}
+	if len(changes) > 0 {
+		lsm.changeHook(changes)
+	}
+}
+
+// Version returns the version of the latest write
+func (lsm *Lsm) Version() uint64 {
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	return lsm.version
+}
+
+// Apply writes changes of another engine keeping their versions, the
+// engine version becomes the highest version seen
+func (lsm *Lsm) Apply(changes []Change) error {
+	target, err := lsm.apply(changes)
+	if err != nil {
+		return err
+	}
+
+	err = lsm.waitLog(target)
+	if err != nil {
+		return lsm.translateError(err)
+	}
+	return nil
+}
+
+// apply logs and applies changes, it returns the log position to wait for
+func (lsm *Lsm) apply(changes []Change) (int64, error) {
+	err := lsm.waitWritable()
+	if err != nil {
+		return 0, err
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.unlockWrite()
+
+	err = lsm.checkWritable()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, c := range changes {
+		if c.Key == "" {
+			return 0, ErrEmptyKey
+		}
+		if !c.Deleted && len(c.Value) == 0 {
+			return 0, ErrEmptyValue
+		}
+		if int64(len(c.Value)) > atomic.LoadInt64(&lsm.maxValueSize) {
+			return 0, ErrValueTooLarge
+		}
+	}
+
+	nodes := make([]*LsmNode, len(changes))
+	existed := make([]bool, len(changes))
+	seen := make(map[string]bool)
+	for i, c := range changes {
+		if lsm.counters.matches(c.Key) && !seen[c.Key] {
+			existed[i], err = lsm.exists(c.Key)
+			if err != nil {
+				return 0, lsm.translateError(err)
+			}
+		}
+		seen[c.Key] = true
+
+		n := newLsmNode(c.Key, c.Value)
+		n.deleted = c.Deleted
+		if c.Deleted {
+			n.value = nil
+		}
+		n.expiresAt = c.ExpiresAt
+		n.version = c.Version
+		n.writtenAt = c.WrittenAt
+		if n.writtenAt == 0 {
+			n.writtenAt = lsm.now()
+		}
+		err = lsm.appendLog(n)
+		if err != nil {
+			return 0, lsm.translateError(err)
+		}
+		nodes[i] = n
+	}
+
+	target := lsm.commitLog(DurabilitySync)
+
+	// counters follow the key state across the whole batch, a key changed
+	// several times only counts its first and last state
+	last := make(map[string]*LsmNode)
+	first := make(map[string]bool)
+	for i, n := range nodes {
+		if _, ok := first[n.key]; !ok {
+			first[n.key] = existed[i]
+		}
+		last[n.key] = n
+		lsm.memtable.put(n)
+		if n.version > lsm.version {
+			lsm.version = n.version
+		}
+	}
+	for key, n := range last {
+		if !lsm.counters.matches(key) {
+			continue
+		}
+		if first[key] && n.deleted {
+			lsm.counters.add(key, -1)
+		} else if !first[key] && !n.deleted {
+			lsm.counters.add(key, 1)
+		}
+	}
+
+	lsm.notify(nodes...)
+	return target, nil
+}
+
+// ScanChanges returns up to limit live values with keys in
+// [startKey, endKey) as changes carrying their versions
+func (lsm *Lsm) ScanChanges(startKey string, endKey string, limit int) ([]Change, error) {
+	if limit <= 0 || limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	if lsm.state != lsmStateOpen {
+		return nil, ErrClosed
+	}
+
+	v := lsm.versions.acquire()
+	defer v.release()
+
+	it, err := lsm.newIterator(v, startKey, endKey)
+	if err != nil {
+		return nil, lsm.translateError(err)
+	}
+	defer it.close()
+
+	now := lsm.now()
+	result := make([]Change, 0)
+	for node := it.current(); node != nil && len(result) < limit; node = it.current() {
+		if !node.deleted && !node.expired(now) {
+			result = append(result, nodeToChange(node))
+		}
+
+		err = it.next()
+		if err != nil {
+			return nil, lsm.translateError(err)
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package lsm
+
+const (
+	// Upper bound of pairs returned by a single scan
+	MaxScanLimit = 10000
+)
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// newIterator merges the memtable and all tables into a single ordered
+// iterator over [startKey, endKey), caller must hold nodeMapLock and keep
+// the version pinned for the lifetime of the iterator
+func (lsm *Lsm) newIterator(v *version, startKey string, endKey string) (*mergeIterator, error) {
+	items := make([]*mergeItem, 0, len(v.tables)+1)
+	items = append(items, &mergeItem{it: newMemIterator(lsm.memtable, startKey, endKey), priority: lsm.time + 1})
+
+	for _, st := range v.tables {
+		it, err := st.newIterator(startKey, endKey)
+		if err != nil {
+			for _, item := range items {
+				item.it.close()
+			}
+			return nil, err
+		}
+		items = append(items, &mergeItem{it: it, priority: st.maxId})
+	}
+
+	return newMergeIterator(items)
+}
+
+// Scan returns up to limit live key value pairs with keys in
+// [startKey, endKey) in ascending key order, empty endKey means no upper bound
+func (lsm *Lsm) Scan(startKey string, endKey string, limit int) ([]KeyValue, error) {
+	if limit <= 0 || limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	lsm.nodeMapLock.RLock()
+	defer lsm.nodeMapLock.RUnlock()
+
+	if lsm.state != lsmStateOpen {
+		return nil, ErrClosed
+	}
+
+	v := lsm.versions.acquire()
+	defer v.release()
+
+	it, err := lsm.newIterator(v, startKey, endKey)
+	if err != nil {
+		return nil, lsm.translateError(err)
+	}
+	defer it.close()
+
+	now := lsm.now()
+	result := make([]KeyValue, 0)
+	for node := it.current(); node != nil && len(result) < limit; node = it.current() {
+		if !node.deleted && !node.expired(now) {
+			result = append(result, KeyValue{Key: node.key, Value: string(node.value)})
+		}
+
+		err = it.next()
+		if err != nil {
+			return nil, lsm.translateError(err)
+		}
+	}
+
+	return result, nil
+}
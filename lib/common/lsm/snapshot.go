@@ -0,0 +1,200 @@
+package lsm
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isStorageFile reports whether name is a file of the engine: tables and
+// their indexes, the manifest, log segments, the legacy log and prefix
+// counters
+func isStorageFile(name string) bool {
+	switch {
+	case ssTableFileNamePattern.MatchString(name):
+		return true
+	case ssTableFileNamePattern.MatchString(strings.TrimSuffix(name, ".index") + ".sstable"):
+		return true
+	case walFileNamePattern.MatchString(name):
+		return true
+	case name == legacyLogFileName, name == countersFileName, name == manifestFileName, name == legacyManifestFileName:
+		return true
+	default:
+		return false
+	}
+}
+
+// StorageFiles returns names of the engine files in rootPath
+func StorageFiles(rootPath string) ([]string, error) {
+	files, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, file := range files {
+		if !file.IsDir() && isStorageFile(file.Name()) {
+			names = append(names, file.Name())
+		}
+	}
+	return names, nil
+}
+
+func copyFile(srcPath string, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	dst.Close()
+	if err != nil {
+		os.Remove(dstPath)
+	}
+	return err
+}
+
+// linkOrCopy hard links srcPath to dstPath and falls back to copying when
+// linking isn't possible, e.g. across file systems. It must only be used on
+// files which are never modified in place.
+func linkOrCopy(srcPath string, dstPath string) error {
+	err := os.Link(srcPath, dstPath)
+	if err == nil {
+		return nil
+	}
+	return copyFile(srcPath, dstPath)
+}
+
+// Snapshot creates dir holding a consistent copy of the engine which
+// OpenLsm can open directly. Writes switch to a new log segment so tables,
+// sealed segments and counters are immutable and get hard linked, writers
+// are blocked only while the files are linked. The snapshot carries a
+// catalog of its files with their sizes and checksums.
+func (lsm *Lsm) Snapshot(dir string) error {
+	lsm.nodeMapLock.Lock()
+	if lsm.state != lsmStateOpen {
+		lsm.nodeMapLock.Unlock()
+		return ErrClosed
+	}
+
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		lsm.nodeMapLock.Unlock()
+		return err
+	}
+
+	catalog, err := lsm.snapshot(dir)
+	lsm.nodeMapLock.Unlock()
+	if err == nil {
+		err = writeCatalog(dir, catalog)
+	}
+	if err != nil {
+		lsm.log.Pf(0, "snapshot %s error %v", dir, err)
+		os.RemoveAll(dir)
+		return lsm.translateError(err)
+	}
+
+	lsm.log.Pf(0, "snapshot %s done version %d files %d size %d", dir, catalog.MaxVersion, len(catalog.Files), catalog.Size)
+	return nil
+}
+
+// snapshot links the files of the current version into dir and returns
+// the catalog to write once writers are unblocked, caller must hold
+// nodeMapLock
+func (lsm *Lsm) snapshot(dir string) (*Catalog, error) {
+	err := lsm.rotateLog()
+	if err != nil {
+		return nil, err
+	}
+
+	// the pinned version keeps merged tables on disk until they are linked
+	v := lsm.versions.acquire()
+	defer v.release()
+
+	names, err := StorageFiles(lsm.rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make(map[string]bool)
+	for _, st := range v.tables {
+		tables[filepath.Base(st.filePath)] = true
+		tables[filepath.Base(ssTableIndexPath(st.filePath))] = true
+	}
+
+	for _, name := range names {
+		// the new segment is empty and still written to, merges in
+		// progress aren't part of the version yet and the manifest is
+		// written for the pinned version
+		if name == filepath.Base(lsm.getWalSegmentPath(lsm.logSeq)) || name == manifestFileName || name == legacyManifestFileName {
+			continue
+		}
+		if !tables[name] && (ssTableFileNamePattern.MatchString(name) || strings.HasSuffix(name, ".index")) {
+			continue
+		}
+
+		err = linkOrCopy(filepath.Join(lsm.rootPath, name), filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = writeManifest(dir, v)
+	if err != nil {
+		return nil, err
+	}
+	return newCatalog(v, lsm.version, lsm.logSeq-1), nil
+}
+
+// Restore places the snapshot from snapshotDir into rootPath which must not
+// hold engine files, the restored engine is opened with OpenLsm
+func Restore(snapshotDir string, rootPath string) error {
+	names, err := StorageFiles(snapshotDir)
+	if err != nil {
+		return err
+	}
+
+	exists, err := hasLog(snapshotDir)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return os.ErrNotExist
+	}
+
+	err = os.MkdirAll(rootPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	current, err := StorageFiles(rootPath)
+	if err != nil {
+		return err
+	}
+	if len(current) != 0 {
+		return os.ErrExist
+	}
+
+	for _, name := range names {
+		err = linkOrCopy(filepath.Join(snapshotDir, name), filepath.Join(rootPath, name))
+		if err != nil {
+			for _, name := range names {
+				os.Remove(filepath.Join(rootPath, name))
+			}
+			return err
+		}
+	}
+
+	return syncDir(rootPath)
+}
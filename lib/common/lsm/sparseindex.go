@@ -0,0 +1,114 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"sort"
+)
+
+const (
+	// Entries between full keys of a sparse index, the others store only
+	// the suffix after the prefix shared with the previous key
+	sparseIndexRestartInterval = 16
+)
+
+// sparseIndex maps the first key of every index block of a table to the
+// block offset. Keys are prefix compressed into a single buffer:
+// sharedLength(uvarint) suffixLength(uvarint) suffix, with a full key at
+// every restart point so a lookup decodes at most one restart group.
+type sparseIndex struct {
+	data     []byte
+	restarts []uint32
+	offsets  []int64
+	// Last added key, only kept while the index is built
+	last string
+}
+
+func newSparseIndex() *sparseIndex {
+	return new(sparseIndex)
+}
+
+// add appends an entry, keys must be added in ascending order
+func (si *sparseIndex) add(key string, offset int64) {
+	shared := 0
+	if len(si.offsets)%sparseIndexRestartInterval == 0 {
+		si.restarts = append(si.restarts, uint32(len(si.data)))
+	} else {
+		for shared < len(key) && shared < len(si.last) && key[shared] == si.last[shared] {
+			shared++
+		}
+	}
+
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(shared))
+	n += binary.PutUvarint(buf[n:], uint64(len(key)-shared))
+	si.data = append(si.data, buf[:n]...)
+	si.data = append(si.data, key[shared:]...)
+	si.offsets = append(si.offsets, offset)
+	si.last = key
+}
+
+// finish drops the state kept for building and trims spare capacity
+func (si *sparseIndex) finish() {
+	si.last = ""
+	si.data = append([]byte(nil), si.data...)
+	si.restarts = append([]uint32(nil), si.restarts...)
+	si.offsets = append([]int64(nil), si.offsets...)
+}
+
+func (si *sparseIndex) len() int {
+	return len(si.offsets)
+}
+
+func (si *sparseIndex) offset(i int) int64 {
+	return si.offsets[i]
+}
+
+// decode returns the key at position pos of data given the previous key of
+// the restart group and the position of the next entry
+func (si *sparseIndex) decode(pos int, prev []byte) ([]byte, int) {
+	shared, n := binary.Uvarint(si.data[pos:])
+	pos += n
+	length, n := binary.Uvarint(si.data[pos:])
+	pos += n
+
+	key := append(prev[:shared:shared], si.data[pos:pos+int(length)]...)
+	return key, pos + int(length)
+}
+
+// key returns the key of entry i
+func (si *sparseIndex) key(i int) string {
+	pos := int(si.restarts[i/sparseIndexRestartInterval])
+	var key []byte
+	for j := 0; j <= i%sparseIndexRestartInterval; j++ {
+		key, pos = si.decode(pos, key)
+	}
+	return string(key)
+}
+
+// search returns the number of entries with keys <= key
+func (si *sparseIndex) search(key string) int {
+	// the last restart group whose first key is <= key holds the answer
+	group := sort.Search(len(si.restarts), func(i int) bool {
+		first, _ := si.decode(int(si.restarts[i]), nil)
+		return string(first) > key
+	}) - 1
+	if group < 0 {
+		return 0
+	}
+
+	i := group * sparseIndexRestartInterval
+	pos := int(si.restarts[group])
+	var current []byte
+	for ; i < len(si.offsets) && i < (group+1)*sparseIndexRestartInterval; i++ {
+		current, pos = si.decode(pos, current)
+		if string(current) > key {
+			break
+		}
+	}
+	return i
+}
+
+// bytes returns the memory held by the index
+func (si *sparseIndex) bytes() int64 {
+	return int64(cap(si.data) + 4*cap(si.restarts) + 8*cap(si.offsets))
+}
@@ -1,35 +1,269 @@
 package lsm
 
 import (
+	"bufio"
+	"bytes"
 	log "ddb/lib/common/log"
 	"fmt"
 	"io"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	ErrDeleted = fmt.Errorf("Deleted")
 )
 
-const (
-	keysPerIndex = 512
-)
-
 type SsTable struct {
 	filePath string
 	file     *os.File
 	lock     sync.RWMutex
 
-	keyToOffset map[string]int64
-	keys        []string
+	// First key and offset of every index block
+	sparse *sparseIndex
 
 	minKey *string
 	maxKey *string
 	log    log.LogInterface
+
+	checksum   ChecksumType
+	dataOffset int64
+	fileSize   int64
+	cache      *blockCache
+	bloom      *bloomFilter
+	// Highest node version in the table
+	maxVersion uint64
+	// Write times of the nodes
+	written writeTimes
+
+	// Compression of the data blocks, see writeBlockFrame
+	compression CompressionType
+	// Nodes in the table and per index block, see chooseKeysPerIndex
+	nodes        int64
+	keysPerIndex int
+
+	// Range of table ids whose data the table holds, maxId orders tables
+	minId int64
+	maxId int64
+
+	// Table views holding the table, an obsolete table is erased when the
+	// last one is released
+	refs     int32
+	obsolete int32
+}
+
+// TableProperties describes a table of the current version
+type TableProperties struct {
+	Path string
+	// Range of table ids whose data the table holds
+	MinId int64
+	MaxId int64
+	Size  int64
+	Nodes int64
+	// Nodes per index block chosen for the table and index entries kept in
+	// memory
+	KeysPerIndex int
+	IndexEntries int
+	Compression  CompressionType
+	Checksum     ChecksumType
+	MaxVersion   uint64
+	// Memory held by the prefix compressed index
+	IndexBytes int64
+
+	// Oldest, newest and mean write time of the nodes in unix nanoseconds
+	// and the nodes which carry one, nodes written before write times were
+	// recorded aren't counted
+	MinWrittenAt  int64
+	MaxWrittenAt  int64
+	MeanWrittenAt int64
+	WrittenNodes  int64
+}
+
+// writeTimes summarizes the write times of the nodes of a table
+type writeTimes struct {
+	min   int64
+	max   int64
+	mean  int64
+	nodes int64
+}
+
+func (wt *writeTimes) add(writtenAt int64) {
+	if writtenAt == 0 {
+		return
+	}
+	if wt.nodes == 0 || writtenAt < wt.min {
+		wt.min = writtenAt
+	}
+	if writtenAt > wt.max {
+		wt.max = writtenAt
+	}
+	wt.nodes++
+	// a running mean as the sum of unix nanoseconds overflows
+	wt.mean += (writtenAt - wt.mean) / wt.nodes
+}
+
+func (st *SsTable) properties() TableProperties {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	return TableProperties{
+		Path:         st.filePath,
+		MinId:        st.minId,
+		MaxId:        st.maxId,
+		Size:         st.fileSize,
+		Nodes:        st.nodes,
+		KeysPerIndex: st.keysPerIndex,
+		IndexEntries: st.sparse.len(),
+		IndexBytes:   st.sparse.bytes(),
+		Compression:  st.compression,
+		Checksum:     st.checksum,
+		MaxVersion:   st.maxVersion,
+
+		MinWrittenAt:  st.written.min,
+		MaxWrittenAt:  st.written.max,
+		MeanWrittenAt: st.written.mean,
+		WrittenNodes:  st.written.nodes,
+	}
+}
+
+// unref drops a reference of a released table view
+func (st *SsTable) unref() {
+	if atomic.AddInt32(&st.refs, -1) == 0 && atomic.LoadInt32(&st.obsolete) != 0 {
+		st.Erase()
+	}
+}
+
+// ssTableWriter writes sorted nodes into a table file and builds the sparse
+// index on the way, with compression the nodes of an index block are
+// buffered and written as one frame
+type ssTableWriter struct {
+	file        *os.File
+	writer      *bufio.Writer
+	checksum    ChecksumType
+	compression CompressionType
+	block       bytes.Buffer
+	density     int
+	offset      int64
+	count       int64
+	sparse      *sparseIndex
+	minKey      string
+	maxKey      string
+	hashes      []uint64
+	maxVersion  uint64
+	written     writeTimes
+}
+
+// newSsTableWriter starts a table with an index entry every keysPerIndex
+// nodes
+func newSsTableWriter(file *os.File, checksum ChecksumType, compression CompressionType, keysPerIndex int) (*ssTableWriter, error) {
+	w := new(ssTableWriter)
+	w.file = file
+	w.writer = bufio.NewWriter(file)
+	w.checksum = checksum
+	w.compression = compression
+	w.density = keysPerIndex
+	w.sparse = newSparseIndex()
+
+	err := writeFileHeader(w.writer, checksum, compression)
+	if err != nil {
+		return nil, err
+	}
+	w.offset = fileHeaderSize
+	return w, nil
+}
+
+func (w *ssTableWriter) add(node *LsmNode) error {
+	if w.count%int64(w.density) == 0 {
+		err := w.flushBlock()
+		if err != nil {
+			return err
+		}
+		w.sparse.add(node.key, w.offset)
+	}
+	if w.count == 0 {
+		w.minKey = node.key
+	}
+
+	if w.compression == CompressionNone {
+		err := node.encode(w.writer, w.checksum)
+		if err != nil {
+			return err
+		}
+		w.offset += node.size(w.checksum)
+	} else {
+		err := node.encode(&w.block, w.checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	w.maxKey = node.key
+	if node.version > w.maxVersion {
+		w.maxVersion = node.version
+	}
+	w.written.add(node.writtenAt)
+	w.hashes = append(w.hashes, bloomHash(node.key))
+	w.count++
+	return nil
+}
+
+// flushBlock writes the buffered nodes of a compressed table as a frame
+func (w *ssTableWriter) flushBlock() error {
+	if w.block.Len() == 0 {
+		return nil
+	}
+
+	size, err := writeBlockFrame(w.writer, w.block.Bytes(), w.compression)
+	if err != nil {
+		return err
+	}
+	w.offset += size
+	w.block.Reset()
+	return nil
 }
 
+func (w *ssTableWriter) finish() error {
+	err := w.flushBlock()
+	if err != nil {
+		return err
+	}
+	err = w.writer.Flush()
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+// setIndex fills the table index from a finished writer
+func (st *SsTable) setIndex(w *ssTableWriter) {
+	st.checksum = w.checksum
+	st.compression = w.compression
+	st.nodes = w.count
+	st.keysPerIndex = w.density
+	st.dataOffset = fileHeaderSize
+	st.fileSize = w.offset
+	st.maxVersion = w.maxVersion
+	st.written = w.written
+	w.sparse.finish()
+	st.sparse = w.sparse
+	st.bloom = newBloomFilter(w.hashes)
+	st.minKey = nil
+	st.maxKey = nil
+	if w.count > 0 {
+		minKey := w.minKey
+		maxKey := w.maxKey
+		st.minKey = &minKey
+		st.maxKey = &maxKey
+	}
+}
+
+// index rebuilds the sparse index by reading the whole data file, it's used
+// for tables without a valid persisted index. Compressed tables get an index
+// entry per frame, others one per minKeysPerIndex nodes thinned out to the
+// density chosen for the table once its size is known.
 func (st *SsTable) index() error {
 	file, err := os.OpenFile(st.filePath, os.O_RDONLY, 0600)
 	if err != nil {
@@ -37,22 +271,50 @@ func (st *SsTable) index() error {
 	}
 	defer file.Close()
 
+	st.checksum, st.compression, st.dataOffset, err = readFileHeader(file)
+	if err != nil {
+		return err
+	}
+
+	// nodes of compressed tables are read through frames, an index block
+	// starts with every frame
+	var br *blockReader
+	if st.compression != CompressionNone {
+		br = newBlockReader(file, st.compression, st.dataOffset)
+	}
+
 	st.minKey = nil
 	st.maxKey = nil
+	st.maxVersion = 0
+	st.written = writeTimes{}
 
 	i := int64(0)
 
-	st.keys = make([]string, 0)
-	st.keyToOffset = make(map[string]int64)
+	// entries are collected before the density of uncompressed tables is
+	// known
+	keys := make([]string, 0)
+	offsets := make([]int64, 0)
+	hashes := make([]uint64, 0)
 
+	st.keysPerIndex = 0
 	for {
 		node := new(LsmNode)
-		offset, err := file.Seek(0, os.SEEK_CUR)
-		if err != nil {
-			return err
+		var offset int64
+		entry := i%minKeysPerIndex == 0
+		if br != nil {
+			entry = br.atFrameStart()
+			if entry && i > 0 && st.keysPerIndex == 0 {
+				st.keysPerIndex = int(i)
+			}
+			offset = br.nextOffset()
+			err = node.decode(br, st.checksum)
+		} else {
+			offset, err = file.Seek(0, os.SEEK_CUR)
+			if err != nil {
+				return err
+			}
+			err = node.decode(file, st.checksum)
 		}
-
-		err = node.ReadFrom(file)
 		if err != nil {
 			if err == io.EOF {
 				break
@@ -72,38 +334,74 @@ func (st *SsTable) index() error {
 			st.maxKey = &node.key
 		}
 
-		if i%keysPerIndex == 0 {
-			st.keys = append(st.keys, node.key)
-			st.keyToOffset[node.key] = offset
+		if entry {
+			keys = append(keys, node.key)
+			offsets = append(offsets, offset)
+		}
+		hashes = append(hashes, bloomHash(node.key))
+		if node.version > st.maxVersion {
+			st.maxVersion = node.version
 		}
+		st.written.add(node.writtenAt)
 		i++
 	}
 
-	sort.Strings(st.keys)
+	st.bloom = newBloomFilter(hashes)
+
+	if br != nil {
+		st.fileSize = br.nextOffset()
+	} else {
+		st.fileSize, err = file.Seek(0, os.SEEK_CUR)
+		if err != nil {
+			return err
+		}
+	}
+	st.nodes = i
+
+	step := 1
+	if br != nil {
+		if st.keysPerIndex == 0 {
+			st.keysPerIndex = int(i)
+		}
+	} else {
+		st.keysPerIndex = chooseKeysPerIndex(i, st.fileSize-st.dataOffset)
+		step = st.keysPerIndex / minKeysPerIndex
+	}
+	if st.keysPerIndex == 0 {
+		st.keysPerIndex = minKeysPerIndex
+	}
+
+	st.sparse = newSparseIndex()
+	for j, key := range keys {
+		if j%step == 0 {
+			st.sparse.add(key, offsets[j])
+		}
+	}
+	st.sparse.finish()
 	return nil
 }
 
-func newSsTable(log log.LogInterface, filePath string, nodeMap map[string]*LsmNode) (*SsTable, error) {
+func newSsTable(log log.LogInterface, filePath string, mem *memtable, checksum ChecksumType, compression CompressionType, cache *blockCache) (*SsTable, error) {
 	st := new(SsTable)
 	st.filePath = filePath
 	st.log = log
+	st.cache = cache
 	file, err := os.OpenFile(st.filePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
 	if err != nil {
 		log.Pf(0, "Create table %s error %v", st.filePath, err)
 		return nil, err
 	}
 
-	keys := make([]string, len(nodeMap))
-	i := 0
-	for key := range nodeMap {
-		keys[i] = key
-		i++
+	nodes := int64(mem.len())
+	w, err := newSsTableWriter(file, checksum, compression, chooseKeysPerIndex(nodes, mem.bytes()-nodes*memtableNodeOverhead))
+	if err != nil {
+		file.Close()
+		os.Remove(st.filePath)
+		return nil, err
 	}
-	sort.Strings(keys)
 
-	for _, key := range keys {
-		node := nodeMap[key]
-		err = node.WriteTo(file)
+	for e := mem.first(""); e != nil; e = e.next[0] {
+		err = w.add(e.node)
 		if err != nil {
 			file.Close()
 			os.Remove(st.filePath)
@@ -111,14 +409,15 @@ func newSsTable(log log.LogInterface, filePath string, nodeMap map[string]*LsmNo
 		}
 	}
 
-	err = file.Sync()
+	err = w.finish()
 	if err != nil {
 		file.Close()
 		os.Remove(st.filePath)
 		return nil, err
 	}
 
-	err = st.index()
+	st.setIndex(w)
+	err = st.writeIndex()
 	if err != nil {
 		file.Close()
 		os.Remove(st.filePath)
@@ -128,86 +427,163 @@ func newSsTable(log log.LogInterface, filePath string, nodeMap map[string]*LsmNo
 	return st, nil
 }
 
-func openSsTable(log log.LogInterface, filePath string) (*SsTable, error) {
+func openSsTable(log log.LogInterface, filePath string, cache *blockCache) (*SsTable, error) {
 	st := new(SsTable)
 	st.filePath = filePath
 	st.log = log
+	st.cache = cache
 	file, err := os.OpenFile(st.filePath, os.O_RDWR, 0600)
 	if err != nil {
 		log.Pf(0, "Open table %s error %v", st.filePath, err)
 		return nil, err
 	}
 	st.file = file
+
+	err = st.loadIndex()
+	if err == nil {
+		return st, nil
+	}
+
+	if !os.IsNotExist(err) {
+		log.Pf(0, "Load table %s index error %v", st.filePath, err)
+	}
+
 	err = st.index()
 	if err != nil {
 		st.file.Close()
 		return nil, err
 	}
+
+	err = st.writeIndex()
+	if err != nil {
+		log.Pf(0, "Write table %s index error %v", st.filePath, err)
+	}
 	return st, nil
 }
 
-func (st *SsTable) Get(key string) (string, error) {
-	st.lock.RLock()
-	defer st.lock.RUnlock()
+// blockFor returns the index block which holds key if the table has it:
+// the block of the last index key <= key. The first block starts at the
+// data offset so keys before the first index key fall into it, the last one
+// extends to the end of the file.
+func (st *SsTable) blockFor(key string) int {
+	block := st.sparse.search(key) - 1
+	if block < 0 {
+		return 0
+	}
+	return block
+}
 
-	if st.minKey != nil && key < *st.minKey {
-		return "", ErrNotFound
+// readBlock returns decoded nodes of the index block i, either from the
+// cache or by reading the block from the data file
+func (st *SsTable) readBlock(i int) ([]*LsmNode, error) {
+	start := st.sparse.offset(i)
+	if i == 0 {
+		start = st.dataOffset
+	}
+	end := st.fileSize
+	if i+1 < st.sparse.len() {
+		end = st.sparse.offset(i + 1)
 	}
 
-	if st.maxKey != nil && key > *st.maxKey {
-		return "", ErrNotFound
+	cacheKey := blockCacheKey{filePath: st.filePath, offset: start}
+	cached, ok := st.cache.get(cacheKey)
+	if ok && !st.cache.sample() {
+		return cached, nil
 	}
 
-	file, err := os.OpenFile(st.filePath, os.O_RDONLY, 0600)
+	nodes, err := st.decodeBlock(start, end)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer file.Close()
 
-	//st.log.Pf(0, "%s keys %d", st.filePath, len(st.keys))
-
-	offset := int64(0)
-	if len(st.keys) > 0 {
-		keyIndex := sort.SearchStrings(st.keys, key)
-		if keyIndex > 0 {
-			keyIndex--
+	if ok {
+		if !st.cache.verify(cacheKey, cached, nodes) {
+			st.log.Pf(0, "stale cached block %s offset %d", st.filePath, start)
 		}
+		return nodes, nil
+	}
 
-		offset = st.keyToOffset[st.keys[keyIndex]]
-		_, err = file.Seek(offset, os.SEEK_SET)
-		if err != nil {
-			return "", err
-		}
+	st.cache.put(cacheKey, nodes)
+	return nodes, nil
+}
+
+// decodeBlock reads and decodes the nodes in [start, end) of the data file,
+// the range is a single frame in compressed tables
+func (st *SsTable) decodeBlock(start int64, end int64) ([]*LsmNode, error) {
+	buf := make([]byte, end-start)
+	_, err := st.file.ReadAt(buf, start)
+	if err != nil {
+		return nil, err
 	}
 
-	for {
-		offset, err = file.Seek(0, os.SEEK_CUR)
+	if st.compression != CompressionNone {
+		buf, _, err = readBlockFrame(bytes.NewReader(buf), st.compression)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
+	}
 
-		//st.log.Pf(0, "lookup %s at %d for key %s", st.filePath, offset, key)
+	reader := bytes.NewReader(buf)
+	nodes := make([]*LsmNode, 0, st.keysPerIndex)
+	for reader.Len() > 0 {
 		node := new(LsmNode)
-		err = node.ReadFrom(file)
+		err = node.decode(reader, st.checksum)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return "", err
+			return nil, err
 		}
-		if node.key == key {
-			if node.deleted {
-				return "", ErrDeleted
-			}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
 
-			return node.value, nil
-		}
-		if node.key > key {
-			break
+// MayContain consults the table bloom filter without touching the file
+func (st *SsTable) MayContain(key string) bool {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	return st.bloom.mayContain(key)
+}
+
+func (st *SsTable) Get(key string) (string, error) {
+	node, err := st.getNode(key, time.Now().UnixNano())
+	if err != nil {
+		return "", err
+	}
+	return string(node.value), nil
+}
+
+// getNode returns the live node of key, deleted and expired values are
+// reported as ErrDeleted since they shadow older versions
+func (st *SsTable) getNode(key string, now int64) (*LsmNode, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	if st.minKey != nil && key < *st.minKey {
+		return nil, ErrNotFound
+	}
+
+	if st.maxKey != nil && key > *st.maxKey {
+		return nil, ErrNotFound
+	}
+
+	if st.sparse.len() == 0 {
+		return nil, ErrNotFound
+	}
+
+	nodes, err := st.readBlock(st.blockFor(key))
+	if err != nil {
+		return nil, err
+	}
+
+	i := sort.Search(len(nodes), func(i int) bool { return nodes[i].key >= key })
+	if i < len(nodes) && nodes[i].key == key {
+		if nodes[i].deleted || nodes[i].expired(now) {
+			return nil, ErrDeleted
 		}
+		return nodes[i], nil
 	}
 
-	return "", ErrNotFound
+	return nil, ErrNotFound
 }
 
 func (st *SsTable) Close() {
@@ -225,118 +601,7 @@ func (st *SsTable) Erase() {
 	st.file.Close()
 	st.log.Pf(0, "erase %s", st.filePath)
 	os.Remove(st.filePath)
+	os.Remove(ssTableIndexPath(st.filePath))
 	st.file = nil
 	st.filePath = ""
 }
-
-func (currSt *SsTable) Merge(prevSt *SsTable, tmpFilePath string) error {
-	prevSt.lock.RLock()
-	defer prevSt.lock.RUnlock()
-
-	currSt.lock.RLock()
-	defer currSt.lock.RUnlock()
-
-	var prevFile, currFile, tmpFile *os.File
-	var err error
-
-	defer func() {
-		if prevFile != nil {
-			prevFile.Close()
-		}
-		if currFile != nil {
-			currFile.Close()
-		}
-
-		if err != nil {
-			if tmpFile != nil {
-				tmpFile.Close()
-				os.Remove(tmpFilePath)
-			}
-		} else {
-			if tmpFile != nil {
-				tmpFile.Close()
-			}
-		}
-	}()
-
-	prevFile, err = os.OpenFile(prevSt.filePath, os.O_RDONLY, 0600)
-	if err != nil {
-		return err
-	}
-
-	currFile, err = os.OpenFile(currSt.filePath, os.O_RDONLY, 0600)
-	if err != nil {
-		return err
-	}
-
-	tmpFile, err = os.OpenFile(tmpFilePath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
-	if err != nil {
-		return err
-	}
-
-	var prevNode, currNode, newNode *LsmNode
-
-	for {
-		if prevNode == nil && prevFile != nil {
-			prevNode = new(LsmNode)
-			err = prevNode.ReadFrom(prevFile)
-			if err != nil {
-				if err != io.EOF {
-					return err
-				}
-				prevFile.Close()
-				prevFile = nil
-				prevNode = nil
-			}
-		}
-
-		if currNode == nil && currFile != nil {
-			currNode = new(LsmNode)
-			err = currNode.ReadFrom(currFile)
-			if err != nil {
-				if err != io.EOF {
-					return err
-				}
-				currFile.Close()
-				currFile = nil
-				currNode = nil
-			}
-		}
-
-		if currNode == nil && prevNode == nil {
-			break
-		}
-
-		if currNode != nil && prevNode == nil {
-			newNode = currNode
-			currNode = nil
-		} else if prevNode != nil && currNode == nil {
-			newNode = prevNode
-			prevNode = nil
-		} else {
-			if prevNode.key == currNode.key {
-				newNode = currNode
-				currNode = nil
-				prevNode = nil
-			} else if prevNode.key < currNode.key {
-				newNode = prevNode
-				prevNode = nil
-			} else {
-				newNode = currNode
-				currNode = nil
-			}
-		}
-
-		err = newNode.WriteTo(tmpFile)
-		if err != nil {
-			return err
-		}
-	}
-
-	err = tmpFile.Sync()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
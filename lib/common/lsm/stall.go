@@ -0,0 +1,161 @@
+package lsm
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Time a writer waits for a flush or merge while writes are stopped
+	defaultWriteStallTimeout = time.Second
+	// Memtable size relative to the compaction threshold at which writers
+	// queue because compaction can't keep up
+	defaultWriteStopFactor = 10
+	// Delay of every write while writes slow down
+	defaultWriteSlowdownDelay = time.Millisecond
+)
+
+// Writes slow down and stop as flushes and merges fall behind, like the
+// level 0 triggers of leveled engines. Past a slowdown trigger, the
+// memtable beyond writeSlowdownFactor times the compaction threshold or
+// writeSlowdownTables tables, every write is delayed by writeSlowdownDelay.
+// Past a stop trigger, writeStopFactor or writeStopTables, writers queue
+// until a flush or merge makes room and fail with ErrBusy once
+// writeStallTimeout passed without one so callers can back off instead of
+// piling up. Zero slowdown and table triggers are off.
+
+// Write states, see stallState
+const (
+	writeRunning = int32(0)
+	writeSlowed  = int32(1)
+	writeStopped = int32(2)
+)
+
+var writeStateNames = []string{"running", "slowed", "stopped"}
+
+// stallState returns the write state for the memtable and the table
+// count, caller must hold nodeMapLock
+func (lsm *Lsm) stallState() int32 {
+	tables := int(atomic.LoadInt32(&lsm.tables))
+	if lsm.memtableOver(lsm.writeStopFactor) || (lsm.writeStopTables > 0 && tables >= lsm.writeStopTables) {
+		return writeStopped
+	}
+	if (lsm.writeSlowdownFactor > 0 && lsm.memtableOver(lsm.writeSlowdownFactor)) ||
+		(lsm.writeSlowdownTables > 0 && tables >= lsm.writeSlowdownTables) {
+		return writeSlowed
+	}
+	return writeRunning
+}
+
+// tablesOver reports whether the table count reached a table trigger
+func (lsm *Lsm) tablesOver() bool {
+	tables := int(atomic.LoadInt32(&lsm.tables))
+	return (lsm.writeSlowdownTables > 0 && tables >= lsm.writeSlowdownTables) ||
+		(lsm.writeStopTables > 0 && tables >= lsm.writeStopTables)
+}
+
+// countTables caches the table count of the current version for the
+// table triggers
+func (lsm *Lsm) countTables() {
+	v := lsm.versions.acquire()
+	defer v.release()
+
+	atomic.StoreInt32(&lsm.tables, int32(len(v.tables)))
+}
+
+// requestCompaction asks the background loop to flush the memtable, a
+// request already pending covers this one
+func (lsm *Lsm) requestCompaction() {
+	select {
+	case lsm.compactChan <- true:
+	default:
+	}
+}
+
+// requestMerge asks the background loop to merge tables
+func (lsm *Lsm) requestMerge() {
+	select {
+	case lsm.mergeChan <- true:
+	default:
+	}
+}
+
+// unlockWrite releases nodeMapLock taken by a writer, it records the write
+// state and requests a flush if the memtable is full
+func (lsm *Lsm) unlockWrite() {
+	compact := lsm.shouldCompact(false)
+	atomic.StoreInt32(&lsm.writeState, lsm.stallState())
+	lsm.nodeMapLock.Unlock()
+	if compact {
+		lsm.requestCompaction()
+	}
+}
+
+// flushSignal returns a channel closed by the next flush or merge
+func (lsm *Lsm) flushSignal() <-chan struct{} {
+	lsm.flushedLock.Lock()
+	defer lsm.flushedLock.Unlock()
+
+	return lsm.flushed
+}
+
+// signalWritable updates the write state after a flush or merge and wakes
+// the queued writers, caller must hold nodeMapLock
+func (lsm *Lsm) signalWritable() {
+	lsm.countTables()
+	atomic.StoreInt32(&lsm.writeState, lsm.stallState())
+
+	lsm.flushedLock.Lock()
+	defer lsm.flushedLock.Unlock()
+
+	close(lsm.flushed)
+	lsm.flushed = make(chan struct{})
+}
+
+// waitWritable delays the writer while writes slow down and queues it
+// while they are stopped, it fails with ErrBusy if no flush or merge made
+// room within writeStallTimeout
+func (lsm *Lsm) waitWritable() error {
+	state := atomic.LoadInt32(&lsm.writeState)
+	if state == writeRunning {
+		return nil
+	}
+	lsm.requestCompaction()
+	if lsm.tablesOver() {
+		lsm.requestMerge()
+	}
+
+	if state == writeSlowed {
+		atomic.AddInt64(&lsm.writeSlowdowns, 1)
+		atomic.AddInt64(&lsm.slowdownNanos, int64(lsm.writeSlowdownDelay))
+		time.Sleep(lsm.writeSlowdownDelay)
+		return nil
+	}
+	if lsm.writeStallTimeout <= 0 {
+		return nil
+	}
+
+	atomic.AddInt64(&lsm.writeStalls, 1)
+	atomic.AddInt64(&lsm.stalledWriters, 1)
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&lsm.stalledWriters, -1)
+		atomic.AddInt64(&lsm.stallNanos, int64(time.Since(start)))
+	}()
+
+	timer := time.NewTimer(lsm.writeStallTimeout)
+	defer timer.Stop()
+	for {
+		flushed := lsm.flushSignal()
+		if atomic.LoadInt32(&lsm.writeState) != writeStopped {
+			return nil
+		}
+
+		select {
+		case <-flushed:
+		case <-timer.C:
+			atomic.AddInt64(&lsm.stallRejects, 1)
+			return ErrBusy
+		}
+	}
+}
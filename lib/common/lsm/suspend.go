@@ -0,0 +1,46 @@
+package lsm
+
+import (
+	"sync/atomic"
+)
+
+// Background work can be suspended without closing the engine, e.g. for a
+// checkpoint or backup copying the files or a maintenance window with
+// little I/O to spare. While suspended the background loop skips memtable
+// flushes and merges, explicit Flush, MajorCompact and CompactWith still
+// run. Writes keep going into the memtable, past the stop trigger they
+// queue and fail with ErrBusy like with a flush falling behind.
+
+// Suspend stops background flushes and merges, it returns once a flush or
+// merge pass in progress finished. A merge pass stops after its current
+// merge.
+func (lsm *Lsm) Suspend() error {
+	if atomic.SwapInt32(&lsm.suspended, 1) == 0 {
+		lsm.event(EventSuspend, 0, "background flushes and merges suspended")
+	}
+
+	// the loop receives between passes
+	select {
+	case lsm.suspendChan <- struct{}{}:
+		return nil
+	case <-lsm.syncStop:
+		return ErrClosed
+	}
+}
+
+// Resume restarts background flushes and merges and catches up with the
+// work skipped while suspended
+func (lsm *Lsm) Resume() {
+	if atomic.SwapInt32(&lsm.suspended, 0) == 0 {
+		return
+	}
+	lsm.event(EventResume, 0, "background flushes and merges resumed")
+
+	lsm.requestCompaction()
+	lsm.requestMerge()
+}
+
+// Suspended reports whether background flushes and merges are suspended
+func (lsm *Lsm) Suspended() bool {
+	return atomic.LoadInt32(&lsm.suspended) != 0
+}
@@ -0,0 +1,369 @@
+package lsm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+var (
+	ErrLsmNodeOutOfOrder = fmt.Errorf("Lsm node out of order")
+)
+
+// Offline inspection and repair of a storage directory which no engine has
+// open, the functions below only read the files they inspect.
+
+// CorruptionError reports the first unreadable node of a file, for
+// compressed tables offset is the one of the frame holding the node
+type CorruptionError struct {
+	Path   string
+	Offset int64
+	Err    error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("%s offset %d: %v", e.Path, e.Offset, e.Err)
+}
+
+// TableInfo describes a table file found by InspectTables
+type TableInfo struct {
+	Path        string
+	MinId       int64
+	MaxId       int64
+	Size        int64
+	Nodes       int64
+	MinKey      string
+	MaxKey      string
+	MaxVersion  uint64
+	Checksum    ChecksumType
+	Compression CompressionType
+	// Oldest, newest and mean write time of the nodes in unix nanoseconds
+	// and the nodes which carry one
+	MinWrittenAt  int64
+	MaxWrittenAt  int64
+	MeanWrittenAt int64
+	WrittenNodes  int64
+	// Listed in the manifest, other tables are leftovers removed on open
+	Live bool
+	// First corruption found, nil if every node is readable
+	Err error
+}
+
+// offsetReader counts bytes read from the underlying reader
+type offsetReader struct {
+	reader *bufio.Reader
+	offset int64
+}
+
+func (r *offsetReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+// ScanTable decodes every node of a table file in order verifying node
+// checksums and key order, fn may be nil. It stops at the first corrupt
+// node and returns a *CorruptionError with what was read before it.
+func ScanTable(filePath string, fn func(offset int64, c Change) error) (TableInfo, error) {
+	info := TableInfo{Path: filePath}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return info, err
+	}
+	info.Size = stat.Size()
+
+	checksum, compression, dataOffset, err := readFileHeader(file)
+	if err != nil {
+		return info, err
+	}
+	info.Checksum = checksum
+	info.Compression = compression
+
+	var reader io.Reader
+	var offset func() int64
+	if compression != CompressionNone {
+		br := newBlockReader(file, compression, dataOffset)
+		reader = br
+		offset = func() int64 {
+			if br.atFrameStart() {
+				return br.nextOffset()
+			}
+			return br.offset
+		}
+	} else {
+		or := &offsetReader{reader: bufio.NewReader(file), offset: dataOffset}
+		reader = or
+		offset = func() int64 { return or.offset }
+	}
+
+	var written writeTimes
+	for {
+		nodeOffset := offset()
+		n := new(LsmNode)
+		err = n.decode(reader, checksum)
+		if err == io.EOF {
+			return info, nil
+		}
+		if err == nil && info.Nodes > 0 && n.key <= info.MaxKey {
+			err = ErrLsmNodeOutOfOrder
+		}
+		if err != nil {
+			return info, &CorruptionError{Path: filePath, Offset: nodeOffset, Err: err}
+		}
+
+		if info.Nodes == 0 {
+			info.MinKey = n.key
+		}
+		info.MaxKey = n.key
+		info.Nodes++
+		if n.version > info.MaxVersion {
+			info.MaxVersion = n.version
+		}
+		written.add(n.writtenAt)
+		info.MinWrittenAt = written.min
+		info.MaxWrittenAt = written.max
+		info.MeanWrittenAt = written.mean
+		info.WrittenNodes = written.nodes
+
+		if fn != nil {
+			err = fn(nodeOffset, nodeToChange(n))
+			if err != nil {
+				return info, err
+			}
+		}
+	}
+}
+
+// InspectTables scans every table file of rootPath in id order, a table
+// which can't be read completely has Err set
+func InspectTables(rootPath string) ([]TableInfo, error) {
+	m, err := readManifest(rootPath)
+	if err != nil {
+		return nil, err
+	}
+	live := make(map[string]bool)
+	if m != nil {
+		for _, name := range m.Tables {
+			live[name] = true
+		}
+	}
+
+	files, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]TableInfo, 0)
+	for _, file := range files {
+		match := ssTableFileNamePattern.FindStringSubmatch(file.Name())
+		if file.IsDir() || match == nil {
+			continue
+		}
+
+		minId, _ := strconv.ParseInt(match[1], 10, 64)
+		maxId := minId
+		if match[2] != "" {
+			maxId, _ = strconv.ParseInt(match[2], 10, 64)
+		}
+
+		info, err := ScanTable(filepath.Join(rootPath, file.Name()), nil)
+		if err != nil {
+			info.Err = err
+		}
+		info.MinId = minId
+		info.MaxId = maxId
+		info.Live = m == nil || live[file.Name()]
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].MaxId < infos[j].MaxId })
+	return infos, nil
+}
+
+// LogFiles returns the paths of the legacy log and the log segments of
+// rootPath in replay order
+func LogFiles(rootPath string) ([]string, error) {
+	seqs, err := listWalSegments(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0, len(seqs)+1)
+	legacyPath := filepath.Join(rootPath, legacyLogFileName)
+	if _, err := os.Stat(legacyPath); err == nil {
+		paths = append(paths, legacyPath)
+	}
+	for _, seq := range seqs {
+		paths = append(paths, filepath.Join(rootPath, "wal_"+strconv.FormatInt(seq, 10)+".log"))
+	}
+	return paths, nil
+}
+
+// ScanLog decodes every logged write of a log file in order with the nodes
+// of batch records expanded, fn may be nil. It returns the number of
+// records read before the first corrupt one, a torn tail is reported as a
+// *CorruptionError of io.ErrUnexpectedEOF.
+func ScanLog(filePath string, fn func(offset int64, c Change) error) (int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	checksum, _, dataOffset, err := readFileHeader(file)
+	if err != nil {
+		return 0, err
+	}
+
+	reader := &offsetReader{reader: bufio.NewReader(file), offset: dataOffset}
+	records := int64(0)
+	for {
+		offset := reader.offset
+		n := new(LsmNode)
+		err = n.decode(reader, checksum)
+		if err == io.EOF {
+			return records, nil
+		}
+
+		nodes := []*LsmNode{n}
+		if err == nil && n.batch {
+			nodes, err = decodeBatch(n, checksum)
+		}
+		if err != nil {
+			return records, &CorruptionError{Path: filePath, Offset: offset, Err: err}
+		}
+		records++
+
+		if fn == nil {
+			continue
+		}
+		for _, n := range nodes {
+			err = fn(offset, nodeToChange(n))
+			if err != nil {
+				return records, err
+			}
+		}
+	}
+}
+
+// SalvageReport describes the result of SalvageLog
+type SalvageReport struct {
+	// Records copied and the writes they hold
+	Records int64
+	Nodes   int64
+	// Unreadable regions skipped and their total size
+	Regions      int64
+	SkippedBytes int64
+}
+
+// nodeFits reports whether the key and value lengths of the node header at
+// the start of data fit in data, garbage lengths would allocate up to 8GB
+func nodeFits(data []byte) bool {
+	if len(data) < 16 {
+		return false
+	}
+	length := int64(binary.LittleEndian.Uint32(data[8:])) + int64(binary.LittleEndian.Uint32(data[12:]))
+	return length <= int64(len(data)-16)
+}
+
+// SalvageLog copies the readable records of a damaged log file into a new
+// log at dstPath. On a corrupt record it skips forward to the next node
+// magic which decodes, so writes after a damaged region are kept. A batch
+// record is kept or skipped as a whole.
+func SalvageLog(srcPath string, dstPath string) (SalvageReport, error) {
+	var report SalvageReport
+	file, err := os.Open(srcPath)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+
+	checksum, _, _, err := readFileHeader(file)
+	if err != nil {
+		return report, err
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return report, err
+	}
+
+	out, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return report, err
+	}
+	writer := bufio.NewWriter(out)
+	err = writeFileHeader(writer, checksum, CompressionNone)
+	if err != nil {
+		out.Close()
+		os.Remove(dstPath)
+		return report, err
+	}
+
+	magic := make([]byte, 4)
+	binary.LittleEndian.PutUint32(magic, LsmNodeMagic)
+
+	skipping := false
+	for pos := 0; pos < len(data); {
+		reader := bytes.NewReader(data[pos:])
+		n := new(LsmNode)
+		err = ErrLsmNodeBadMagic
+		if nodeFits(data[pos:]) {
+			err = n.decode(reader, checksum)
+		}
+		nodes := []*LsmNode{n}
+		if err == nil && n.batch {
+			nodes, err = decodeBatch(n, checksum)
+		}
+
+		if err == nil {
+			length := len(data) - pos - reader.Len()
+			_, err = writer.Write(data[pos : pos+length])
+			if err != nil {
+				out.Close()
+				os.Remove(dstPath)
+				return report, err
+			}
+			report.Records++
+			report.Nodes += int64(len(nodes))
+			pos += length
+			skipping = false
+			continue
+		}
+
+		if !skipping {
+			report.Regions++
+			skipping = true
+		}
+		next := bytes.Index(data[pos+1:], magic)
+		if next < 0 {
+			report.SkippedBytes += int64(len(data) - pos)
+			break
+		}
+		report.SkippedBytes += int64(next + 1)
+		pos += next + 1
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(dstPath)
+		return report, err
+	}
+	return report, syncDir(filepath.Dir(dstPath))
+}
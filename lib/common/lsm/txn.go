@@ -0,0 +1,245 @@
+package lsm
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// Operations of a transaction
+const (
+	TxnSet = iota
+	TxnGet
+	TxnDelete
+)
+
+// Compare is a condition of a transaction on the live value of Key
+type Compare struct {
+	Key string
+	// The live value must have Version, zero for a key without live value
+	CompareVersion bool
+	Version        uint64
+	// The live value must equal Value
+	CompareValue bool
+	Value        []byte
+}
+
+type TxnOp struct {
+	Op    int
+	Key   string
+	Value []byte
+	// Expiration time of a set in unix nanoseconds, zero means never
+	ExpiresAt int64
+}
+
+// Txn runs Success if all Compares hold and Failure otherwise, the
+// compares and the operations happen atomically
+type Txn struct {
+	Compares   []Compare
+	Success    []TxnOp
+	Failure    []TxnOp
+	Durability Durability
+	// Version of the first write, the following writes get the next ones,
+	// zero means after the engine version. See WriteOptions.Version.
+	Version uint64
+}
+
+// TxnOpResult is the value and version a get read or the version a set
+// wrote, Err is ErrNotFound for a get of a key without live value
+type TxnOpResult struct {
+	Key     string
+	Value   []byte
+	Version uint64
+	Err     error
+}
+
+type TxnResult struct {
+	Succeeded bool
+	Results   []TxnOpResult
+}
+
+func (c *Compare) holds(current *LsmNode) bool {
+	if c.CompareVersion {
+		version := uint64(0)
+		if current != nil {
+			version = current.version
+		}
+		if version != c.Version {
+			return false
+		}
+	}
+	if c.CompareValue && (current == nil || !bytes.Equal(current.value, c.Value)) {
+		return false
+	}
+	return true
+}
+
+func (lsm *Lsm) checkTxnOps(ops []TxnOp) error {
+	for _, op := range ops {
+		if op.Key == "" {
+			return ErrEmptyKey
+		}
+		switch op.Op {
+		case TxnSet:
+			if len(op.Value) == 0 {
+				return ErrEmptyValue
+			}
+			if int64(len(op.Value)) > atomic.LoadInt64(&lsm.maxValueSize) {
+				return ErrValueTooLarge
+			}
+		case TxnGet, TxnDelete:
+		default:
+			return ErrUnknownTxnOp
+		}
+	}
+	return nil
+}
+
+// Txn evaluates the compares and runs the matching operations atomically,
+// gets observe the writes of earlier operations. The writes are logged as a
+// single batch record, unlike writes of a batch they become visible together
+// and a crash never leaves a part of them.
+func (lsm *Lsm) Txn(txn *Txn) (*TxnResult, error) {
+	for _, c := range txn.Compares {
+		if c.Key == "" {
+			return nil, ErrEmptyKey
+		}
+	}
+	err := lsm.checkTxnOps(txn.Success)
+	if err == nil {
+		err = lsm.checkTxnOps(txn.Failure)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result, target, err := lsm.txn(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	err = lsm.waitLog(target)
+	if err != nil {
+		return nil, lsm.translateError(err)
+	}
+	return result, nil
+}
+
+// txn logs and applies the operations of a checked transaction, it returns
+// the log position to wait for
+func (lsm *Lsm) txn(txn *Txn) (*TxnResult, int64, error) {
+	err := lsm.waitWritable()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lsm.nodeMapLock.Lock()
+	defer lsm.unlockWrite()
+
+	err = lsm.checkWritable()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := &TxnResult{Succeeded: true}
+	for i := range txn.Compares {
+		current, err := lsm.current(txn.Compares[i].Key)
+		if err != nil {
+			return nil, 0, lsm.translateError(err)
+		}
+		if !txn.Compares[i].holds(current) {
+			result.Succeeded = false
+			break
+		}
+	}
+
+	ops := txn.Success
+	if !result.Succeeded {
+		ops = txn.Failure
+	}
+
+	// writes of the transaction shadow the engine for later operations
+	pending := make(map[string]*LsmNode)
+	now := lsm.now()
+	live := func(key string) (*LsmNode, error) {
+		if n, ok := pending[key]; ok {
+			if n.deleted || n.expired(now) {
+				return nil, nil
+			}
+			return n, nil
+		}
+		return lsm.current(key)
+	}
+
+	version := lsm.version
+	if txn.Version != 0 {
+		version = txn.Version - 1
+	}
+	nodes := make([]*LsmNode, 0, len(ops))
+	counts := make(map[string]int64)
+	result.Results = make([]TxnOpResult, len(ops))
+	for i, op := range ops {
+		res := &result.Results[i]
+		res.Key = op.Key
+
+		current, err := live(op.Key)
+		if err != nil {
+			return nil, 0, lsm.translateError(err)
+		}
+
+		switch op.Op {
+		case TxnGet:
+			if current == nil {
+				res.Err = ErrNotFound
+			} else {
+				res.Value = current.value
+				res.Version = current.version
+			}
+			continue
+		case TxnSet:
+			n := newLsmNode(op.Key, op.Value)
+			n.expiresAt = op.ExpiresAt
+			version++
+			n.version = version
+			n.writtenAt = now
+			res.Version = n.version
+			nodes = append(nodes, n)
+			pending[op.Key] = n
+			if current == nil {
+				counts[op.Key]++
+			}
+		case TxnDelete:
+			n := newLsmNode(op.Key, nil)
+			n.deleted = true
+			version++
+			n.version = version
+			n.writtenAt = now
+			nodes = append(nodes, n)
+			pending[op.Key] = n
+			if current != nil {
+				counts[op.Key]--
+			}
+		}
+	}
+
+	if len(nodes) == 0 {
+		return result, 0, nil
+	}
+
+	err = lsm.appendLogBatch(nodes)
+	if err != nil {
+		return nil, 0, lsm.translateError(err)
+	}
+	target := lsm.commitLog(txn.Durability)
+	lsm.advanceVersion(version)
+	for _, n := range nodes {
+		lsm.memtable.put(n)
+	}
+	for key, delta := range counts {
+		if delta != 0 && lsm.counters.matches(key) {
+			lsm.counters.add(key, delta)
+		}
+	}
+	lsm.notify(nodes...)
+
+	return result, target, nil
+}
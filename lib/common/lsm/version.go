@@ -0,0 +1,365 @@
+package lsm
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Test seam called at the points of a manifest write with the file and the
+// bytes written there, a test panics in it to stop the write as if the
+// process died. It's nil outside of tests.
+var manifestCrash func(point string, file *os.File, data []byte)
+
+func manifestCrashPoint(point string, file *os.File, data []byte) {
+	if manifestCrash != nil {
+		manifestCrash(point, file, data)
+	}
+}
+
+const (
+	manifestFileName    = "lsm_manifest.log"
+	manifestTmpFileName = "lsm_manifest.log.tmp"
+	// Manifest written before edits were logged, read if there is no log
+	legacyManifestFileName   = "lsm_manifest.json"
+	manifestRecordHeaderSize = 8
+	// Edits after which the manifest is rewritten as a single snapshot
+	manifestMaxEdits = 1000
+)
+
+// version is an immutable set of tables ordered from newest to oldest.
+// Lookups, scans and snapshots pin the current version and see the same
+// tables until they release it, no matter which flushes and merges commit
+// meanwhile. Tables removed by a merge are erased once no pinned version
+// holds them.
+type version struct {
+	number uint64
+	tables []*SsTable
+	// Pins of the version, the version set holds one while it's current
+	refs int32
+}
+
+func newVersion(number uint64, tables []*SsTable) *version {
+	v := &version{number: number, tables: append([]*SsTable(nil), tables...), refs: 1}
+	sort.Slice(v.tables, func(i, j int) bool { return v.tables[i].maxId > v.tables[j].maxId })
+	for _, st := range v.tables {
+		atomic.AddInt32(&st.refs, 1)
+	}
+	return v
+}
+
+// ascending returns the tables ordered from oldest to newest
+func (v *version) ascending() []*SsTable {
+	tables := make([]*SsTable, len(v.tables))
+	for i, st := range v.tables {
+		tables[len(tables)-1-i] = st
+	}
+	return tables
+}
+
+func (v *version) release() {
+	if atomic.AddInt32(&v.refs, -1) != 0 {
+		return
+	}
+
+	for _, st := range v.tables {
+		st.unref()
+	}
+}
+
+// versionEdit describes how a flush or a merge changes the current version
+type versionEdit struct {
+	added   []*SsTable
+	removed []*SsTable
+}
+
+// manifest lists the tables of a version, tables of rootPath missing from
+// it are leftovers of interrupted flushes and merges
+type manifest struct {
+	Number uint64   `json:"number"`
+	Tables []string `json:"tables"`
+}
+
+// manifestRecord is a record of the manifest log, either a snapshot of the
+// tables of a version or the edit from the previous version. The log starts
+// with a snapshot and every record is framed as length(4) crc32c(4) json.
+type manifestRecord struct {
+	Number   uint64   `json:"number"`
+	Snapshot bool     `json:"snapshot,omitempty"`
+	Tables   []string `json:"tables,omitempty"`
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+}
+
+// versionSet holds the current version and logs its edits in the manifest
+type versionSet struct {
+	rootPath string
+	lock     sync.Mutex
+	current  *version
+
+	// Manifest log appended to, its size up to the last complete record
+	// and the edits logged since its snapshot. A nil file makes the next
+	// edit rewrite the manifest.
+	file  *os.File
+	size  int64
+	edits int
+}
+
+func newVersionSet(rootPath string) *versionSet {
+	return &versionSet{rootPath: rootPath, current: newVersion(0, nil)}
+}
+
+// acquire pins the current version, the caller must release it
+func (vs *versionSet) acquire() *version {
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+
+	v := vs.current
+	atomic.AddInt32(&v.refs, 1)
+	return v
+}
+
+// apply makes the edit durable in the manifest and installs the new version,
+// the removed tables are erased when the last version holding them is
+// released. Nothing changes if the manifest can't be written.
+func (vs *versionSet) apply(edit *versionEdit) error {
+	vs.lock.Lock()
+	old := vs.current
+
+	removed := make(map[*SsTable]bool)
+	for _, st := range edit.removed {
+		removed[st] = true
+	}
+	tables := append([]*SsTable(nil), edit.added...)
+	for _, st := range old.tables {
+		if !removed[st] {
+			tables = append(tables, st)
+		}
+	}
+
+	v := newVersion(old.number+1, tables)
+	err := vs.logEdit(v, edit)
+	if err != nil {
+		vs.lock.Unlock()
+		v.refs = 0
+		for _, st := range v.tables {
+			atomic.AddInt32(&st.refs, -1)
+		}
+		return err
+	}
+
+	for _, st := range edit.removed {
+		atomic.StoreInt32(&st.obsolete, 1)
+	}
+	vs.current = v
+	vs.lock.Unlock()
+
+	old.release()
+	return nil
+}
+
+// logEdit appends the edit making v to the manifest, a failed append is
+// truncated so the manifest ends with the last complete record
+func (vs *versionSet) logEdit(v *version, edit *versionEdit) error {
+	if vs.file == nil || vs.edits >= manifestMaxEdits {
+		return vs.rewrite(v)
+	}
+
+	record := manifestRecord{Number: v.number, Added: tableNames(edit.added), Removed: tableNames(edit.removed)}
+	n, err := appendManifestRecord(vs.file, &record)
+	if err != nil {
+		// with the truncate failing the record may survive a crash, the
+		// manifest is rewritten by the next edit
+		if vs.file.Truncate(vs.size) != nil || vs.file.Sync() != nil {
+			vs.closeManifest()
+		}
+		return err
+	}
+	vs.size += n
+	vs.edits++
+	return nil
+}
+
+// rewrite replaces the manifest by a snapshot of v and appends later edits
+// to it
+func (vs *versionSet) rewrite(v *version) error {
+	size, err := writeManifest(vs.rootPath, v)
+	if err != nil {
+		return err
+	}
+	manifestCrashPoint("rewritten", nil, nil)
+
+	file, err := os.OpenFile(filepath.Join(vs.rootPath, manifestFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	os.Remove(filepath.Join(vs.rootPath, legacyManifestFileName))
+
+	vs.closeManifest()
+	vs.file = file
+	vs.size = size
+	vs.edits = 0
+	return nil
+}
+
+func (vs *versionSet) closeManifest() {
+	if vs.file != nil {
+		vs.file.Close()
+		vs.file = nil
+	}
+}
+
+func tableNames(tables []*SsTable) []string {
+	names := make([]string, 0, len(tables))
+	for _, st := range tables {
+		names = append(names, filepath.Base(st.filePath))
+	}
+	return names
+}
+
+// appendManifestRecord writes and syncs a framed record, it returns the
+// record size
+func appendManifestRecord(file *os.File, record *manifestRecord) (int64, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+
+	data := make([]byte, manifestRecordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(data[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(data[4:], crc32.Checksum(payload, crc32cTable))
+	copy(data[manifestRecordHeaderSize:], payload)
+
+	manifestCrashPoint("append", file, data)
+	_, err = file.Write(data)
+	if err != nil {
+		return 0, err
+	}
+	manifestCrashPoint("sync", file, data)
+	err = file.Sync()
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// writeManifest atomically replaces the manifest of dir by a snapshot of v,
+// it returns the manifest size
+func writeManifest(dir string, v *version) (int64, error) {
+	record := manifestRecord{Number: v.number, Snapshot: true, Tables: tableNames(v.ascending())}
+
+	tmpPath := filepath.Join(dir, manifestTmpFileName)
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	size, err := appendManifestRecord(file, &record)
+	file.Close()
+	if err == nil {
+		manifestCrashPoint("rename", nil, nil)
+		err = os.Rename(tmpPath, filepath.Join(dir, manifestFileName))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return size, syncDir(dir)
+}
+
+// readManifest replays the manifest log of rootPath up to the last complete
+// record. Only the last record may be torn or damaged, its edit was never
+// applied, a damaged record followed by others is ErrCorrupted. It returns
+// nil if rootPath has no manifest, such storage was written before
+// manifests existed.
+func readManifest(rootPath string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(rootPath, manifestFileName))
+	if os.IsNotExist(err) {
+		return readLegacyManifest(rootPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var m *manifest
+	for len(data) >= manifestRecordHeaderSize {
+		length := int64(binary.LittleEndian.Uint32(data[0:]))
+		if length > int64(len(data)-manifestRecordHeaderSize) {
+			// the record runs past the end of the file
+			break
+		}
+		payload := data[manifestRecordHeaderSize : manifestRecordHeaderSize+length]
+		crc := binary.LittleEndian.Uint32(data[4:])
+		data = data[manifestRecordHeaderSize+length:]
+		if crc != crc32.Checksum(payload, crc32cTable) {
+			if len(data) != 0 {
+				return nil, ErrCorrupted
+			}
+			break
+		}
+
+		var record manifestRecord
+		err = json.Unmarshal(payload, &record)
+		if err != nil {
+			return nil, ErrCorrupted
+		}
+
+		if m == nil {
+			if !record.Snapshot {
+				return nil, ErrCorrupted
+			}
+			m = &manifest{Number: record.Number, Tables: record.Tables}
+			continue
+		}
+		if record.Snapshot || record.Number != m.Number+1 {
+			return nil, ErrCorrupted
+		}
+		m.apply(&record)
+	}
+
+	if m == nil {
+		return nil, ErrCorrupted
+	}
+	return m, nil
+}
+
+// apply adds and removes the tables of an edit record
+func (m *manifest) apply(record *manifestRecord) {
+	removed := make(map[string]bool)
+	for _, name := range record.Removed {
+		removed[name] = true
+	}
+
+	tables := make([]string, 0, len(m.Tables)+len(record.Added))
+	for _, name := range m.Tables {
+		if !removed[name] {
+			tables = append(tables, name)
+		}
+	}
+	m.Tables = append(tables, record.Added...)
+	m.Number = record.Number
+}
+
+// readLegacyManifest reads the json manifest written before edits were
+// logged
+func readLegacyManifest(rootPath string) (*manifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(rootPath, legacyManifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var m manifest
+	err = json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, ErrCorrupted
+	}
+	return &m, nil
+}
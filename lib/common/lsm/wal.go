@@ -0,0 +1,482 @@
+package lsm
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	walFileNamePattern = regexp.MustCompile(`^wal\_([0-9]+)\.log$`)
+)
+
+const (
+	// Log written before segmentation, it is replayed as the oldest segment
+	legacyLogFileName     = "lsm.log"
+	defaultWalSegmentSize = 64 * 1024 * 1024
+)
+
+// The write ahead log is a sequence of segments wal_<seq>.log, writes go to
+// the newest segment. A compaction switches writes to a new segment before
+// flushing the memtable and deletes older segments only once the table is
+// durable, so a crash at any point leaves every acknowledged write either
+// in a table or in a segment replayed on open.
+
+func (lsm *Lsm) getWalSegmentPath(seq int64) string {
+	return path.Join(lsm.rootPath, "wal_"+strconv.FormatInt(seq, 10)+".log")
+}
+
+// listWalSegments returns sequence numbers of log segments in ascending order
+func listWalSegments(rootPath string) ([]int64, error) {
+	files, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := make([]int64, 0)
+	for _, file := range files {
+		if file.IsDir() {
+			continue
+		}
+
+		match := walFileNamePattern.FindStringSubmatch(file.Name())
+		if match == nil {
+			continue
+		}
+
+		seq, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// walBytes returns the size of the legacy log and all segments
+func walBytes(rootPath string) int64 {
+	files, err := ioutil.ReadDir(rootPath)
+	if err != nil {
+		return 0
+	}
+
+	var size int64
+	for _, file := range files {
+		if !file.IsDir() && (file.Name() == legacyLogFileName || walFileNamePattern.MatchString(file.Name())) {
+			size += file.Size()
+		}
+	}
+	return size
+}
+
+// hasLog reports whether rootPath holds a log, legacy or segmented
+func hasLog(rootPath string) (bool, error) {
+	seqs, err := listWalSegments(rootPath)
+	if err != nil {
+		return false, err
+	}
+	if len(seqs) > 0 {
+		return true, nil
+	}
+
+	_, err = os.Stat(filepath.Join(rootPath, legacyLogFileName))
+	if err == nil {
+		return true, nil
+	}
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// rotateLog switches writes to a new log segment, caller must hold
+// nodeMapLock
+func (lsm *Lsm) rotateLog() error {
+	seq := lsm.logSeq + 1
+	file, err := os.OpenFile(lsm.getWalSegmentPath(seq), os.O_APPEND|os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileHeader(file, lsm.checksum, CompressionNone)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = syncDir(lsm.rootPath)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(lsm.getWalSegmentPath(seq))
+		return err
+	}
+
+	// writes not yet synced by a group commit become durable with the
+	// sealed segment
+	lsm.walLock.Lock()
+	defer lsm.walLock.Unlock()
+	if lsm.logFile != nil {
+		written := atomic.LoadInt64(&lsm.logWritten)
+		err = lsm.logFile.Sync()
+		if err != nil {
+			file.Close()
+			os.Remove(lsm.getWalSegmentPath(seq))
+			return err
+		}
+		lsm.markSynced(written)
+		lsm.logFile.Close()
+	}
+	lsm.logFile = file
+	lsm.logSeq = seq
+	lsm.logSize = fileHeaderSize
+	return nil
+}
+
+// removeLogSegments deletes segments up to seq and the legacy log, their
+// content must already be durable in tables
+func (lsm *Lsm) removeLogSegments(seq int64) error {
+	seqs, err := listWalSegments(lsm.rootPath)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range seqs {
+		if s > seq {
+			break
+		}
+		err = os.Remove(lsm.getWalSegmentPath(s))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(filepath.Join(lsm.rootPath, legacyLogFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// appendLog writes a node to the current segment without syncing it, caller
+// must hold nodeMapLock
+func (lsm *Lsm) appendLog(n *LsmNode) error {
+	err := n.encode(lsm.logFile, lsm.checksum)
+	if err != nil {
+		return err
+	}
+	lsm.coalescer.logged(n.key)
+	size := n.size(lsm.checksum)
+	lsm.logSize += size
+	atomic.AddInt64(&lsm.logWritten, size)
+	return nil
+}
+
+// appendLogNodes writes nodes to the current segment with a single write,
+// caller must hold nodeMapLock
+func (lsm *Lsm) appendLogNodes(nodes []*LsmNode) error {
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		err := n.encode(&buf, lsm.checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := lsm.logFile.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		lsm.coalescer.logged(n.key)
+	}
+	lsm.logSize += int64(buf.Len())
+	atomic.AddInt64(&lsm.logWritten, int64(buf.Len()))
+	return nil
+}
+
+// appendLogBatch writes nodes as a single batch record so a torn write never
+// replays a part of them, caller must hold nodeMapLock
+func (lsm *Lsm) appendLogBatch(nodes []*LsmNode) error {
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		err := n.encode(&buf, lsm.checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	batch := newLsmNode("", buf.Bytes())
+	batch.batch = true
+	err := lsm.appendLog(batch)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		lsm.coalescer.logged(n.key)
+	}
+	return nil
+}
+
+// decodeBatch returns the nodes of a batch record
+func decodeBatch(batch *LsmNode, checksum ChecksumType) ([]*LsmNode, error) {
+	reader := bytes.NewReader(batch.value)
+	nodes := make([]*LsmNode, 0)
+	for reader.Len() > 0 {
+		n := new(LsmNode)
+		err := n.decode(reader, checksum)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// commitLog ends the appends of a write and starts a new segment once the
+// current one is full. It returns the log position the writer passes to
+// waitLog after releasing nodeMapLock, zero if the write doesn't wait for
+// a sync. Caller must hold nodeMapLock.
+func (lsm *Lsm) commitLog(durability Durability) int64 {
+	target := atomic.LoadInt64(&lsm.logWritten)
+	if lsm.logSize >= lsm.walSegmentSize {
+		err := lsm.rotateLog()
+		if err != nil {
+			// the write is synced by the next sync of the full segment
+			lsm.log.Pf(0, "rotate log error %v", err)
+			lsm.event(EventError, 0, "rotate log error %v", err)
+		}
+	}
+
+	switch durability {
+	case DurabilityBatched:
+		lsm.syncLock.Lock()
+		if target > lsm.logBatched {
+			lsm.logBatched = target
+		}
+		lsm.syncLock.Unlock()
+		return 0
+	case DurabilityNone:
+		return 0
+	default:
+		return target
+	}
+}
+
+// markSynced records the log position known to be durable
+func (lsm *Lsm) markSynced(position int64) {
+	lsm.syncLock.Lock()
+	defer lsm.syncLock.Unlock()
+
+	if position > lsm.logSynced {
+		lsm.logSynced = position
+	}
+	lsm.syncCond.Broadcast()
+}
+
+// waitLog returns once the log is durable up to target. One waiter syncs
+// the log while writers arriving meanwhile wait for the next sync, so
+// concurrent writes share a sync. Caller must not hold nodeMapLock.
+func (lsm *Lsm) waitLog(target int64) error {
+	lsm.syncLock.Lock()
+	defer lsm.syncLock.Unlock()
+
+	for lsm.logSynced < target {
+		if lsm.syncing {
+			lsm.syncCond.Wait()
+			continue
+		}
+
+		lsm.syncing = true
+		lsm.syncLock.Unlock()
+		position, err := lsm.syncLogFile()
+		lsm.syncLock.Lock()
+		lsm.syncing = false
+		if err == nil && position > lsm.logSynced {
+			lsm.logSynced = position
+		}
+		lsm.syncCond.Broadcast()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncLogFile syncs the current segment and returns the log position it
+// made durable, segments sealed earlier were synced when rotated
+func (lsm *Lsm) syncLogFile() (int64, error) {
+	lsm.walLock.Lock()
+	defer lsm.walLock.Unlock()
+
+	if lsm.logFile == nil {
+		return 0, ErrClosed
+	}
+	position := atomic.LoadInt64(&lsm.logWritten)
+	err := lsm.logFile.Sync()
+	if err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&lsm.logSyncs, 1)
+	return position, nil
+}
+
+// closeLog syncs and closes the current segment, caller must hold
+// nodeMapLock
+func (lsm *Lsm) closeLog() {
+	lsm.walLock.Lock()
+	defer lsm.walLock.Unlock()
+
+	written := atomic.LoadInt64(&lsm.logWritten)
+	err := lsm.logFile.Sync()
+	if err != nil {
+		lsm.log.Pf(0, "sync log error %v", err)
+	} else {
+		lsm.markSynced(written)
+	}
+	lsm.logFile.Close()
+	lsm.logFile = nil
+}
+
+// syncBatched syncs writes of batched durability every sync interval until
+// the engine stops
+func (lsm *Lsm) syncBatched() {
+	defer lsm.wg.Done()
+
+	ticker := time.NewTicker(lsm.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-lsm.syncStop:
+			return
+		}
+
+		lsm.syncLock.Lock()
+		target := lsm.logBatched
+		lsm.syncLock.Unlock()
+
+		err := lsm.waitLog(target)
+		if err != nil {
+			lsm.log.Pf(0, "batched log sync error %v", err)
+		}
+	}
+}
+
+// replayLog reads a log file into the memtable adjusting prefix counters, a
+// partially written node at the end of the newest segment belongs to a write
+// which was never acknowledged and is ignored. The nodes of a batch record
+// are replayed together.
+func (lsm *Lsm) replayLog(filePath string, newest bool) (int64, error) {
+	logFile, err := os.OpenFile(filePath, os.O_RDONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer logFile.Close()
+
+	checksum, _, _, err := readFileHeader(logFile)
+	if err != nil {
+		return 0, err
+	}
+
+	records := int64(0)
+	for {
+		n := new(LsmNode)
+		err := n.decode(logFile, checksum)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF && newest {
+				lsm.log.Pf(0, "log %s torn tail ignored", filePath)
+				lsm.event(EventRecovery, 0, "log %s torn tail ignored", filePath)
+				break
+			}
+			return records, err
+		}
+
+		nodes := []*LsmNode{n}
+		if n.batch {
+			nodes, err = decodeBatch(n, checksum)
+			if err != nil {
+				return records, err
+			}
+		}
+
+		for _, n := range nodes {
+			err = lsm.replayNode(n)
+			if err != nil {
+				return records, err
+			}
+		}
+		records++
+	}
+	return records, nil
+}
+
+// replayNode applies a logged node to the memtable and prefix counters
+func (lsm *Lsm) replayNode(n *LsmNode) error {
+	if lsm.counters.matches(n.key) {
+		existed, err := lsm.exists(n.key)
+		if err != nil {
+			return err
+		}
+		if existed && n.deleted {
+			lsm.counters.add(n.key, -1)
+		} else if !existed && !n.deleted {
+			lsm.counters.add(n.key, 1)
+		}
+	}
+
+	lsm.memtable.put(n)
+	if n.version > lsm.version {
+		lsm.version = n.version
+	}
+	return nil
+}
+
+// restoreFromLog replays the legacy log and all segments in order and
+// checkpoints the result into a table
+func (lsm *Lsm) restoreFromLog() error {
+	legacyPath := filepath.Join(lsm.rootPath, legacyLogFileName)
+	seqs, err := listWalSegments(lsm.rootPath)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	records, err := lsm.replayLog(legacyPath, len(seqs) == 0)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i, seq := range seqs {
+		segmentRecords, err := lsm.replayLog(lsm.getWalSegmentPath(seq), i == len(seqs)-1)
+		records += segmentRecords
+		if err != nil {
+			return err
+		}
+		lsm.logSeq = seq
+	}
+	lsm.event(EventRecovery, time.Since(start), "replayed %d records of %d log segments, memtable nodes %d", records, len(seqs), lsm.memtable.len())
+
+	return lsm.compact(true)
+}
@@ -0,0 +1,186 @@
+package lsm
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	accessProfileFileName    = "lsm_access_profile.json"
+	accessProfileTmpFileName = "lsm_access_profile.json.tmp"
+	// Interval between saves of the access profile
+	accessProfileIntervalMs = 60 * 1000
+)
+
+// accessProfile lists the blocks held by the block cache from the most to
+// the least recently used, it is a hint and may name tables which no
+// longer exist
+type accessProfile struct {
+	Blocks []profileBlock `json:"blocks"`
+}
+
+type profileBlock struct {
+	// File name of the table and the offset of the block in it
+	Table  string `json:"table"`
+	Offset int64  `json:"offset"`
+}
+
+// WarmupStats describes the result of Warmup
+type WarmupStats struct {
+	// Tables whose bloom filter and index are resident and the memory held
+	// by their indexes
+	Tables     int
+	IndexBytes int64
+	// Profiled blocks read into the cache, profiled blocks of tables which
+	// no longer exist and the cache size afterwards
+	Blocks    int64
+	Skipped   int64
+	CacheSize int64
+}
+
+// saveAccessProfile writes the blocks of the cache into the access profile
+func (lsm *Lsm) saveAccessProfile() error {
+	if lsm.cache == nil {
+		return nil
+	}
+
+	profile := accessProfile{Blocks: make([]profileBlock, 0)}
+	for _, key := range lsm.cache.keys() {
+		if filepath.Dir(key.filePath) == lsm.rootPath {
+			profile.Blocks = append(profile.Blocks, profileBlock{Table: filepath.Base(key.filePath), Offset: key.offset})
+		}
+	}
+
+	data, err := json.Marshal(&profile)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(lsm.rootPath, accessProfileTmpFileName)
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err == nil {
+		err = os.Rename(tmpPath, filepath.Join(lsm.rootPath, accessProfileFileName))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// readAccessProfile returns nil if rootPath has no access profile
+func readAccessProfile(rootPath string) (*accessProfile, error) {
+	data, err := ioutil.ReadFile(filepath.Join(rootPath, accessProfileFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	profile := new(accessProfile)
+	err = json.Unmarshal(data, profile)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// saveAccessProfiles saves the access profile periodically until the engine
+// stops, a restart warms up with the blocks hot before it
+func (lsm *Lsm) saveAccessProfiles() {
+	defer lsm.wg.Done()
+
+	ticker := time.NewTicker(accessProfileIntervalMs * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := lsm.saveAccessProfile()
+			if err != nil {
+				lsm.log.Pf(0, "save access profile error %v", err)
+			}
+		case <-lsm.syncStop:
+			return
+		}
+	}
+}
+
+// Warmup reads the blocks of the saved access profile into the block
+// cache from the hottest until the cache is full, bloom filters and indexes
+// are resident since the tables were opened.
+func (lsm *Lsm) Warmup(ctx context.Context) (WarmupStats, error) {
+	var stats WarmupStats
+	v := lsm.versions.acquire()
+	defer v.release()
+
+	tables := make(map[string]*SsTable)
+	for _, st := range v.tables {
+		stats.Tables++
+		stats.IndexBytes += st.properties().IndexBytes
+		tables[filepath.Base(st.filePath)] = st
+	}
+
+	profile, err := readAccessProfile(lsm.rootPath)
+	if err != nil || profile == nil || lsm.cache == nil {
+		return stats, err
+	}
+
+	for _, block := range profile.Blocks {
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		if lsm.cache.full() {
+			break
+		}
+
+		st := tables[block.Table]
+		if st == nil {
+			stats.Skipped++
+			continue
+		}
+		var ok bool
+		ok, err = st.warm(block.Offset)
+		if err != nil {
+			break
+		}
+		if !ok {
+			stats.Skipped++
+			continue
+		}
+		stats.Blocks++
+	}
+
+	_, _, stats.CacheSize = lsm.cache.stats()
+	return stats, err
+}
+
+// warm reads the index block starting at offset into the cache, it reports
+// false if no block starts there
+func (st *SsTable) warm(offset int64) (bool, error) {
+	st.lock.RLock()
+	defer st.lock.RUnlock()
+
+	count := st.sparse.len()
+	if count == 0 {
+		return false, nil
+	}
+
+	i := 0
+	if offset != st.dataOffset {
+		i = sort.Search(count, func(i int) bool { return st.sparse.offset(i) >= offset })
+		if i == 0 || i == count || st.sparse.offset(i) != offset {
+			return false, nil
+		}
+	}
+
+	_, err := st.readBlock(i)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
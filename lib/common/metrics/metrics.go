@@ -0,0 +1,229 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric types of the prometheus text format
+const (
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+// LatencyBuckets are upper bounds in seconds suited to request latencies
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations in buckets with fixed upper bounds, unlike
+// a sequence its memory doesn't grow with the number of observations
+type Histogram struct {
+	lock   sync.Mutex
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    float64
+
+	// Objectives and windows fed with every observation
+	trackers []Observer
+}
+
+// Observer is fed with the observations of a histogram
+type Observer interface {
+	Observe(v float64)
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.lock.Lock()
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+	trackers := h.trackers
+	h.lock.Unlock()
+
+	for _, t := range trackers {
+		t.Observe(v)
+	}
+}
+
+// Track feeds the later observations of h to t
+func (h *Histogram) Track(t Observer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.trackers = append(h.trackers[:len(h.trackers):len(h.trackers)], t)
+}
+
+func (h *Histogram) Count() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+// Summary returns the observations since the start or the last Reset
+func (h *Histogram) Summary() Summary {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := Summary{Bounds: h.bounds, Counts: make([]uint64, len(h.bounds)+1), Count: h.count, Sum: h.sum}
+	above := h.count
+	for i, n := range h.counts {
+		s.Counts[i] = n
+		above -= n
+	}
+	s.Counts[len(h.bounds)] = above
+	return s
+}
+
+// Reset forgets the observations, the tracked objectives and windows keep
+// theirs
+func (h *Histogram) Reset() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for i := range h.counts {
+		h.counts[i] = 0
+	}
+	h.count = 0
+	h.sum = 0
+}
+
+// snapshot returns cumulative bucket counts, the total count and the sum
+func (h *Histogram) snapshot() ([]uint64, uint64, float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	cumulative := make([]uint64, len(h.counts))
+	var total uint64
+	for i, n := range h.counts {
+		total += n
+		cumulative[i] = total
+	}
+	return cumulative, h.count, h.sum
+}
+
+// CounterVec counts events by a label value
+type CounterVec struct {
+	lock   sync.Mutex
+	values map[string]uint64
+}
+
+func NewCounterVec() *CounterVec {
+	return &CounterVec{values: make(map[string]uint64)}
+}
+
+func (c *CounterVec) Inc(label string) {
+	c.Add(label, 1)
+}
+
+func (c *CounterVec) Add(label string, n uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[label] += n
+}
+
+// Reset forgets the counts
+func (c *CounterVec) Reset() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values = make(map[string]uint64)
+}
+
+// Values returns a copy of the counts by label value
+func (c *CounterVec) Values() map[string]uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	values := make(map[string]uint64, len(c.values))
+	for label, n := range c.values {
+		values[label] = n
+	}
+	return values
+}
+
+// Writer writes metrics in the prometheus text format, the first write
+// error is kept and later writes are skipped
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) printf(format string, v ...interface{}) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, v...)
+}
+
+// Family starts a metric, its samples follow
+func (w *Writer) Family(name string, metricType string, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// Sample writes a value of the current family, labels are name value pairs
+func (w *Writer) Sample(name string, value float64, labels ...string) {
+	w.printf("%s%s %s\n", name, formatLabels(labels), formatValue(value))
+}
+
+// Histogram writes the buckets, sum and count of h
+func (w *Writer) Histogram(name string, h *Histogram, labels ...string) {
+	cumulative, count, sum := h.snapshot()
+	for i, bound := range h.bounds {
+		w.printf("%s_bucket%s %d\n", name, formatLabels(append(labels, "le", formatValue(bound))), cumulative[i])
+	}
+	w.printf("%s_bucket%s %d\n", name, formatLabels(append(labels, "le", "+Inf")), count)
+	w.printf("%s_sum%s %s\n", name, formatLabels(labels), formatValue(sum))
+	w.printf("%s_count%s %d\n", name, formatLabels(labels), count)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,111 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"ddb/lib/common/clock"
+)
+
+const (
+	// Resolution of the rolling windows of a SloTracker
+	sloBucketDuration = 10 * time.Second
+)
+
+// SloWindows are the rolling windows compliance and burn rates are kept
+// for, a fast burn shows in the short windows and a slow one in the long
+var SloWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+type sloBucket struct {
+	// Number of the bucket since the unix epoch, a slot holding an older
+	// number is stale
+	number int64
+	good   uint64
+	total  uint64
+}
+
+// SloTracker counts observations meeting a latency objective in rolling
+// windows, an observation is good if it is at most Threshold seconds. The
+// objective is met if at least Target of the observations are good.
+type SloTracker struct {
+	Threshold float64
+	Target    float64
+
+	lock    sync.Mutex
+	clock   clock.Clock
+	buckets []sloBucket
+}
+
+// NewSloTracker returns a tracker of the objective that target of the
+// observations are at most threshold, nil clock means the system clock
+func NewSloTracker(threshold time.Duration, target float64, c clock.Clock) *SloTracker {
+	longest := SloWindows[len(SloWindows)-1]
+	return &SloTracker{
+		Threshold: threshold.Seconds(),
+		Target:    target,
+		clock:     clock.OrReal(c),
+		buckets:   make([]sloBucket, longest/sloBucketDuration),
+	}
+}
+
+func (t *SloTracker) now() int64 {
+	return t.clock.Now().UnixNano() / int64(sloBucketDuration)
+}
+
+func (t *SloTracker) Observe(v float64) {
+	number := t.now()
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	b := &t.buckets[number%int64(len(t.buckets))]
+	if b.number != number {
+		*b = sloBucket{number: number}
+	}
+	b.total++
+	if v <= t.Threshold {
+		b.good++
+	}
+}
+
+// Counts returns the good and total observations of the last window,
+// rounded up to whole buckets
+func (t *SloTracker) Counts(window time.Duration) (uint64, uint64) {
+	number := t.now()
+	n := int64((window + sloBucketDuration - 1) / sloBucketDuration)
+	if n > int64(len(t.buckets)) {
+		n = int64(len(t.buckets))
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var good, total uint64
+	for _, b := range t.buckets {
+		if b.number > number-n && b.number <= number {
+			good += b.good
+			total += b.total
+		}
+	}
+	return good, total
+}
+
+// Compliance returns the fraction of good observations of the last window,
+// 1 if there were none
+func (t *SloTracker) Compliance(window time.Duration) float64 {
+	good, total := t.Counts(window)
+	if total == 0 {
+		return 1
+	}
+	return float64(good) / float64(total)
+}
+
+// BurnRate returns how fast the last window consumed the error budget: 1
+// spends exactly the budget of the objective, above 1 exhausts it early
+func (t *SloTracker) BurnRate(window time.Duration) float64 {
+	budget := 1 - t.Target
+	if budget <= 0 {
+		budget = 1e-9
+	}
+	return (1 - t.Compliance(window)) / budget
+}
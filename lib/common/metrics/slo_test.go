@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"ddb/lib/common/clock"
+)
+
+func TestSloTracker(t *testing.T) {
+	clk := clock.NewManual(time.Unix(1000, 0))
+	tracker := NewSloTracker(100*time.Millisecond, 0.99, clk)
+	h := NewHistogram(LatencyBuckets)
+	h.Track(tracker)
+
+	if tracker.Compliance(time.Hour) != 1 || tracker.BurnRate(time.Hour) != 0 {
+		t.Fatalf("compliance %v burn rate %v without requests", tracker.Compliance(time.Hour), tracker.BurnRate(time.Hour))
+		return
+	}
+
+	// 90 requests within the threshold, one at it, and 9 slower ones
+	for i := 0; i < 90; i++ {
+		h.Observe(0.05)
+	}
+	h.Observe(0.1)
+	for i := 0; i < 9; i++ {
+		h.Observe(0.2)
+	}
+	good, total := tracker.Counts(5 * time.Minute)
+	if good != 91 || total != 100 {
+		t.Fatalf("good %d total %d", good, total)
+		return
+	}
+	// 9% of the requests are slow with a budget of 1%
+	if tracker.Compliance(5*time.Minute) != 0.91 || math.Abs(tracker.BurnRate(5*time.Minute)-9) > 1e-9 {
+		t.Fatalf("compliance %v burn rate %v", tracker.Compliance(5*time.Minute), tracker.BurnRate(5*time.Minute))
+		return
+	}
+
+	// all good requests later halve the burn rate of the longer window
+	clk.Advance(10 * time.Minute)
+	for i := 0; i < 100; i++ {
+		h.Observe(0.01)
+	}
+	if tracker.Compliance(5*time.Minute) != 1 || tracker.BurnRate(5*time.Minute) != 0 {
+		t.Fatalf("short window compliance %v burn rate %v", tracker.Compliance(5*time.Minute), tracker.BurnRate(5*time.Minute))
+		return
+	}
+	if tracker.Compliance(30*time.Minute) != 0.955 || math.Abs(tracker.BurnRate(30*time.Minute)-4.5) > 1e-9 {
+		t.Fatalf("long window compliance %v burn rate %v", tracker.Compliance(30*time.Minute), tracker.BurnRate(30*time.Minute))
+		return
+	}
+
+	// observations older than the longest window are forgotten
+	clk.Advance(6 * time.Hour)
+	if good, total = tracker.Counts(6 * time.Hour); good != 0 || total != 0 {
+		t.Fatalf("good %d total %d after the longest window", good, total)
+		return
+	}
+}
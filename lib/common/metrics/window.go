@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"ddb/lib/common/clock"
+)
+
+const (
+	// Resolution of the rolling buckets of a Window
+	windowBucketDuration = 10 * time.Second
+	// Longest window a Window keeps
+	MaxWindow = time.Hour
+)
+
+// Summary describes the observations of a histogram or a window of it
+type Summary struct {
+	Bounds []float64
+	// Observations by bucket, the last one counts those above all bounds
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+// Mean returns the average observation, zero without observations
+func (s *Summary) Mean() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.Sum / float64(s.Count)
+}
+
+// Quantile returns the upper bound of the bucket holding the q quantile,
+// +Inf if it's above all bounds and zero without observations
+func (s *Summary) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(q * float64(s.Count)))
+	if rank == 0 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range s.Counts {
+		seen += n
+		if seen >= rank {
+			if i < len(s.Bounds) {
+				return s.Bounds[i]
+			}
+			break
+		}
+	}
+	return math.Inf(1)
+}
+
+type windowBucket struct {
+	// Number of the bucket since the unix epoch, a slot holding an older
+	// number is stale
+	number int64
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Window keeps the observations of the last MaxWindow in rolling buckets,
+// unlike the lifetime totals of a Histogram a window shows recent changes
+// and forgets old outliers. Feed it with Histogram.Track.
+type Window struct {
+	lock    sync.Mutex
+	clock   clock.Clock
+	bounds  []float64
+	buckets []windowBucket
+}
+
+// NewWindow returns a window with the bucket bounds of a histogram, nil
+// clock means the system clock
+func NewWindow(bounds []float64, c clock.Clock) *Window {
+	return &Window{
+		clock:   clock.OrReal(c),
+		bounds:  bounds,
+		buckets: make([]windowBucket, MaxWindow/windowBucketDuration),
+	}
+}
+
+func (w *Window) now() int64 {
+	return w.clock.Now().UnixNano() / int64(windowBucketDuration)
+}
+
+func (w *Window) Observe(v float64) {
+	number := w.now()
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	b := &w.buckets[number%int64(len(w.buckets))]
+	if b.number != number || b.counts == nil {
+		*b = windowBucket{number: number, counts: make([]uint64, len(w.bounds)+1)}
+	}
+	b.counts[sort.SearchFloat64s(w.bounds, v)]++
+	b.count++
+	b.sum += v
+}
+
+// Summary returns the observations of the last window, rounded up to whole
+// buckets and at most MaxWindow
+func (w *Window) Summary(window time.Duration) Summary {
+	number := w.now()
+	n := int64((window + windowBucketDuration - 1) / windowBucketDuration)
+	if n > int64(len(w.buckets)) {
+		n = int64(len(w.buckets))
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	s := Summary{Bounds: w.bounds, Counts: make([]uint64, len(w.bounds)+1)}
+	for _, b := range w.buckets {
+		if b.counts == nil || b.number <= number-n || b.number > number {
+			continue
+		}
+		for i, c := range b.counts {
+			s.Counts[i] += c
+		}
+		s.Count += b.count
+		s.Sum += b.sum
+	}
+	return s
+}
+
+// Reset forgets all observations
+func (w *Window) Reset() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for i := range w.buckets {
+		w.buckets[i] = windowBucket{}
+	}
+}
@@ -0,0 +1,1009 @@
+package raft
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"ddb/lib/common/clock"
+	"ddb/lib/common/log"
+	"ddb/lib/common/random"
+)
+
+// Raft consensus: a leader elected by a majority of nodes appends proposed
+// commands to its log and replicates them, a command is committed once a
+// majority stored it and every node then applies committed commands to its
+// state machine in log order. The term, vote and log are durable before a
+// node answers, so a majority of nodes surviving a crash keeps every
+// committed command. A leader holds a lease while a majority answered
+// requests it sent within the election timeout, one cut off from the
+// majority steps down once the lease runs out, before the others can elect
+// a new leader, so a deposed leader doesn't keep accepting proposals it
+// can't commit. A peer restarts its election timer when it receives a
+// request, after it was sent, so the lease is counted from the send time.
+// A node which heard from the leader within the election timeout refuses
+// votes, so no majority elects another leader before the lease ran out.
+// Applied entries every node stored are compacted away from the log. A
+// node down or lagging keeps the others from compacting the entries it
+// misses, the log then grows up to a limit and proposals fail until the
+// node catches up. A node which lost its log can't catch up from compacted
+// logs, it has to be restored from a copy of another node.
+
+var (
+	ErrNotLeader = fmt.Errorf("Not leader")
+	ErrStopped   = fmt.Errorf("Stopped")
+	ErrTooLarge  = fmt.Errorf("Entry too large")
+	ErrEmpty     = fmt.Errorf("Empty entry")
+	ErrLogFull   = fmt.Errorf("Log full")
+)
+
+const (
+	defaultElectionTimeout   = time.Second
+	defaultHeartbeatInterval = 100 * time.Millisecond
+	// Entries sent in one AppendEntries rpc
+	maxAppendEntries = 256
+	// Wait before applying an entry again which failed to apply
+	applyRetryInterval = 100 * time.Millisecond
+	// Entries compacted at once, the log is rewritten on compaction
+	compactEntries     = 1024
+	defaultMaxLogBytes = 1024 * 1024 * 1024
+)
+
+type Entry struct {
+	Term  uint64 `json:"term"`
+	Index uint64 `json:"index"`
+	// Proposed command, nil for entries a new leader appends to commit
+	// entries of previous terms
+	Data []byte `json:"data,omitempty"`
+}
+
+type RequestVoteArgs struct {
+	Term         uint64 `json:"term"`
+	CandidateId  string `json:"candidateId"`
+	LastLogIndex uint64 `json:"lastLogIndex"`
+	LastLogTerm  uint64 `json:"lastLogTerm"`
+}
+
+type RequestVoteReply struct {
+	Term        uint64 `json:"term"`
+	VoteGranted bool   `json:"voteGranted"`
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64  `json:"term"`
+	LeaderId     string  `json:"leaderId"`
+	PrevLogIndex uint64  `json:"prevLogIndex"`
+	PrevLogTerm  uint64  `json:"prevLogTerm"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leaderCommit"`
+	// Index up to which every node stored the log
+	CompactIndex uint64 `json:"compactIndex,omitempty"`
+}
+
+type AppendEntriesReply struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// Index the leader should continue from after a mismatch
+	ConflictIndex uint64 `json:"conflictIndex,omitempty"`
+}
+
+// StateMachine applies committed commands, it must be deterministic so all
+// nodes reach the same state. The result is returned to the proposer, so
+// outcomes of the command itself like a failed condition belong in it. An
+// error means the node couldn't apply the command now, e.g. its disk is
+// full, the entry is applied again until it succeeds and no later entry is
+// applied before. The index of the entry is the same on every node, a
+// command applied right before a crash may be applied again with it.
+type StateMachine interface {
+	Apply(index uint64, data []byte) (interface{}, error)
+}
+
+type Config struct {
+	// Id of this node, with HttpTransport the base url of its server
+	Id string
+	// Ids of all cluster nodes, this node included
+	Peers []string
+	// Directory for the state and the log
+	Dir string
+	// Followers start an election after hearing nothing from a leader
+	// within a random time between ElectionTimeout and twice that
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// Data of the entries the log keeps, proposals fail with ErrLogFull
+	// while a lagging node keeps it from being compacted below that. Zero
+	// means 1GB.
+	MaxLogBytes  int64
+	Transport    Transport
+	StateMachine StateMachine
+	Log          log.LogInterface
+	// Time source of election and heartbeat deadlines and the source of
+	// election timeouts, nil means the system clock and a time seed
+	Clock  clock.Clock
+	Random random.Source
+}
+
+type role int
+
+const (
+	roleFollower role = iota
+	roleCandidate
+	roleLeader
+)
+
+func (r role) String() string {
+	switch r {
+	case roleLeader:
+		return "leader"
+	case roleCandidate:
+		return "candidate"
+	default:
+		return "follower"
+	}
+}
+
+type result struct {
+	value interface{}
+	err   error
+}
+
+// waiter is a proposer waiting for its entry to be applied
+type waiter struct {
+	term     uint64
+	resultCh chan result
+}
+
+// Status describes the node for monitoring
+type Status struct {
+	Id          string
+	Role        string
+	Term        uint64
+	Leader      string
+	LastIndex   uint64
+	CommitIndex uint64
+	LastApplied uint64
+	// Last entry compacted away and the data of the entries after it
+	CompactedIndex uint64
+	LogBytes       int64
+}
+
+type Node struct {
+	lock              sync.Mutex
+	id                string
+	peers             []string
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	transport         Transport
+	stateMachine      StateMachine
+	log               log.LogInterface
+	storage           *storage
+
+	role     role
+	term     uint64
+	votedFor string
+	leader   string
+	votes    int
+	// Index and term of the last entry compacted away, entries[i] has index
+	// compacted.Index+i+1
+	compacted   Entry
+	entries     []Entry
+	logBytes    int64
+	maxLogBytes int64
+	commitIndex uint64
+	lastApplied uint64
+	// Last applied index known to be durable
+	savedApplied uint64
+	// Index up to which every node stored the log as far as the leader
+	// knows, applied entries up to it are compacted
+	compactIndex uint64
+
+	nextIndex   map[string]uint64
+	matchIndex  map[string]uint64
+	replicating map[string]bool
+	// Peers missing compacted entries, logged once
+	missing map[string]bool
+	// Send time of the latest request of this term a peer answered, a
+	// granted vote or an AppendEntries
+	answeredAt map[string]time.Time
+
+	electionDeadline time.Time
+	// When the last request of the leader was received
+	heardAt       time.Time
+	lastBroadcast time.Time
+	waiters       map[uint64]waiter
+	applyCond     *sync.Cond
+	clock         clock.Clock
+	random        random.Source
+	stopped       bool
+	stopChan      chan bool
+	wg            sync.WaitGroup
+}
+
+func NewNode(cfg *Config) (*Node, error) {
+	if cfg.Id == "" || cfg.Transport == nil || cfg.StateMachine == nil || cfg.Log == nil {
+		return nil, fmt.Errorf("raft config requires id, transport, state machine and log")
+	}
+
+	storage, state, compacted, entries, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if state.Applied < compacted.Index {
+		storage.close()
+		return nil, fmt.Errorf("raft applied %d behind compacted %d", state.Applied, compacted.Index)
+	}
+
+	n := &Node{
+		id:                cfg.Id,
+		electionTimeout:   cfg.ElectionTimeout,
+		heartbeatInterval: cfg.HeartbeatInterval,
+		transport:         cfg.Transport,
+		stateMachine:      cfg.StateMachine,
+		log:               cfg.Log,
+		storage:           storage,
+		term:              state.Term,
+		votedFor:          state.VotedFor,
+		compacted:         compacted,
+		entries:           entries,
+		maxLogBytes:       cfg.MaxLogBytes,
+		nextIndex:         make(map[string]uint64),
+		matchIndex:        make(map[string]uint64),
+		replicating:       make(map[string]bool),
+		missing:           make(map[string]bool),
+		answeredAt:        make(map[string]time.Time),
+		waiters:           make(map[uint64]waiter),
+		clock:             clock.OrReal(cfg.Clock),
+		random:            cfg.Random,
+		stopChan:          make(chan bool),
+	}
+	n.applyCond = sync.NewCond(&n.lock)
+	if n.random == nil {
+		n.random = random.NewTimeSource()
+	}
+
+	if n.electionTimeout <= 0 {
+		n.electionTimeout = defaultElectionTimeout
+	}
+	if n.heartbeatInterval <= 0 {
+		n.heartbeatInterval = defaultHeartbeatInterval
+	}
+	if n.maxLogBytes <= 0 {
+		n.maxLogBytes = defaultMaxLogBytes
+	}
+	for _, e := range n.entries {
+		n.logBytes += int64(len(e.Data))
+	}
+
+	for _, peer := range cfg.Peers {
+		if peer != cfg.Id {
+			n.peers = append(n.peers, peer)
+		}
+	}
+
+	// entries up to the applied one were committed
+	n.lastApplied = state.Applied
+	if n.lastApplied > n.lastIndex() {
+		n.lastApplied = n.lastIndex()
+	}
+	n.commitIndex = n.lastApplied
+	n.savedApplied = n.lastApplied
+
+	n.log.Pf(0, "raft %s term %d compacted %d entries %d applied %d peers %v", n.id, n.term, n.compacted.Index, len(n.entries), n.lastApplied, n.peers)
+
+	n.resetElectionDeadline()
+	n.wg.Add(2)
+	go n.tickLoop()
+	go n.applyLoop()
+	return n, nil
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.compacted.Index + uint64(len(n.entries))
+}
+
+// termAt returns the term of the entry at index, zero for index zero and
+// indexes compacted away before the last compacted entry
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.compacted.Index {
+		return n.compacted.Term
+	}
+	if index < n.compacted.Index || index > n.lastIndex() {
+		return 0
+	}
+	return n.entries[index-n.compacted.Index-1].Term
+}
+
+// slice returns the entries after from up to to, from must not be before
+// the last compacted entry. Caller must hold lock.
+func (n *Node) slice(from uint64, to uint64) []Entry {
+	return n.entries[from-n.compacted.Index : to-n.compacted.Index]
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) resetElectionDeadline() {
+	timeout := n.electionTimeout + time.Duration(n.random.Int63n(int64(n.electionTimeout)))
+	n.electionDeadline = n.clock.Now().Add(timeout)
+}
+
+// persist makes term and vote durable, caller must hold lock
+func (n *Node) persist() error {
+	applied := n.lastApplied
+	err := n.storage.saveState(persistentState{Term: n.term, VotedFor: n.votedFor, Applied: applied})
+	if err != nil {
+		n.log.Pf(0, "raft save state error %v", err)
+		return err
+	}
+	n.savedApplied = applied
+	return nil
+}
+
+// stepDown follows a newer term, caller must hold lock
+func (n *Node) stepDown(term uint64) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persist()
+	}
+	if n.role != roleFollower {
+		n.log.Pf(0, "raft %s %s steps down in term %d", n.id, n.role, n.term)
+	}
+	if n.leader == n.id {
+		n.leader = ""
+	}
+	n.role = roleFollower
+}
+
+func (n *Node) tickLoop() {
+	defer n.wg.Done()
+
+	tick := n.heartbeatInterval / 4
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.stopChan:
+			return
+		}
+
+		n.lock.Lock()
+		now := n.clock.Now()
+		if n.role == roleLeader {
+			if !n.hasLease(now) {
+				n.log.Pf(0, "raft %s lease expired in term %d", n.id, n.term)
+				n.stepDown(n.term)
+			} else if now.Sub(n.lastBroadcast) >= n.heartbeatInterval {
+				n.broadcast()
+			}
+		} else if now.After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.lock.Unlock()
+	}
+}
+
+// startElection votes for itself in a new term and asks peers for votes,
+// caller must hold lock
+func (n *Node) startElection() {
+	n.term++
+	n.role = roleCandidate
+	n.votedFor = n.id
+	n.leader = ""
+	n.votes = 1
+	n.answeredAt = make(map[string]time.Time)
+	n.resetElectionDeadline()
+	if n.persist() != nil {
+		return
+	}
+
+	n.log.Pf(0, "raft %s starts election in term %d", n.id, n.term)
+
+	if n.votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+
+	args := &RequestVoteArgs{
+		Term:         n.term,
+		CandidateId:  n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	sent := n.clock.Now()
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go n.requestVote(peer, args, sent)
+	}
+}
+
+func (n *Node) requestVote(peer string, args *RequestVoteArgs, sent time.Time) {
+	defer n.wg.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+	defer cancel()
+
+	reply, err := n.transport.RequestVote(ctx, peer, args)
+	if err != nil {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.stopped {
+		return
+	}
+	if reply.Term > n.term {
+		n.stepDown(reply.Term)
+		return
+	}
+	if n.role != roleCandidate || n.term != args.Term || !reply.VoteGranted {
+		return
+	}
+
+	n.votes++
+	n.answered(peer, sent)
+	if n.votes >= n.quorum() {
+		n.becomeLeader()
+	}
+}
+
+// becomeLeader appends an empty entry of the new term, committing it
+// commits all entries before it. Caller must hold lock.
+func (n *Node) becomeLeader() {
+	n.role = roleLeader
+	n.leader = n.id
+	// the votes of the majority start the lease
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = n.lastIndex() + 1
+		n.matchIndex[peer] = 0
+	}
+
+	n.log.Pf(0, "raft %s leader in term %d", n.id, n.term)
+
+	err := n.appendEntry(nil)
+	if err != nil {
+		n.stepDown(n.term)
+		return
+	}
+	n.broadcast()
+}
+
+// answered records that peer answered a request sent at sent, caller must
+// hold lock
+func (n *Node) answered(peer string, sent time.Time) {
+	if sent.After(n.answeredAt[peer]) {
+		n.answeredAt[peer] = sent
+	}
+}
+
+// hasLease reports whether a majority answered requests the leader sent
+// within the election timeout, caller must hold lock
+func (n *Node) hasLease(now time.Time) bool {
+	count := 1
+	for _, peer := range n.peers {
+		sent, ok := n.answeredAt[peer]
+		if ok && now.Sub(sent) < n.electionTimeout {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+// leaderAlive reports whether this node leads with the lease or heard from
+// the leader within the election timeout, caller must hold lock
+func (n *Node) leaderAlive(now time.Time) bool {
+	switch n.role {
+	case roleLeader:
+		return n.hasLease(now)
+	case roleFollower:
+		return n.leader != "" && now.Sub(n.heardAt) < n.electionTimeout
+	default:
+		return false
+	}
+}
+
+// appendEntry appends data to the leader log, caller must hold lock
+func (n *Node) appendEntry(data []byte) error {
+	e := Entry{Term: n.term, Index: n.lastIndex() + 1, Data: data}
+	err := n.storage.append([]Entry{e})
+	if err != nil {
+		n.log.Pf(0, "raft append error %v", err)
+		return err
+	}
+	n.entries = append(n.entries, e)
+	n.logBytes += int64(len(data))
+	n.advanceCommit()
+	return nil
+}
+
+// broadcast replicates the log to peers which aren't being replicated to,
+// caller must hold lock
+func (n *Node) broadcast() {
+	n.lastBroadcast = n.clock.Now()
+	for _, peer := range n.peers {
+		if n.replicating[peer] {
+			continue
+		}
+		n.replicating[peer] = true
+		n.wg.Add(1)
+		go n.replicate(peer)
+	}
+}
+
+// replicate sends entries to peer until it has the whole log, an empty
+// AppendEntries is a heartbeat
+func (n *Node) replicate(peer string) {
+	defer n.wg.Done()
+
+	n.lock.Lock()
+	defer func() {
+		n.replicating[peer] = false
+		n.lock.Unlock()
+	}()
+
+	for !n.stopped && n.role == roleLeader {
+		prev := n.nextIndex[peer] - 1
+		if prev < n.compacted.Index {
+			// the peer misses compacted entries, heartbeats still tell it
+			// the leader
+			prev = n.compacted.Index
+		}
+		end := n.lastIndex()
+		if end > prev+maxAppendEntries {
+			end = prev + maxAppendEntries
+		}
+		args := &AppendEntriesArgs{
+			Term:         n.term,
+			LeaderId:     n.id,
+			PrevLogIndex: prev,
+			PrevLogTerm:  n.termAt(prev),
+			Entries:      append([]Entry(nil), n.slice(prev, end)...),
+			LeaderCommit: n.commitIndex,
+			CompactIndex: n.compactIndex,
+		}
+
+		sent := n.clock.Now()
+		n.lock.Unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), n.electionTimeout)
+		reply, err := n.transport.AppendEntries(ctx, peer, args)
+		cancel()
+		n.lock.Lock()
+
+		if err != nil || n.stopped {
+			return
+		}
+		if reply.Term > n.term {
+			n.stepDown(reply.Term)
+			return
+		}
+		if n.role != roleLeader || n.term != args.Term {
+			return
+		}
+		n.answered(peer, sent)
+
+		if !reply.Success {
+			next := reply.ConflictIndex
+			if next == 0 || next > prev {
+				next = prev
+			}
+			if next < 1 {
+				next = 1
+			}
+			n.nextIndex[peer] = next
+			if next <= n.compacted.Index {
+				if !n.missing[peer] {
+					n.log.Pf(0, "raft %s peer %s misses compacted entries from %d", n.id, peer, next)
+					n.missing[peer] = true
+				}
+				return
+			}
+			continue
+		}
+		delete(n.missing, peer)
+
+		match := prev + uint64(len(args.Entries))
+		if match > n.matchIndex[peer] {
+			n.matchIndex[peer] = match
+		}
+		n.nextIndex[peer] = match + 1
+		n.advanceCommit()
+
+		if n.nextIndex[peer] > n.lastIndex() {
+			return
+		}
+	}
+}
+
+// advanceCommit commits the newest entry of the current term stored by a
+// majority, caller must hold lock
+func (n *Node) advanceCommit() {
+	if n.role != roleLeader {
+		return
+	}
+
+	compactIndex := n.commitIndex
+	for _, peer := range n.peers {
+		if n.matchIndex[peer] < compactIndex {
+			compactIndex = n.matchIndex[peer]
+		}
+	}
+	if compactIndex > n.compactIndex {
+		n.compactIndex = compactIndex
+		n.compact()
+	}
+
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.term {
+			break
+		}
+
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= index {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+func (n *Node) applyLoop() {
+	defer n.wg.Done()
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for {
+		for !n.stopped && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.stopped {
+			return
+		}
+
+		batch := append([]Entry(nil), n.slice(n.lastApplied, n.commitIndex)...)
+		n.lock.Unlock()
+
+		results := make([]result, len(batch))
+		var err error
+		for i, e := range batch {
+			if e.Data != nil {
+				results[i].value, err = n.stateMachine.Apply(e.Index, e.Data)
+			}
+			if err != nil {
+				n.log.Pf(0, "raft %s apply %d error %v, retrying", n.id, e.Index, err)
+				batch = batch[:i]
+				break
+			}
+		}
+
+		n.lock.Lock()
+		for i, e := range batch {
+			n.lastApplied = e.Index
+			w, ok := n.waiters[e.Index]
+			if !ok {
+				continue
+			}
+			delete(n.waiters, e.Index)
+			if w.term == e.Term {
+				w.resultCh <- results[i]
+			} else {
+				// the proposed entry was replaced by another leader
+				w.resultCh <- result{err: ErrNotLeader}
+			}
+		}
+		// an entry applied right before a crash may be applied again
+		if n.persist() == nil {
+			n.compact()
+		}
+
+		if err != nil {
+			n.lock.Unlock()
+			select {
+			case <-n.clock.After(applyRetryInterval):
+			case <-n.stopChan:
+			}
+			n.lock.Lock()
+		}
+	}
+}
+
+// compact drops entries every node stored and this one recorded as applied
+// from the log once there are enough of them, caller must hold lock
+func (n *Node) compact() {
+	index := n.compactIndex
+	if index > n.savedApplied {
+		index = n.savedApplied
+	}
+	if index <= n.compacted.Index {
+		return
+	}
+
+	dropped := n.slice(n.compacted.Index, index)
+	droppedBytes := int64(0)
+	for _, e := range dropped {
+		droppedBytes += int64(len(e.Data))
+	}
+	if len(dropped) < compactEntries && droppedBytes < n.maxLogBytes/4 {
+		return
+	}
+	// the log is rewritten with the kept entries, dropping at least as much
+	// keeps the rewrites linear in the log growth
+	keptCount := len(n.entries) - len(dropped)
+	if len(dropped) < keptCount && droppedBytes < n.logBytes-droppedBytes {
+		return
+	}
+
+	compacted := Entry{Term: n.termAt(index), Index: index}
+	kept := append([]Entry(nil), n.slice(index, n.lastIndex())...)
+	err := n.storage.truncate(compacted, kept)
+	if err != nil {
+		n.log.Pf(0, "raft compact error %v", err)
+		return
+	}
+	n.logBytes -= droppedBytes
+	n.compacted = compacted
+	n.entries = kept
+}
+
+// Propose appends data to the log and waits until it is applied, returning
+// the state machine result. A proposal abandoned by ctx may still be
+// applied later.
+func (n *Node) Propose(ctx context.Context, data []byte) (interface{}, error) {
+	if len(data) == 0 {
+		return nil, ErrEmpty
+	}
+	if recordSize(data) > maxRecordSize {
+		return nil, ErrTooLarge
+	}
+
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return nil, ErrStopped
+	}
+	if n.role != roleLeader || !n.hasLease(n.clock.Now()) {
+		n.lock.Unlock()
+		return nil, ErrNotLeader
+	}
+	if n.logBytes+int64(len(data)) > n.maxLogBytes {
+		n.lock.Unlock()
+		return nil, ErrLogFull
+	}
+
+	err := n.appendEntry(data)
+	if err != nil {
+		n.lock.Unlock()
+		return nil, err
+	}
+	index := n.lastIndex()
+	w := waiter{term: n.term, resultCh: make(chan result, 1)}
+	n.waiters[index] = w
+	n.broadcast()
+	n.lock.Unlock()
+
+	select {
+	case r := <-w.resultCh:
+		return r.value, r.err
+	case <-ctx.Done():
+		n.lock.Lock()
+		delete(n.waiters, index)
+		n.lock.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// RequestVote grants the vote to a candidate with a log at least as up to
+// date as ours, once per term. While the leader is alive the request is
+// refused without following its term.
+func (n *Node) RequestVote(args *RequestVoteArgs) (*RequestVoteReply, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+
+	if args.Term > n.term && n.leaderAlive(n.clock.Now()) {
+		return &RequestVoteReply{Term: n.term}, nil
+	}
+	if args.Term > n.term {
+		n.stepDown(args.Term)
+	}
+
+	reply := &RequestVoteReply{Term: n.term}
+	if args.Term < n.term {
+		return reply, nil
+	}
+
+	lastTerm := n.termAt(n.lastIndex())
+	upToDate := args.LastLogTerm > lastTerm || (args.LastLogTerm == lastTerm && args.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == args.CandidateId) && upToDate {
+		n.votedFor = args.CandidateId
+		if n.persist() != nil {
+			return nil, ErrStopped
+		}
+		n.resetElectionDeadline()
+		reply.VoteGranted = true
+	}
+	return reply, nil
+}
+
+// AppendEntries stores entries of the leader after the entry it expects us
+// to have, replacing conflicting entries
+func (n *Node) AppendEntries(args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.stopped {
+		return nil, ErrStopped
+	}
+
+	reply := &AppendEntriesReply{Term: n.term}
+	if args.Term < n.term {
+		return reply, nil
+	}
+	if args.Term > n.term || n.role != roleFollower {
+		n.stepDown(args.Term)
+		reply.Term = n.term
+	}
+	if n.leader != args.LeaderId {
+		n.log.Pf(0, "raft %s follows %s in term %d", n.id, args.LeaderId, n.term)
+	}
+	n.leader = args.LeaderId
+	n.heardAt = n.clock.Now()
+	n.resetElectionDeadline()
+
+	prevIndex, prevTerm, entries := args.PrevLogIndex, args.PrevLogTerm, args.Entries
+	if prevIndex < n.compacted.Index {
+		// compacted entries were committed, they match those of the leader
+		skip := n.compacted.Index - prevIndex
+		if skip > uint64(len(entries)) {
+			skip = uint64(len(entries))
+		}
+		prevIndex, prevTerm, entries = n.compacted.Index, n.compacted.Term, entries[skip:]
+	}
+
+	if prevIndex > n.lastIndex() {
+		reply.ConflictIndex = n.lastIndex() + 1
+		return reply, nil
+	}
+	if n.termAt(prevIndex) != prevTerm {
+		// skip the whole conflicting term at once
+		term := n.termAt(prevIndex)
+		index := prevIndex
+		for index > n.compacted.Index+1 && n.termAt(index-1) == term {
+			index--
+		}
+		reply.ConflictIndex = index
+		return reply, nil
+	}
+
+	newEntries := entries
+	for i, e := range entries {
+		if e.Index > n.lastIndex() {
+			newEntries = entries[i:]
+			break
+		}
+		if n.termAt(e.Index) == e.Term {
+			newEntries = entries[i+1:]
+			continue
+		}
+
+		// committed entries never conflict, a leader has all of them
+		kept := n.slice(n.compacted.Index, e.Index-1)
+		err := n.storage.truncate(n.compacted, kept)
+		if err != nil {
+			n.log.Pf(0, "raft truncate error %v", err)
+			return nil, err
+		}
+		for _, dropped := range n.slice(e.Index-1, n.lastIndex()) {
+			n.logBytes -= int64(len(dropped.Data))
+		}
+		n.entries = kept
+		newEntries = entries[i:]
+		break
+	}
+
+	if len(newEntries) > 0 {
+		err := n.storage.append(newEntries)
+		if err != nil {
+			n.log.Pf(0, "raft append error %v", err)
+			return nil, err
+		}
+		n.entries = append(n.entries, newEntries...)
+		for _, e := range newEntries {
+			n.logBytes += int64(len(e.Data))
+		}
+	}
+
+	last := args.PrevLogIndex + uint64(len(args.Entries))
+	if args.LeaderCommit > n.commitIndex {
+		commit := args.LeaderCommit
+		if commit > last {
+			commit = last
+		}
+		if commit > n.commitIndex {
+			n.commitIndex = commit
+			n.applyCond.Broadcast()
+		}
+	}
+	if args.CompactIndex > n.compactIndex {
+		n.compactIndex = args.CompactIndex
+		n.compact()
+	}
+
+	reply.Success = true
+	return reply, nil
+}
+
+// IsLeader reports whether the node is the leader and holds the lease
+func (n *Node) IsLeader() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.role == roleLeader && n.hasLease(n.clock.Now())
+}
+
+// Leader returns the id of the current leader, empty if unknown
+func (n *Node) Leader() string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return n.leader
+}
+
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return Status{
+		Id:          n.id,
+		Role:        n.role.String(),
+		Term:        n.term,
+		Leader:      n.leader,
+		LastIndex:   n.lastIndex(),
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+
+		CompactedIndex: n.compacted.Index,
+		LogBytes:       n.logBytes,
+	}
+}
+
+// Stop stops the node, pending proposals fail with ErrStopped
+func (n *Node) Stop() {
+	n.lock.Lock()
+	if n.stopped {
+		n.lock.Unlock()
+		return
+	}
+	n.stopped = true
+	n.role = roleFollower
+	for index, w := range n.waiters {
+		delete(n.waiters, index)
+		w.resultCh <- result{err: ErrStopped}
+	}
+	n.applyCond.Broadcast()
+	n.lock.Unlock()
+
+	close(n.stopChan)
+	n.wg.Wait()
+
+	n.lock.Lock()
+	n.persist()
+	n.storage.close()
+	n.lock.Unlock()
+}
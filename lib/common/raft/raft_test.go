@@ -0,0 +1,698 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"ddb/lib/common/filelog"
+	"ddb/lib/common/log"
+	"ddb/lib/common/random"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memTransport delivers rpcs directly to nodes of the test cluster
+type memTransport struct {
+	lock  sync.Mutex
+	nodes map[string]*Node
+	// Latency of AppendEntries replies
+	delay time.Duration
+	// Pairs of nodes which can't reach each other
+	cut map[[2]string]bool
+}
+
+// linkTransport sends the rpcs of node from over the links of a
+// memTransport
+type linkTransport struct {
+	*memTransport
+	from string
+}
+
+func (t *linkTransport) reachable(peer string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.cut[[2]string{t.from, peer}] || t.cut[[2]string{peer, t.from}] {
+		return fmt.Errorf("link %s %s cut", t.from, peer)
+	}
+	return nil
+}
+
+func (t *linkTransport) RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	err := t.reachable(peer)
+	if err != nil {
+		return nil, err
+	}
+	return t.memTransport.RequestVote(ctx, peer, args)
+}
+
+func (t *linkTransport) AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	err := t.reachable(peer)
+	if err != nil {
+		return nil, err
+	}
+	return t.memTransport.AppendEntries(ctx, peer, args)
+}
+
+func (t *memTransport) node(peer string) (*Node, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n, ok := t.nodes[peer]
+	if !ok {
+		return nil, fmt.Errorf("peer %s unreachable", peer)
+	}
+	return n, nil
+}
+
+func (t *memTransport) RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	n, err := t.node(peer)
+	if err != nil {
+		return nil, err
+	}
+	return n.RequestVote(args)
+}
+
+func (t *memTransport) AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	n, err := t.node(peer)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := n.AppendEntries(args)
+
+	t.lock.Lock()
+	delay := t.delay
+	t.lock.Unlock()
+	time.Sleep(delay)
+	return reply, err
+}
+
+type memStateMachine struct {
+	lock    sync.Mutex
+	applied []string
+	// Applies failing before the next succeeds
+	failures int
+}
+
+func (sm *memStateMachine) Apply(index uint64, data []byte) (interface{}, error) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	if sm.failures > 0 {
+		sm.failures--
+		return nil, fmt.Errorf("disk full")
+	}
+	sm.applied = append(sm.applied, string(data))
+	return len(sm.applied), nil
+}
+
+func (sm *memStateMachine) count() int {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+
+	return len(sm.applied)
+}
+
+func waitLeader(t *testing.T, nodes map[string]*Node) *Node {
+	for i := 0; i < 200; i++ {
+		for _, n := range nodes {
+			if n.IsLeader() {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no leader elected")
+	return nil
+}
+
+func TestRaftCluster(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestRaftCluster_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	ids := []string{"n1", "n2", "n3"}
+	transport := &memTransport{nodes: make(map[string]*Node)}
+	machines := make(map[string]*memStateMachine)
+	for i, id := range ids {
+		machines[id] = &memStateMachine{}
+		n, err := NewNode(&Config{
+			Id:                id,
+			Peers:             ids,
+			Dir:               filepath.Join(rootPath, id),
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			Transport:         transport,
+			StateMachine:      machines[id],
+			Log:               log,
+			// distinct seeds keep election timeouts apart
+			Random: random.NewSource(int64(i)),
+		})
+		if err != nil {
+			t.Fatalf("can't create node error %v", err)
+			return
+		}
+		transport.nodes[id] = n
+	}
+
+	leader := waitLeader(t, transport.nodes)
+	for i := 0; i < 10; i++ {
+		value, err := leader.Propose(context.Background(), []byte(fmt.Sprintf("c%d", i)))
+		if err != nil || value.(int) != i+1 {
+			t.Fatalf("propose %d value %v error %v", i, value, err)
+			return
+		}
+	}
+
+	for _, id := range ids {
+		if id == leader.id {
+			continue
+		}
+		_, err = transport.nodes[id].Propose(context.Background(), []byte("x"))
+		if err != ErrNotLeader {
+			t.Fatalf("follower propose error %v", err)
+			return
+		}
+	}
+
+	// the remaining majority elects a new leader which keeps the log
+	transport.lock.Lock()
+	delete(transport.nodes, leader.id)
+	transport.lock.Unlock()
+	leader.Stop()
+
+	next := waitLeader(t, transport.nodes)
+	_, err = next.Propose(context.Background(), []byte("c10"))
+	if err != nil {
+		t.Fatalf("propose after failover error %v", err)
+		return
+	}
+
+	for id := range transport.nodes {
+		for i := 0; i < 200 && machines[id].count() != 11; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if machines[id].count() != 11 {
+			t.Fatalf("node %s applied %v", id, machines[id].applied)
+			return
+		}
+		for i, data := range machines[id].applied {
+			if data != fmt.Sprintf("c%d", i) {
+				t.Fatalf("node %s applied %v", id, machines[id].applied)
+				return
+			}
+		}
+	}
+	for _, n := range transport.nodes {
+		n.Stop()
+	}
+
+	// a restarted node doesn't apply the log again
+	restarted := &memStateMachine{}
+	n, err := NewNode(&Config{
+		Id:           leader.id,
+		Peers:        ids,
+		Dir:          filepath.Join(rootPath, leader.id),
+		Transport:    transport,
+		StateMachine: restarted,
+		Log:          log,
+	})
+	if err != nil {
+		t.Fatalf("can't restart node error %v", err)
+		return
+	}
+	defer n.Stop()
+
+	if status := n.Status(); status.LastApplied != 11 || status.LastIndex < 11 {
+		t.Fatalf("unexpected status after restart %+v", status)
+		return
+	}
+}
+
+func TestRaftLease(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestRaftLease_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	ids := []string{"n1", "n2", "n3"}
+	transport := &memTransport{nodes: make(map[string]*Node)}
+	nodes := make(map[string]*Node)
+	for i, id := range ids {
+		n, err := NewNode(&Config{
+			Id:                id,
+			Peers:             ids,
+			Dir:               filepath.Join(rootPath, id),
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			Transport:         transport,
+			StateMachine:      &memStateMachine{},
+			Log:               log,
+			Random:            random.NewSource(int64(i)),
+		})
+		if err != nil {
+			t.Fatalf("can't create node error %v", err)
+			return
+		}
+		transport.nodes[id] = n
+		nodes[id] = n
+		defer n.Stop()
+	}
+
+	leader := waitLeader(t, transport.nodes)
+	_, err = leader.Propose(context.Background(), []byte("c0"))
+	if err != nil {
+		t.Fatalf("propose error %v", err)
+		return
+	}
+
+	// cut off from the others the leader gives up leadership on its own
+	transport.lock.Lock()
+	for id := range transport.nodes {
+		if id != leader.id {
+			delete(transport.nodes, id)
+		}
+	}
+	transport.lock.Unlock()
+
+	for i := 0; i < 100 && leader.IsLeader(); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if leader.IsLeader() {
+		t.Fatalf("isolated leader kept the lease")
+		return
+	}
+	_, err = leader.Propose(context.Background(), []byte("c1"))
+	if err != ErrNotLeader {
+		t.Fatalf("isolated leader propose error %v", err)
+		return
+	}
+
+	// the lease counts from when requests were sent, slow replies don't
+	// stretch it past the election timeout of the followers
+	transport.lock.Lock()
+	for id, n := range nodes {
+		transport.nodes[id] = n
+	}
+	transport.lock.Unlock()
+	leader = waitLeader(t, transport.nodes)
+
+	transport.lock.Lock()
+	transport.delay = 40 * time.Millisecond
+	transport.lock.Unlock()
+	for i := 0; i < 200 && leader.IsLeader(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if leader.IsLeader() {
+		t.Fatalf("leader kept the lease with slow replies")
+		return
+	}
+}
+
+func TestRaftApplyRetry(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestRaftApplyRetry_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	machine := &memStateMachine{}
+	transport := &memTransport{nodes: make(map[string]*Node)}
+	n, err := NewNode(&Config{
+		Id:                "n1",
+		Peers:             []string{"n1"},
+		Dir:               rootPath,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		Transport:         transport,
+		StateMachine:      machine,
+		Log:               log,
+	})
+	if err != nil {
+		t.Fatalf("can't create node error %v", err)
+		return
+	}
+	defer n.Stop()
+	transport.nodes["n1"] = n
+	waitLeader(t, transport.nodes)
+
+	// a failed apply is retried, the entry is neither skipped nor
+	// overtaken by the next one
+	machine.lock.Lock()
+	machine.failures = 2
+	machine.lock.Unlock()
+	done := make(chan error, 1)
+	go func() {
+		_, err := n.Propose(context.Background(), []byte("c1"))
+		done <- err
+	}()
+	value, err := n.Propose(context.Background(), []byte("c0"))
+	if err != nil {
+		t.Fatalf("propose error %v", err)
+		return
+	}
+	if err = <-done; err != nil {
+		t.Fatalf("propose error %v", err)
+		return
+	}
+	if value.(int) > 2 || machine.count() != 2 {
+		t.Fatalf("unexpected value %v applied %v", value, machine.applied)
+		return
+	}
+}
+
+func TestRaftLogRestart(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestRaftLogRestart_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	transport := &memTransport{nodes: make(map[string]*Node)}
+	cfg := &Config{
+		Id:                "n1",
+		Peers:             []string{"n1"},
+		Dir:               rootPath,
+		ElectionTimeout:   50 * time.Millisecond,
+		HeartbeatInterval: 10 * time.Millisecond,
+		Transport:         transport,
+		StateMachine:      &memStateMachine{},
+		Log:               log,
+	}
+	n, err := NewNode(cfg)
+	if err != nil {
+		t.Fatalf("can't create node error %v", err)
+		return
+	}
+	transport.nodes["n1"] = n
+	waitLeader(t, transport.nodes)
+
+	// the largest entry fills a whole record
+	large := make([]byte, maxRecordSize-recordSize(nil))
+	for i := range large {
+		large[i] = byte(i)
+	}
+	_, err = n.Propose(context.Background(), append(large, 'x'))
+	if err != ErrTooLarge {
+		t.Fatalf("propose of a too large entry error %v", err)
+		return
+	}
+	for _, data := range [][]byte{[]byte("c0"), large, []byte("c2")} {
+		_, err = n.Propose(context.Background(), data)
+		if err != nil {
+			t.Fatalf("propose error %v", err)
+			return
+		}
+	}
+	before := n.Status()
+	n.Stop()
+
+	// a record torn by a crash is cut off, the entries before it are kept
+	logPath := filepath.Join(rootPath, logFileName)
+	file, err := os.OpenFile(logPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatalf("can't open log error %v", err)
+		return
+	}
+	torn, _ := encodeEntries([]Entry{{Term: before.Term, Index: before.LastIndex + 1, Data: []byte("torn")}})
+	file.Write(torn[:len(torn)-1])
+	file.Close()
+
+	cfg.StateMachine = &memStateMachine{}
+	n, err = NewNode(cfg)
+	if err != nil {
+		t.Fatalf("can't restart node error %v", err)
+		return
+	}
+	after := n.Status()
+	n.Stop()
+	if after.LastIndex < before.LastIndex || after.LastApplied != before.LastApplied {
+		t.Fatalf("status before restart %+v after %+v", before, after)
+		return
+	}
+	_, entries, valid, err := readLog(logPath)
+	if err != nil || valid != -1 || !bytes.Equal(entries[2].Data, large) {
+		t.Fatalf("read log entries %d valid %d error %v", len(entries), valid, err)
+		return
+	}
+
+	// damage before the last record fails the open instead of dropping
+	// committed entries
+	data, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("can't read log error %v", err)
+		return
+	}
+	data[2*recordHeaderSize+entryHeaderSize] ^= 0xff
+	err = ioutil.WriteFile(logPath, data, 0600)
+	if err != nil {
+		t.Fatalf("can't write log error %v", err)
+		return
+	}
+	_, err = NewNode(cfg)
+	if err == nil {
+		t.Fatalf("node opened a corrupted log")
+		return
+	}
+}
+
+func TestRaftCompaction(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestRaftCompaction_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	ids := []string{"n1", "n2", "n3"}
+	transport := &memTransport{nodes: make(map[string]*Node)}
+	nodes := make(map[string]*Node)
+	configs := make(map[string]*Config)
+	for i, id := range ids {
+		configs[id] = &Config{
+			Id:                id,
+			Peers:             ids,
+			Dir:               filepath.Join(rootPath, id),
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			MaxLogBytes:       64 * 1024,
+			Transport:         transport,
+			StateMachine:      &memStateMachine{},
+			Log:               log,
+			Random:            random.NewSource(int64(i)),
+		}
+		n, err := NewNode(configs[id])
+		if err != nil {
+			t.Fatalf("can't create node error %v", err)
+			return
+		}
+		transport.nodes[id] = n
+		nodes[id] = n
+	}
+	defer func() {
+		for _, n := range nodes {
+			n.Stop()
+		}
+	}()
+
+	leader := waitLeader(t, transport.nodes)
+	for i := 0; i < compactEntries+10; i++ {
+		_, err = leader.Propose(context.Background(), []byte(fmt.Sprintf("c%d", i)))
+		if err != nil {
+			t.Fatalf("propose %d error %v", i, err)
+			return
+		}
+	}
+	if status := leader.Status(); status.CompactedIndex < compactEntries || status.LastIndex-status.CompactedIndex > 20 {
+		t.Fatalf("log not compacted %+v", status)
+		return
+	}
+
+	// a node cut off keeps the log from being compacted, it grows up to the
+	// limit and proposals fail until the node catches up
+	var lagging string
+	for _, id := range ids {
+		if id != leader.id {
+			lagging = id
+		}
+	}
+	transport.lock.Lock()
+	delete(transport.nodes, lagging)
+	transport.lock.Unlock()
+
+	value := make([]byte, 1024)
+	for i := 0; ; i++ {
+		_, err = leader.Propose(context.Background(), value)
+		if err == ErrLogFull {
+			break
+		}
+		if err != nil || i > 100 {
+			t.Fatalf("propose %d to a full log error %v", i, err)
+			return
+		}
+	}
+
+	transport.lock.Lock()
+	transport.nodes[lagging] = nodes[lagging]
+	transport.lock.Unlock()
+	for i := 0; i < 200; i++ {
+		_, err = leader.Propose(context.Background(), value)
+		if err == ErrNotLeader {
+			// the newer term of the returning node may depose the leader
+			leader = waitLeader(t, transport.nodes)
+			continue
+		}
+		if err != ErrLogFull {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("propose after catching up error %v", err)
+		return
+	}
+
+	// a restarted node continues after its compacted entries
+	for i := 0; i < 200 && nodes[lagging].Status().LastApplied != leader.Status().CommitIndex; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	before := nodes[lagging].Status()
+	transport.lock.Lock()
+	delete(transport.nodes, lagging)
+	transport.lock.Unlock()
+	nodes[lagging].Stop()
+
+	n, err := NewNode(configs[lagging])
+	if err != nil {
+		t.Fatalf("can't restart node error %v", err)
+		return
+	}
+	nodes[lagging] = n
+	after := n.Status()
+	if before.CompactedIndex == 0 || after.CompactedIndex != before.CompactedIndex || after.LastApplied != before.LastApplied {
+		t.Fatalf("status before restart %+v after %+v", before, after)
+		return
+	}
+}
+
+func TestRaftPartition(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestRaftPartition_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	ids := []string{"n1", "n2", "n3"}
+	transport := &memTransport{nodes: make(map[string]*Node), cut: make(map[[2]string]bool)}
+	for i, id := range ids {
+		n, err := NewNode(&Config{
+			Id:                id,
+			Peers:             ids,
+			Dir:               filepath.Join(rootPath, id),
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+			Transport:         &linkTransport{memTransport: transport, from: id},
+			StateMachine:      &memStateMachine{},
+			Log:               log,
+			Random:            random.NewSource(int64(i)),
+		})
+		if err != nil {
+			t.Fatalf("can't create node error %v", err)
+			return
+		}
+		transport.nodes[id] = n
+		defer n.Stop()
+	}
+
+	leader := waitLeader(t, transport.nodes)
+	var others []*Node
+	for _, id := range ids {
+		if id != leader.id {
+			others = append(others, transport.nodes[id])
+		}
+	}
+	for i := 0; i < 100 && (others[0].Status().Leader != leader.id || others[1].Status().Leader != leader.id); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// a follower hearing from the leader refuses a candidate of a newer term
+	term := leader.Status().Term
+	reply, err := others[0].RequestVote(&RequestVoteArgs{Term: term + 1, CandidateId: others[1].id, LastLogIndex: 100, LastLogTerm: term})
+	if err != nil || reply.VoteGranted || others[0].Status().Term != term {
+		t.Fatalf("vote reply %+v error %v status %+v", reply, err, others[0].Status())
+		return
+	}
+
+	// a follower cut off from the leader alone can't win the other one over,
+	// the leader keeps leading and no other node leads meanwhile
+	transport.lock.Lock()
+	transport.cut[[2]string{leader.id, others[1].id}] = true
+	transport.lock.Unlock()
+	for i := 0; i < 50; i++ {
+		time.Sleep(5 * time.Millisecond)
+		for _, n := range others {
+			if n.IsLeader() {
+				t.Fatalf("%s leads next to %s, leading %v", n.id, leader.id, leader.IsLeader())
+				return
+			}
+		}
+	}
+	_, err = leader.Propose(context.Background(), []byte("c0"))
+	if err != nil {
+		t.Fatalf("propose with a cut link error %v", err)
+		return
+	}
+
+	// cut off from both the leader loses its lease before another node is
+	// elected
+	transport.lock.Lock()
+	transport.cut[[2]string{leader.id, others[0].id}] = true
+	transport.lock.Unlock()
+	var next *Node
+	for i := 0; i < 1000 && next == nil; i++ {
+		for _, n := range others {
+			if n.IsLeader() {
+				next = n
+			}
+		}
+		if next != nil && leader.IsLeader() {
+			t.Fatalf("%s and %s lead at once", next.id, leader.id)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if next == nil {
+		t.Fatalf("no leader elected after the partition")
+		return
+	}
+}
@@ -0,0 +1,386 @@
+package raft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFileName = "raft_state.json"
+	logFileName   = "raft.log"
+	// Log of json lines written before records were checksummed, it is
+	// converted on open
+	legacyLogFileName = "raft_log.json"
+	// Length and crc32c of the payload
+	recordHeaderSize = 8
+	// Term and index of the entry before its data
+	entryHeaderSize = 16
+	// Largest record of the log, the entry data is limited to what fits
+	maxRecordSize = 16 * 1024 * 1024
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// persistentState must be durable before the node answers rpcs
+type persistentState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"votedFor"`
+	// Index of the last entry applied to the state machine
+	Applied uint64 `json:"applied"`
+}
+
+// storage keeps the state in a small file replaced on every change and the
+// log as records appended to a file which is rewritten on truncation and
+// compaction. A record is the length and crc32c of its payload followed by
+// the payload, the term, index and data of an entry. The first record holds
+// the index and term of the last entry compacted away, the entries follow
+// it. Only a damaged last record is a write torn by a crash, it was never
+// acknowledged and is cut off on open, damage anywhere else fails the open.
+type storage struct {
+	dir     string
+	logFile *os.File
+}
+
+// recordSize returns the size of the record of an entry with data
+func recordSize(data []byte) int {
+	return recordHeaderSize + entryHeaderSize + len(data)
+}
+
+// openStorage returns the state, the last compacted entry and the entries
+// after it
+func openStorage(dir string) (*storage, persistentState, Entry, []Entry, error) {
+	var state persistentState
+	var compacted Entry
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, state, compacted, nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFileName))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, state, compacted, nil, err
+	}
+
+	s := &storage{dir: dir}
+	entries, converted, err := s.convertLegacyLog()
+	if err != nil {
+		return nil, state, compacted, nil, err
+	}
+	if converted {
+		return s, state, compacted, entries, nil
+	}
+
+	logPath := filepath.Join(dir, logFileName)
+	compacted, entries, valid, err := readLog(logPath)
+	if os.IsNotExist(err) {
+		return s, state, compacted, entries, s.truncate(compacted, entries)
+	}
+	if err != nil {
+		return nil, state, compacted, nil, err
+	}
+	if valid >= 0 {
+		// a partially written record was never acknowledged
+		err = truncateFile(logPath, valid)
+		if err != nil {
+			return nil, state, compacted, nil, err
+		}
+	}
+
+	err = s.openLog()
+	if err != nil {
+		return nil, state, compacted, nil, err
+	}
+	return s, state, compacted, entries, nil
+}
+
+// readLog reads the last compacted entry and the entries of the log, if it
+// ends with a torn record it returns the size of the log before it and -1
+// otherwise
+func readLog(filePath string) (Entry, []Entry, int64, error) {
+	var compacted Entry
+	entries := make([]Entry, 0)
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return compacted, entries, -1, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return compacted, nil, -1, err
+	}
+	size := info.Size()
+	if size == 0 {
+		// the log is created with its first record, it is never torn
+		return compacted, nil, -1, fmt.Errorf("raft log %s empty", filePath)
+	}
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, recordHeaderSize)
+	offset := int64(0)
+	for offset < size {
+		if size-offset < recordHeaderSize {
+			break
+		}
+		_, err = io.ReadFull(reader, header)
+		if err != nil {
+			return compacted, nil, -1, err
+		}
+
+		length := int64(binary.LittleEndian.Uint32(header[0:]))
+		end := offset + recordHeaderSize + length
+		if length < entryHeaderSize || length > maxRecordSize-recordHeaderSize {
+			// preallocated space a crash left unwritten reads as zeros
+			rest, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return compacted, nil, -1, err
+			}
+			if length == 0 && allZeros(header[4:]) && allZeros(rest) {
+				break
+			}
+			return compacted, nil, -1, corruptedLog(filePath, offset)
+		}
+		if end > size {
+			break
+		}
+
+		payload := make([]byte, length)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return compacted, nil, -1, err
+		}
+		if crc32.Checksum(payload, crc32cTable) != binary.LittleEndian.Uint32(header[4:]) {
+			if end == size {
+				break
+			}
+			return compacted, nil, -1, corruptedLog(filePath, offset)
+		}
+
+		e := decodeEntry(payload)
+		if offset == 0 {
+			compacted = e
+		} else if e.Index == compacted.Index+uint64(len(entries)+1) {
+			entries = append(entries, e)
+		} else {
+			return compacted, nil, -1, corruptedLog(filePath, offset)
+		}
+		offset = end
+	}
+
+	if offset == size {
+		return compacted, entries, -1, nil
+	}
+	if offset == 0 {
+		// the first record is written with the file, it is never torn
+		return compacted, nil, -1, corruptedLog(filePath, offset)
+	}
+	return compacted, entries, offset, nil
+}
+
+func corruptedLog(filePath string, offset int64) error {
+	return fmt.Errorf("raft log %s record at %d corrupted", filePath, offset)
+}
+
+func allZeros(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// convertLegacyLog rewrites a log of json lines into records, it reports
+// whether there was one
+func (s *storage) convertLegacyLog() ([]Entry, bool, error) {
+	legacyPath := filepath.Join(s.dir, legacyLogFileName)
+	file, err := os.Open(legacyPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer file.Close()
+
+	entries := make([]Entry, 0)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without its newline is torn
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		var e Entry
+		if json.Unmarshal(line, &e) != nil || e.Index != uint64(len(entries)+1) {
+			return nil, false, fmt.Errorf("raft log %s entry %d corrupted", legacyPath, len(entries)+1)
+		}
+		entries = append(entries, e)
+	}
+
+	err = s.truncate(Entry{}, entries)
+	if err != nil {
+		return nil, false, err
+	}
+	err = os.Remove(legacyPath)
+	if err != nil {
+		return nil, false, err
+	}
+	return entries, true, syncDir(s.dir)
+}
+
+func syncDir(dirPath string) error {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// truncateFile cuts the file at filePath to size durably
+func truncateFile(filePath string, size int64) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = file.Truncate(size)
+	if err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// replaceFile atomically replaces the file at filePath with data
+func replaceFile(filePath string, data []byte) error {
+	tmpPath := filePath + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(filePath))
+}
+
+func (s *storage) saveState(state persistentState) error {
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(s.dir, stateFileName), data)
+}
+
+func (s *storage) openLog() error {
+	file, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.logFile = file
+	return nil
+}
+
+func decodeEntry(payload []byte) Entry {
+	e := Entry{
+		Term:  binary.LittleEndian.Uint64(payload[0:]),
+		Index: binary.LittleEndian.Uint64(payload[8:]),
+	}
+	if len(payload) > entryHeaderSize {
+		e.Data = payload[entryHeaderSize:]
+	}
+	return e
+}
+
+func encodeEntries(entries []Entry) ([]byte, error) {
+	var buf bytes.Buffer
+	for i := range entries {
+		e := &entries[i]
+		if recordSize(e.Data) > maxRecordSize {
+			return nil, ErrTooLarge
+		}
+
+		record := make([]byte, recordHeaderSize+entryHeaderSize)
+		binary.LittleEndian.PutUint32(record[0:], uint32(entryHeaderSize+len(e.Data)))
+		binary.LittleEndian.PutUint64(record[8:], e.Term)
+		binary.LittleEndian.PutUint64(record[16:], e.Index)
+		h := crc32.New(crc32cTable)
+		h.Write(record[recordHeaderSize:])
+		h.Write(e.Data)
+		binary.LittleEndian.PutUint32(record[4:], h.Sum32())
+
+		buf.Write(record)
+		buf.Write(e.Data)
+	}
+	return buf.Bytes(), nil
+}
+
+// append makes entries durable at the end of the log
+func (s *storage) append(entries []Entry) error {
+	data, err := encodeEntries(entries)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.logFile.Write(data)
+	if err != nil {
+		return err
+	}
+	return s.logFile.Sync()
+}
+
+// truncate replaces the log with the last compacted entry and the entries
+// after it
+func (s *storage) truncate(compacted Entry, entries []Entry) error {
+	data, err := encodeEntries(append([]Entry{{Term: compacted.Term, Index: compacted.Index}}, entries...))
+	if err != nil {
+		return err
+	}
+
+	if s.logFile != nil {
+		s.logFile.Close()
+		s.logFile = nil
+	}
+
+	err = replaceFile(filepath.Join(s.dir, logFileName), data)
+	if err != nil {
+		return err
+	}
+	return s.openLog()
+}
+
+func (s *storage) close() {
+	if s.logFile != nil {
+		s.logFile.Close()
+		s.logFile = nil
+	}
+}
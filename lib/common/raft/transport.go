@@ -0,0 +1,131 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"ddb/lib/common/auth"
+)
+
+const (
+	requestVotePath   = "/raft/vote"
+	appendEntriesPath = "/raft/append"
+)
+
+// Transport delivers rpcs to peers identified by their ids
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error)
+	AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error)
+}
+
+// HttpTransport sends rpcs as json posts, peer ids are base urls of the
+// servers which route the rpc paths to ServeRequestVote and
+// ServeAppendEntries
+type HttpTransport struct {
+	client *http.Client
+}
+
+// NewHttpTransport signs rpcs with creds, nil creds send them unsigned.
+// tlsConfig is used for https peers, nil means the system defaults.
+func NewHttpTransport(timeout time.Duration, creds *auth.Credentials, tlsConfig *tls.Config) *HttpTransport {
+	var transport http.RoundTripper = &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: 4,
+		IdleConnTimeout:     30 * time.Second,
+	}
+	if creds != nil {
+		transport = &auth.Transport{Base: transport, Credentials: creds}
+	}
+	return &HttpTransport{client: &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}}
+}
+
+func (t *HttpTransport) post(ctx context.Context, url string, args interface{}, reply interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("rpc %s status %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (t *HttpTransport) RequestVote(ctx context.Context, peer string, args *RequestVoteArgs) (*RequestVoteReply, error) {
+	reply := &RequestVoteReply{}
+	err := t.post(ctx, peer+requestVotePath, args, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (t *HttpTransport) AppendEntries(ctx context.Context, peer string, args *AppendEntriesArgs) (*AppendEntriesReply, error) {
+	reply := &AppendEntriesReply{}
+	err := t.post(ctx, peer+appendEntriesPath, args, reply)
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func writeReply(w http.ResponseWriter, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// ServeRequestVote handles RequestVote rpcs of HttpTransport at /raft/vote
+func (n *Node) ServeRequestVote(w http.ResponseWriter, r *http.Request) {
+	var args RequestVoteArgs
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reply, err := n.RequestVote(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeReply(w, reply)
+}
+
+// ServeAppendEntries handles AppendEntries rpcs of HttpTransport at
+// /raft/append
+func (n *Node) ServeAppendEntries(w http.ResponseWriter, r *http.Request) {
+	var args AppendEntriesArgs
+	err := json.NewDecoder(r.Body).Decode(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	reply, err := n.AppendEntries(&args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeReply(w, reply)
+}
@@ -4,6 +4,9 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	mathrand "math/rand"
+	"sync"
+	"time"
 )
 
 func GenerateRandomHexString(numBytes int) string {
@@ -14,3 +17,32 @@ func GenerateRandomHexString(numBytes int) string {
 	}
 	return hex.EncodeToString(b)
 }
+
+// Source produces pseudo random numbers, components take a Source so tests
+// can make randomized behavior reproducible
+type Source interface {
+	// Int63n returns a number in [0, n)
+	Int63n(n int64) int64
+}
+
+type lockedSource struct {
+	lock sync.Mutex
+	rand *mathrand.Rand
+}
+
+func (s *lockedSource) Int63n(n int64) int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.rand.Int63n(n)
+}
+
+// NewSource returns a Source safe for concurrent use producing the same
+// numbers for the same seed
+func NewSource(seed int64) Source {
+	return &lockedSource{rand: mathrand.New(mathrand.NewSource(seed))}
+}
+
+// NewTimeSource returns a Source seeded by the current time
+func NewTimeSource() Source {
+	return NewSource(time.Now().UnixNano())
+}
@@ -0,0 +1,47 @@
+package random
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestSource(t *testing.T) {
+	a := NewSource(7)
+	b := NewSource(7)
+	for i := 0; i < 100; i++ {
+		x, y := a.Int63n(10), b.Int63n(10)
+		if x != y {
+			t.Fatalf("sources of one seed returned %d and %d", x, y)
+			return
+		}
+		if x < 0 || x >= 10 {
+			t.Fatalf("number %d out of range", x)
+			return
+		}
+	}
+
+	same := true
+	c, d := NewSource(1), NewSource(2)
+	for i := 0; i < 10; i++ {
+		if c.Int63n(1<<62) != d.Int63n(1<<62) {
+			same = false
+		}
+	}
+	if same {
+		t.Fatalf("sources of different seeds returned the same numbers")
+		return
+	}
+}
+
+func TestGenerateRandomHexString(t *testing.T) {
+	s := GenerateRandomHexString(5)
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 5 {
+		t.Fatalf("hex string %s error %v", s, err)
+		return
+	}
+	if GenerateRandomHexString(5) == s {
+		t.Fatalf("hex strings repeat")
+		return
+	}
+}
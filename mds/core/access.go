@@ -0,0 +1,252 @@
+package mds
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"ddb/lib/common/auth"
+	"ddb/lib/common/log"
+)
+
+const (
+	defaultAccessExportInterval = time.Minute
+	// Groups tracked per interval, keys of further groups count as
+	// accessOtherPrefix
+	maxAccessGroups   = 1024
+	accessOtherPrefix = "other"
+	// Value sizes are counted in power of two buckets
+	accessSizeBuckets   = 64
+	accessExportTimeout = 10 * time.Second
+)
+
+// PrefixAccess summarizes the accesses of a key group during an interval.
+// Groups are the configured prefixes, other keys are grouped by a hash of
+// their first '/' separated segment so no key leaves the node.
+type PrefixAccess struct {
+	Prefix         string  `json:"prefix"`
+	Reads          int64   `json:"reads"`
+	Writes         int64   `json:"writes"`
+	Deletes        int64   `json:"deletes"`
+	ReadsPerSec    float64 `json:"readsPerSec"`
+	WritesPerSec   float64 `json:"writesPerSec"`
+	ReadWriteRatio float64 `json:"readWriteRatio"`
+	// Upper bounds of the written value size percentiles in bytes
+	ValueSize50P int64 `json:"valueSize50p"`
+	ValueSize95P int64 `json:"valueSize95p"`
+	ValueSize99P int64 `json:"valueSize99p"`
+}
+
+// AccessSummary is one exported record, times are unix nanoseconds
+type AccessSummary struct {
+	Node     string         `json:"node"`
+	Start    int64          `json:"start"`
+	End      int64          `json:"end"`
+	Prefixes []PrefixAccess `json:"prefixes"`
+}
+
+type accessCounters struct {
+	reads   int64
+	writes  int64
+	deletes int64
+	sizes   [accessSizeBuckets]int64
+}
+
+// accessLog counts accesses per key group between exports, a nil log
+// counts nothing
+type accessLog struct {
+	lock     sync.Mutex
+	prefixes []string
+	groups   map[string]*accessCounters
+	start    time.Time
+}
+
+func newAccessLog(prefixes []string, now time.Time) *accessLog {
+	return &accessLog{prefixes: prefixes, groups: make(map[string]*accessCounters), start: now}
+}
+
+// group returns the configured prefix of key or an anonymized group
+func (a *accessLog) group(key string) string {
+	for _, prefix := range a.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return prefix
+		}
+	}
+
+	segment := key
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		segment = key[:i+1]
+	}
+	sum := sha256.Sum256([]byte(segment))
+	return "h:" + hex.EncodeToString(sum[:4])
+}
+
+func (a *accessLog) counters(key string) *accessCounters {
+	group := a.group(key)
+	c := a.groups[group]
+	if c == nil {
+		if len(a.groups) >= maxAccessGroups {
+			group = accessOtherPrefix
+			c = a.groups[group]
+		}
+		if c == nil {
+			c = &accessCounters{}
+			a.groups[group] = c
+		}
+	}
+	return c
+}
+
+func (a *accessLog) read(key string) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.counters(key).reads++
+}
+
+func (a *accessLog) write(key string, size int) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c := a.counters(key)
+	c.writes++
+	c.sizes[bits.Len64(uint64(size))]++
+}
+
+func (a *accessLog) delete(key string) {
+	if a == nil {
+		return
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.counters(key).deletes++
+}
+
+// sizePercentile returns the upper bound of the bucket holding the p-th
+// fraction of the written sizes
+func (c *accessCounters) sizePercentile(p float64) int64 {
+	if c.writes == 0 {
+		return 0
+	}
+
+	rank := int64(p * float64(c.writes))
+	var seen int64
+	for i, n := range c.sizes {
+		seen += n
+		if seen > rank {
+			return int64(1)<<uint(i) - 1
+		}
+	}
+	return math.MaxInt64
+}
+
+// take returns the summary of the accesses since the last take and starts a
+// new interval
+func (a *accessLog) take(node string, now time.Time) *AccessSummary {
+	a.lock.Lock()
+	groups := a.groups
+	start := a.start
+	a.groups = make(map[string]*accessCounters)
+	a.start = now
+	a.lock.Unlock()
+
+	summary := &AccessSummary{Node: node, Start: start.UnixNano(), End: now.UnixNano(),
+		Prefixes: make([]PrefixAccess, 0, len(groups))}
+	secs := now.Sub(start).Seconds()
+	for prefix, c := range groups {
+		pa := PrefixAccess{
+			Prefix:       prefix,
+			Reads:        c.reads,
+			Writes:       c.writes,
+			Deletes:      c.deletes,
+			ValueSize50P: c.sizePercentile(0.50),
+			ValueSize95P: c.sizePercentile(0.95),
+			ValueSize99P: c.sizePercentile(0.99),
+		}
+		if secs > 0 {
+			pa.ReadsPerSec = float64(c.reads) / secs
+			pa.WritesPerSec = float64(c.writes+c.deletes) / secs
+		}
+		if c.writes+c.deletes > 0 {
+			pa.ReadWriteRatio = float64(c.reads) / float64(c.writes+c.deletes)
+		}
+		summary.Prefixes = append(summary.Prefixes, pa)
+	}
+	sort.Slice(summary.Prefixes, func(i, j int) bool { return summary.Prefixes[i].Prefix < summary.Prefixes[j].Prefix })
+	return summary
+}
+
+// sendAccessSummary posts the summary to an http sink with httpClient or
+// appends it as a json line to a file sink
+func (mds *Mds) sendAccessSummary(httpClient *http.Client, summary *AccessSummary) error {
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+
+	sink := mds.accessSink
+	if strings.HasPrefix(sink, "http://") || strings.HasPrefix(sink, "https://") {
+		resp, err := httpClient.Post(sink, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("access sink %s status %d", sink, resp.StatusCode)
+		}
+		return nil
+	}
+
+	file, err := os.OpenFile(sink, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// exportAccess sends an access summary every export interval until stopped
+func (mds *Mds) exportAccess() {
+	defer mds.agentWg.Done()
+
+	var transport http.RoundTripper = &http.Transport{TLSClientConfig: mds.peerTls}
+	if mds.peerCredentials != nil {
+		transport = &auth.Transport{Base: transport, Credentials: mds.peerCredentials, Clock: mds.clock}
+	}
+	httpClient := &http.Client{Timeout: accessExportTimeout, Transport: transport}
+
+	for {
+		select {
+		case <-mds.clock.After(mds.accessInterval):
+		case <-mds.agentStop:
+			return
+		}
+
+		summary := mds.access.take(mds.nodeId, mds.clock.Now())
+		err := mds.sendAccessSummary(httpClient, summary)
+		if err != nil {
+			mds.log.Pf(log.LevelError, "access export to %s error %v", mds.accessSink, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package mds
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ddb/lib/common/random"
+)
+
+func TestAccessExport(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestAccessExport_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	start := time.Unix(1000, 0)
+	access := newAccessLog([]string{"users/"}, start)
+	access.write("users/a", 100)
+	access.write("users/b", 3)
+	for i := 0; i < 3; i++ {
+		access.read("users/a")
+	}
+	access.delete("users/b")
+	access.write("orders/1", 10)
+	access.read("orders/2")
+	summary := access.take("node1", start.Add(time.Second))
+
+	// keys outside the prefixes are only known by a hash of their first
+	// segment, sizes by the upper bound of their power of two bucket
+	sum := sha256.Sum256([]byte("orders/"))
+	orders := "h:" + hex.EncodeToString(sum[:4])
+	expected := fmt.Sprintf(`{"node":"node1","start":1000000000000,"end":1001000000000,"prefixes":[`+
+		`{"prefix":"%s","reads":1,"writes":1,"deletes":0,"readsPerSec":1,"writesPerSec":1,"readWriteRatio":1,`+
+		`"valueSize50p":15,"valueSize95p":15,"valueSize99p":15},`+
+		`{"prefix":"users/","reads":3,"writes":2,"deletes":1,"readsPerSec":3,"writesPerSec":3,"readWriteRatio":1,`+
+		`"valueSize50p":127,"valueSize95p":127,"valueSize99p":127}]}`, orders)
+
+	// a file sink gets a json line per summary
+	mds := &Mds{accessSink: filepath.Join(rootPath, "access.log")}
+	for i := 0; i < 2; i++ {
+		err = mds.sendAccessSummary(nil, summary)
+		if err != nil {
+			t.Fatalf("send to file error %v", err)
+			return
+		}
+	}
+	data, err := ioutil.ReadFile(mds.accessSink)
+	if err != nil {
+		t.Fatalf("read sink error %v", err)
+		return
+	}
+	if string(data) != expected+"\n"+expected+"\n" {
+		t.Fatalf("file sink %s expected %s", data, expected)
+		return
+	}
+
+	// an http sink gets the same record posted
+	var posted string
+	var contentType string
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		posted = string(body)
+		contentType = r.Header.Get("Content-Type")
+		if strings.HasSuffix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer sink.Close()
+	mds.accessSink = sink.URL + "/access"
+	err = mds.sendAccessSummary(sink.Client(), summary)
+	if err != nil || posted != expected || contentType != "application/json" {
+		t.Fatalf("http sink %s content type %s error %v", posted, contentType, err)
+		return
+	}
+	mds.accessSink = sink.URL + "/fail"
+	if err = mds.sendAccessSummary(sink.Client(), summary); err == nil {
+		t.Fatalf("failed post not reported")
+		return
+	}
+
+	// the next interval starts empty
+	summary = access.take("node1", start.Add(2*time.Second))
+	if len(summary.Prefixes) != 0 || summary.Start != start.Add(time.Second).UnixNano() {
+		t.Fatalf("next summary %+v", summary)
+		return
+	}
+}
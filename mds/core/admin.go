@@ -0,0 +1,321 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+)
+
+func adminError(err error) error {
+	switch {
+	case os.IsExist(err):
+		return ErrAlreadyExists
+	case os.IsNotExist(err):
+		return ErrNotFound
+	default:
+		return err
+	}
+}
+
+func backup(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.AdminRequest{}
+	resp := &client.AdminResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, adminError(err), resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request backup %s", req.Path)
+
+	if req.Path == "" {
+		err = ErrBadRequest
+		return
+	}
+
+	job, err := GetMds().jobs.submit(client.Job{Type: client.JobBackup, Path: req.Path})
+	if err != nil {
+		return
+	}
+
+	job, err = GetMds().jobs.wait(r.Context(), job.Id)
+	if err != nil {
+		return
+	}
+
+	switch job.State {
+	case client.JobSucceeded:
+		resp.Path = req.Path
+	case client.JobCanceled:
+		err = context.Canceled
+	default:
+		err = jobError(job.Error)
+	}
+}
+
+// jobError converts the message of a failed job back into the error it was
+// made from
+func jobError(message string) error {
+	for _, err := range []error{ErrNotFound, ErrAlreadyExists, ErrBadRequest, ErrShuttingDown,
+		lsm.ErrDiskFull, lsm.ErrBusy, lsm.ErrClosed} {
+		if err.Error() == message {
+			return err
+		}
+	}
+	return fmt.Errorf("%s", message)
+}
+
+func restore(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.AdminRequest{}
+	resp := &client.AdminResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, adminError(err), resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request restore %s dry run %v", req.Path, req.DryRun)
+
+	if req.Path == "" {
+		err = ErrBadRequest
+		return
+	}
+
+	if req.DryRun {
+		resp.Preflight, err = GetMds().restorePreflight(req.Path)
+		return
+	}
+	resp.Path, err = GetMds().restore(req.Path)
+}
+
+func warmup(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.BaseRequest{}
+	resp := &client.WarmupResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request warmup")
+
+	stats, err := GetMds().storage().Warmup(r.Context())
+	resp.Tables = stats.Tables
+	resp.IndexBytes = stats.IndexBytes
+	resp.Blocks = stats.Blocks
+	resp.Skipped = stats.Skipped
+	resp.CacheSize = stats.CacheSize
+}
+
+// suspendBackground stops background flushes and merges of the storage,
+// e.g. for a checkpoint, it responds once those in progress finished
+func suspendBackground(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.BaseRequest{}
+	resp := &client.BaseResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request suspend background")
+	err = GetMds().storage().Suspend()
+}
+
+func resumeBackground(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.BaseRequest{}
+	resp := &client.BaseResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request resume background")
+	GetMds().storage().Resume()
+}
+
+// warmup preloads the cache after startup so the first requests don't all
+// go to disk
+func (mds *Mds) warmup() {
+	stats, err := mds.storage().Warmup(context.Background())
+	if err != nil {
+		mds.log.Pf(log.LevelError, "warmup error %v", err)
+		return
+	}
+	mds.log.Pf(0, "warmup tables %d index bytes %d blocks %d skipped %d cache size %d",
+		stats.Tables, stats.IndexBytes, stats.Blocks, stats.Skipped, stats.CacheSize)
+}
+
+// restorePreflight checks the snapshot in dir and estimates its restore,
+// the storage isn't touched
+func (mds *Mds) restorePreflight(dir string) (*client.RestorePreflight, error) {
+	start := time.Now()
+	catalog, problems, err := lsm.CheckSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &client.RestorePreflight{Compatible: true, Problems: problems}
+	if catalog != nil {
+		p.Catalog = true
+		p.FormatVersion = catalog.FormatVersion
+		p.Compatible = catalog.Compatible()
+		p.MaxVersion = catalog.MaxVersion
+	}
+
+	names, err := lsm.StorageFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		p.Files++
+		p.Size += info.Size()
+	}
+
+	_, free := diskSpace(mds.storagePath)
+	p.DiskNeeded = p.Size
+	p.DiskFree = int64(free)
+	p.EstimatedMs = time.Since(start).Milliseconds()
+	mds.log.Pf(0, "restore preflight %s files %d size %d problems %d", dir, p.Files, p.Size, len(p.Problems))
+	return p, nil
+}
+
+// restore replaces the storage with the snapshot in dir, api requests are
+// rejected while the storage is swapped. Current storage files are moved
+// aside into a directory next to the storage whose path is returned and put
+// back if the snapshot can't be opened.
+func (mds *Mds) restore(dir string) (string, error) {
+	// nodes of a cluster have to be restored together
+	if mds.raft != nil {
+		return "", ErrNotImplemented
+	}
+
+	if !atomic.CompareAndSwapInt32(&mds.state, mdsStateRunning, mdsStateRestoring) {
+		return "", ErrShuttingDown
+	}
+	defer atomic.StoreInt32(&mds.state, mdsStateRunning)
+
+	// a job interrupted here runs again on the restored storage
+	mds.jobs.suspend()
+	defer mds.jobs.resume()
+
+	// config changes wait for the new storage
+	mds.configLock.Lock()
+	defer mds.configLock.Unlock()
+
+	names, err := lsm.StorageFiles(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", ErrNotFound
+	}
+
+	// handlers which got past the state check finish before the storage
+	// closes
+	mds.requestLock.Lock()
+	defer mds.requestLock.Unlock()
+
+	mds.storage().Close()
+
+	aside := filepath.Clean(mds.storagePath) + ".restore_" + strconv.FormatInt(mds.clock.Now().UnixNano(), 10)
+	err = moveStorageFiles(mds.storagePath, aside)
+	if err == nil {
+		err = lsm.Restore(dir, mds.storagePath)
+	}
+
+	var kvs *lsm.Lsm
+	if err == nil {
+		kvs, err = lsm.OpenLsm(mds.log, mds.storagePath, mds.lsmParams)
+	}
+
+	if err != nil {
+		mds.log.Pf(log.LevelError, "restore %s error %v, rolling back", dir, err)
+		removeStorageFiles(mds.storagePath)
+		rollbackErr := moveStorageFiles(aside, mds.storagePath)
+		if rollbackErr == nil {
+			os.Remove(aside)
+			kvs, rollbackErr = lsm.OpenLsm(mds.log, mds.storagePath, mds.lsmParams)
+		}
+		if rollbackErr != nil {
+			mds.log.Pf(log.LevelError, "restore rollback error %v", rollbackErr)
+			return "", err
+		}
+		mds.setStorage(kvs)
+		return "", err
+	}
+
+	mds.setStorage(kvs)
+	mds.log.Pf(0, "restore %s done, previous storage in %s", dir, aside)
+	return aside, nil
+}
+
+func moveStorageFiles(fromDir string, toDir string) error {
+	names, err := lsm.StorageFiles(fromDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(toDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = os.Rename(filepath.Join(fromDir, name), filepath.Join(toDir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeStorageFiles(dir string) {
+	names, err := lsm.StorageFiles(dir)
+	if err != nil {
+		return
+	}
+
+	for _, name := range names {
+		os.Remove(filepath.Join(dir, name))
+	}
+}
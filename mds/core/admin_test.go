@@ -0,0 +1,173 @@
+package mds
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	client "ddb/client/core"
+	"ddb/lib/common/lsm"
+)
+
+func TestRestore(t *testing.T) {
+	server, stop := startTestMds(t, "TestRestore", &MdsParameters{})
+	defer stop()
+	debug := httptest.NewServer(GetMds().debugServer.Handler)
+	defer debug.Close()
+
+	ctx := context.Background()
+	api := client.NewClient(server.URL)
+	admin := client.NewClient(debug.URL)
+	err := api.SetKey(ctx, "k1", "v1")
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+	backup := filepath.Join(filepath.Dir(GetMds().storagePath), "backup")
+	err = admin.Backup(ctx, backup)
+	if err != nil {
+		t.Fatalf("backup error %v", err)
+		return
+	}
+	err = api.SetKey(ctx, "k2", "v2")
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+
+	// requests keep coming while the storage is swapped
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c := client.NewClient(server.URL)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			c.GetKey(ctx, "k1")
+			c.SetKey(ctx, "k3", "v3")
+		}
+	}()
+
+	aside, err := admin.Restore(ctx, backup)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("restore error %v", err)
+		return
+	}
+
+	// the previous storage is kept next to the storage, not in it
+	if strings.HasPrefix(aside, GetMds().storagePath+string(filepath.Separator)) {
+		t.Fatalf("previous storage %s inside the storage", aside)
+		return
+	}
+	names, err := lsm.StorageFiles(aside)
+	if err != nil || len(names) == 0 {
+		t.Fatalf("previous storage files %v error %v", names, err)
+		return
+	}
+
+	value, err := api.GetKey(ctx, "k1")
+	if err != nil || value != "v1" {
+		t.Fatalf("get restored key %s error %v", value, err)
+		return
+	}
+	_, err = api.GetKey(ctx, "k2")
+	if err != client.ErrNotFound {
+		t.Fatalf("get key written after the backup error %v", err)
+		return
+	}
+}
+
+func TestRestorePreflight(t *testing.T) {
+	server, stop := startTestMds(t, "TestRestorePreflight", &MdsParameters{})
+	defer stop()
+	debug := httptest.NewServer(GetMds().debugServer.Handler)
+	defer debug.Close()
+
+	ctx := context.Background()
+	api := client.NewClient(server.URL)
+	admin := client.NewClient(debug.URL)
+	err := api.SetKey(ctx, "k1", "v1")
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+	root := filepath.Dir(GetMds().storagePath)
+	backup := filepath.Join(root, "backup")
+	err = admin.Backup(ctx, backup)
+	if err != nil {
+		t.Fatalf("backup error %v", err)
+		return
+	}
+	err = api.SetKey(ctx, "k2", "v2")
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+
+	storage := GetMds().storage()
+	before, err := lsm.StorageFiles(GetMds().storagePath)
+	if err != nil {
+		t.Fatalf("storage files error %v", err)
+		return
+	}
+
+	p, err := admin.RestorePreflight(ctx, backup)
+	if err != nil {
+		t.Fatalf("preflight error %v", err)
+		return
+	}
+	if !p.Ok() || !p.Catalog || p.Files == 0 || p.Size == 0 || p.DiskNeeded != p.Size {
+		t.Fatalf("preflight %+v", p)
+		return
+	}
+
+	// a damaged backup is reported
+	catalog, err := lsm.ReadCatalog(backup)
+	if err != nil || len(catalog.Files) == 0 {
+		t.Fatalf("catalog %+v error %v", catalog, err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(backup, catalog.Files[0].Name), []byte("damaged"), 0600)
+	if err != nil {
+		t.Fatalf("write error %v", err)
+		return
+	}
+	p, err = admin.RestorePreflight(ctx, backup)
+	if err != nil || p.Ok() || len(p.Problems) == 0 {
+		t.Fatalf("preflight of damaged backup %+v error %v", p, err)
+		return
+	}
+
+	// the live storage is left as it was
+	after, err := lsm.StorageFiles(GetMds().storagePath)
+	if err != nil || !reflect.DeepEqual(before, after) {
+		t.Fatalf("storage files %v before %v error %v", after, before, err)
+		return
+	}
+	if GetMds().storage() != storage {
+		t.Fatalf("storage swapped by a dry run")
+		return
+	}
+	asides, _ := filepath.Glob(GetMds().storagePath + ".restore_*")
+	if len(asides) != 0 {
+		t.Fatalf("dry run moved the storage to %v", asides)
+		return
+	}
+	value, err := api.GetKey(ctx, "k2")
+	if err != nil || value != "v2" {
+		t.Fatalf("get key written after the backup %s error %v", value, err)
+		return
+	}
+}
@@ -0,0 +1,201 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/log"
+)
+
+const (
+	defaultReportInterval = 10 * time.Second
+)
+
+// nodeConfig returns the live config in effect
+func (mds *Mds) nodeConfig() client.NodeConfig {
+	mds.configLock.Lock()
+	defer mds.configLock.Unlock()
+
+	logLevel := mds.log.Level()
+	sampleRate := mds.sampler.getRate()
+	return client.NodeConfig{
+		MaxValueSize:      atomic.LoadInt64(&mds.maxValueSize),
+		MergeTimeoutMs:    mds.lsmParams.MergeTimeoutMs,
+		LogLevel:          &logLevel,
+		RequestSampleRate: &sampleRate,
+	}
+}
+
+// applyConfig changes the settings set in config, they are kept in the
+// storage parameters so a restored storage runs with them as well
+func (mds *Mds) applyConfig(config *client.NodeConfig) error {
+	if config.MaxValueSize < 0 || config.MergeTimeoutMs < 0 {
+		return ErrBadRequest
+	}
+	if config.LogLevel != nil && (*config.LogLevel < log.LevelError || *config.LogLevel > log.LevelDebug) {
+		return ErrBadRequest
+	}
+	if config.RequestSampleRate != nil && (*config.RequestSampleRate < 0 || *config.RequestSampleRate > 1) {
+		return ErrBadRequest
+	}
+
+	mds.configLock.Lock()
+	defer mds.configLock.Unlock()
+
+	if config.MaxValueSize > 0 {
+		mds.lsmParams.MaxValueSize = config.MaxValueSize
+		atomic.StoreInt64(&mds.maxValueSize, config.MaxValueSize)
+		mds.storage().SetMaxValueSize(config.MaxValueSize)
+	}
+	if config.MergeTimeoutMs > 0 {
+		mds.lsmParams.MergeTimeoutMs = config.MergeTimeoutMs
+		mds.storage().SetMergeTimeout(time.Duration(config.MergeTimeoutMs) * time.Millisecond)
+	}
+	if config.LogLevel != nil {
+		mds.log.SetLevel(*config.LogLevel)
+	}
+	if config.RequestSampleRate != nil {
+		mds.sampler.setRate(*config.RequestSampleRate)
+	}
+	mds.log.Pf(log.LevelInfo, "config max value size %d merge timeout ms %d log level %d",
+		atomic.LoadInt64(&mds.maxValueSize), mds.lsmParams.MergeTimeoutMs, mds.log.Level())
+	return nil
+}
+
+func (mds *Mds) nodeRole() string {
+	if mds.raft != nil {
+		return mds.raft.Status().Role
+	}
+	if mds.isFollower() {
+		return "follower"
+	}
+	return "primary"
+}
+
+func (mds *Mds) nodeReport() *client.NodeReport {
+	hits, misses, size := mds.storage().CacheStats()
+	cs := mds.storage().CompactionStats()
+
+	return &client.NodeReport{
+		Id:         mds.nodeId,
+		ApiAddress: mds.apiServer.Addr,
+		Role:       mds.nodeRole(),
+		Version:    mds.storage().Version(),
+		StartedAt:  mds.startedAt,
+		ReportedAt: mds.clock.Now().UnixNano(),
+		Stats: client.NodeStats{
+			SetKeys:      int(mds.stats.setKey.Count()),
+			GetKeys:      int(mds.stats.getKey.Count()),
+			DeleteKeys:   int(mds.stats.deleteKey.Count()),
+			Batches:      int(mds.stats.batch.Count()),
+			Scans:        int(mds.stats.scan.Count()),
+			CacheHits:    hits,
+			CacheMisses:  misses,
+			CacheSize:    size,
+			Tables:       cs.Tables,
+			PendingBytes: cs.PendingBytes,
+			Merges:       cs.Merges,
+			PrefixCounts: mds.storage().PrefixCounts(),
+		},
+		Config: mds.nodeConfig(),
+	}
+}
+
+// report sends a node report to the controller every report interval and
+// applies the config pushed in the response until stopped
+func (mds *Mds) report() {
+	defer mds.agentWg.Done()
+
+	c := client.NewClientWithOptions(mds.controllerUrl, mds.peerOptions())
+	for {
+		config, err := c.Report(context.Background(), mds.nodeReport())
+		if err != nil {
+			mds.log.Pf(log.LevelError, "report to %s error %v", mds.controllerUrl, err)
+		} else if config != nil {
+			err = mds.applyConfig(config)
+			if err != nil {
+				mds.log.Pf(log.LevelError, "pushed config error %v", err)
+			}
+		}
+
+		select {
+		case <-mds.clock.After(mds.reportInterval):
+		case <-mds.agentStop:
+			return
+		}
+	}
+}
+
+func getConfig(w http.ResponseWriter, r *http.Request) {
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.ConfigResponse{}
+	resp.Config = GetMds().nodeConfig()
+	completeRequest(w, requestId, nil, resp)
+}
+
+func listEvents(w http.ResponseWriter, r *http.Request) {
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.EventsResponse{Events: make([]client.Event, 0)}
+	for _, event := range GetMds().storage().Events() {
+		resp.Events = append(resp.Events, client.Event{
+			Seq:        event.Seq,
+			Time:       event.Time,
+			Type:       event.Type,
+			Message:    event.Message,
+			DurationMs: event.Duration.Milliseconds(),
+		})
+	}
+	completeRequest(w, requestId, nil, resp)
+}
+
+func listTables(w http.ResponseWriter, r *http.Request) {
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.TablesResponse{}
+	for _, props := range GetMds().storage().TableProperties() {
+		resp.Tables = append(resp.Tables, client.TableProperties{
+			Path:         props.Path,
+			MinId:        props.MinId,
+			MaxId:        props.MaxId,
+			Size:         props.Size,
+			Nodes:        props.Nodes,
+			KeysPerIndex: props.KeysPerIndex,
+			IndexEntries: props.IndexEntries,
+			Compression:  props.Compression.String(),
+			Checksum:     props.Checksum.String(),
+			MaxVersion:   props.MaxVersion,
+			IndexBytes:   props.IndexBytes,
+
+			MinWrittenAt:  props.MinWrittenAt,
+			MaxWrittenAt:  props.MaxWrittenAt,
+			MeanWrittenAt: props.MeanWrittenAt,
+			WrittenNodes:  props.WrittenNodes,
+		})
+	}
+	completeRequest(w, requestId, nil, resp)
+}
+
+func setConfig(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.ConfigRequest{}
+	resp := &client.ConfigResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request config")
+
+	err = GetMds().applyConfig(&req.Config)
+	if err != nil {
+		return
+	}
+	resp.Config = GetMds().nodeConfig()
+}
@@ -0,0 +1,314 @@
+package mds
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+
+	"ddb/lib/common/auth"
+)
+
+// Credential lets a client in by its secret, either sent as a bearer token
+// or used to sign requests with the id
+type Credential struct {
+	Id     string `json:"id"`
+	Secret string `json:"secret"`
+	// Key prefixes the credential may access, empty means all keys
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Forbid writes of the keys
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Allow the admin, replication and raft apis, which aren't limited to
+	// prefixes
+	Admin bool `json:"admin,omitempty"`
+}
+
+// Kinds of access a route requires of the credential of a request
+const (
+	accessRead = iota
+	accessWrite
+	accessAdmin
+)
+
+type credentialKey struct{}
+
+// authenticator checks requests against the configured credentials, a nil
+// authenticator lets every request in with full access
+type authenticator struct {
+	credentials []*Credential
+	byId        map[string]*Credential
+}
+
+// loadCredentials reads a json array of credentials
+func loadCredentials(filePath string) ([]Credential, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials []Credential
+	err = json.Unmarshal(data, &credentials)
+	if err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+// newAuthenticator returns nil if no credentials are configured
+func newAuthenticator(params *MdsParameters) (*authenticator, error) {
+	credentials := append([]Credential(nil), params.Credentials...)
+	if params.AuthFile != "" {
+		loaded, err := loadCredentials(params.AuthFile)
+		if err != nil {
+			return nil, err
+		}
+		credentials = append(credentials, loaded...)
+	}
+	if len(credentials) == 0 {
+		if params.PeerKeyId != "" {
+			return nil, ErrBadRequest
+		}
+		return nil, nil
+	}
+
+	a := &authenticator{byId: make(map[string]*Credential)}
+	for i := range credentials {
+		cred := &credentials[i]
+		if cred.Id == "" || cred.Secret == "" || a.byId[cred.Id] != nil {
+			return nil, ErrBadRequest
+		}
+		a.credentials = append(a.credentials, cred)
+		a.byId[cred.Id] = cred
+	}
+	if params.PeerKeyId != "" && a.byId[params.PeerKeyId] == nil {
+		return nil, ErrBadRequest
+	}
+	return a, nil
+}
+
+// peerCredentials returns the credentials this server signs its requests to
+// the primary and raft peers with, nil if they aren't authenticated
+func (a *authenticator) peerCredentials(keyId string) *auth.Credentials {
+	if a == nil || keyId == "" {
+		return nil
+	}
+	return &auth.Credentials{KeyId: keyId, Secret: a.byId[keyId].Secret}
+}
+
+// authenticate returns the credential of the request. A signed request must
+// be recent and its body is verified against the signed content hash, a
+// body which doesn't match fails to read with ErrUnauthorized. Only a
+// streamed value may leave its body unsigned.
+func (a *authenticator) authenticate(r *http.Request) (*Credential, error) {
+	scheme, param, err := auth.ParseAuthorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	switch scheme {
+	case auth.SchemeBearer:
+		for _, cred := range a.credentials {
+			if subtle.ConstantTimeCompare([]byte(param), []byte(cred.Secret)) == 1 {
+				return cred, nil
+			}
+		}
+		return nil, ErrUnauthorized
+	case auth.SchemeHmac:
+	default:
+		return nil, ErrUnauthorized
+	}
+
+	keyId, signature, err := auth.ParseSigned(param)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+	cred := a.byId[keyId]
+	if cred == nil {
+		return nil, ErrUnauthorized
+	}
+
+	date := r.Header.Get(auth.DateHeader)
+	contentHash := r.Header.Get(auth.ContentHashHeader)
+	if auth.CheckDate(date, GetMds().clock.Now()) != nil || contentHash == "" {
+		return nil, ErrUnauthorized
+	}
+	expected := auth.Signature(cred.Secret, r.Method, r.Host, r.URL.RequestURI(), date, r.Header.Get(auth.RequestIdHeader), contentHash)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return nil, ErrUnauthorized
+	}
+
+	streamed := strings.HasPrefix(r.Header.Get("Content-Type"), "application/octet-stream")
+	if contentHash == auth.UnsignedPayload {
+		if !streamed {
+			return nil, ErrUnauthorized
+		}
+		return cred, nil
+	}
+	if streamed {
+		// Raw values are read to the end before they are stored
+		r.Body = &verifyingReader{body: r.Body, hash: sha256.New(), expected: contentHash}
+		return cred, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if auth.ContentHash(body) != contentHash {
+		return nil, ErrUnauthorized
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return cred, nil
+}
+
+// verifyingReader fails the last read of a body which doesn't match the
+// signed content hash
+type verifyingReader struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.body.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(v.hash.Sum(nil)) != v.expected {
+		return n, ErrUnauthorized
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error {
+	return v.body.Close()
+}
+
+// authenticating rejects requests without valid credentials and passes the
+// credential to the handler in the request context
+func authenticating(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a := GetMds().auth
+		if a == nil {
+			handler(w, r)
+			return
+		}
+
+		cred, err := a.authenticate(r)
+		if err != nil {
+			completeRequest(w, "", err, nil)
+			return
+		}
+		handler(w, r.WithContext(context.WithValue(r.Context(), credentialKey{}, cred)))
+	}
+}
+
+// allowed rejects requests whose credential lacks access, read and write
+// access is checked against the key of the route
+func allowed(access int, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var ok bool
+		switch access {
+		case accessRead:
+			ok = canRead(r, mux.Vars(r)["key"])
+		case accessWrite:
+			ok = canWrite(r, mux.Vars(r)["key"])
+		case accessAdmin:
+			ok = isAdmin(r)
+		}
+		if !ok {
+			completeRequest(w, "", ErrForbidden, nil)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// credentialOf returns nil if authentication is disabled
+func credentialOf(r *http.Request) *Credential {
+	cred, _ := r.Context().Value(credentialKey{}).(*Credential)
+	return cred
+}
+
+func (cred *Credential) covers(key string) bool {
+	if len(cred.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range cred.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func canRead(r *http.Request, key string) bool {
+	if GetMds().auth == nil {
+		return true
+	}
+	cred := credentialOf(r)
+	return cred != nil && cred.covers(key)
+}
+
+func canWrite(r *http.Request, key string) bool {
+	if GetMds().auth == nil {
+		return true
+	}
+	cred := credentialOf(r)
+	return cred != nil && !cred.ReadOnly && cred.covers(key)
+}
+
+func isAdmin(r *http.Request) bool {
+	if GetMds().auth == nil {
+		return true
+	}
+	cred := credentialOf(r)
+	return cred != nil && cred.Admin
+}
+
+// canScan reports whether the keys in [startKey, endKey) all lie under one
+// prefix of the credential, an empty endKey means no upper bound
+func canScan(r *http.Request, startKey string, endKey string) bool {
+	if GetMds().auth == nil {
+		return true
+	}
+	cred := credentialOf(r)
+	if cred == nil {
+		return false
+	}
+	if len(cred.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range cred.Prefixes {
+		if !strings.HasPrefix(startKey, prefix) {
+			continue
+		}
+		limit := prefixEnd(prefix)
+		if limit == "" || (endKey != "" && endKey <= limit) {
+			return true
+		}
+	}
+	return false
+}
+
+// prefixEnd returns the smallest key greater than all keys with prefix, an
+// empty key if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
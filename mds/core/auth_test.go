@@ -0,0 +1,120 @@
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/auth"
+)
+
+func TestAuthenticating(t *testing.T) {
+	params := &MdsParameters{Credentials: []Credential{
+		{Id: "app1", Secret: "secret1", Prefixes: []string{"app1-"}},
+		{Id: "reader", Secret: "secret2", ReadOnly: true},
+	}}
+	server, stop := startTestMds(t, "TestAuthenticating", params)
+	defer stop()
+
+	app1 := &auth.Credentials{KeyId: "app1", Secret: "secret1"}
+	newRequest := func(method string, path string, contentType string, body []byte) *http.Request {
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request error %v", err)
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set(auth.RequestIdHeader, "id1")
+		return req
+	}
+	setJson := func(key string, value string) *http.Request {
+		body, err := json.Marshal(&client.SetKeyRequest{Value: value})
+		if err != nil {
+			t.Fatalf("marshal error %v", err)
+		}
+		return newRequest("POST", "/set/"+key, "application/json", body)
+	}
+	signed := func(req *http.Request, creds *auth.Credentials) *http.Request {
+		err := auth.Sign(req, creds, time.Now())
+		if err != nil {
+			t.Fatalf("sign error %v", err)
+		}
+		return req
+	}
+	status := func(req *http.Request) int {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request error %v", err)
+		}
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	check := func(name string, req *http.Request, expected int) {
+		got := status(req)
+		if got != expected {
+			t.Fatalf("%s status %d expected %d", name, got, expected)
+		}
+	}
+
+	check("signed", signed(setJson("app1-k1", "v1"), app1), http.StatusOK)
+	check("bearer", signed(newRequest("GET", "/get/app1-k1", "application/json", []byte("{}")), &auth.Credentials{Token: "secret1"}), http.StatusOK)
+	check("unsigned", setJson("app1-k1", "v1"), http.StatusUnauthorized)
+	check("wrong secret", signed(setJson("app1-k1", "v1"), &auth.Credentials{KeyId: "app1", Secret: "secret2"}), http.StatusUnauthorized)
+	check("outside prefixes", signed(setJson("app2-k1", "v1"), app1), http.StatusForbidden)
+	check("read only", signed(setJson("app1-k1", "v1"), &auth.Credentials{KeyId: "reader", Secret: "secret2"}), http.StatusForbidden)
+	check("admin", signed(newRequest("GET", "/replication/changes", "application/json", nil), app1), http.StatusForbidden)
+
+	// a request signed for another server
+	req := setJson("app1-k1", "v1")
+	req.Host = "other:8080"
+	signed(req, app1)
+	req.Host = ""
+	check("other host", req, http.StatusUnauthorized)
+
+	// the request id is signed, dedup can't be bypassed or poisoned
+	req = signed(setJson("app1-k1", "v1"), app1)
+	req.Header.Set(auth.RequestIdHeader, "id2")
+	check("changed request id", req, http.StatusUnauthorized)
+	req = setJson("app1-k1", "v1")
+	req.Header.Del(auth.RequestIdHeader)
+	signed(req, app1)
+	req.Header.Set(auth.RequestIdHeader, "id2")
+	check("added request id", req, http.StatusUnauthorized)
+
+	req = setJson("app1-k1", "v1")
+	err := auth.Sign(req, app1, time.Now().Add(-2*auth.MaxClockSkew))
+	if err != nil {
+		t.Fatalf("sign error %v", err)
+		return
+	}
+	check("stale", req, http.StatusUnauthorized)
+
+	// the body must match the signed content hash
+	req = signed(setJson("app1-k1", "v1"), app1)
+	body, _ := json.Marshal(&client.SetKeyRequest{Value: "v2"})
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = nil
+	check("json body changed", req, http.StatusUnauthorized)
+	req = signed(newRequest("POST", "/set/app1-k2", "application/octet-stream", []byte("v1")), app1)
+	req.Body = ioutil.NopCloser(bytes.NewReader([]byte("v2")))
+	req.GetBody = nil
+	check("raw body changed", req, http.StatusUnauthorized)
+	check("raw body not stored", signed(newRequest("GET", "/get/app1-k2?raw=true", "", nil), app1), http.StatusNotFound)
+	check("raw", signed(newRequest("POST", "/set/app1-k2", "application/octet-stream", []byte("v1")), app1), http.StatusOK)
+
+	// only a streamed value may leave its body unsigned
+	req = setJson("app1-k1", "v1")
+	req.GetBody = nil
+	check("unsigned json payload", signed(req, app1), http.StatusUnauthorized)
+	req = newRequest("POST", "/set/app1-k3", "application/octet-stream", []byte("v1"))
+	req.GetBody = nil
+	check("unsigned raw payload", signed(req, app1), http.StatusOK)
+	if req.Header.Get(auth.ContentHashHeader) != auth.UnsignedPayload {
+		t.Fatalf("content hash %s", req.Header.Get(auth.ContentHashHeader))
+		return
+	}
+}
@@ -0,0 +1,300 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/clock"
+	"ddb/lib/common/lsm"
+	"ddb/lib/common/raft"
+)
+
+// In consensus mode writes are raft commands: the leader proposes them and
+// every node applies committed commands to its storage in the same order.
+// Reads are served by any node from its storage and may miss the latest
+// committed writes on followers. Writes sent to a follower are redirected
+// to the leader, the raft id of a node is its api url.
+//
+// Commands are applied with synced writes whatever durability the client
+// asked for, raft records the entries applied only after them, and the
+// versions they write are derived from their raft index. A command applied
+// again after a crash writes the versions it wrote before, so all nodes
+// agree on the version of every value.
+
+const (
+	raftOpSet        = "set"
+	raftOpDelete     = "delete"
+	raftOpDeleteKeys = "mdelete"
+	raftOpTxn        = "txn"
+	raftRpcTimeout   = 5 * time.Second
+	// The writes of the command at raft index i get versions from i <<
+	// raftVersionShift on, a command has fewer writes than that
+	raftVersionShift = 20
+	raftMaxWrites    = 1 << raftVersionShift
+)
+
+type raftCommand struct {
+	Op   string   `json:"op"`
+	Key  string   `json:"key,omitempty"`
+	Keys []string `json:"keys,omitempty"`
+	// Fields of set, expiration is absolute so all nodes agree on it
+	Value           []byte   `json:"value,omitempty"`
+	ExpiresAt       int64    `json:"expiresAt,omitempty"`
+	Create          bool     `json:"create,omitempty"`
+	CompareVersion  bool     `json:"compareVersion,omitempty"`
+	ExpectedVersion uint64   `json:"expectedVersion,omitempty"`
+	Txn             *lsm.Txn `json:"txn,omitempty"`
+}
+
+// raftStateMachine applies committed commands to the local storage
+type raftStateMachine struct {
+	storage KeyValueStorage
+}
+
+// deleteKeysResult carries per key errors of a replicated mdelete
+type deleteKeysResult struct {
+	errs []error
+}
+
+// applyResult is the outcome of a command, the same on every node
+type applyResult struct {
+	value interface{}
+	err   error
+}
+
+// deterministic reports whether every node applying a command gets err,
+// other errors like a full disk or a write stall are local to the node
+func deterministic(err error) bool {
+	switch err {
+	case nil, lsm.ErrNotFound, lsm.ErrEmptyKey, lsm.ErrEmptyValue, lsm.ErrExists, lsm.ErrVersionMismatch,
+		lsm.ErrValueTooLarge, lsm.ErrUnknownTxnOp, ErrBadRequest:
+		return true
+	default:
+		return false
+	}
+}
+
+// Apply returns the outcome of the command as the result, a local failure
+// is returned as the error so raft applies the command again rather than
+// skipping it on this node
+func (sm *raftStateMachine) Apply(index uint64, data []byte) (interface{}, error) {
+	value, err := sm.apply(index, data)
+	if !deterministic(err) {
+		return nil, err
+	}
+	return applyResult{value: value, err: err}, nil
+}
+
+func (sm *raftStateMachine) apply(index uint64, data []byte) (interface{}, error) {
+	var cmd raftCommand
+	err := json.Unmarshal(data, &cmd)
+	if err != nil {
+		return nil, ErrBadRequest
+	}
+
+	ctx := context.Background()
+	version := index << raftVersionShift
+	switch cmd.Op {
+	case raftOpSet:
+		return sm.storage.SetBytes(ctx, cmd.Key, cmd.Value, &SetOptions{
+			ExpiresAt:       cmd.ExpiresAt,
+			Create:          cmd.Create,
+			CompareVersion:  cmd.CompareVersion,
+			ExpectedVersion: cmd.ExpectedVersion,
+			Durability:      lsm.DurabilitySync,
+			Version:         version,
+		})
+	case raftOpDelete:
+		return nil, sm.storage.Delete(ctx, cmd.Key, &DeleteOptions{
+			CompareVersion:  cmd.CompareVersion,
+			ExpectedVersion: cmd.ExpectedVersion,
+			Durability:      lsm.DurabilitySync,
+			Version:         version,
+		})
+	case raftOpDeleteKeys:
+		if len(cmd.Keys) >= raftMaxWrites {
+			return nil, ErrBadRequest
+		}
+		errs, err := sm.storage.DeleteKeys(ctx, cmd.Keys, &DeleteOptions{Version: version})
+		return deleteKeysResult{errs: errs}, err
+	case raftOpTxn:
+		if cmd.Txn == nil || len(cmd.Txn.Success) >= raftMaxWrites || len(cmd.Txn.Failure) >= raftMaxWrites {
+			return nil, ErrBadRequest
+		}
+		txn := *cmd.Txn
+		txn.Durability = lsm.DurabilitySync
+		txn.Version = version
+		return sm.storage.Txn(ctx, &txn)
+	default:
+		return nil, ErrBadRequest
+	}
+}
+
+// raftStorage sends writes through consensus and serves everything else
+// from the local storage
+type raftStorage struct {
+	KeyValueStorage
+	node  *raft.Node
+	clock clock.Clock
+}
+
+func raftError(err error) error {
+	switch err {
+	case raft.ErrNotLeader:
+		return ErrNotLeader
+	case raft.ErrStopped:
+		return ErrShuttingDown
+	case raft.ErrTooLarge:
+		return lsm.ErrValueTooLarge
+	case raft.ErrLogFull:
+		return lsm.ErrBusy
+	default:
+		return err
+	}
+}
+
+func (s *raftStorage) propose(ctx context.Context, cmd *raftCommand) (interface{}, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.node.Propose(ctx, data)
+	if err != nil {
+		return nil, raftError(err)
+	}
+	result := value.(applyResult)
+	return result.value, result.err
+}
+
+func (s *raftStorage) Set(ctx context.Context, key string, value string, opts *SetOptions) (Meta, error) {
+	return s.SetBytes(ctx, key, []byte(value), opts)
+}
+
+func (s *raftStorage) SetBytes(ctx context.Context, key string, value []byte, opts *SetOptions) (Meta, error) {
+	cmd := &raftCommand{Op: raftOpSet, Key: key, Value: value}
+	if opts != nil {
+		cmd.ExpiresAt = opts.ExpiresAt
+		if cmd.ExpiresAt == 0 && opts.Ttl > 0 {
+			cmd.ExpiresAt = s.clock.Now().Add(opts.Ttl).UnixNano()
+		}
+		cmd.Create = opts.Create
+		cmd.CompareVersion = opts.CompareVersion
+		cmd.ExpectedVersion = opts.ExpectedVersion
+	}
+
+	result, err := s.propose(ctx, cmd)
+	if err != nil {
+		return Meta{}, err
+	}
+	return result.(Meta), nil
+}
+
+func (s *raftStorage) Delete(ctx context.Context, key string, opts *DeleteOptions) error {
+	cmd := &raftCommand{Op: raftOpDelete, Key: key}
+	if opts != nil {
+		cmd.CompareVersion = opts.CompareVersion
+		cmd.ExpectedVersion = opts.ExpectedVersion
+	}
+
+	_, err := s.propose(ctx, cmd)
+	return err
+}
+
+func (s *raftStorage) DeleteKeys(ctx context.Context, keys []string, opts *DeleteOptions) ([]error, error) {
+	result, err := s.propose(ctx, &raftCommand{Op: raftOpDeleteKeys, Keys: keys})
+	if err != nil {
+		return nil, err
+	}
+	return result.(deleteKeysResult).errs, nil
+}
+
+func (s *raftStorage) Txn(ctx context.Context, txn *lsm.Txn) (*lsm.TxnResult, error) {
+	result, err := s.propose(ctx, &raftCommand{Op: raftOpTxn, Txn: txn})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*lsm.TxnResult), nil
+}
+
+func (s *raftStorage) Close() {
+	s.node.Stop()
+	s.KeyValueStorage.Close()
+}
+
+// startRaft wraps the storage to replicate writes through consensus
+func (mds *Mds) startRaft(id string, peers string) error {
+	local := mds.storage()
+	node, err := raft.NewNode(&raft.Config{
+		Id:           id,
+		Peers:        splitList(peers),
+		Dir:          filepath.Join(mds.storagePath, "raft"),
+		Transport:    raft.NewHttpTransport(raftRpcTimeout, mds.peerCredentials, mds.peerTls),
+		StateMachine: &raftStateMachine{storage: local},
+		Log:          mds.log,
+		Clock:        mds.clock,
+	})
+	if err != nil {
+		return err
+	}
+
+	mds.raft = node
+	mds.kvs.Store(storageRef{kvs: &raftStorage{KeyValueStorage: local, node: node, clock: mds.hlc}})
+	return nil
+}
+
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// leaderFor returns the raft leader a write failed with err is to be sent
+// to, empty unless err is ErrNotLeader and another node leads
+func (mds *Mds) leaderFor(err error) string {
+	if err != ErrNotLeader || mds.raft == nil {
+		return ""
+	}
+
+	status := mds.raft.Status()
+	if status.Leader == status.Id {
+		return ""
+	}
+	return status.Leader
+}
+
+// isLeading reports whether the node takes writes, always without raft
+func (mds *Mds) isLeading() bool {
+	return mds.raft == nil || mds.raft.IsLeader()
+}
+
+// leading redirects writes to the raft leader, the response carries the
+// leader in the error payload too. A leader which lost its lease rejects
+// writes at once, with 503 until it learns the new leader.
+func leading(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mds := GetMds()
+		if mds.isLeading() {
+			handler(w, r)
+			return
+		}
+
+		leader := mds.leaderFor(ErrNotLeader)
+		if leader == "" {
+			completeRequest(w, "", ErrNotLeader, nil)
+			return
+		}
+		w.Header().Set("Location", leader+r.URL.RequestURI())
+		writeJson(w, http.StatusTemporaryRedirect, &client.BaseResponse{Error: ErrNotLeader.Error(), Leader: leader})
+	}
+}
@@ -0,0 +1,85 @@
+package mds
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"ddb/lib/common/filelog"
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+	"ddb/lib/common/random"
+)
+
+func TestRaftStateMachineReplay(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestRaftStateMachineReplay_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	engine, err := lsm.NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	storage := newLsmStorage(engine)
+	defer storage.Close()
+	sm := &raftStateMachine{storage: storage}
+
+	apply := func(index uint64, cmd *raftCommand) applyResult {
+		data, err := json.Marshal(cmd)
+		if err != nil {
+			t.Fatalf("marshal error %v", err)
+		}
+		value, err := sm.Apply(index, data)
+		if err != nil {
+			t.Fatalf("apply %d error %v", index, err)
+		}
+		return value.(applyResult)
+	}
+
+	// a batched write is applied synced with a version of its index
+	set := &raftCommand{Op: raftOpSet, Key: "k1", Value: []byte("v1")}
+	result := apply(1, set)
+	version := uint64(1) << raftVersionShift
+	if result.err != nil || result.value.(Meta).Version != version {
+		t.Fatalf("set result %+v", result)
+		return
+	}
+
+	// applying it again after a crash writes the same version
+	result = apply(1, set)
+	if result.err != nil || result.value.(Meta).Version != version {
+		t.Fatalf("replayed set result %+v", result)
+		return
+	}
+	cas := &raftCommand{Op: raftOpSet, Key: "k1", Value: []byte("v2"), CompareVersion: true, ExpectedVersion: version}
+	result = apply(2, cas)
+	if result.err != nil || result.value.(Meta).Version != 2<<raftVersionShift {
+		t.Fatalf("compare and set result %+v", result)
+		return
+	}
+
+	txn := &raftCommand{Op: raftOpTxn, Txn: &lsm.Txn{Success: []lsm.TxnOp{
+		{Op: lsm.TxnSet, Key: "k2", Value: []byte("v2")},
+		{Op: lsm.TxnSet, Key: "k3", Value: []byte("v3")},
+	}, Durability: lsm.DurabilityNone}}
+	result = apply(3, txn)
+	txnResult := result.value.(*lsm.TxnResult)
+	if result.err != nil || txnResult.Results[0].Version != 3<<raftVersionShift || txnResult.Results[1].Version != 3<<raftVersionShift+1 {
+		t.Fatalf("txn result %+v %+v", result, txnResult)
+		return
+	}
+
+	result = apply(4, &raftCommand{Op: raftOpDeleteKeys, Keys: make([]string, raftMaxWrites)})
+	if result.err != ErrBadRequest {
+		t.Fatalf("oversized mdelete result %+v", result)
+		return
+	}
+}
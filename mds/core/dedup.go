@@ -0,0 +1,173 @@
+package mds
+
+import (
+	"bytes"
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"ddb/lib/common/clock"
+)
+
+// Writes are deduplicated by request id: the response of a successful
+// write is kept for dedupTtl and a write resent with the same X-Request-Id,
+// by a client retry or a journal replaying it after a restart, gets that
+// response again instead of being applied twice. A resend arriving while
+// the first is still served waits for it.
+
+const (
+	defaultDedupSize = 10000
+	defaultDedupTtl  = time.Hour
+)
+
+type dedupEntry struct {
+	key string
+	// Closed once the first request completed
+	done   chan struct{}
+	status int
+	body   []byte
+	at     time.Time
+	elem   *list.Element
+}
+
+// dedupCache keeps the responses of the latest successful writes by
+// request id
+type dedupCache struct {
+	lock    sync.Mutex
+	size    int
+	ttl     time.Duration
+	clock   clock.Clock
+	entries map[string]*dedupEntry
+	// Completed entries from the oldest
+	order *list.List
+	hits  int64
+}
+
+func newDedupCache(size int, ttl time.Duration, c clock.Clock) *dedupCache {
+	if size == 0 {
+		size = defaultDedupSize
+	}
+	if size < 0 {
+		return nil
+	}
+	if ttl <= 0 {
+		ttl = defaultDedupTtl
+	}
+	return &dedupCache{size: size, ttl: ttl, clock: c, entries: make(map[string]*dedupEntry), order: list.New()}
+}
+
+// begin returns the entry of key and whether the caller is the first
+// request with it, the first one must call finish
+func (d *dedupCache) begin(key string) (*dedupEntry, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.clock.Now()
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		e := front.Value.(*dedupEntry)
+		if d.order.Len() <= d.size && now.Sub(e.at) < d.ttl {
+			break
+		}
+		d.remove(front)
+	}
+
+	if e, ok := d.entries[key]; ok {
+		return e, false
+	}
+	e := &dedupEntry{key: key, done: make(chan struct{})}
+	d.entries[key] = e
+	return e, true
+}
+
+// remove drops a completed entry, caller must hold lock
+func (d *dedupCache) remove(elem *list.Element) {
+	d.order.Remove(elem)
+	delete(d.entries, elem.Value.(*dedupEntry).key)
+}
+
+// finish keeps the response of a successful first request, a failed one is
+// forgotten so a resend is served again
+func (d *dedupCache) finish(key string, e *dedupEntry, status int, body []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if status == http.StatusOK {
+		e.status = status
+		e.body = body
+		e.at = d.clock.Now()
+		e.elem = d.order.PushBack(e)
+	} else {
+		delete(d.entries, key)
+	}
+	close(e.done)
+}
+
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// deduplicating serves a write resent with the request id of a successful
+// one with the response of that write
+func deduplicating(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		d := GetMds().dedup
+		id := r.Header.Get("X-Request-Id")
+		if d == nil || id == "" {
+			handler(w, r)
+			return
+		}
+
+		tenant := ""
+		if cred := credentialOf(r); cred != nil {
+			tenant = cred.Id
+		}
+		key := tenant + " " + r.URL.Path + " " + id
+
+		e, first := d.begin(key)
+		if !first {
+			select {
+			case <-e.done:
+			case <-r.Context().Done():
+				completeRequest(w, id, r.Context().Err(), nil)
+				return
+			}
+			if e.status != 0 {
+				atomic.AddInt64(&d.hits, 1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Content-Length", strconv.Itoa(len(e.body)))
+				w.Header().Set("X-Deduplicated", "true")
+				w.WriteHeader(e.status)
+				w.Write(e.body)
+				return
+			}
+			handler(w, r)
+			return
+		}
+
+		rw := &recordingResponseWriter{ResponseWriter: w}
+		defer func() {
+			d.finish(key, e, rw.status, rw.body.Bytes())
+		}()
+		handler(rw, r)
+	}
+}
@@ -0,0 +1,83 @@
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/clock"
+)
+
+func TestDeduplicating(t *testing.T) {
+	c := clock.NewManual(time.Now())
+	server, stop := startTestMds(t, "TestDeduplicating", &MdsParameters{Clock: c, DedupTtlMs: 1000})
+	defer stop()
+
+	// post sets key and returns the status, the version and whether the
+	// response was deduplicated
+	post := func(path string, requestId string, value string) (int, uint64, bool) {
+		body, err := json.Marshal(&client.SetKeyRequest{Value: value})
+		if err != nil {
+			t.Fatalf("marshal error %v", err)
+		}
+		req, err := http.NewRequest("POST", server.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("new request error %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Request-Id", requestId)
+
+		httpResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request error %v", err)
+		}
+		defer httpResp.Body.Close()
+
+		resp := &client.SetKeyResponse{}
+		err = json.NewDecoder(httpResp.Body).Decode(resp)
+		if err != nil {
+			t.Fatalf("decode error %v", err)
+		}
+		return httpResp.StatusCode, resp.Version, httpResp.Header.Get("X-Deduplicated") == "true"
+	}
+
+	status, version, dedup := post("/set/k1", "id1", "v1")
+	if status != http.StatusOK || dedup {
+		t.Fatalf("set status %d dedup %v", status, dedup)
+		return
+	}
+
+	// a resend gets the first response, the value isn't written again
+	status, resent, dedup := post("/set/k1", "id1", "v1")
+	if status != http.StatusOK || !dedup || resent != version {
+		t.Fatalf("resend status %d version %d dedup %v expected version %d", status, resent, dedup, version)
+		return
+	}
+
+	// the id is scoped to the path
+	status, other, dedup := post("/set/k2", "id1", "v1")
+	if status != http.StatusOK || dedup || other == version {
+		t.Fatalf("other key status %d version %d dedup %v", status, other, dedup)
+		return
+	}
+
+	// a failed write is served again
+	for i := 0; i < 2; i++ {
+		status, _, dedup = post("/set/k1?mode=create", "id2", "v2")
+		if status != http.StatusConflict || dedup {
+			t.Fatalf("create status %d dedup %v", status, dedup)
+			return
+		}
+	}
+
+	// the response is forgotten after the ttl
+	c.Advance(2 * time.Second)
+	status, resent, dedup = post("/set/k1", "id1", "v1")
+	if status != http.StatusOK || dedup || resent <= other {
+		t.Fatalf("expired resend status %d version %d dedup %v", status, resent, dedup)
+		return
+	}
+}
@@ -11,4 +11,12 @@ var (
 	ErrNotFound       = fmt.Errorf("Not found")
 	ErrAlreadyExists  = fmt.Errorf("Already exists")
 	ErrBadRequest     = fmt.Errorf("Bad request")
+	ErrShuttingDown   = fmt.Errorf("Shutting down")
+	ErrReadOnly       = fmt.Errorf("Read only")
+	ErrNotLeader      = fmt.Errorf("Not leader")
+	ErrUnauthorized   = fmt.Errorf("Unauthorized")
+	ErrForbidden      = fmt.Errorf("Forbidden")
+	ErrInvalidSlo     = fmt.Errorf("Invalid slo")
+	ErrFrozen         = fmt.Errorf("Frozen")
+	ErrMoved          = fmt.Errorf("Moved")
 )
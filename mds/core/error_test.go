@@ -0,0 +1,96 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	client "ddb/client/core"
+	"ddb/lib/common/lsm"
+)
+
+func TestErrorTaxonomy(t *testing.T) {
+	_, stop := startTestMds(t, "TestErrorTaxonomy", &MdsParameters{})
+	defer stop()
+
+	expected := []struct {
+		err        error
+		status     int
+		retryAfter int
+		clientErr  error
+	}{
+		{ErrBadRequest, http.StatusBadRequest, 0, client.ErrBadRequest},
+		{lsm.ErrValueTooLarge, http.StatusRequestEntityTooLarge, 0, client.ErrValueTooLarge},
+		{ErrNotFound, http.StatusNotFound, 0, client.ErrNotFound},
+		{lsm.ErrNotFound, http.StatusNotFound, 0, client.ErrNotFound},
+		{ErrAlreadyExists, http.StatusConflict, 0, client.ErrConflict},
+		{lsm.ErrExists, http.StatusConflict, 0, client.ErrConflict},
+		{lsm.ErrVersionMismatch, http.StatusConflict, 0, client.ErrConflict},
+		{ErrNotImplemented, http.StatusNotImplemented, 0, client.ErrNotImplemented},
+		{context.DeadlineExceeded, http.StatusRequestTimeout, 0, client.ErrUnknown},
+		{lsm.ErrDiskFull, http.StatusInsufficientStorage, 60, client.ErrDiskFull},
+		{lsm.ErrBusy, http.StatusTooManyRequests, 1, client.ErrBusy},
+		{lsm.ErrClosed, http.StatusServiceUnavailable, 5, client.ErrClosed},
+		{ErrShuttingDown, http.StatusServiceUnavailable, 5, client.ErrClosed},
+		{ErrNotLeader, http.StatusServiceUnavailable, 1, client.ErrClosed},
+		{ErrFrozen, http.StatusServiceUnavailable, 1, client.ErrFrozen},
+		{ErrMoved, http.StatusMisdirectedRequest, 0, client.ErrMoved},
+		{ErrReadOnly, http.StatusForbidden, 0, client.ErrReadOnly},
+		{ErrForbidden, http.StatusForbidden, 0, client.ErrForbidden},
+		{ErrUnauthorized, http.StatusUnauthorized, 0, client.ErrUnauthorized},
+		{lsm.ErrCorrupted, http.StatusInternalServerError, 0, client.ErrCorrupted},
+		{fmt.Errorf("other"), http.StatusInternalServerError, 0, client.ErrInternal},
+	}
+
+	// the key of a request selects the error it fails with
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i, _ := strconv.Atoi(r.URL.Path[len("/get/"):])
+		completeRequest(w, "", expected[i].err, nil)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	c := client.NewClientWithOptions(server.URL, &client.ClientOptions{MaxRetries: -1, BreakerThreshold: -1})
+	for i, e := range expected {
+		if status := errorToHttpStatus(e.err); status != e.status {
+			t.Fatalf("error %v status %d expected %d", e.err, status, e.status)
+			return
+		}
+		if retryAfter := errorToRetryAfter(e.err); retryAfter != e.retryAfter {
+			t.Fatalf("error %v retry after %d expected %d", e.err, retryAfter, e.retryAfter)
+			return
+		}
+
+		resp, err := http.Get(fmt.Sprintf("%s/get/%d", server.URL, i))
+		if err != nil {
+			t.Fatalf("get error %v", err)
+			return
+		}
+		resp.Body.Close()
+		header := resp.Header.Get("Retry-After")
+		if resp.StatusCode != e.status || (e.retryAfter == 0 && header != "") ||
+			(e.retryAfter != 0 && header != strconv.Itoa(e.retryAfter)) {
+			t.Fatalf("error %v status %d retry after %q", e.err, resp.StatusCode, header)
+			return
+		}
+
+		// the client gets back an error it can act on, the retryable ones
+		// are those the server asks to retry
+		_, err = c.GetKey(ctx, strconv.Itoa(i))
+		if err != e.clientErr {
+			t.Fatalf("error %v client error %v expected %v", e.err, err, e.clientErr)
+			return
+		}
+		if client.IsRetryable(err) != (e.retryAfter > 0) {
+			t.Fatalf("error %v client error %v retryable %v", e.err, err, client.IsRetryable(err))
+			return
+		}
+	}
+	if status := errorToHttpStatus(nil); status != http.StatusOK {
+		t.Fatalf("no error status %d", status)
+		return
+	}
+}
@@ -0,0 +1,33 @@
+package mds
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	client "ddb/client/core"
+)
+
+// readyz reports whether the server serves requests, it fails with 503
+// while the server starts, restores or shuts down. A ready server lists
+// warnings such as a sstable count above the limit, merges are forced then
+// but reads are slower until they catch up.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	mds := GetMds()
+	requestId := r.Header.Get("X-Request-Id")
+
+	if atomic.LoadInt32(&mds.state) != mdsStateRunning {
+		completeRequest(w, requestId, ErrShuttingDown, nil)
+		return
+	}
+
+	resp := &client.ReadyResponse{Ready: true}
+	cs := mds.storage().CompactionStats()
+	if cs.TableLimit > 0 && cs.Tables > cs.TableLimit {
+		resp.Warnings = append(resp.Warnings, fmt.Sprintf("%d sstables above limit %d", cs.Tables, cs.TableLimit))
+	}
+	if cs.Suspended {
+		resp.Warnings = append(resp.Warnings, "background flushes and merges suspended")
+	}
+	completeRequest(w, requestId, nil, resp)
+}
@@ -0,0 +1,477 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gorilla/mux"
+	uuid "github.com/pborman/uuid"
+
+	client "ddb/client/core"
+	"ddb/lib/common/clock"
+	log "ddb/lib/common/log"
+)
+
+const (
+	jobsFileName = "jobs.json"
+	// Finished jobs kept for listing, older ones are forgotten
+	maxFinishedJobs = 100
+)
+
+// jobFunc performs a job of some type until it is done or ctx is canceled,
+// the job carries its arguments and progress reports the completed fraction
+type jobFunc func(ctx context.Context, job client.Job, progress func(float64)) error
+
+type job struct {
+	client.Job
+	cancel context.CancelFunc
+	// Set when a client canceled the job
+	canceled bool
+	// Set when the job is interrupted by shutdown or restore and has to run
+	// again later
+	requeue bool
+	done    chan struct{}
+}
+
+// jobManager runs jobs one at a time in creation order. Jobs are persisted
+// in the storage directory on every state change, so jobs which were
+// pending or running when the server stopped run again after a restart.
+type jobManager struct {
+	lock      sync.Mutex
+	jobs      []*job
+	funcs     map[string]jobFunc
+	filePath  string
+	log       *log.Log
+	clock     clock.Clock
+	running   *job
+	suspended bool
+	closed    bool
+	// Held while a job runs so suspend can wait for it
+	runLock  sync.Mutex
+	wakeChan chan bool
+	stopChan chan bool
+	wg       sync.WaitGroup
+}
+
+func newJobManager(log *log.Log, clock clock.Clock, filePath string, funcs map[string]jobFunc) (*jobManager, error) {
+	m := &jobManager{
+		funcs:    funcs,
+		filePath: filePath,
+		log:      log,
+		clock:    clock,
+		wakeChan: make(chan bool, 1),
+		stopChan: make(chan bool),
+	}
+
+	err := m.load()
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *jobManager) load() error {
+	data, err := ioutil.ReadFile(m.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	var jobs []client.Job
+	err = json.Unmarshal(data, &jobs)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range jobs {
+		job := &job{Job: j, done: make(chan struct{})}
+		if job.Done() {
+			close(job.done)
+		} else {
+			m.log.Pf(0, "job %s %s resumed in state %s", job.Id, job.Type, job.State)
+			job.State = client.JobPending
+		}
+		m.jobs = append(m.jobs, job)
+	}
+	return nil
+}
+
+// save writes jobs to the jobs file, caller must hold lock
+func (m *jobManager) save() {
+	finished := 0
+	for _, job := range m.jobs {
+		if job.Done() {
+			finished++
+		}
+	}
+
+	jobs := make([]*job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		if job.Done() && finished > maxFinishedJobs {
+			finished--
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	m.jobs = jobs
+
+	records := make([]client.Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		records = append(records, job.Job)
+	}
+
+	data, err := json.Marshal(records)
+	if err == nil {
+		tmpPath := m.filePath + ".tmp"
+		err = ioutil.WriteFile(tmpPath, data, 0600)
+		if err == nil {
+			err = os.Rename(tmpPath, m.filePath)
+		}
+	}
+	if err != nil {
+		m.log.Pf(log.LevelError, "save jobs error %v", err)
+	}
+}
+
+func (m *jobManager) start() {
+	m.wg.Add(1)
+	go m.worker()
+	m.wake()
+}
+
+func (m *jobManager) wake() {
+	select {
+	case m.wakeChan <- true:
+	default:
+	}
+}
+
+func (m *jobManager) worker() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case <-m.wakeChan:
+		case <-m.stopChan:
+			return
+		}
+
+		for {
+			job, ctx := m.next()
+			if job == nil {
+				break
+			}
+			m.run(ctx, job)
+		}
+	}
+}
+
+// next marks the oldest pending job running and returns it
+func (m *jobManager) next() (*job, context.Context) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.suspended || m.closed {
+		return nil, nil
+	}
+
+	for _, job := range m.jobs {
+		if job.State != client.JobPending {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		job.cancel = cancel
+		job.State = client.JobRunning
+		job.UpdatedAt = m.clock.Now().UnixNano()
+		m.running = job
+		m.save()
+		return job, ctx
+	}
+	return nil, nil
+}
+
+func (m *jobManager) run(ctx context.Context, job *job) {
+	m.runLock.Lock()
+	defer m.runLock.Unlock()
+
+	m.log.Pf(0, "job %s %s %s started", job.Id, job.Type, job.Path)
+	var err error
+	fn, ok := m.funcs[job.Type]
+	if ok {
+		err = fn(ctx, job.Job, func(progress float64) {
+			m.setProgress(job, progress)
+		})
+	} else {
+		err = ErrNotImplemented
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job.cancel()
+	m.running = nil
+	requeue := job.requeue
+	job.requeue = false
+	switch {
+	case requeue && err != nil:
+		job.State = client.JobPending
+	case err == nil:
+		job.State = client.JobSucceeded
+		job.Progress = 1
+	case job.canceled:
+		job.State = client.JobCanceled
+	default:
+		job.State = client.JobFailed
+		job.Error = adminError(err).Error()
+	}
+	job.UpdatedAt = m.clock.Now().UnixNano()
+	if job.Done() {
+		close(job.done)
+	}
+	m.log.Pf(log.LevelError, "job %s %s error %v", job.Id, job.State, err)
+	m.save()
+}
+
+// setProgress records the completed fraction of a running job, it's saved
+// with the next state change
+func (m *jobManager) setProgress(job *job, progress float64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job.Progress = progress
+	job.UpdatedAt = m.clock.Now().UnixNano()
+}
+
+// interrupt cancels the running job so it runs again later, caller must
+// hold lock
+func (m *jobManager) interrupt() {
+	if m.running != nil {
+		m.running.requeue = true
+		m.running.cancel()
+	}
+}
+
+// suspend interrupts the running job and holds new jobs until resume
+func (m *jobManager) suspend() {
+	m.lock.Lock()
+	m.suspended = true
+	m.interrupt()
+	m.lock.Unlock()
+
+	m.runLock.Lock()
+}
+
+func (m *jobManager) resume() {
+	m.lock.Lock()
+	m.suspended = false
+	m.lock.Unlock()
+
+	m.runLock.Unlock()
+	m.wake()
+}
+
+// close interrupts the running job and stops the worker, unfinished jobs
+// stay persisted
+func (m *jobManager) close() {
+	m.lock.Lock()
+	if m.closed {
+		m.lock.Unlock()
+		return
+	}
+	m.closed = true
+	m.interrupt()
+	m.lock.Unlock()
+
+	close(m.stopChan)
+	m.wg.Wait()
+}
+
+// submit queues a job of the type and arguments of args
+func (m *jobManager) submit(args client.Job) (client.Job, error) {
+	if _, ok := m.funcs[args.Type]; !ok {
+		return client.Job{}, ErrBadRequest
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.closed {
+		return client.Job{}, ErrShuttingDown
+	}
+
+	now := m.clock.Now().UnixNano()
+	job := &job{Job: args, done: make(chan struct{})}
+	job.Id = uuid.New()
+	job.State = client.JobPending
+	job.Progress = 0
+	job.Error = ""
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	m.jobs = append(m.jobs, job)
+	m.save()
+	m.wake()
+	return job.Job, nil
+}
+
+// find returns the job with id, caller must hold lock
+func (m *jobManager) find(id string) *job {
+	for _, job := range m.jobs {
+		if job.Id == id {
+			return job
+		}
+	}
+	return nil
+}
+
+func (m *jobManager) get(id string) (client.Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job := m.find(id)
+	if job == nil {
+		return client.Job{}, ErrNotFound
+	}
+	return job.Job, nil
+}
+
+func (m *jobManager) list() []client.Job {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	jobs := make([]client.Job, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job.Job)
+	}
+	return jobs
+}
+
+// cancel cancels a pending job at once and a running one once its
+// operation notices, canceling a finished job changes nothing
+func (m *jobManager) cancel(id string) (client.Job, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	job := m.find(id)
+	if job == nil {
+		return client.Job{}, ErrNotFound
+	}
+
+	switch job.State {
+	case client.JobPending:
+		job.State = client.JobCanceled
+		job.UpdatedAt = m.clock.Now().UnixNano()
+		close(job.done)
+		m.save()
+	case client.JobRunning:
+		job.canceled = true
+		job.cancel()
+	}
+	return job.Job, nil
+}
+
+// wait blocks until the job is done or ctx is canceled
+func (m *jobManager) wait(ctx context.Context, id string) (client.Job, error) {
+	m.lock.Lock()
+	job := m.find(id)
+	m.lock.Unlock()
+	if job == nil {
+		return client.Job{}, ErrNotFound
+	}
+
+	select {
+	case <-job.done:
+		return m.get(id)
+	case <-ctx.Done():
+		return client.Job{}, ctx.Err()
+	}
+}
+
+// jobFuncs returns the operations run as jobs by type
+func (mds *Mds) jobFuncs() map[string]jobFunc {
+	return map[string]jobFunc{
+		client.JobBackup: func(ctx context.Context, job client.Job, progress func(float64)) error {
+			return mds.storage().Snapshot(ctx, job.Path)
+		},
+		client.JobCompaction: func(ctx context.Context, job client.Job, progress func(float64)) error {
+			return mds.storage().MajorCompact(ctx)
+		},
+		client.JobSplit: mds.split,
+	}
+}
+
+func createJob(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.CreateJobRequest{}
+	resp := &client.JobResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request create job %s %s", req.Type, req.Path)
+
+	if req.Type == client.JobBackup && req.Path == "" {
+		err = ErrBadRequest
+		return
+	}
+	if req.Type == client.JobSplit {
+		err = GetMds().checkSplit(req.Start, req.End, req.Target)
+		if err != nil {
+			return
+		}
+	}
+
+	resp.Job, err = GetMds().jobs.submit(client.Job{Type: req.Type, Path: req.Path,
+		Start: req.Start, End: req.End, Target: req.Target})
+}
+
+func getJob(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.JobResponse{}
+	defer func() {
+		completeRequest(w, requestId, err, resp)
+	}()
+
+	resp.Job, err = GetMds().jobs.get(mux.Vars(r)["id"])
+}
+
+func listJobs(w http.ResponseWriter, r *http.Request) {
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.JobsResponse{}
+	resp.Jobs = GetMds().jobs.list()
+	completeRequest(w, requestId, nil, resp)
+}
+
+func cancelJob(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.BaseRequest{}
+	resp := &client.JobResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	requestLog(r).Pf(0, "request cancel job %s", id)
+
+	resp.Job, err = GetMds().jobs.cancel(id)
+}
@@ -0,0 +1,115 @@
+package mds
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	client "ddb/client/core"
+	"ddb/lib/common/clock"
+	"ddb/lib/common/filelog"
+	"ddb/lib/common/log"
+	"ddb/lib/common/random"
+)
+
+func TestJobManagerRestart(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestJobManagerRestart_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	started := make(chan string, 8)
+	release := make(chan struct{})
+	funcs := map[string]jobFunc{
+		"block": func(ctx context.Context, job client.Job, progress func(float64)) error {
+			started <- job.Id
+			progress(0.5)
+			select {
+			case <-release:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+	filePath := filepath.Join(rootPath, jobsFileName)
+
+	m, err := newJobManager(log, clock.Real(), filePath, funcs)
+	if err != nil {
+		t.Fatalf("new job manager error %v", err)
+		return
+	}
+	m.start()
+
+	_, err = m.submit(client.Job{Type: "unknown"})
+	if err != ErrBadRequest {
+		t.Fatalf("submit of unknown type error %v", err)
+		return
+	}
+
+	jobs := make([]client.Job, 3)
+	for i := range jobs {
+		jobs[i], err = m.submit(client.Job{Type: "block"})
+		if err != nil {
+			t.Fatalf("submit error %v", err)
+			return
+		}
+	}
+
+	// jobs run one at a time in creation order
+	if id := <-started; id != jobs[0].Id {
+		t.Fatalf("started %s expected %s", id, jobs[0].Id)
+		return
+	}
+	job, err := m.get(jobs[0].Id)
+	if err != nil || job.State != client.JobRunning || job.Progress != 0.5 {
+		t.Fatalf("running job %+v error %v", job, err)
+		return
+	}
+
+	job, err = m.cancel(jobs[1].Id)
+	if err != nil || job.State != client.JobCanceled {
+		t.Fatalf("canceled job %+v error %v", job, err)
+		return
+	}
+
+	// the running job is interrupted by close and runs again after the
+	// restart
+	m.close()
+	m, err = newJobManager(log, clock.Real(), filePath, funcs)
+	if err != nil {
+		t.Fatalf("reopen job manager error %v", err)
+		return
+	}
+	defer m.close()
+
+	states := []string{client.JobPending, client.JobCanceled, client.JobPending}
+	listed := m.list()
+	if len(listed) != len(states) {
+		t.Fatalf("reopened jobs %+v", listed)
+		return
+	}
+	for i, job := range listed {
+		if job.Id != jobs[i].Id || job.State != states[i] {
+			t.Fatalf("reopened job %d %+v expected state %s", i, job, states[i])
+			return
+		}
+	}
+
+	close(release)
+	m.start()
+	for _, i := range []int{0, 2} {
+		job, err = m.wait(context.Background(), jobs[i].Id)
+		if err != nil || job.State != client.JobSucceeded || job.Progress != 1 {
+			t.Fatalf("job %d %+v error %v", i, job, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package mds
+
+import (
+	"context"
+	"time"
+
+	"ddb/lib/common/lsm"
+)
+
+// Meta describes a stored value
+type Meta struct {
+	// Version of the value, zero if the storage doesn't track versions
+	Version uint64
+	// Expiration time in unix nanoseconds, zero if the value never expires
+	ExpiresAt int64
+}
+
+type SetOptions struct {
+	// Expire the value after ttl, zero means never
+	Ttl time.Duration
+	// Expiration time in unix nanoseconds, overrides Ttl if set
+	ExpiresAt int64
+	// Only set the value if its current version equals ExpectedVersion
+	CompareVersion  bool
+	ExpectedVersion uint64
+	// Only set the value if the key doesn't exist
+	Create bool
+	// When the write is acknowledged relative to syncing the log
+	Durability lsm.Durability
+	// Version of the write, zero lets the storage assign the next one
+	Version uint64
+}
+
+type DeleteOptions struct {
+	// Only delete the value if its current version equals ExpectedVersion
+	CompareVersion  bool
+	ExpectedVersion uint64
+	Durability      lsm.Durability
+	// Version of the delete, zero lets the storage assign the next one
+	Version uint64
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+type KeyValueStorage interface {
+	Get(ctx context.Context, key string) (string, Meta, error)
+	Set(ctx context.Context, key string, value string, opts *SetOptions) (Meta, error)
+	// GetBytes and SetBytes are Get and Set for binary values, the values
+	// are shared with the storage and must not be modified
+	GetBytes(ctx context.Context, key string) ([]byte, Meta, error)
+	SetBytes(ctx context.Context, key string, value []byte, opts *SetOptions) (Meta, error)
+	Delete(ctx context.Context, key string, opts *DeleteOptions) error
+	// DeleteKeys deletes keys in one storage write, it returns per key errors
+	// or an error if nothing was deleted. Only the version of opts applies,
+	// the keys get the versions from it on.
+	DeleteKeys(ctx context.Context, keys []string, opts *DeleteOptions) ([]error, error)
+	// Txn runs the operations of a branch chosen by the compares atomically
+	Txn(ctx context.Context, txn *lsm.Txn) (*lsm.TxnResult, error)
+	// Scan returns up to limit pairs with keys in [startKey, endKey) in key
+	// order, empty endKey means no upper bound
+	Scan(ctx context.Context, startKey string, endKey string, limit int) ([]KeyValue, error)
+	PrefixCounts() map[string]int64
+	// CacheStats returns read cache hits, misses and size in bytes
+	CacheStats() (int64, int64, int64)
+	// CacheVerifyStats returns verified read cache hits and the stale ones
+	CacheVerifyStats() (int64, int64)
+	CompactionStats() lsm.CompactionStats
+	// TableProperties describes the sstables from the oldest to the newest
+	TableProperties() []lsm.TableProperties
+	// Warmup reads the blocks hot before the last restart into the cache
+	Warmup(ctx context.Context) (lsm.WarmupStats, error)
+	// Events returns the latest storage state transitions from the oldest
+	Events() []lsm.Event
+	// Snapshot writes a consistent copy of the storage into a new directory
+	Snapshot(ctx context.Context, dir string) error
+	// MajorCompact merges the whole storage into one table dropping deleted
+	// and expired keys
+	MajorCompact(ctx context.Context) error
+	// Version returns the version of the latest write
+	Version() uint64
+	// Apply writes changes replicated from another storage keeping their
+	// versions
+	Apply(ctx context.Context, changes []lsm.Change) error
+	// ScanChanges is Scan returning values with their versions
+	ScanChanges(ctx context.Context, startKey string, endKey string, limit int) ([]lsm.Change, error)
+	// SetChangeHook installs hook to observe every write in version order
+	SetChangeHook(hook lsm.ChangeHook)
+	// SetMaxValueSize and SetMergeTimeout change the storage tuning while
+	// it runs
+	SetMaxValueSize(size int64)
+	SetMergeTimeout(timeout time.Duration)
+	// Flush writes the memtable into a table
+	Flush() error
+	// Suspend stops background flushes and merges once those in progress
+	// finished, Resume restarts them
+	Suspend() error
+	Resume()
+	Suspended() bool
+	Close()
+}
+
+// lsmStorage adapts lsm.Lsm to KeyValueStorage
+type lsmStorage struct {
+	lsm *lsm.Lsm
+}
+
+func newLsmStorage(lsm *lsm.Lsm) KeyValueStorage {
+	return &lsmStorage{lsm: lsm}
+}
+
+func (s *lsmStorage) Get(ctx context.Context, key string) (string, Meta, error) {
+	value, meta, err := s.GetBytes(ctx, key)
+	if err != nil {
+		return "", Meta{}, err
+	}
+	return string(value), meta, nil
+}
+
+func (s *lsmStorage) GetBytes(ctx context.Context, key string) ([]byte, Meta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Meta{}, err
+	}
+
+	value, meta, err := s.lsm.GetBytes(key)
+	if err != nil {
+		return nil, Meta{}, err
+	}
+	return value, Meta{Version: meta.Version, ExpiresAt: meta.ExpiresAt}, nil
+}
+
+func (s *lsmStorage) Set(ctx context.Context, key string, value string, opts *SetOptions) (Meta, error) {
+	return s.SetBytes(ctx, key, []byte(value), opts)
+}
+
+func (s *lsmStorage) SetBytes(ctx context.Context, key string, value []byte, opts *SetOptions) (Meta, error) {
+	if err := ctx.Err(); err != nil {
+		return Meta{}, err
+	}
+
+	var writeOpts lsm.WriteOptions
+	if opts != nil {
+		writeOpts.Ttl = opts.Ttl
+		writeOpts.ExpiresAt = opts.ExpiresAt
+		writeOpts.Create = opts.Create
+		writeOpts.CompareVersion = opts.CompareVersion
+		writeOpts.ExpectedVersion = opts.ExpectedVersion
+		writeOpts.Durability = opts.Durability
+		writeOpts.Version = opts.Version
+	}
+
+	meta, err := s.lsm.SetBytes(key, value, &writeOpts)
+	if err != nil {
+		return Meta{}, err
+	}
+	return Meta{Version: meta.Version, ExpiresAt: meta.ExpiresAt}, nil
+}
+
+func (s *lsmStorage) Delete(ctx context.Context, key string, opts *DeleteOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var writeOpts lsm.WriteOptions
+	if opts != nil {
+		writeOpts.CompareVersion = opts.CompareVersion
+		writeOpts.ExpectedVersion = opts.ExpectedVersion
+		writeOpts.Durability = opts.Durability
+		writeOpts.Version = opts.Version
+	}
+
+	return s.lsm.DeleteWithOptions(key, &writeOpts)
+}
+
+func (s *lsmStorage) DeleteKeys(ctx context.Context, keys []string, opts *DeleteOptions) ([]error, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var writeOpts lsm.WriteOptions
+	if opts != nil {
+		writeOpts.Version = opts.Version
+	}
+	return s.lsm.DeleteKeysWithOptions(keys, &writeOpts)
+}
+
+func (s *lsmStorage) Txn(ctx context.Context, txn *lsm.Txn) (*lsm.TxnResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.lsm.Txn(txn)
+}
+
+func (s *lsmStorage) Scan(ctx context.Context, startKey string, endKey string, limit int) ([]KeyValue, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	kvs, err := s.lsm.Scan(startKey, endKey, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]KeyValue, len(kvs))
+	for i, kv := range kvs {
+		result[i] = KeyValue{Key: kv.Key, Value: kv.Value}
+	}
+	return result, nil
+}
+
+func (s *lsmStorage) PrefixCounts() map[string]int64 {
+	return s.lsm.PrefixCounts()
+}
+
+func (s *lsmStorage) CacheStats() (int64, int64, int64) {
+	return s.lsm.CacheStats()
+}
+
+func (s *lsmStorage) CacheVerifyStats() (int64, int64) {
+	return s.lsm.CacheVerifyStats()
+}
+
+func (s *lsmStorage) CompactionStats() lsm.CompactionStats {
+	return s.lsm.CompactionStats()
+}
+
+func (s *lsmStorage) TableProperties() []lsm.TableProperties {
+	return s.lsm.TableProperties()
+}
+
+func (s *lsmStorage) Warmup(ctx context.Context) (lsm.WarmupStats, error) {
+	return s.lsm.Warmup(ctx)
+}
+
+func (s *lsmStorage) Events() []lsm.Event {
+	return s.lsm.Events()
+}
+
+func (s *lsmStorage) SetMaxValueSize(size int64) {
+	s.lsm.SetMaxValueSize(size)
+}
+
+func (s *lsmStorage) SetMergeTimeout(timeout time.Duration) {
+	s.lsm.SetMergeTimeout(timeout)
+}
+
+func (s *lsmStorage) Flush() error {
+	return s.lsm.Flush()
+}
+
+func (s *lsmStorage) Suspend() error {
+	return s.lsm.Suspend()
+}
+
+func (s *lsmStorage) Resume() {
+	s.lsm.Resume()
+}
+
+func (s *lsmStorage) Suspended() bool {
+	return s.lsm.Suspended()
+}
+
+func (s *lsmStorage) Snapshot(ctx context.Context, dir string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.lsm.Snapshot(dir)
+}
+
+func (s *lsmStorage) MajorCompact(ctx context.Context) error {
+	return s.lsm.MajorCompact(ctx)
+}
+
+func (s *lsmStorage) Version() uint64 {
+	return s.lsm.Version()
+}
+
+func (s *lsmStorage) Apply(ctx context.Context, changes []lsm.Change) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.lsm.Apply(changes)
+}
+
+func (s *lsmStorage) ScanChanges(ctx context.Context, startKey string, endKey string, limit int) ([]lsm.Change, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return s.lsm.ScanChanges(startKey, endKey, limit)
+}
+
+func (s *lsmStorage) SetChangeHook(hook lsm.ChangeHook) {
+	s.lsm.SetChangeHook(hook)
+}
+
+func (s *lsmStorage) Close() {
+	s.lsm.Close()
+}
@@ -0,0 +1,126 @@
+package mds
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"ddb/lib/common/filelog"
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+	"ddb/lib/common/random"
+)
+
+func TestLsmStorage(t *testing.T) {
+	rootPath, err := ioutil.TempDir("", "TestLsmStorage_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(rootPath)
+
+	log := log.NewLog(filelog.NewFileLogWithFile(os.Stdout))
+	defer log.Sync()
+
+	engine, err := lsm.NewLsm(log, rootPath, nil)
+	if err != nil {
+		t.Fatalf("can't create lsm error %v", err)
+		return
+	}
+	storage := newLsmStorage(engine)
+	defer storage.Close()
+
+	// writes return the metadata a get returns
+	ctx := context.Background()
+	meta, err := storage.Set(ctx, "k1", "v1", nil)
+	if err != nil || meta.Version == 0 || meta.ExpiresAt != 0 {
+		t.Fatalf("set meta %+v error %v", meta, err)
+		return
+	}
+	value, got, err := storage.Get(ctx, "k1")
+	if err != nil || value != "v1" || got != meta {
+		t.Fatalf("get value %s meta %+v expected %+v error %v", value, got, meta, err)
+		return
+	}
+	before := time.Now().UnixNano()
+	ttlMeta, err := storage.Set(ctx, "k2", "v2", &SetOptions{Ttl: time.Hour})
+	if err != nil || ttlMeta.ExpiresAt < before+int64(time.Hour) || ttlMeta.Version <= meta.Version {
+		t.Fatalf("set with ttl meta %+v error %v", ttlMeta, err)
+		return
+	}
+	explicit, err := storage.SetBytes(ctx, "k3", []byte{0, 1}, &SetOptions{ExpiresAt: before + int64(time.Minute), Ttl: time.Hour})
+	if err != nil || explicit.ExpiresAt != before+int64(time.Minute) {
+		t.Fatalf("set with expiration meta %+v error %v", explicit, err)
+		return
+	}
+
+	// options are passed down to the engine
+	_, err = storage.Set(ctx, "k1", "v2", &SetOptions{Create: true})
+	if err != lsm.ErrExists {
+		t.Fatalf("create of existing key error %v", err)
+		return
+	}
+	_, err = storage.Set(ctx, "k1", "v2", &SetOptions{CompareVersion: true, ExpectedVersion: meta.Version + 100})
+	if err != lsm.ErrVersionMismatch {
+		t.Fatalf("set with stale version error %v", err)
+		return
+	}
+	meta, err = storage.Set(ctx, "k1", "v2", &SetOptions{CompareVersion: true, ExpectedVersion: meta.Version})
+	if err != nil {
+		t.Fatalf("set with version error %v", err)
+		return
+	}
+	err = storage.Delete(ctx, "k1", &DeleteOptions{CompareVersion: true, ExpectedVersion: meta.Version - 1})
+	if err != lsm.ErrVersionMismatch {
+		t.Fatalf("delete with stale version error %v", err)
+		return
+	}
+	err = storage.Delete(ctx, "k1", &DeleteOptions{CompareVersion: true, ExpectedVersion: meta.Version})
+	if err != nil {
+		t.Fatalf("delete with version error %v", err)
+		return
+	}
+	if _, _, err = storage.Get(ctx, "k1"); err != lsm.ErrNotFound {
+		t.Fatalf("get of deleted key error %v", err)
+		return
+	}
+
+	kvs, err := storage.Scan(ctx, "", "", 10)
+	expected := []KeyValue{{Key: "k2", Value: "v2"}, {Key: "k3", Value: "\x00\x01"}}
+	if err != nil || !reflect.DeepEqual(kvs, expected) {
+		t.Fatalf("scan %v error %v", kvs, err)
+		return
+	}
+
+	// a canceled request doesn't reach the storage
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	version := storage.Version()
+	if _, err = storage.Set(canceled, "k4", "v4", nil); err != context.Canceled {
+		t.Fatalf("canceled set error %v", err)
+		return
+	}
+	if err = storage.Delete(canceled, "k2", nil); err != context.Canceled {
+		t.Fatalf("canceled delete error %v", err)
+		return
+	}
+	if _, _, err = storage.Get(canceled, "k2"); err != context.Canceled {
+		t.Fatalf("canceled get error %v", err)
+		return
+	}
+	if _, err = storage.Scan(canceled, "", "", 10); err != context.Canceled {
+		t.Fatalf("canceled scan error %v", err)
+		return
+	}
+	if storage.Version() != version {
+		t.Fatalf("canceled writes changed version %d to %d", version, storage.Version())
+		return
+	}
+	if _, _, err = storage.Get(ctx, "k2"); err != nil {
+		t.Fatalf("get after canceled delete error %v", err)
+		return
+	}
+}
@@ -0,0 +1,44 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+
+	"ddb/lib/common/log"
+)
+
+// requestTraceKey is the context key of the request trace
+type requestTraceKey struct{}
+
+// requestTrace carries the id of a request to the log lines of its
+// handler, the id comes from the X-Request-Id header or from the json body
+// once it's decoded
+type requestTrace struct {
+	id string
+}
+
+// tracing passes a request trace to the handler in the request context
+func tracing(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		trace := &requestTrace{id: r.Header.Get("X-Request-Id")}
+		handler(w, r.WithContext(context.WithValue(r.Context(), requestTraceKey{}, trace)))
+	}
+}
+
+// setRequestId records the id of a request read from its body
+func setRequestId(r *http.Request, id string) {
+	trace, ok := r.Context().Value(requestTraceKey{}).(*requestTrace)
+	if ok && id != "" {
+		trace.id = id
+	}
+}
+
+// requestLog returns the log of a handler of r, its lines carry the
+// request id
+func requestLog(r *http.Request) log.LogInterface {
+	trace, ok := r.Context().Value(requestTraceKey{}).(*requestTrace)
+	if !ok || trace.id == "" {
+		return GetMds().log
+	}
+	return GetMds().log.With("requestId", trace.id)
+}
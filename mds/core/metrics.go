@@ -0,0 +1,217 @@
+package mds
+
+import (
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync/atomic"
+
+	"ddb/lib/common/log"
+	"ddb/lib/common/metrics"
+)
+
+const metricsContentType = "text/plain; version=0.0.4"
+
+// getMetrics serves the request, storage and runtime metrics in the
+// prometheus text format
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	mds := GetMds()
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.WriteHeader(http.StatusOK)
+	mw := metrics.NewWriter(w)
+
+	mw.Family("ddb_request_duration_seconds", metrics.TypeHistogram, "Api request latency by operation.")
+	mw.Histogram("ddb_request_duration_seconds", mds.stats.setKey, "op", "set")
+	mw.Histogram("ddb_request_duration_seconds", mds.stats.getKey, "op", "get")
+	mw.Histogram("ddb_request_duration_seconds", mds.stats.deleteKey, "op", "delete")
+	mw.Histogram("ddb_request_duration_seconds", mds.stats.batch, "op", "batch")
+	mw.Histogram("ddb_request_duration_seconds", mds.stats.scan, "op", "scan")
+	mw.Histogram("ddb_request_duration_seconds", mds.stats.txn, "op", "txn")
+	mds.stats.writeSloMetrics(mw)
+	mds.stats.traffic.writeMetrics(mw)
+	if mds.dedup != nil {
+		mw.Family("ddb_request_dedup_hits_total", metrics.TypeCounter, "Resent writes answered with the response of the first one.")
+		mw.Sample("ddb_request_dedup_hits_total", float64(atomic.LoadInt64(&mds.dedup.hits)))
+	}
+
+	responses := mds.stats.responses.Values()
+	codes := make([]string, 0, len(responses))
+	for code := range responses {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	mw.Family("ddb_responses_total", metrics.TypeCounter, "Api responses by http status code.")
+	for _, code := range codes {
+		mw.Sample("ddb_responses_total", float64(responses[code]), "code", code)
+	}
+
+	hits, misses, size := mds.storage().CacheStats()
+	mw.Family("ddb_block_cache_hits_total", metrics.TypeCounter, "Sstable block cache hits.")
+	mw.Sample("ddb_block_cache_hits_total", float64(hits))
+	mw.Family("ddb_block_cache_misses_total", metrics.TypeCounter, "Sstable block cache misses.")
+	mw.Sample("ddb_block_cache_misses_total", float64(misses))
+	mw.Family("ddb_block_cache_bytes", metrics.TypeGauge, "Sstable block cache size.")
+	mw.Sample("ddb_block_cache_bytes", float64(size))
+	verified, stale := mds.storage().CacheVerifyStats()
+	mw.Family("ddb_block_cache_verified_total", metrics.TypeCounter, "Block cache hits re-read from sstables.")
+	mw.Sample("ddb_block_cache_verified_total", float64(verified))
+	mw.Family("ddb_block_cache_stale_total", metrics.TypeCounter, "Verified block cache hits which differed from sstables.")
+	mw.Sample("ddb_block_cache_stale_total", float64(stale))
+
+	cs := mds.storage().CompactionStats()
+	mw.Family("ddb_memtable_nodes", metrics.TypeGauge, "Nodes in the memtable.")
+	mw.Sample("ddb_memtable_nodes", float64(cs.MemtableNodes))
+	mw.Family("ddb_memtable_bytes", metrics.TypeGauge, "Approximate memory used by memtable nodes.")
+	mw.Sample("ddb_memtable_bytes", float64(cs.MemtableBytes))
+	mw.Family("ddb_wal_bytes", metrics.TypeGauge, "Write ahead log bytes not yet flushed into sstables.")
+	mw.Sample("ddb_wal_bytes", float64(cs.WalBytes))
+	mw.Family("ddb_wal_syncs_total", metrics.TypeCounter, "Write ahead log syncs, each covers all writes logged before it.")
+	mw.Sample("ddb_wal_syncs_total", float64(cs.LogSyncs))
+	mw.Family("ddb_coalesced_writes_total", metrics.TypeCounter, "Writes to hot keys replaced by a later write before being logged.")
+	mw.Sample("ddb_coalesced_writes_total", float64(cs.CoalescedWrites))
+	mw.Family("ddb_hot_keys", metrics.TypeGauge, "Keys written at least -coalesceThreshold times in the last second.")
+	mw.Sample("ddb_hot_keys", float64(cs.HotKeys))
+	mw.Family("ddb_sstables", metrics.TypeGauge, "Sstables of the current version.")
+	mw.Sample("ddb_sstables", float64(cs.Tables))
+	mw.Family("ddb_sstable_bytes", metrics.TypeGauge, "Bytes of the current sstables.")
+	mw.Sample("ddb_sstable_bytes", float64(cs.TableBytes))
+	mw.Family("ddb_sstable_index_bytes", metrics.TypeGauge, "Memory held by the sparse indexes of the current sstables.")
+	mw.Sample("ddb_sstable_index_bytes", float64(cs.IndexBytes))
+	mw.Family("ddb_compaction_pending_sstables", metrics.TypeGauge, "Sstables in runs eligible for merging.")
+	mw.Sample("ddb_compaction_pending_sstables", float64(cs.PendingTables))
+	mw.Family("ddb_compaction_pending_bytes", metrics.TypeGauge, "Bytes in runs eligible for merging.")
+	mw.Sample("ddb_compaction_pending_bytes", float64(cs.PendingBytes))
+	mw.Family("ddb_flushes_total", metrics.TypeCounter, "Memtable flushes into sstables.")
+	mw.Sample("ddb_flushes_total", float64(cs.Flushes))
+	mw.Family("ddb_flush_seconds_total", metrics.TypeCounter, "Time spent flushing the memtable.")
+	mw.Sample("ddb_flush_seconds_total", cs.FlushDuration.Seconds())
+	mw.Family("ddb_merges_total", metrics.TypeCounter, "Sstable merges.")
+	mw.Sample("ddb_merges_total", float64(cs.Merges))
+	mw.Family("ddb_forced_merges_total", metrics.TypeCounter, "Sstable merges forced by the sstable count exceeding -maxTables.")
+	mw.Sample("ddb_forced_merges_total", float64(cs.ForcedMerges))
+	mw.Family("ddb_stalled_writers", metrics.TypeGauge, "Writers queued for a flush of the busy memtable.")
+	mw.Sample("ddb_stalled_writers", float64(cs.StalledWriters))
+	mw.Family("ddb_write_stalls_total", metrics.TypeCounter, "Writers queued for a flush of the busy memtable.")
+	mw.Sample("ddb_write_stalls_total", float64(cs.WriteStalls))
+	mw.Family("ddb_write_stall_rejects_total", metrics.TypeCounter, "Queued writers failed as busy because no flush made room in time.")
+	mw.Sample("ddb_write_stall_rejects_total", float64(cs.StallRejects))
+	mw.Family("ddb_write_stall_seconds_total", metrics.TypeCounter, "Time writers spent queued while writes were stopped.")
+	mw.Sample("ddb_write_stall_seconds_total", cs.StallDuration.Seconds())
+	mw.Family("ddb_write_slowdowns_total", metrics.TypeCounter, "Writes delayed by a slowdown trigger.")
+	mw.Sample("ddb_write_slowdowns_total", float64(cs.WriteSlowdowns))
+	mw.Family("ddb_write_slowdown_seconds_total", metrics.TypeCounter, "Time writes were delayed by slowdown triggers.")
+	mw.Sample("ddb_write_slowdown_seconds_total", cs.SlowdownDuration.Seconds())
+	mw.Family("ddb_write_state", metrics.TypeGauge, "1 for the current write state: running, slowed or stopped.")
+	for _, state := range []string{"running", "slowed", "stopped"} {
+		mw.Sample("ddb_write_state", boolMetric(cs.WriteState == state), "state", state)
+	}
+	mw.Family("ddb_background_suspended", metrics.TypeGauge, "1 while background flushes and merges are suspended.")
+	mw.Sample("ddb_background_suspended", boolMetric(cs.Suspended))
+	mw.Family("ddb_merge_seconds_total", metrics.TypeCounter, "Time spent merging sstables.")
+	mw.Sample("ddb_merge_seconds_total", cs.MergeDuration.Seconds())
+	mw.Family("ddb_merge_wait_seconds_total", metrics.TypeCounter, "Time merges waited for another merge on the disk.")
+	mw.Sample("ddb_merge_wait_seconds_total", cs.MergeWaitDuration.Seconds())
+	mw.Family("ddb_merge_throttle_seconds_total", metrics.TypeCounter, "Time merges slept to stay within -mergeBytesPerSec.")
+	mw.Sample("ddb_merge_throttle_seconds_total", cs.MergeThrottleDuration.Seconds())
+	mw.Family("ddb_merged_bytes_total", metrics.TypeCounter, "Bytes written by merges.")
+	mw.Sample("ddb_merged_bytes_total", float64(cs.MergedBytes))
+	mw.Family("ddb_dropped_tombstones_total", metrics.TypeCounter, "Tombstones dropped by merges.")
+	mw.Sample("ddb_dropped_tombstones_total", float64(cs.DroppedTombstones))
+	mw.Family("ddb_purged_expired_total", metrics.TypeCounter, "Expired values purged by merges.")
+	mw.Sample("ddb_purged_expired_total", float64(cs.PurgedExpired))
+
+	mds.writeValueAgeMetrics(mw)
+
+	counts := mds.storage().PrefixCounts()
+	prefixes := make([]string, 0, len(counts))
+	for prefix := range counts {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	mw.Family("ddb_prefix_keys", metrics.TypeGauge, "Approximate live keys by counted prefix.")
+	for _, prefix := range prefixes {
+		mw.Sample("ddb_prefix_keys", float64(counts[prefix]), "prefix", prefix)
+	}
+
+	mw.Family("ddb_version", metrics.TypeGauge, "Version of the latest write.")
+	mw.Sample("ddb_version", float64(mds.storage().Version()))
+	if mds.raft != nil {
+		rs := mds.raft.Status()
+		mw.Family("ddb_raft_term", metrics.TypeGauge, "Raft term.")
+		mw.Sample("ddb_raft_term", float64(rs.Term))
+		mw.Family("ddb_raft_leader", metrics.TypeGauge, "1 if the node is the raft leader.")
+		mw.Sample("ddb_raft_leader", boolMetric(rs.Role == "leader"))
+		mw.Family("ddb_raft_commit_index", metrics.TypeGauge, "Raft commit index.")
+		mw.Sample("ddb_raft_commit_index", float64(rs.CommitIndex))
+		mw.Family("ddb_raft_last_applied", metrics.TypeGauge, "Raft last applied index.")
+		mw.Sample("ddb_raft_last_applied", float64(rs.LastApplied))
+		mw.Family("ddb_raft_compacted_index", metrics.TypeGauge, "Last raft index compacted away from the log.")
+		mw.Sample("ddb_raft_compacted_index", float64(rs.CompactedIndex))
+		mw.Family("ddb_raft_log_bytes", metrics.TypeGauge, "Data of the entries the raft log keeps.")
+		mw.Sample("ddb_raft_log_bytes", float64(rs.LogBytes))
+	}
+	if mds.isFollower() {
+		mw.Family("ddb_replication_applied_version", metrics.TypeGauge, "Latest primary version applied by the follower.")
+		mw.Sample("ddb_replication_applied_version", float64(atomic.LoadUint64(&mds.appliedVersion)))
+		mw.Family("ddb_replication_primary_version", metrics.TypeGauge, "Latest version seen on the primary.")
+		mw.Sample("ddb_replication_primary_version", float64(atomic.LoadUint64(&mds.primaryVersion)))
+		if skew, ok := mds.hlc.Skew(); ok {
+			mw.Family("ddb_clock_skew_seconds", metrics.TypeGauge, "Clock of the follower minus clock of the primary at the latest poll.")
+			mw.Sample("ddb_clock_skew_seconds", skew.Seconds())
+		}
+	} else {
+		base, kept := mds.replication.stats()
+		mw.Family("ddb_replication_log_base", metrics.TypeGauge, "Oldest version kept in the replication log.")
+		mw.Sample("ddb_replication_log_base", float64(base))
+		mw.Family("ddb_replication_log_changes", metrics.TypeGauge, "Changes kept in the replication log.")
+		mw.Sample("ddb_replication_log_changes", float64(kept))
+	}
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	mw.Family("go_goroutines", metrics.TypeGauge, "Number of goroutines.")
+	mw.Sample("go_goroutines", float64(runtime.NumGoroutine()))
+	mw.Family("go_memstats_alloc_bytes", metrics.TypeGauge, "Bytes of allocated heap objects.")
+	mw.Sample("go_memstats_alloc_bytes", float64(ms.HeapAlloc))
+	mw.Family("go_memstats_heap_inuse_bytes", metrics.TypeGauge, "Bytes in in-use heap spans.")
+	mw.Sample("go_memstats_heap_inuse_bytes", float64(ms.HeapInuse))
+	mw.Family("go_memstats_sys_bytes", metrics.TypeGauge, "Bytes obtained from the system.")
+	mw.Sample("go_memstats_sys_bytes", float64(ms.Sys))
+	mw.Family("go_gc_cycles_total", metrics.TypeCounter, "Completed gc cycles.")
+	mw.Sample("go_gc_cycles_total", float64(ms.NumGC))
+	mw.Family("go_gc_pause_seconds_total", metrics.TypeCounter, "Total gc pause time.")
+	mw.Sample("go_gc_pause_seconds_total", float64(ms.PauseTotalNs)/1e9)
+	mw.Family("process_start_time_seconds", metrics.TypeGauge, "Start time of the process since unix epoch.")
+	mw.Sample("process_start_time_seconds", float64(mds.startedAt)/1e9)
+	mds.writeBackupMetrics(mw)
+
+	if mw.Err() != nil {
+		mds.log.Pf(log.LevelError, "write metrics error %v", mw.Err())
+	}
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// writeValueAgeMetrics exports the age of the oldest, newest and mean value
+// of every sstable to tune merges and ttls, tables without write times are
+// skipped
+func (mds *Mds) writeValueAgeMetrics(mw *metrics.Writer) {
+	now := mds.clock.Now().UnixNano()
+	mw.Family("ddb_sstable_value_age_seconds", metrics.TypeGauge, "Age of the oldest, newest and mean value of an sstable.")
+	for _, props := range mds.storage().TableProperties() {
+		if props.WrittenNodes == 0 {
+			continue
+		}
+		table := filepath.Base(props.Path)
+		mw.Sample("ddb_sstable_value_age_seconds", float64(now-props.MinWrittenAt)/1e9, "table", table, "stat", "max")
+		mw.Sample("ddb_sstable_value_age_seconds", float64(now-props.MaxWrittenAt)/1e9, "table", table, "stat", "min")
+		mw.Sample("ddb_sstable_value_age_seconds", float64(now-props.MeanWrittenAt)/1e9, "table", table, "stat", "mean")
+	}
+}
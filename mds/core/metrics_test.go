@@ -0,0 +1,101 @@
+package mds
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	client "ddb/client/core"
+)
+
+// scrapeMetrics returns the samples of /metrics by name and labels, e.g.
+// ddb_responses_total{code="200"}
+func scrapeMetrics(t *testing.T, url string) map[string]float64 {
+	resp, err := http.Get(url + "/metrics")
+	if err != nil {
+		t.Fatalf("get metrics error %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != metricsContentType {
+		t.Fatalf("metrics status %d content type %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		if i < 0 {
+			t.Fatalf("metrics line %q", line)
+		}
+		value, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("metrics line %q error %v", line, err)
+		}
+		samples[line[:i]] = value
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	server, stop := startTestMds(t, "TestMetrics", &MdsParameters{})
+	defer stop()
+
+	ctx := context.Background()
+	c := client.NewClient(server.URL)
+	for _, key := range []string{"k1", "k2", "k3"} {
+		err := c.SetKey(ctx, key, "v"+key)
+		if err != nil {
+			t.Fatalf("set %s error %v", key, err)
+			return
+		}
+	}
+	for _, key := range []string{"k1", "k2", "k4"} {
+		c.GetKey(ctx, key)
+	}
+	err := c.DeleteKey(ctx, "k3")
+	if err != nil {
+		t.Fatalf("delete error %v", err)
+		return
+	}
+
+	samples := scrapeMetrics(t, server.URL)
+	expected := map[string]float64{
+		`ddb_request_duration_seconds_count{op="set"}`:    3,
+		`ddb_request_duration_seconds_count{op="get"}`:    3,
+		`ddb_request_duration_seconds_count{op="delete"}`: 1,
+		`ddb_request_duration_seconds_count{op="batch"}`:  0,
+		`ddb_responses_total{code="200"}`:                 6,
+		`ddb_responses_total{code="404"}`:                 1,
+		`ddb_version`:                                     4,
+	}
+	for name, value := range expected {
+		got, ok := samples[name]
+		if !ok || got != value {
+			t.Fatalf("metric %s %v expected %v", name, got, value)
+			return
+		}
+	}
+
+	// histograms are cumulative up to the count
+	count := samples[`ddb_request_duration_seconds_count{op="set"}`]
+	if samples[`ddb_request_duration_seconds_bucket{op="set",le="+Inf"}`] != count ||
+		samples[`ddb_request_duration_seconds_sum{op="set"}`] <= 0 {
+		t.Fatalf("set histogram count %v +Inf %v sum %v", count,
+			samples[`ddb_request_duration_seconds_bucket{op="set",le="+Inf"}`], samples[`ddb_request_duration_seconds_sum{op="set"}`])
+		return
+	}
+	for _, name := range []string{"ddb_block_cache_hits_total", "ddb_block_cache_bytes", "go_goroutines"} {
+		if _, ok := samples[name]; !ok {
+			t.Fatalf("metric %s missing", name)
+			return
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package mds
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+)
+
+// Asynchronous primary/follower replication: the primary keeps its latest
+// writes in memory and followers poll them over the api, applying them to
+// their own storage with the primary versions. A follower which is too far
+// behind copies the whole storage page by page and continues from the
+// version the copy started at, replaying changes over the copied pages
+// makes them consistent.
+
+const (
+	defaultReplicationLogSize = 100000
+	replicationBatchSize      = 1000
+	replicationWait           = time.Second
+	maxReplicationWait        = 30 * time.Second
+	replicationRetryInterval  = time.Second
+	// Present while a follower copies the storage, an interrupted copy is
+	// started over
+	resyncFileName = "replication.resync"
+)
+
+// replicationLog keeps the latest writes for followers
+type replicationLog struct {
+	lock    sync.Mutex
+	changes []lsm.Change
+	// Version preceding the oldest kept change, followers behind it need a
+	// full copy
+	base uint64
+	size int
+	// Closed and replaced when changes are appended
+	notifyChan chan struct{}
+}
+
+func newReplicationLog(size int, version uint64) *replicationLog {
+	if size <= 0 {
+		size = defaultReplicationLogSize
+	}
+	return &replicationLog{base: version, size: size, notifyChan: make(chan struct{})}
+}
+
+// reset forgets kept changes when the storage is replaced
+func (l *replicationLog) reset(version uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.changes = nil
+	l.base = version
+}
+
+func (l *replicationLog) append(changes []lsm.Change) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.changes = append(l.changes, changes...)
+	// trim with some slack to not copy the log on every write
+	if len(l.changes) > l.size+l.size/4 {
+		drop := len(l.changes) - l.size
+		l.base = l.changes[drop-1].Version
+		l.changes = append([]lsm.Change(nil), l.changes[drop:]...)
+	}
+
+	close(l.notifyChan)
+	l.notifyChan = make(chan struct{})
+}
+
+// since returns up to limit changes with versions above from and the latest
+// version, ok is false if the changes are no longer kept. The returned
+// channel is closed once more changes are appended.
+func (l *replicationLog) since(from uint64, limit int) ([]lsm.Change, uint64, bool, <-chan struct{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	last := l.base
+	if len(l.changes) > 0 {
+		last = l.changes[len(l.changes)-1].Version
+	}
+	if from < l.base || from > last {
+		return nil, last, false, l.notifyChan
+	}
+
+	i := sort.Search(len(l.changes), func(i int) bool { return l.changes[i].Version > from })
+	j := i + limit
+	if j > len(l.changes) {
+		j = len(l.changes)
+	}
+	changes := make([]lsm.Change, j-i)
+	copy(changes, l.changes[i:j])
+	return changes, last, true, l.notifyChan
+}
+
+func (l *replicationLog) stats() (uint64, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.base, len(l.changes)
+}
+
+func toClientChanges(changes []lsm.Change) []client.Change {
+	result := make([]client.Change, len(changes))
+	for i, c := range changes {
+		result[i] = client.Change{Key: c.Key, Value: c.Value, Deleted: c.Deleted, ExpiresAt: c.ExpiresAt, Version: c.Version, WrittenAt: c.WrittenAt}
+	}
+	return result
+}
+
+func fromClientChanges(changes []client.Change) []lsm.Change {
+	result := make([]lsm.Change, len(changes))
+	for i, c := range changes {
+		result[i] = lsm.Change{Key: c.Key, Value: c.Value, Deleted: c.Deleted, ExpiresAt: c.ExpiresAt, Version: c.Version, WrittenAt: c.WrittenAt}
+	}
+	return result
+}
+
+// setStorage switches api requests and replication to kvs, kvs stays
+// suspended if the storage it replaces was
+func (mds *Mds) setStorage(kvs *lsm.Lsm) {
+	if current := mds.storage(); current != nil && current.Suspended() {
+		kvs.Suspend()
+	}
+	storage := newLsmStorage(kvs)
+	version := storage.Version()
+	if mds.replication == nil {
+		mds.replication = newReplicationLog(mds.replicationLogSize, version)
+	} else {
+		mds.replication.reset(version)
+	}
+	storage.SetChangeHook(mds.replication.append)
+	mds.kvs.Store(storageRef{kvs: storage})
+}
+
+func (mds *Mds) isFollower() bool {
+	return mds.replicaOf != ""
+}
+
+// writing rejects writes on a follower, its storage only changes by
+// replication
+func writing(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if GetMds().isFollower() {
+			completeRequest(w, "", ErrReadOnly, nil)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func getChanges(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.ChangesResponse{}
+	defer func() {
+		completeRequest(w, requestId, err, resp)
+	}()
+
+	query := r.URL.Query()
+	from, err := strconv.ParseUint(query.Get("from"), 10, 64)
+	if err != nil {
+		err = ErrBadRequest
+		return
+	}
+
+	limit := replicationBatchSize
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			err = ErrBadRequest
+			return
+		}
+		if limit > replicationBatchSize {
+			limit = replicationBatchSize
+		}
+	}
+
+	wait := time.Duration(0)
+	if query.Get("waitMs") != "" {
+		var waitMs int
+		waitMs, err = strconv.Atoi(query.Get("waitMs"))
+		if err != nil || waitMs < 0 {
+			err = ErrBadRequest
+			return
+		}
+		wait = time.Duration(waitMs) * time.Millisecond
+		if wait > maxReplicationWait {
+			wait = maxReplicationWait
+		}
+	}
+
+	changes, last, ok, notifyChan := GetMds().replication.since(from, limit)
+	if ok && len(changes) == 0 && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-notifyChan:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+		changes, last, ok, _ = GetMds().replication.since(from, limit)
+	}
+
+	resp.Changes = toClientChanges(changes)
+	resp.Version = last
+	resp.Reset = !ok
+	resp.Time = GetMds().hlc.Now().UnixNano()
+}
+
+func getSnapshotPage(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.SnapshotPageResponse{}
+	defer func() {
+		completeRequest(w, requestId, err, resp)
+	}()
+
+	query := r.URL.Query()
+	limit := replicationBatchSize
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			err = ErrBadRequest
+			return
+		}
+		if limit >= lsm.MaxScanLimit {
+			limit = lsm.MaxScanLimit - 1
+		}
+	}
+
+	kvs := GetMds().storage()
+	// the version is taken first so the changes after it cover
+	// everything the page may miss
+	resp.Version = kvs.Version()
+	changes, err := kvs.ScanChanges(r.Context(), query.Get("start"), "", limit+1)
+	if err != nil {
+		return
+	}
+	if len(changes) > limit {
+		resp.Next = changes[limit].Key
+		changes = changes[:limit]
+	}
+	resp.Changes = toClientChanges(changes)
+	resp.Time = GetMds().hlc.Now().UnixNano()
+}
+
+// retryWait waits before retrying a failed replication step, it returns
+// early once the follower is stopped
+func (mds *Mds) retryWait() {
+	select {
+	case <-mds.clock.After(replicationRetryInterval):
+	case <-mds.followerStop:
+	}
+}
+
+// follow applies changes of the primary until stopped
+func (mds *Mds) follow() {
+	defer mds.followerWg.Done()
+
+	c := client.NewClientWithOptions(mds.replicaOf, mds.peerOptions())
+	from := mds.storage().Version()
+	_, err := os.Stat(filepath.Join(mds.storagePath, resyncFileName))
+	resync := err == nil
+
+	for {
+		select {
+		case <-mds.followerStop:
+			return
+		default:
+		}
+
+		if atomic.LoadInt32(&mds.state) != mdsStateRunning {
+			mds.retryWait()
+			continue
+		}
+
+		if resync {
+			from, err = mds.resync(c)
+			if err != nil {
+				mds.log.Pf(log.LevelError, "replication resync from %s error %v", mds.replicaOf, err)
+				mds.retryWait()
+				continue
+			}
+			resync = false
+		}
+
+		resp, err := c.Changes(context.Background(), from, replicationBatchSize, replicationWait)
+		if err != nil {
+			mds.log.Pf(log.LevelError, "replication changes from %s error %v", mds.replicaOf, err)
+			mds.retryWait()
+			continue
+		}
+		atomic.StoreUint64(&mds.primaryVersion, resp.Version)
+		mds.observePrimary(resp.Time)
+
+		if resp.Reset {
+			mds.log.Pf(0, "replication version %d not kept by primary %s version %d", from, mds.replicaOf, resp.Version)
+			resync = true
+			continue
+		}
+		if len(resp.Changes) == 0 {
+			continue
+		}
+
+		err = mds.storage().Apply(context.Background(), fromClientChanges(resp.Changes))
+		if err != nil {
+			mds.log.Pf(log.LevelError, "replication apply error %v", err)
+			mds.retryWait()
+			continue
+		}
+		from = resp.Changes[len(resp.Changes)-1].Version
+		atomic.StoreUint64(&mds.appliedVersion, from)
+	}
+}
+
+// observePrimary moves the hybrid clock to the time of the primary so
+// expiration on the follower agrees with it, zero is an older primary
+// which doesn't send its time
+func (mds *Mds) observePrimary(t int64) {
+	if t != 0 {
+		mds.hlc.Observe(time.Unix(0, t))
+	}
+}
+
+// resync copies the storage of the primary and deletes keys it doesn't
+// have, it returns the version changes have to be applied from
+func (mds *Mds) resync(c *client.Client) (uint64, error) {
+	mds.log.Pf(0, "replication resync from %s", mds.replicaOf)
+
+	markerPath := filepath.Join(mds.storagePath, resyncFileName)
+	f, err := os.OpenFile(markerPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return 0, err
+	}
+	f.Close()
+
+	ctx := context.Background()
+	base := uint64(0)
+	start := ""
+	for first := true; ; first = false {
+		page, err := c.SnapshotPage(ctx, start, replicationBatchSize)
+		if err != nil {
+			return 0, err
+		}
+		if first {
+			base = page.Version
+		}
+		mds.observePrimary(page.Time)
+
+		// values written after base come with the changes, applying them
+		// now would move the follower version past changes not applied yet
+		keys := make(map[string]bool)
+		changes := make([]lsm.Change, 0, len(page.Changes))
+		for _, change := range fromClientChanges(page.Changes) {
+			keys[change.Key] = true
+			if change.Version <= base {
+				changes = append(changes, change)
+			}
+		}
+
+		err = mds.deleteMissing(ctx, start, page.Next, keys, base)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(changes) > 0 {
+			err = mds.storage().Apply(ctx, changes)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		if page.Next == "" {
+			break
+		}
+		start = page.Next
+	}
+
+	err = os.Remove(markerPath)
+	if err != nil {
+		return 0, err
+	}
+
+	mds.log.Pf(0, "replication resync done version %d", base)
+	return base, nil
+}
+
+// deleteMissing deletes local keys in [start, end) which aren't in keys
+func (mds *Mds) deleteMissing(ctx context.Context, start string, end string, keys map[string]bool, version uint64) error {
+	for {
+		local, err := mds.storage().ScanChanges(ctx, start, end, lsm.MaxScanLimit)
+		if err != nil {
+			return err
+		}
+
+		deletes := make([]lsm.Change, 0)
+		for _, change := range local {
+			if !keys[change.Key] {
+				deletes = append(deletes, lsm.Change{Key: change.Key, Deleted: true, Version: version})
+			}
+		}
+		if len(deletes) > 0 {
+			err = mds.storage().Apply(ctx, deletes)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(local) < lsm.MaxScanLimit {
+			return nil
+		}
+		start = local[len(local)-1].Key + "\x00"
+	}
+}
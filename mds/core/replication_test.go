@@ -0,0 +1,187 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	client "ddb/client/core"
+)
+
+func TestReplicationChanges(t *testing.T) {
+	server, stop := startTestMds(t, "TestReplicationChanges", &MdsParameters{ReplicationLogSize: 4})
+	defer stop()
+
+	ctx := context.Background()
+	c := client.NewClient(server.URL)
+	for _, key := range []string{"k1", "k2", "k3"} {
+		err := c.SetKey(ctx, key, "v"+key)
+		if err != nil {
+			t.Fatalf("set %s error %v", key, err)
+			return
+		}
+	}
+	err := c.DeleteKey(ctx, "k1")
+	if err != nil {
+		t.Fatalf("delete error %v", err)
+		return
+	}
+
+	resp, err := c.Changes(ctx, 0, 10, 0)
+	if err != nil || resp.Reset || len(resp.Changes) != 4 {
+		t.Fatalf("changes %+v error %v", resp, err)
+		return
+	}
+	last := resp.Changes[3]
+	if last.Key != "k1" || !last.Deleted || last.Version != resp.Version {
+		t.Fatalf("last change %+v version %d", last, resp.Version)
+		return
+	}
+
+	// changes are returned after from and up to limit
+	resp, err = c.Changes(ctx, resp.Changes[0].Version, 2, 0)
+	if err != nil || len(resp.Changes) != 2 || resp.Changes[0].Key != "k2" || resp.Changes[1].Key != "k3" {
+		t.Fatalf("changes after the first %+v error %v", resp, err)
+		return
+	}
+
+	// a follower behind the kept changes has to copy the storage
+	for _, key := range []string{"k4", "k5", "k6", "k7"} {
+		err = c.SetKey(ctx, key, "v"+key)
+		if err != nil {
+			t.Fatalf("set %s error %v", key, err)
+			return
+		}
+	}
+	resp, err = c.Changes(ctx, 0, 10, 0)
+	if err != nil || !resp.Reset {
+		t.Fatalf("changes of trimmed log %+v error %v", resp, err)
+		return
+	}
+
+	keys := make([]string, 0)
+	start := ""
+	for {
+		page, err := c.SnapshotPage(ctx, start, 4)
+		if err != nil || len(page.Changes) > 4 || page.Version != resp.Version {
+			t.Fatalf("snapshot page %+v error %v", page, err)
+			return
+		}
+		for _, change := range page.Changes {
+			keys = append(keys, change.Key)
+		}
+		if page.Next == "" {
+			break
+		}
+		start = page.Next
+	}
+	if len(keys) != 6 || keys[0] != "k2" || keys[5] != "k7" {
+		t.Fatalf("snapshot keys %v", keys)
+		return
+	}
+}
+
+// replicationPrimary serves a fixed snapshot and the changes after it to a
+// follower
+type replicationPrimary struct {
+	base     uint64
+	snapshot []client.Change
+	changes  []client.Change
+}
+
+func (p *replicationPrimary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	w.Header().Set("Content-Type", "application/json")
+	switch r.URL.Path {
+	case "/replication/snapshot":
+		resp := &client.SnapshotPageResponse{Version: p.base}
+		for i, change := range p.snapshot {
+			if change.Key < query.Get("start") {
+				continue
+			}
+			// pages of two keys
+			if len(resp.Changes) == 2 {
+				resp.Next = p.snapshot[i].Key
+				break
+			}
+			resp.Changes = append(resp.Changes, change)
+		}
+		json.NewEncoder(w).Encode(resp)
+	case "/replication/changes":
+		from, _ := strconv.ParseUint(query.Get("from"), 10, 64)
+		resp := &client.ChangesResponse{Version: p.changes[len(p.changes)-1].Version, Reset: from < p.base}
+		if !resp.Reset {
+			for _, change := range p.changes {
+				if change.Version > from {
+					resp.Changes = append(resp.Changes, change)
+				}
+			}
+		}
+		if len(resp.Changes) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	primary := httptest.NewServer(&replicationPrimary{
+		base: 10,
+		snapshot: []client.Change{
+			{Key: "k1", Value: []byte("v1"), Version: 5},
+			{Key: "k2", Value: []byte("v2"), Version: 8},
+			{Key: "k3", Value: []byte("v3"), Version: 12},
+		},
+		changes: []client.Change{
+			{Key: "k3", Value: []byte("v3"), Version: 12},
+			{Key: "k1", Deleted: true, Version: 13},
+			{Key: "k4", Value: []byte("v4"), Version: 14},
+		},
+	})
+	defer primary.Close()
+
+	server, stop := startTestMds(t, "TestFollower", &MdsParameters{ReplicaOf: primary.URL})
+	defer stop()
+
+	for i := 0; atomic.LoadUint64(&GetMds().appliedVersion) != 14; i++ {
+		if i == 500 {
+			t.Fatalf("applied version %d", atomic.LoadUint64(&GetMds().appliedVersion))
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// values get the versions of the primary
+	ctx := context.Background()
+	c := client.NewClient(server.URL)
+	expected := []struct {
+		key     string
+		value   string
+		version uint64
+	}{{"k2", "v2", 8}, {"k3", "v3", 12}, {"k4", "v4", 14}}
+	for _, e := range expected {
+		value, version, err := c.GetKeyVersion(ctx, e.key)
+		if err != nil || value != e.value || version != e.version {
+			t.Fatalf("get %s value %s version %d error %v", e.key, value, version, err)
+			return
+		}
+	}
+	_, err := c.GetKey(ctx, "k1")
+	if err != client.ErrNotFound {
+		t.Fatalf("get of deleted key error %v", err)
+		return
+	}
+
+	err = c.SetKey(ctx, "k5", "v5")
+	if err != client.ErrReadOnly {
+		t.Fatalf("set on follower error %v", err)
+		return
+	}
+}
@@ -0,0 +1,63 @@
+package mds
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+const (
+	// Larger buffers are dropped instead of returned to the pool so a single
+	// huge value doesn't pin memory
+	maxPooledBufferSize = 1 << 20
+)
+
+type responseEncoder struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var responseEncoderPool = sync.Pool{
+	New: func() interface{} {
+		re := new(responseEncoder)
+		re.enc = json.NewEncoder(&re.buf)
+		return re
+	},
+}
+
+// writeJson encodes v into a pooled buffer and writes it with a single
+// write and known Content-Length
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	re := responseEncoderPool.Get().(*responseEncoder)
+	re.buf.Reset()
+	defer func() {
+		if re.buf.Cap() <= maxPooledBufferSize {
+			responseEncoderPool.Put(re)
+		}
+	}()
+
+	GetMds().stats.responses.Inc(strconv.Itoa(status))
+
+	err := re.enc.Encode(v)
+	if err != nil {
+		panic(fmt.Sprintf("encode error failed, error %v", err))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(re.buf.Len()))
+	w.WriteHeader(status)
+	w.Write(re.buf.Bytes())
+}
+
+// writeRaw writes value as the response body without any encoding
+func writeRaw(w http.ResponseWriter, value []byte) {
+	GetMds().stats.responses.Inc(strconv.Itoa(http.StatusOK))
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(value)
+}
@@ -0,0 +1,141 @@
+package mds
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+	"ddb/lib/common/metrics"
+)
+
+const (
+	defaultRetentionInterval = time.Hour
+)
+
+// Backups are directories directly under BackupDir with a catalog, the
+// janitor keeps the newest backup of each of the last BackupKeepDaily days
+// and of each of the last BackupKeepWeekly weeks and deletes the others.
+// Directories without a catalog, e.g. backups in progress, are left alone.
+
+type backupInfo struct {
+	path      string
+	createdAt time.Time
+	size      int64
+}
+
+// listBackups returns the backups in dir from the newest
+func listBackups(dir string) ([]backupInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]backupInfo, 0)
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		catalog, err := lsm.ReadCatalog(path)
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backupInfo{path: path, createdAt: time.Unix(0, catalog.CreatedAt), size: catalog.Size})
+	}
+
+	sort.Slice(backups, func(i, j int) bool { return backups[i].createdAt.After(backups[j].createdAt) })
+	return backups, nil
+}
+
+// expiredBackups returns the backups outside the retention, backups must
+// be ordered from the newest which is always kept
+func expiredBackups(backups []backupInfo, daily int, weekly int) []backupInfo {
+	days := make(map[string]bool)
+	weeks := make(map[string]bool)
+	expired := make([]backupInfo, 0)
+	for i, b := range backups {
+		keep := i == 0
+
+		day := b.createdAt.UTC().Format("2006-01-02")
+		if !days[day] && len(days) < daily {
+			days[day] = true
+			keep = true
+		}
+
+		year, w := b.createdAt.UTC().ISOWeek()
+		week := fmt.Sprintf("%d-%d", year, w)
+		if !weeks[week] && len(weeks) < weekly {
+			weeks[week] = true
+			keep = true
+		}
+
+		if !keep {
+			expired = append(expired, b)
+		}
+	}
+	return expired
+}
+
+// pruneBackups deletes the backups outside the retention
+func (mds *Mds) pruneBackups() error {
+	backups, err := listBackups(mds.backupDir)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range expiredBackups(backups, mds.backupKeepDaily, mds.backupKeepWeekly) {
+		err = os.RemoveAll(b.path)
+		if err != nil {
+			return err
+		}
+		mds.log.Pf(0, "retention deleted backup %s created %s size %d", b.path, b.createdAt.Format(time.RFC3339), b.size)
+	}
+	return nil
+}
+
+// janitor enforces the backup retention every retention interval until
+// stopped
+func (mds *Mds) janitor() {
+	defer mds.agentWg.Done()
+
+	for {
+		err := mds.pruneBackups()
+		if err != nil {
+			mds.log.Pf(log.LevelError, "retention of %s error %v", mds.backupDir, err)
+		}
+
+		select {
+		case <-mds.clock.After(defaultRetentionInterval):
+		case <-mds.agentStop:
+			return
+		}
+	}
+}
+
+// writeBackupMetrics exports the backups of the backup directory so
+// alerts can catch backups which stopped
+func (mds *Mds) writeBackupMetrics(mw *metrics.Writer) {
+	if mds.backupDir == "" {
+		return
+	}
+
+	backups, err := listBackups(mds.backupDir)
+	if err != nil {
+		return
+	}
+
+	mw.Family("ddb_backups", metrics.TypeGauge, "Backups in the backup directory.")
+	mw.Sample("ddb_backups", float64(len(backups)))
+	if len(backups) == 0 {
+		return
+	}
+	mw.Family("ddb_backup_age_seconds", metrics.TypeGauge, "Age of the newest backup.")
+	mw.Sample("ddb_backup_age_seconds", mds.clock.Now().Sub(backups[0].createdAt).Seconds())
+	mw.Family("ddb_backup_bytes", metrics.TypeGauge, "Size of the newest backup.")
+	mw.Sample("ddb_backup_bytes", float64(backups[0].size))
+}
@@ -0,0 +1,118 @@
+package mds
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"ddb/lib/common/lsm"
+	"ddb/lib/common/random"
+)
+
+func TestExpiredBackups(t *testing.T) {
+	// a backup every 12 hours over three weeks, from the newest
+	newest := time.Date(2024, 3, 20, 18, 0, 0, 0, time.UTC)
+	backups := make([]backupInfo, 0)
+	for i := 0; i < 42; i++ {
+		createdAt := newest.Add(-time.Duration(i) * 12 * time.Hour)
+		backups = append(backups, backupInfo{path: createdAt.Format(time.RFC3339), createdAt: createdAt})
+	}
+
+	kept := func(daily int, weekly int) []string {
+		expired := make(map[string]bool)
+		for _, b := range expiredBackups(backups, daily, weekly) {
+			expired[b.path] = true
+		}
+		paths := make([]string, 0)
+		for _, b := range backups {
+			if !expired[b.path] {
+				paths = append(paths, b.path)
+			}
+		}
+		return paths
+	}
+
+	// the newest backup of each of the last days, 2024-03-20 is a wednesday
+	expected := []string{"2024-03-20T18:00:00Z", "2024-03-19T18:00:00Z", "2024-03-18T18:00:00Z"}
+	if paths := kept(3, 0); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("kept daily %v expected %v", paths, expected)
+		return
+	}
+	// and of each of the last weeks, which start on mondays
+	expected = []string{"2024-03-20T18:00:00Z", "2024-03-17T18:00:00Z", "2024-03-10T18:00:00Z"}
+	if paths := kept(0, 3); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("kept weekly %v expected %v", paths, expected)
+		return
+	}
+	expected = []string{"2024-03-20T18:00:00Z", "2024-03-19T18:00:00Z", "2024-03-17T18:00:00Z"}
+	if paths := kept(2, 2); !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("kept daily and weekly %v expected %v", paths, expected)
+		return
+	}
+	// the newest backup is kept without a retention
+	if paths := kept(0, 0); len(paths) != 1 || paths[0] != backups[0].path {
+		t.Fatalf("kept without retention %v", paths)
+		return
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	backupDir, err := ioutil.TempDir("", "TestJanitor_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+		return
+	}
+	defer os.RemoveAll(backupDir)
+
+	// a backup a day, the first one of today, and one in progress
+	now := time.Now()
+	for i := 0; i < 6; i++ {
+		dir := filepath.Join(backupDir, fmt.Sprintf("backup_%d", i))
+		err = os.Mkdir(dir, 0700)
+		if err != nil {
+			t.Fatalf("mkdir error %v", err)
+			return
+		}
+		data, _ := json.Marshal(&lsm.Catalog{CreatedAt: now.Add(-time.Duration(i) * 24 * time.Hour).UnixNano()})
+		err = ioutil.WriteFile(filepath.Join(dir, lsm.CatalogFileName), data, 0600)
+		if err != nil {
+			t.Fatalf("write catalog error %v", err)
+			return
+		}
+	}
+	err = os.Mkdir(filepath.Join(backupDir, "in_progress"), 0700)
+	if err != nil {
+		t.Fatalf("mkdir error %v", err)
+		return
+	}
+
+	_, stop := startTestMds(t, "TestJanitor", &MdsParameters{BackupDir: backupDir, BackupKeepDaily: 3})
+	defer stop()
+
+	expected := []string{"backup_0", "backup_1", "backup_2", "in_progress"}
+	var names []string
+	for i := 0; ; i++ {
+		files, err := ioutil.ReadDir(backupDir)
+		if err != nil {
+			t.Fatalf("read dir error %v", err)
+			return
+		}
+		names = names[:0]
+		for _, file := range files {
+			names = append(names, file.Name())
+		}
+		if reflect.DeepEqual(names, expected) {
+			break
+		}
+		if i == 500 {
+			t.Fatalf("backups %v expected %v", names, expected)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,188 @@
+package mds
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/random"
+)
+
+const (
+	// Sampled requests kept, older ones are dropped
+	requestSampleLogSize = 256
+	// Resolution of the sampled fraction
+	requestSampleScale = 1 << 53
+)
+
+// requestSampler captures a fraction of the api requests with their
+// headers, sizes and timings into a ring buffer
+type requestSampler struct {
+	// Sampled fraction as float64 bits, changed by config at runtime
+	rate    uint64
+	random  random.Source
+	lock    sync.Mutex
+	samples []client.RequestSample
+	seq     uint64
+}
+
+func newRequestSampler(rate float64, source random.Source) *requestSampler {
+	if source == nil {
+		source = random.NewTimeSource()
+	}
+	s := &requestSampler{random: source, samples: make([]client.RequestSample, 0, requestSampleLogSize)}
+	s.setRate(rate)
+	return s
+}
+
+func (s *requestSampler) setRate(rate float64) {
+	atomic.StoreUint64(&s.rate, math.Float64bits(rate))
+}
+
+func (s *requestSampler) getRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&s.rate))
+}
+
+// sampled decides whether a request is captured
+func (s *requestSampler) sampled() bool {
+	rate := s.getRate()
+	if rate <= 0 {
+		return false
+	}
+	return float64(s.random.Int63n(requestSampleScale))/requestSampleScale < rate
+}
+
+func (s *requestSampler) add(sample client.RequestSample) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.seq++
+	sample.Seq = s.seq
+	if len(s.samples) < requestSampleLogSize {
+		s.samples = append(s.samples, sample)
+	} else {
+		s.samples[(s.seq-1)%requestSampleLogSize] = sample
+	}
+}
+
+// list returns the samples from the oldest
+func (s *requestSampler) list() []client.RequestSample {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	samples := make([]client.RequestSample, 0, len(s.samples))
+	start := 0
+	if len(s.samples) == requestSampleLogSize {
+		start = int(s.seq % requestSampleLogSize)
+	}
+	samples = append(samples, s.samples[start:]...)
+	return append(samples, s.samples[:start]...)
+}
+
+// sampledResponseWriter records the status, size and header time of a
+// response
+type sampledResponseWriter struct {
+	http.ResponseWriter
+	start    time.Time
+	status   int
+	bytes    int64
+	headerAt time.Duration
+}
+
+func (w *sampledResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.headerAt = time.Since(w.start)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sampledResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// countingReader counts the bytes of a request body read by the handler
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.bytes += int64(n)
+	return n, err
+}
+
+// sampleHeaders copies the request headers without credentials
+func sampleHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for name, values := range header {
+		value := strings.Join(values, ", ")
+		if name == "Authorization" {
+			value = strings.SplitN(value, " ", 2)[0] + " <redacted>"
+		}
+		headers[name] = value
+	}
+	return headers
+}
+
+// sampleKey returns the key of a set, get or delete path
+func sampleKey(path string) string {
+	for _, prefix := range []string{"/set/", "/get/", "/delete/"} {
+		if strings.HasPrefix(path, prefix) {
+			return path[len(prefix):]
+		}
+	}
+	return ""
+}
+
+// sampling captures the configured fraction of the requests served by
+// handler, it must run inside tracing to see the request ids
+func sampling(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := GetMds().sampler
+		if !s.sampled() {
+			handler(w, r)
+			return
+		}
+
+		sw := &sampledResponseWriter{ResponseWriter: w, start: time.Now()}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		handler(sw, r)
+
+		sample := client.RequestSample{
+			Time:          sw.start.UnixNano(),
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Query:         r.URL.RawQuery,
+			Key:           sampleKey(r.URL.Path),
+			Headers:       sampleHeaders(r.Header),
+			RequestBytes:  body.bytes,
+			Status:        sw.status,
+			ResponseBytes: sw.bytes,
+			HeaderUs:      sw.headerAt.Microseconds(),
+			DurationUs:    time.Since(sw.start).Microseconds(),
+		}
+		if trace, ok := r.Context().Value(requestTraceKey{}).(*requestTrace); ok {
+			sample.RequestId = trace.id
+		}
+		s.add(sample)
+	}
+}
+
+func listSamples(w http.ResponseWriter, r *http.Request) {
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.SamplesResponse{Samples: GetMds().sampler.list()}
+	completeRequest(w, requestId, nil, resp)
+}
@@ -0,0 +1,70 @@
+package mds
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	client "ddb/client/core"
+	"ddb/lib/common/random"
+)
+
+func TestSampling(t *testing.T) {
+	const seed = 7
+	server, stop := startTestMds(t, "TestSampling", &MdsParameters{RequestSampleRate: 0.3, Random: random.NewSource(seed)})
+	defer stop()
+	debug := httptest.NewServer(GetMds().debugServer.Handler)
+	defer debug.Close()
+
+	// a sampler of the same seed predicts the captured requests
+	expected := make([]string, 0)
+	predict := newRequestSampler(0.3, random.NewSource(seed))
+	ctx := context.Background()
+	c := client.NewClient(server.URL)
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("k%d", i)
+		if predict.sampled() {
+			expected = append(expected, key)
+		}
+		err := c.SetKey(ctx, key, "v")
+		if err != nil {
+			t.Fatalf("set %s error %v", key, err)
+			return
+		}
+	}
+	if len(expected) == 0 || len(expected) == 50 {
+		t.Fatalf("expected samples %v", expected)
+		return
+	}
+
+	samples, err := client.NewClient(debug.URL).Samples(ctx)
+	if err != nil {
+		t.Fatalf("samples error %v", err)
+		return
+	}
+	keys := make([]string, 0, len(samples))
+	for i, sample := range samples {
+		if sample.Seq != uint64(i+1) || sample.Method != "POST" || sample.Status != 200 || sample.RequestBytes == 0 {
+			t.Fatalf("sample %+v", sample)
+			return
+		}
+		keys = append(keys, sample.Key)
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("sampled keys %v expected %v", keys, expected)
+		return
+	}
+
+	// no request is captured at rate 0 and every one at rate 1
+	for _, rate := range []float64{0, 1} {
+		s := newRequestSampler(rate, random.NewSource(seed))
+		for i := 0; i < 100; i++ {
+			if s.sampled() != (rate == 1) {
+				t.Fatalf("rate %v sampled %v", rate, !(rate == 1))
+				return
+			}
+		}
+	}
+}
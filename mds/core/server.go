@@ -1,69 +1,293 @@
 package mds
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 
 	client "ddb/client/core"
+	"ddb/lib/common/auth"
+	"ddb/lib/common/clock"
 	filelog "ddb/lib/common/filelog"
 	log "ddb/lib/common/log"
 	"ddb/lib/common/lsm"
-	"ddb/lib/common/sequence"
+	"ddb/lib/common/metrics"
+	"ddb/lib/common/raft"
+	"ddb/lib/common/random"
 )
 
-type KeyValueStorage interface {
-	Get(key string) (string, error)
-	Set(key string, value string) error
-	Delete(key string) error
-	Close()
-}
-
 type MdsParameters struct {
 	ApiAddress   string
 	DebugAddress string
 	LogFile      string
 	PidFile      string
 	StoragePath  string
+	// Comma separated key prefixes to maintain live key counts for
+	CountPrefixes string
+	// Checksum algorithm for storage files: xxhash64, crc32c or sha256
+	Checksum string
+	// Block compression of new sstables: none, snappy or zstd
+	Compression string
+	// Overrides of the startup tuning, 0 means detect
+	GoMaxProcs     int
+	MemtableSize   int64
+	MergeTimeoutMs int
+	// Memtable node count triggering compaction besides the size, 0 means
+	// no count limit
+	MemtableNodes int
+	// Sstable block cache size in bytes, 0 means sized by memory, negative
+	// disables
+	BlockCacheSize int64
+	// Fraction of block cache hits verified against the sstable files
+	CacheVerifyRate float64
+	// Interval of log syncs for batched durability writes, 0 means default
+	SyncIntervalMs int
+	// Durability of writes not setting one, empty means fsync, and the
+	// weakest durability a write gets, empty means none
+	Durability    string
+	MinDurability string
+	// Writes per second making a key hot so its writes are coalesced, 0
+	// disables coalescing
+	CoalesceThreshold int
+	CoalesceWindowMs  int
+	// Size tiered compaction tuning, 0 means default
+	CompactionMinTables   int
+	CompactionSizeRatio   float64
+	CompactionMinTierSize int64
+	// Sstable count above which merges are forced, 0 means default and
+	// negative no limit
+	MaxTables int
+	// Bytes per second merges write at most, 0 means no limit
+	MergeBytesPerSec int64
+	// Time writers wait for a flush of a busy memtable before failing with
+	// 429 in milliseconds, 0 means default and negative fails them at once
+	WriteStallTimeoutMs int
+	// Write slowdown and stop triggers, see lsm.LsmParameters
+	WriteSlowdownFactor  int
+	WriteSlowdownTables  int
+	WriteSlowdownDelayMs int
+	WriteStopFactor      int
+	WriteStopTables      int
+	// Write ahead log segment size in bytes, 0 means default
+	WalSegmentSize int64
+	// Largest accepted value in bytes, 0 means default
+	MaxValueSize int64
+	// Time requests in flight are waited for on shutdown in milliseconds, 0
+	// means default
+	ShutdownTimeoutMs int
+	// Time source of expiration, jobs and retries and the source of request
+	// sampling, nil means the system clock and a time seed
+	Clock  clock.Clock
+	Random random.Source
+	// Api address of the primary, a follower only serves reads and applies
+	// writes of the primary
+	ReplicaOf string
+	// Writes kept in memory for followers, 0 means default
+	ReplicationLogSize int
+	// Api url of this node and comma separated api urls of all nodes of a
+	// raft cluster, writes are replicated by consensus if set
+	RaftId    string
+	RaftPeers string
+	// Credentials and a json file of more credentials, requests are only
+	// served with one of them if any is configured
+	Credentials []Credential
+	AuthFile    string
+	// Id of the credential this server signs its requests to the primary,
+	// raft peers and the controller with
+	PeerKeyId string
+	// Url of a controller to report to, the controller may push config in
+	// its responses. The node is identified by NodeId or ApiAddress.
+	ControllerUrl    string
+	ReportIntervalMs int
+	NodeId           string
+	// Pem certificate and key of https api and debug servers, plain http
+	// if unset. Clients must present a certificate signed by the
+	// TlsClientCaFile certificates if set. TlsCaFile adds certificates
+	// trusted in requests to https peers.
+	TlsCertFile     string
+	TlsKeyFile      string
+	TlsClientCaFile string
+	TlsCaFile       string
+	// File or http url access pattern summaries are exported to every
+	// AccessExportIntervalMs, keys are grouped by the comma separated
+	// AccessPrefixes and anonymized otherwise
+	AccessSink             string
+	AccessExportIntervalMs int
+	AccessPrefixes         string
+	// Read the blocks hot before the restart into the cache after startup
+	Warmup bool
+	// Log verbosity, LogFormat text or json, and rotation of LogFile by
+	// size and age keeping LogKeep rotated files, zero means no limit
+	LogLevel    int
+	LogFormat   string
+	LogMaxSize  int64
+	LogMaxAgeMs int
+	LogKeep     int
+	// Comma separated latency objectives op:threshold:target, e.g.
+	// get:10ms:0.99 for 99% of gets within 10ms
+	Slos string
+	// Fraction of api requests captured with headers, sizes and timings
+	// into /admin/samples
+	RequestSampleRate float64
+	// Directory of backups exported in /metrics, the newest backup of each
+	// of the last BackupKeepDaily days and BackupKeepWeekly weeks is kept
+	// and older ones are deleted, zero for both keeps all
+	BackupDir        string
+	BackupKeepDaily  int
+	BackupKeepWeekly int
+	// Successful writes whose responses are kept by request id so resends
+	// aren't applied twice, 0 means default and negative disables it, and
+	// the time they are kept in milliseconds
+	DedupSize  int
+	DedupTtlMs int
 }
 
 type Stats struct {
-	getKey    *sequence.Sequence
-	setKey    *sequence.Sequence
-	deleteKey *sequence.Sequence
+	getKey    *metrics.Histogram
+	setKey    *metrics.Histogram
+	deleteKey *metrics.Histogram
+	batch     *metrics.Histogram
+	scan      *metrics.Histogram
+	txn       *metrics.Histogram
+	// Responses by http status code
+	responses *metrics.CounterVec
+	// Latency objectives fed by the histograms
+	slos []*slo
+	// Request and response payload bytes by operation and by credential
+	traffic *traffic
+	// Recent latencies by operation and the start of the totals in unix
+	// nanoseconds
+	windows map[string]*metrics.Window
+	since   int64
 }
 
+// Server states, requests are only served in mdsStateRunning
+const (
+	mdsStateStarting = iota
+	mdsStateRunning
+	mdsStateShuttingDown
+	mdsStateStopped
+	mdsStateRestoring
+)
+
 type Mds struct {
 	apiServer     *http.Server
 	debugServer   *http.Server
 	signalChannel chan os.Signal
 	errorChannel  chan error
 	log           *log.Log
-	kvs           KeyValueStorage
+	kvs           atomic.Value
 	stats         Stats
+	state         int32
+	storagePath   string
+	lsmParams     *lsm.LsmParameters
+	jobs          *jobManager
+	maxValueSize  int64
+	clock         clock.Clock
+	startedAt     int64
+	auth          *authenticator
+	// Credentials of requests to the primary, raft peers and the
+	// controller
+	peerCredentials *auth.Credentials
+	// Tls config of requests to the primary, raft peers and the controller
+	peerTls *tls.Config
+	// Serializes config changes with storage swaps
+	configLock sync.Mutex
+	// Held shared by served requests, shutdown takes it to wait for them
+	requestLock sync.RWMutex
+	// Time requests in flight are waited for on shutdown
+	shutdownTimeout time.Duration
+	// Durability of writes not setting one and the weakest one
+	durability    lsm.Durability
+	minDurability lsm.Durability
+	// Log file reopened on SIGHUP, nil if the log isn't a file
+	logFile *filelog.FileLog
+
+	replicaOf          string
+	replicationLogSize int
+	replication        *replicationLog
+	followerStop       chan bool
+	followerWg         sync.WaitGroup
+	// Latest versions applied by a follower and seen on its primary
+	appliedVersion uint64
+	primaryVersion uint64
+	// Clock of the storage, a follower moves it to the primary's time
+	hlc *clock.Hybrid
+
+	raft *raft.Node
+
+	nodeId         string
+	controllerUrl  string
+	reportInterval time.Duration
+	agentStop      chan bool
+	agentWg        sync.WaitGroup
+
+	// Access pattern counters, nil unless exported to accessSink
+	access         *accessLog
+	accessSink     string
+	accessInterval time.Duration
+
+	// Captures sampled api requests
+	sampler *requestSampler
+	// Responses of recent writes by request id, nil if disabled
+	dedup *dedupCache
+
+	// Key ranges frozen or moved by split jobs
+	ranges *rangeTable
+
+	// Backup directory and its retention
+	backupDir        string
+	backupKeepDaily  int
+	backupKeepWeekly int
 }
 
+const defaultShutdownTimeout = 30 * time.Second
+
 var globalMds Mds
 
 func GetMds() *Mds {
 	return &globalMds
 }
 
+// storageRef holds the storage in Mds.kvs, a restore swaps it while
+// requests, metrics and agents read it. An atomic.Value takes values of a
+// single type.
+type storageRef struct {
+	kvs KeyValueStorage
+}
+
+// storage returns the storage of api requests, replication and jobs, it's
+// nil until the server opens
+func (mds *Mds) storage() KeyValueStorage {
+	ref, _ := mds.kvs.Load().(storageRef)
+	return ref.kvs
+}
+
 func decodeJson(w http.ResponseWriter, r *http.Request, v interface{}) error {
 	err := json.NewDecoder(r.Body).Decode(v)
 	if err != nil {
-		GetMds().log.Pf(0, "json parse error %v")
+		requestLog(r).Pf(log.LevelWarn, "json parse error %v", err)
 		return err
 	}
+	if req, ok := v.(interface{ GetRequestId() string }); ok {
+		setRequestId(r, req.GetRequestId())
+	}
 	return nil
 }
 
@@ -75,27 +299,59 @@ func errorToHttpStatus(err error) int {
 	switch err {
 	case ErrBadRequest:
 		return http.StatusBadRequest
+	case lsm.ErrValueTooLarge:
+		return http.StatusRequestEntityTooLarge
 	case ErrNotFound, lsm.ErrNotFound:
 		return http.StatusNotFound
-	case ErrAlreadyExists:
+	case ErrAlreadyExists, lsm.ErrExists, lsm.ErrVersionMismatch:
 		return http.StatusConflict
+	case ErrNotImplemented:
+		return http.StatusNotImplemented
+	case context.Canceled, context.DeadlineExceeded:
+		return http.StatusRequestTimeout
+	case lsm.ErrDiskFull:
+		return http.StatusInsufficientStorage
+	case lsm.ErrBusy:
+		return http.StatusTooManyRequests
+	case lsm.ErrClosed, ErrShuttingDown, ErrNotLeader, ErrFrozen:
+		return http.StatusServiceUnavailable
+	case ErrMoved:
+		return http.StatusMisdirectedRequest
+	case ErrReadOnly, ErrForbidden:
+		return http.StatusForbidden
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
 	default:
 		return http.StatusInternalServerError
 	}
 }
 
+// errorToRetryAfter returns the number of seconds a client should wait
+// before retrying the failed request, zero means don't retry
+func errorToRetryAfter(err error) int {
+	switch err {
+	case lsm.ErrBusy, ErrNotLeader, ErrFrozen:
+		return 1
+	case lsm.ErrClosed, ErrShuttingDown:
+		return 5
+	case lsm.ErrDiskFull:
+		return 60
+	default:
+		return 0
+	}
+}
+
 func completeRequest(w http.ResponseWriter, requestId string, err error, v interface{}) {
-	GetMds().log.Pf(0, "request %s complete error %v", requestId, err)
+	GetMds().log.With("requestId", requestId).Pf(0, "request complete error %v", err)
 
-	w.Header().Set("Content-Type", "application/json")
 	if err != nil {
-		w.WriteHeader(errorToHttpStatus(err))
-		err = json.NewEncoder(w).Encode(&client.BaseResponse{RequestId: requestId, Error: err.Error()})
-		if err != nil {
-			panic(fmt.Sprintf("encode error failed, error %v", err))
+		retryAfter := errorToRetryAfter(err)
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
 		}
+		writeJson(w, errorToHttpStatus(err), &client.BaseResponse{RequestId: requestId, Error: err.Error(), RetryAfter: retryAfter,
+			Leader: GetMds().leaderFor(err)})
 	} else {
-		w.WriteHeader(http.StatusOK)
 		switch tv := v.(type) {
 		case *client.GetKeyResponse:
 			resp := v.(*client.GetKeyResponse)
@@ -105,14 +361,96 @@ func completeRequest(w http.ResponseWriter, requestId string, err error, v inter
 			resp := v.(*client.BaseResponse)
 			resp.Error = ""
 			resp.RequestId = requestId
+		case *client.StatsResponse:
+			resp := v.(*client.StatsResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.SetKeyResponse:
+			resp := v.(*client.SetKeyResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.BatchResponse:
+			resp := v.(*client.BatchResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.ScanResponse:
+			resp := v.(*client.ScanResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.AdminResponse:
+			resp := v.(*client.AdminResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.JobResponse:
+			resp := v.(*client.JobResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.RangesResponse:
+			resp := v.(*client.RangesResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.JobsResponse:
+			resp := v.(*client.JobsResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.ChangesResponse:
+			resp := v.(*client.ChangesResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.SnapshotPageResponse:
+			resp := v.(*client.SnapshotPageResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.ConfigResponse:
+			resp := v.(*client.ConfigResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.TxnResponse:
+			resp := v.(*client.TxnResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.TablesResponse:
+			resp := v.(*client.TablesResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.WarmupResponse:
+			resp := v.(*client.WarmupResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.EventsResponse:
+			resp := v.(*client.EventsResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.SamplesResponse:
+			resp := v.(*client.SamplesResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
+		case *client.ReadyResponse:
+			resp := v.(*client.ReadyResponse)
+			resp.Error = ""
+			resp.RequestId = requestId
 		default:
 			panic(fmt.Sprintf("unknown type %v", tv))
 		}
 
-		err = json.NewEncoder(w).Encode(v)
-		if err != nil {
-			panic(fmt.Sprintf("encode error failed, error %v", err))
+		writeJson(w, http.StatusOK, v)
+	}
+}
+
+// serving wraps an api handler to reject requests unless the server is
+// running, so nothing reaches the storage while it is being closed. Shutdown
+// waits for the handlers which got past the check.
+func serving(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mds := GetMds()
+		mds.requestLock.RLock()
+		defer mds.requestLock.RUnlock()
+
+		if atomic.LoadInt32(&mds.state) != mdsStateRunning {
+			completeRequest(w, "", ErrShuttingDown, nil)
+			return
 		}
+		handler(w, r)
 	}
 }
 
@@ -122,10 +460,10 @@ func setKey(w http.ResponseWriter, r *http.Request) {
 	var err error
 
 	req := &client.SetKeyRequest{}
-	resp := &client.BaseResponse{}
+	resp := &client.SetKeyResponse{}
 	defer func() {
 		completeRequest(w, req.RequestId, err, resp)
-		GetMds().stats.setKey.Append(time.Since(timeStart).Seconds())
+		GetMds().stats.setKey.Observe(time.Since(timeStart).Seconds())
 	}()
 
 	vars := mux.Vars(r)
@@ -135,22 +473,41 @@ func setKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	GetMds().log.Pf(0, "request %s", req.RequestId)
-
 	err = decodeJson(w, r, req)
 	if err != nil {
 		return
 	}
 
+	requestLog(r).Pf(0, "request set")
+
 	if key == "" || req.Value == "" {
 		err = ErrBadRequest
 		return
 	}
 
-	err = GetMds().kvs.Set(key, req.Value)
+	opts, err := setModeOptions(r)
+	if err != nil {
+		return
+	}
+
+	if req.TtlSeconds < 0 {
+		err = ErrBadRequest
+		return
+	}
+	opts.Ttl = time.Duration(req.TtlSeconds) * time.Second
+	opts.CompareVersion = req.CompareVersion
+	opts.ExpectedVersion = req.ExpectedVersion
+	opts.Durability, err = requestDurability(req.Durability)
+	if err != nil {
+		return
+	}
+
+	meta, err := GetMds().storage().Set(r.Context(), key, req.Value, opts)
 	if err != nil {
 		return
 	}
+	resp.Version = meta.Version
+	GetMds().access.write(key, len(req.Value))
 
 	return
 }
@@ -160,11 +517,11 @@ func deleteKey(w http.ResponseWriter, r *http.Request) {
 
 	var err error
 
-	req := &client.BaseRequest{}
+	req := &client.DeleteKeyRequest{}
 	resp := &client.BaseResponse{}
 	defer func() {
 		completeRequest(w, req.RequestId, err, resp)
-		GetMds().stats.deleteKey.Append(time.Since(timeStart).Seconds())
+		GetMds().stats.deleteKey.Observe(time.Since(timeStart).Seconds())
 	}()
 
 	err = decodeJson(w, r, req)
@@ -172,7 +529,7 @@ func deleteKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	GetMds().log.Pf(0, "request %s", req.RequestId)
+	requestLog(r).Pf(0, "request delete")
 
 	vars := mux.Vars(r)
 	key, ok := vars["key"]
@@ -186,8 +543,16 @@ func deleteKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = GetMds().kvs.Delete(key)
-	return
+	opts := &DeleteOptions{CompareVersion: req.CompareVersion, ExpectedVersion: req.ExpectedVersion}
+	opts.Durability, err = requestDurability(req.Durability)
+	if err != nil {
+		return
+	}
+	err = GetMds().storage().Delete(r.Context(), key, opts)
+	if err != nil {
+		return
+	}
+	GetMds().access.delete(key)
 }
 
 func getKey(w http.ResponseWriter, r *http.Request) {
@@ -198,7 +563,7 @@ func getKey(w http.ResponseWriter, r *http.Request) {
 	resp := &client.GetKeyResponse{}
 	defer func() {
 		completeRequest(w, req.RequestId, err, resp)
-		GetMds().stats.getKey.Append(time.Since(timeStart).Seconds())
+		GetMds().stats.getKey.Observe(time.Since(timeStart).Seconds())
 	}()
 
 	err = decodeJson(w, r, req)
@@ -206,7 +571,7 @@ func getKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	GetMds().log.Pf(0, "request %s", req.RequestId)
+	requestLog(r).Pf(0, "request get")
 
 	vars := mux.Vars(r)
 	key, ok := vars["key"]
@@ -220,51 +585,502 @@ func getKey(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp.Value, err = GetMds().kvs.Get(key)
+	GetMds().access.read(key)
+
+	var meta Meta
+	resp.Value, meta, err = GetMds().storage().Get(r.Context(), key)
 	if err != nil {
 		return
 	}
+	resp.ExpiresAt = meta.ExpiresAt
+	resp.Version = meta.Version
 
 	return
 }
 
-func getStats(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
+// setModeOptions parses the create only mode which fails with conflict if
+// the key exists
+func setModeOptions(r *http.Request) (*SetOptions, error) {
+	opts := &SetOptions{}
+	switch r.URL.Query().Get("mode") {
+	case "":
+	case "create":
+		opts.Create = true
+	default:
+		return nil, ErrBadRequest
+	}
+	if r.Header.Get("If-None-Match") == "*" {
+		opts.Create = true
+	}
+	return opts, nil
+}
+
+// parseDurability maps a durability name, empty means def
+func parseDurability(durability string, def lsm.Durability) (lsm.Durability, error) {
+	switch durability {
+	case "":
+		return def, nil
+	case client.DurabilityFsync:
+		return lsm.DurabilitySync, nil
+	case client.DurabilityBatched, client.DurabilityBuffered:
+		return lsm.DurabilityBatched, nil
+	case client.DurabilityNone:
+		return lsm.DurabilityNone, nil
+	default:
+		return lsm.DurabilitySync, ErrBadRequest
+	}
+}
+
+// requestDurability maps the durability of a request, empty means the
+// server default and weaker ones than the floor get the floor
+func requestDurability(durability string) (lsm.Durability, error) {
+	mds := GetMds()
+	d, err := parseDurability(durability, mds.durability)
+	if err != nil {
+		return d, err
+	}
+	if d > mds.minDurability {
+		d = mds.minDurability
+	}
+	return d, nil
+}
+
+// readValue reads the request body up to the largest accepted value
+func readValue(r *http.Request) ([]byte, error) {
+	maxValueSize := atomic.LoadInt64(&GetMds().maxValueSize)
+	if r.ContentLength > maxValueSize {
+		return nil, lsm.ErrValueTooLarge
+	}
+
+	var buf bytes.Buffer
+	if r.ContentLength > 0 {
+		buf.Grow(int(r.ContentLength))
+	}
+	_, err := buf.ReadFrom(io.LimitReader(r.Body, maxValueSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > maxValueSize {
+		return nil, lsm.ErrValueTooLarge
+	}
+	if buf.Len() == 0 {
+		return nil, ErrBadRequest
+	}
+	return buf.Bytes(), nil
+}
+
+// setKeyRaw stores the raw request body as the value, which keeps binary
+// values intact. The request id is taken from the X-Request-Id header, the
+// options from the query: mode, ttlSeconds, expectedVersion and durability.
+func setKeyRaw(w http.ResponseWriter, r *http.Request) {
+	timeStart := time.Now()
+	var err error
+
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.SetKeyResponse{}
+	defer func() {
+		completeRequest(w, requestId, err, resp)
+		GetMds().stats.setKey.Observe(time.Since(timeStart).Seconds())
+	}()
+
+	requestLog(r).Pf(0, "request raw")
+
+	key := mux.Vars(r)["key"]
+	if key == "" {
+		err = ErrBadRequest
+		return
+	}
+
+	opts, err := setModeOptions(r)
+	if err != nil {
+		return
+	}
+
+	query := r.URL.Query()
+	if query.Get("ttlSeconds") != "" {
+		ttlSeconds, parseErr := strconv.ParseInt(query.Get("ttlSeconds"), 10, 64)
+		if parseErr != nil || ttlSeconds < 0 {
+			err = ErrBadRequest
+			return
+		}
+		opts.Ttl = time.Duration(ttlSeconds) * time.Second
+	}
+	if query.Get("expectedVersion") != "" {
+		opts.ExpectedVersion, err = strconv.ParseUint(query.Get("expectedVersion"), 10, 64)
+		if err != nil {
+			err = ErrBadRequest
+			return
+		}
+		opts.CompareVersion = true
+	}
+	opts.Durability, err = requestDurability(query.Get("durability"))
+	if err != nil {
+		return
+	}
+
+	value, err := readValue(r)
+	if err != nil {
+		return
+	}
+
+	meta, err := GetMds().storage().SetBytes(r.Context(), key, value, opts)
+	if err == nil {
+		GetMds().access.write(key, len(value))
+	}
+	if err != nil {
+		return
+	}
+	resp.Version = meta.Version
+}
+
+// getKeyRaw returns the value bytes as the response body, the request id
+// is taken from the X-Request-Id header since there is no json body
+func getKeyRaw(w http.ResponseWriter, r *http.Request) {
+	timeStart := time.Now()
+	var err error
+
+	requestId := r.Header.Get("X-Request-Id")
+	defer func() {
+		GetMds().stats.getKey.Observe(time.Since(timeStart).Seconds())
+	}()
+
+	requestLog(r).Pf(0, "request raw")
+
+	key := mux.Vars(r)["key"]
+	if key == "" {
+		completeRequest(w, requestId, ErrBadRequest, nil)
+		return
+	}
+
+	GetMds().access.read(key)
+
+	value, _, err := GetMds().storage().GetBytes(r.Context(), key)
+	if err != nil {
+		completeRequest(w, requestId, err, nil)
+		return
+	}
+
+	GetMds().log.With("requestId", requestId).Pf(0, "request complete error %v", err)
+	writeRaw(w, value)
+}
+
+func batch(w http.ResponseWriter, r *http.Request) {
+	timeStart := time.Now()
+	var err error
+
+	req := &client.BatchRequest{}
+	resp := &client.BatchResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+		GetMds().stats.batch.Observe(time.Since(timeStart).Seconds())
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request batch %d", len(req.Operations))
+
+	if len(req.Operations) > client.MaxBatchOperations {
+		err = ErrBadRequest
+		return
+	}
+
+	durability, err := requestDurability(req.Durability)
+	if err != nil {
+		return
+	}
+
+	maxValueSize := atomic.LoadInt64(&GetMds().maxValueSize)
+	resp.Results = make([]client.BatchResult, len(req.Operations))
+	ops := make([]lsm.TxnOp, 0, len(req.Operations))
+	// Index of the result of every operation of ops
+	indexes := make([]int, 0, len(req.Operations))
+	writes := false
+	for i, op := range req.Operations {
+		result := &resp.Results[i]
+		result.Key = op.Key
+
+		var opErr error
+		txnOp := lsm.TxnOp{Key: op.Key}
+		switch op.Op {
+		case client.BatchOpSet:
+			if op.Key == "" || op.Value == "" {
+				opErr = ErrBadRequest
+			} else if int64(len(op.Value)) > maxValueSize {
+				opErr = lsm.ErrValueTooLarge
+			} else if !canWrite(r, op.Key) {
+				opErr = ErrForbidden
+			} else if GetMds().isFollower() {
+				opErr = ErrReadOnly
+			} else if rangeErr := GetMds().ranges.check(op.Key, true); rangeErr != nil {
+				opErr = rangeErr
+			} else {
+				txnOp.Op = lsm.TxnSet
+				txnOp.Value = []byte(op.Value)
+				writes = true
+			}
+		case client.BatchOpGet:
+			if op.Key == "" {
+				opErr = ErrBadRequest
+			} else if !canRead(r, op.Key) {
+				opErr = ErrForbidden
+			} else if rangeErr := GetMds().ranges.check(op.Key, false); rangeErr != nil {
+				opErr = rangeErr
+			} else {
+				txnOp.Op = lsm.TxnGet
+			}
+		case client.BatchOpDelete:
+			if op.Key == "" {
+				opErr = ErrBadRequest
+			} else if !canWrite(r, op.Key) {
+				opErr = ErrForbidden
+			} else if GetMds().isFollower() {
+				opErr = ErrReadOnly
+			} else if rangeErr := GetMds().ranges.check(op.Key, true); rangeErr != nil {
+				opErr = rangeErr
+			} else {
+				txnOp.Op = lsm.TxnDelete
+				writes = true
+			}
+		default:
+			opErr = ErrBadRequest
+		}
+
+		if opErr != nil {
+			result.Error = opErr.Error()
+			continue
+		}
+		ops = append(ops, txnOp)
+		indexes = append(indexes, i)
+	}
+
+	kvs := GetMds().storage()
+	if !writes {
+		// gets only are served by any node
+		for _, i := range indexes {
+			result := &resp.Results[i]
+			GetMds().access.read(result.Key)
+			var opErr error
+			result.Value, _, opErr = kvs.Get(r.Context(), result.Key)
+			if opErr != nil {
+				result.Error = opErr.Error()
+			}
+		}
+		return
+	}
+
+	if !GetMds().isLeading() {
+		err = ErrNotLeader
+		return
+	}
+
+	// the writes are applied all or none, gets see the earlier writes
+	txnResult, err := kvs.Txn(r.Context(), &lsm.Txn{Success: ops, Durability: durability})
+	if err != nil {
+		return
+	}
+	for j, res := range txnResult.Results {
+		result := &resp.Results[indexes[j]]
+		switch ops[j].Op {
+		case lsm.TxnGet:
+			result.Value = string(res.Value)
+			GetMds().access.read(res.Key)
+		case lsm.TxnSet:
+			GetMds().access.write(res.Key, len(ops[j].Value))
+		case lsm.TxnDelete:
+			GetMds().access.delete(res.Key)
+		}
+		if res.Err != nil {
+			result.Error = res.Err.Error()
+		}
+	}
+}
+
+func deleteKeys(w http.ResponseWriter, r *http.Request) {
+	timeStart := time.Now()
+	var err error
+
+	req := &client.DeleteKeysRequest{}
+	resp := &client.BatchResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+		GetMds().stats.deleteKey.Observe(time.Since(timeStart).Seconds())
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request mdelete %d", len(req.Keys))
+
+	if len(req.Keys) == 0 || len(req.Keys) > client.MaxBatchOperations {
+		err = ErrBadRequest
+		return
+	}
+
+	for _, key := range req.Keys {
+		if !canWrite(r, key) {
+			err = ErrForbidden
+			return
+		}
+		err = GetMds().ranges.check(key, true)
+		if err != nil {
+			return
+		}
+	}
+
+	errs, err := GetMds().storage().DeleteKeys(r.Context(), req.Keys, nil)
+	if err != nil {
+		return
+	}
+
+	resp.Results = make([]client.BatchResult, len(req.Keys))
+	for i, key := range req.Keys {
+		resp.Results[i].Key = key
+		if errs[i] != nil {
+			resp.Results[i].Error = errs[i].Error()
+		} else {
+			GetMds().access.delete(key)
+		}
+	}
+}
+
+func scanKeys(w http.ResponseWriter, r *http.Request) {
+	timeStart := time.Now()
+	var err error
 
-	stats := &GetMds().stats
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.ScanResponse{}
+	defer func() {
+		completeRequest(w, requestId, err, resp)
+		GetMds().stats.scan.Observe(time.Since(timeStart).Seconds())
+	}()
 
-	fmt.Fprintf(w, "setKey count %d avg %f 50p %f 95p %f 99p %f\n",
-		stats.setKey.Count(), stats.setKey.GetAverage(), stats.setKey.Get50P(), stats.setKey.Get95P(), stats.setKey.Get99P())
-	fmt.Fprintf(w, "getKey count %d avg %f 50p %f 95p %f 99p %f\n",
-		stats.getKey.Count(), stats.getKey.GetAverage(), stats.getKey.Get50P(), stats.getKey.Get95P(), stats.getKey.Get99P())
-	fmt.Fprintf(w, "deleteKey count %d avg %f 50p %f 95p %f 99p %f\n",
-		stats.getKey.Count(), stats.deleteKey.GetAverage(), stats.deleteKey.Get50P(), stats.deleteKey.Get95P(), stats.deleteKey.Get99P())
+	query := r.URL.Query()
+	startKey := query.Get("start")
+	endKey := query.Get("end")
+	limit := 0
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			err = ErrBadRequest
+			return
+		}
+	}
+
+	requestLog(r).Pf(0, "request scan %s %s %d", startKey, endKey, limit)
+
+	if !canScan(r, startKey, endKey) {
+		err = ErrForbidden
+		return
+	}
+
+	kvs, err := GetMds().storage().Scan(r.Context(), startKey, endKey, limit)
+	if err != nil {
+		return
+	}
+
+	resp.Items = make([]client.KeyValue, len(kvs))
+	for i, kv := range kvs {
+		resp.Items[i] = client.KeyValue{Key: kv.Key, Value: kv.Value}
+		GetMds().access.read(kv.Key)
+	}
 }
 
-func (mds *Mds) shutdown() {
+// shutdown stops accepting requests, waits up to the shutdown timeout for
+// requests in flight, flushes the memtable and closes the storage. It
+// returns the first error, the storage is closed regardless.
+func (mds *Mds) shutdown() error {
+	if !atomic.CompareAndSwapInt32(&mds.state, mdsStateRunning, mdsStateShuttingDown) {
+		return nil
+	}
+
 	mds.log.Pf(0, "shutdowning")
-	mds.apiServer.Shutdown(context.Background())
-	mds.debugServer.Shutdown(context.Background())
-	mds.kvs.Close()
-	mds.log.Pf(0, "shutdown")
+
+	var result error
+	ctx, cancel := context.WithTimeout(context.Background(), mds.shutdownTimeout)
+	defer cancel()
+	for _, server := range []*http.Server{mds.apiServer, mds.debugServer} {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			mds.log.Pf(log.LevelError, "drain %s error %v", server.Addr, err)
+			server.Close()
+			if result == nil {
+				result = err
+			}
+		}
+	}
+
+	// handlers which outlived the drain still finish before the storage
+	// closes, later ones see the state and don't touch it
+	mds.requestLock.Lock()
+	mds.requestLock.Unlock()
+
+	if mds.isFollower() {
+		close(mds.followerStop)
+		mds.followerWg.Wait()
+	}
+	close(mds.agentStop)
+	mds.agentWg.Wait()
+	mds.jobs.close()
+
+	err := mds.storage().Flush()
+	if err != nil {
+		mds.log.Pf(log.LevelError, "flush error %v", err)
+		if result == nil {
+			result = err
+		}
+	}
+	mds.storage().Close()
+	atomic.StoreInt32(&mds.state, mdsStateStopped)
+	if result != nil {
+		mds.log.Pf(log.LevelError, "shutdown error %v", result)
+	} else {
+		mds.log.Pf(0, "shutdown done")
+	}
 	mds.log.Shutdown()
+	return result
+}
+
+// listenAndServe serves https if the server has a tls config
+func listenAndServe(server *http.Server) error {
+	if server.TLSConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// reopenLog switches to a new log file after the old one was rotated
+func (mds *Mds) reopenLog() {
+	if mds.logFile == nil {
+		return
+	}
+
+	err := mds.logFile.Reopen()
+	if err != nil {
+		mds.log.Pf(log.LevelError, "reopen log error %v", err)
+		return
+	}
+	mds.log.Pf(0, "log reopened")
 }
 
 func (mds *Mds) apiLoop() {
 	mds.log.Pf(0, "running api server")
-	err := mds.apiServer.ListenAndServe()
-	if err != nil {
-		mds.log.Pf(0, "run api server error %v", err)
+	err := listenAndServe(mds.apiServer)
+	if err != nil && err != http.ErrServerClosed {
+		mds.log.Pf(log.LevelError, "run api server error %v", err)
 		mds.errorChannel <- err
 	}
 }
 
 func (mds *Mds) debugLoop() {
 	mds.log.Pf(0, "running debug server")
-	err := mds.debugServer.ListenAndServe()
-	if err != nil {
-		mds.log.Pf(0, "run debug server error %v", err)
+	err := listenAndServe(mds.debugServer)
+	if err != nil && err != http.ErrServerClosed {
+		mds.log.Pf(log.LevelError, "run debug server error %v", err)
 		mds.errorChannel <- err
 	}
 }
@@ -273,43 +1089,236 @@ func (mds *Mds) eventLoop() error {
 	mds.log.Pf(0, "running event loop")
 	for {
 		select {
-		case <-mds.signalChannel:
-			mds.log.Pf(0, "received signal")
-			mds.shutdown()
-			return nil
-		case <-mds.errorChannel:
-			mds.log.Pf(0, "received error")
-			mds.shutdown()
-			return nil
+		case sig := <-mds.signalChannel:
+			if sig == syscall.SIGHUP {
+				mds.log.Pf(0, "reopening log")
+				mds.reopenLog()
+				continue
+			}
+			mds.log.Pf(0, "received signal %v", sig)
+			return mds.shutdown()
+		case err := <-mds.errorChannel:
+			mds.log.Pf(log.LevelError, "received error %v", err)
+			shutdownErr := mds.shutdown()
+			if shutdownErr != nil {
+				return shutdownErr
+			}
+			return err
 		}
 	}
 }
 
 func (mds *Mds) Run(params *MdsParameters) error {
-	filelog, err := filelog.NewFileLog(params.LogFile)
+	err := mds.open(params)
+	if err != nil {
+		return err
+	}
+
+	mds.signalChannel = make(chan os.Signal, 1)
+	mds.errorChannel = make(chan error, 1)
+	signal.Notify(mds.signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	mds.start()
+	if params.Warmup {
+		go mds.warmup()
+	}
+	go mds.apiLoop()
+	go mds.debugLoop()
+	return mds.eventLoop()
+}
+
+// open sets up the log, the storage and the servers without serving
+func (mds *Mds) open(params *MdsParameters) error {
+	logFormat, err := log.ParseFormat(params.LogFormat)
+	if err != nil {
+		return err
+	}
+	slos, err := parseSlos(params.Slos)
+	if err != nil {
+		return err
+	}
+	mds.durability, err = parseDurability(params.Durability, lsm.DurabilitySync)
+	if err != nil {
+		return err
+	}
+	mds.minDurability, err = parseDurability(params.MinDurability, lsm.DurabilityNone)
+	if err != nil {
+		return err
+	}
+	logBackend, err := filelog.NewRotatingFileLog(params.LogFile, &filelog.RotationParameters{
+		MaxSize: params.LogMaxSize,
+		MaxAge:  time.Duration(params.LogMaxAgeMs) * time.Millisecond,
+		Keep:    params.LogKeep,
+	})
+	if err != nil {
+		return err
+	}
+
+	mds.log = log.NewLog(logBackend)
+	mds.log.SetLevel(params.LogLevel)
+	mds.log.SetFormat(logFormat)
+	mds.logFile, _ = logBackend.(*filelog.FileLog)
+	mds.shutdownTimeout = time.Duration(params.ShutdownTimeoutMs) * time.Millisecond
+	if mds.shutdownTimeout <= 0 {
+		mds.shutdownTimeout = defaultShutdownTimeout
+	}
+	mds.clock = clock.OrReal(params.Clock)
+	mds.hlc = clock.NewHybrid(mds.clock)
+
+	mds.auth, err = newAuthenticator(params)
+	if err != nil {
+		mds.log.Shutdown()
+		return err
+	}
+	mds.peerCredentials = mds.auth.peerCredentials(params.PeerKeyId)
+
+	serverTls, err := newServerTlsConfig(params)
+	if err != nil {
+		mds.log.Shutdown()
+		return err
+	}
+	mds.peerTls, err = newPeerTlsConfig(params)
+	if err != nil {
+		mds.log.Shutdown()
+		return err
+	}
+
+	mds.startedAt = mds.clock.Now().UnixNano()
+	mds.controllerUrl = params.ControllerUrl
+	mds.reportInterval = time.Duration(params.ReportIntervalMs) * time.Millisecond
+	if mds.reportInterval <= 0 {
+		mds.reportInterval = defaultReportInterval
+	}
+	mds.nodeId = params.NodeId
+	if mds.nodeId == "" {
+		mds.nodeId = params.ApiAddress
+	}
+	mds.accessSink = params.AccessSink
+	if mds.accessSink != "" {
+		var prefixes []string
+		for _, prefix := range strings.Split(params.AccessPrefixes, ",") {
+			if prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+		mds.access = newAccessLog(prefixes, mds.clock.Now())
+		mds.accessInterval = time.Duration(params.AccessExportIntervalMs) * time.Millisecond
+		if mds.accessInterval <= 0 {
+			mds.accessInterval = defaultAccessExportInterval
+		}
+	}
+
+	lsmParams := &lsm.LsmParameters{}
+	lsmParams.Checksum, err = lsm.ParseChecksumType(params.Checksum)
+	if err != nil {
+		mds.log.Shutdown()
+		return err
+	}
+	lsmParams.Compression, err = lsm.ParseCompressionType(params.Compression)
 	if err != nil {
+		mds.log.Shutdown()
 		return err
 	}
 
-	mds.log = log.NewLog(filelog)
-	kvs, err := lsm.OpenLsm(mds.log, params.StoragePath)
+	for _, prefix := range strings.Split(params.CountPrefixes, ",") {
+		if prefix != "" {
+			lsmParams.CountPrefixes = append(lsmParams.CountPrefixes, prefix)
+		}
+	}
+
+	tuning := newTuning(params)
+	tuning.apply(lsmParams)
+	lsmParams.CacheVerifyRate = params.CacheVerifyRate
+	lsmParams.SyncIntervalMs = params.SyncIntervalMs
+	lsmParams.CoalesceThreshold = params.CoalesceThreshold
+	lsmParams.CoalesceWindowMs = params.CoalesceWindowMs
+	lsmParams.CompactionMinTables = params.CompactionMinTables
+	lsmParams.CompactionSizeRatio = params.CompactionSizeRatio
+	lsmParams.CompactionMinTierSize = params.CompactionMinTierSize
+	lsmParams.MaxTables = params.MaxTables
+	if params.MergeBytesPerSec > 0 {
+		lsmParams.Coordinator = lsm.NewCompactionCoordinator(1, params.MergeBytesPerSec)
+	}
+	lsmParams.WriteStallTimeoutMs = params.WriteStallTimeoutMs
+	lsmParams.WriteSlowdownFactor = params.WriteSlowdownFactor
+	lsmParams.WriteSlowdownTables = params.WriteSlowdownTables
+	lsmParams.WriteSlowdownDelayMs = params.WriteSlowdownDelayMs
+	lsmParams.WriteStopFactor = params.WriteStopFactor
+	lsmParams.WriteStopTables = params.WriteStopTables
+	lsmParams.WalSegmentSize = params.WalSegmentSize
+	lsmParams.MaxValueSize = params.MaxValueSize
+	lsmParams.Clock = mds.hlc
+	mds.maxValueSize = params.MaxValueSize
+	if mds.maxValueSize <= 0 {
+		mds.maxValueSize = lsm.DefaultMaxValueSize
+	}
+	mds.log.Pf(0, "tuning cpus %d gomaxprocs %d memory %d disk total %d free %d memtable nodes %d size %d block cache %d",
+		tuning.NumCpu, tuning.GoMaxProcs, tuning.TotalMemory, tuning.DiskTotal, tuning.DiskFree,
+		tuning.MemtableNodes, tuning.MemtableSize, tuning.BlockCacheSize)
+
+	kvs, err := lsm.OpenLsm(mds.log, params.StoragePath, lsmParams)
 	if err != nil {
-		kvs, err = lsm.NewLsm(mds.log, params.StoragePath)
+		kvs, err = lsm.NewLsm(mds.log, params.StoragePath, lsmParams)
+		if err != nil {
+			mds.log.Shutdown()
+			return err
+		}
+	}
+	mds.replicaOf = params.ReplicaOf
+	mds.replicationLogSize = params.ReplicationLogSize
+	mds.setStorage(kvs)
+	mds.storagePath = params.StoragePath
+	mds.lsmParams = lsmParams
+
+	if params.RaftId != "" {
+		if params.ReplicaOf != "" {
+			kvs.Close()
+			mds.log.Shutdown()
+			return ErrBadRequest
+		}
+
+		err = mds.startRaft(params.RaftId, params.RaftPeers)
 		if err != nil {
+			kvs.Close()
 			mds.log.Shutdown()
 			return err
 		}
 	}
-	mds.kvs = kvs
 
-	mds.stats.setKey = sequence.NewSequence()
-	mds.stats.getKey = sequence.NewSequence()
-	mds.stats.deleteKey = sequence.NewSequence()
+	mds.ranges, err = newRangeTable(filepath.Join(params.StoragePath, rangesFileName))
+	if err != nil {
+		mds.storage().Close()
+		mds.log.Shutdown()
+		return err
+	}
+
+	mds.jobs, err = newJobManager(mds.log, mds.clock, filepath.Join(params.StoragePath, jobsFileName), mds.jobFuncs())
+	if err != nil {
+		mds.storage().Close()
+		mds.log.Shutdown()
+		return err
+	}
+
+	mds.stats.setKey = metrics.NewHistogram(metrics.LatencyBuckets)
+	mds.stats.getKey = metrics.NewHistogram(metrics.LatencyBuckets)
+	mds.stats.deleteKey = metrics.NewHistogram(metrics.LatencyBuckets)
+	mds.stats.batch = metrics.NewHistogram(metrics.LatencyBuckets)
+	mds.stats.scan = metrics.NewHistogram(metrics.LatencyBuckets)
+	mds.stats.txn = metrics.NewHistogram(metrics.LatencyBuckets)
+	mds.stats.responses = metrics.NewCounterVec()
+	mds.stats.traffic = newTraffic()
+	mds.stats.track(slos, mds.clock)
+	mds.stats.trackWindows(mds.clock)
+	mds.sampler = newRequestSampler(params.RequestSampleRate, params.Random)
+	mds.dedup = newDedupCache(params.DedupSize, time.Duration(params.DedupTtlMs)*time.Millisecond, mds.clock)
+	mds.backupDir = params.BackupDir
+	mds.backupKeepDaily = params.BackupKeepDaily
+	mds.backupKeepWeekly = params.BackupKeepWeekly
 
 	if params.PidFile != "" {
 		f, err := os.OpenFile(params.PidFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
 		if err != nil {
-			mds.kvs.Close()
+			mds.storage().Close()
 			mds.log.Shutdown()
 			return err
 		}
@@ -317,7 +1326,7 @@ func (mds *Mds) Run(params *MdsParameters) error {
 
 		_, err = f.WriteString(strconv.Itoa(os.Getpid()))
 		if err != nil {
-			mds.kvs.Close()
+			mds.storage().Close()
 			mds.log.Shutdown()
 			return err
 		}
@@ -332,32 +1341,85 @@ func (mds *Mds) Run(params *MdsParameters) error {
 	dr.Handle("/debug/pprof/heap", pprof.Handler("heap"))
 	dr.Handle("/debug/pprof/threadcreate", pprof.Handler("threadcreate"))
 	dr.Handle("/debug/pprof/block", pprof.Handler("block"))
+	dr.HandleFunc("/admin/backup", serving(backup)).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	dr.HandleFunc("/admin/restore", restore).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	dr.HandleFunc("/admin/jobs", serving(createJob)).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	dr.HandleFunc("/admin/jobs", listJobs).Methods("GET")
+	dr.HandleFunc("/admin/jobs/{id}", getJob).Methods("GET")
+	dr.HandleFunc("/admin/jobs/{id}/cancel", serving(cancelJob)).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	dr.HandleFunc("/admin/config", getConfig).Methods("GET")
+	dr.HandleFunc("/admin/tables", listTables).Methods("GET")
+	dr.HandleFunc("/admin/events", listEvents).Methods("GET")
+	dr.HandleFunc("/admin/samples", listSamples).Methods("GET")
+	dr.HandleFunc("/admin/stats/reset", resetStats).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	dr.HandleFunc("/admin/ranges", listRanges).Methods("GET")
+	dr.HandleFunc("/admin/warmup", serving(warmup)).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	dr.HandleFunc("/admin/background/suspend", serving(suspendBackground)).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	dr.HandleFunc("/admin/background/resume", serving(resumeBackground)).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	dr.HandleFunc("/admin/config", serving(setConfig)).Methods("POST").HeadersRegexp("Content-Type", "application/json")
 
 	r := mux.NewRouter()
-	r.HandleFunc("/set/{key}", setKey).Methods("POST").HeadersRegexp("Content-Type", "application/json")
-	r.HandleFunc("/get/{key}", getKey).Methods("GET").HeadersRegexp("Content-Type", "application/json")
-	r.HandleFunc("/delete/{key}", deleteKey).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/set/{key}", serving(allowed(accessWrite, writing(leading(owning(deduplicating(setKey))))))).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/set/{key}", serving(allowed(accessWrite, writing(leading(owning(deduplicating(setKeyRaw))))))).Methods("POST").HeadersRegexp("Content-Type", "application/octet-stream")
+	r.HandleFunc("/get/{key}", serving(allowed(accessRead, owning(getKeyRaw)))).Methods("GET").Queries("raw", "true")
+	r.HandleFunc("/get/{key}", serving(allowed(accessRead, owning(getKey)))).Methods("GET").HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/delete/{key}", serving(allowed(accessWrite, writing(leading(owning(deduplicating(deleteKey))))))).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/batch", serving(owning(deduplicating(batch)))).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/mdelete", serving(writing(leading(owning(deduplicating(deleteKeys)))))).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/txn", serving(writing(leading(owning(deduplicating(txn)))))).Methods("POST").HeadersRegexp("Content-Type", "application/json")
+	r.HandleFunc("/scan", serving(scanKeys)).Methods("GET")
+	r.HandleFunc("/metrics", getMetrics).Methods("GET")
 	r.HandleFunc("/stats", getStats).Methods("GET")
+	r.HandleFunc("/readyz", readyz).Methods("GET")
+	r.HandleFunc("/replication/changes", serving(allowed(accessAdmin, getChanges))).Methods("GET")
+	r.HandleFunc("/replication/snapshot", serving(allowed(accessAdmin, getSnapshotPage))).Methods("GET")
+	if mds.raft != nil {
+		r.HandleFunc("/raft/vote", allowed(accessAdmin, mds.raft.ServeRequestVote)).Methods("POST")
+		r.HandleFunc("/raft/append", allowed(accessAdmin, mds.raft.ServeAppendEntries)).Methods("POST")
+	}
 
 	mds.debugServer = &http.Server{
-		Handler:      dr,
+		Handler:      tracing(authenticating(allowed(accessAdmin, dr.ServeHTTP))),
 		Addr:         params.DebugAddress,
+		TLSConfig:    serverTls,
 		WriteTimeout: 120 * time.Second,
 		ReadTimeout:  120 * time.Second,
 	}
 
 	mds.apiServer = &http.Server{
-		Handler:      r,
+		Handler:      tracing(sampling(authenticating(metering(r.ServeHTTP)))),
 		Addr:         params.ApiAddress,
+		TLSConfig:    serverTls,
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 	}
+	return nil
+}
 
-	mds.signalChannel = make(chan os.Signal, 1)
-	mds.errorChannel = make(chan error, 1)
-	signal.Notify(mds.signalChannel, syscall.SIGINT, syscall.SIGTERM)
-
-	go mds.apiLoop()
-	go mds.debugLoop()
-	return mds.eventLoop()
+// start lets requests in and starts the background work
+func (mds *Mds) start() {
+	atomic.StoreInt32(&mds.state, mdsStateRunning)
+	mds.jobs.start()
+	if mds.isFollower() {
+		mds.log.Pf(0, "replicating from %s", mds.replicaOf)
+		mds.followerStop = make(chan bool)
+		mds.followerWg.Add(1)
+		go mds.follow()
+	}
+	mds.agentStop = make(chan bool)
+	if mds.controllerUrl != "" {
+		mds.log.Pf(0, "reporting to %s", mds.controllerUrl)
+		mds.agentWg.Add(1)
+		go mds.report()
+	}
+	if mds.access != nil {
+		mds.log.Pf(0, "exporting access patterns to %s", mds.accessSink)
+		mds.agentWg.Add(1)
+		go mds.exportAccess()
+	}
+	if mds.backupDir != "" && (mds.backupKeepDaily > 0 || mds.backupKeepWeekly > 0) {
+		mds.log.Pf(0, "keeping %d daily and %d weekly backups in %s", mds.backupKeepDaily, mds.backupKeepWeekly, mds.backupDir)
+		mds.agentWg.Add(1)
+		go mds.janitor()
+	}
 }
@@ -0,0 +1,272 @@
+package mds
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	client "ddb/client/core"
+	"ddb/lib/common/lsm"
+	"ddb/lib/common/random"
+)
+
+// startTestMds opens a server with params on a new storage and serves its
+// api, stop shuts it down and removes the storage
+func startTestMds(t *testing.T, name string, params *MdsParameters) (*httptest.Server, func()) {
+	rootPath, err := ioutil.TempDir("", name+"_"+random.GenerateRandomHexString(5))
+	if err != nil {
+		t.Fatalf("can't create tmp dir error %v", err)
+	}
+
+	globalMds = Mds{}
+	params.LogFile = filepath.Join(rootPath, "mds.log")
+	params.StoragePath = filepath.Join(rootPath, "storage")
+	err = GetMds().open(params)
+	if err != nil {
+		os.RemoveAll(rootPath)
+		t.Fatalf("can't open mds error %v", err)
+	}
+	GetMds().start()
+
+	server := httptest.NewServer(GetMds().apiServer.Handler)
+	return server, func() {
+		server.Close()
+		err := GetMds().shutdown()
+		if err != nil {
+			t.Errorf("shutdown error %v", err)
+		}
+		os.RemoveAll(rootPath)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	server, stop := startTestMds(t, "TestBatch", &MdsParameters{MaxValueSize: 16})
+	defer stop()
+
+	ctx := context.Background()
+	c := client.NewClient(server.URL)
+	err := c.SetKey(ctx, "k2", "v2")
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+
+	results, err := c.Batch(ctx, []client.BatchOperation{
+		{Op: client.BatchOpSet, Key: "k1", Value: "v1"},
+		{Op: client.BatchOpGet, Key: "k1"},
+		{Op: client.BatchOpSet, Key: "k3", Value: strings.Repeat("v", 17)},
+		{Op: client.BatchOpSet, Key: "k4"},
+		{Op: client.BatchOpDelete, Key: "k2"},
+		{Op: client.BatchOpGet, Key: "k2"},
+	})
+	if err != nil {
+		t.Fatalf("batch error %v", err)
+		return
+	}
+	expected := []client.BatchResult{
+		{Key: "k1"},
+		{Key: "k1", Value: "v1"},
+		{Key: "k3", Error: lsm.ErrValueTooLarge.Error()},
+		{Key: "k4", Error: ErrBadRequest.Error()},
+		{Key: "k2"},
+		{Key: "k2", Error: lsm.ErrNotFound.Error()},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("results %+v expected %+v", results, expected)
+		return
+	}
+
+	// a batch of gets only is read outside a transaction
+	results, err = c.Batch(ctx, []client.BatchOperation{
+		{Op: client.BatchOpGet, Key: "k1"},
+		{Op: client.BatchOpGet, Key: "k3"},
+	})
+	if err != nil {
+		t.Fatalf("batch error %v", err)
+		return
+	}
+	expected = []client.BatchResult{
+		{Key: "k1", Value: "v1"},
+		{Key: "k3", Error: lsm.ErrNotFound.Error()},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("get results %+v expected %+v", results, expected)
+		return
+	}
+
+	// the writes take the durability of the batch
+	batched := client.NewClientWithOptions(server.URL, &client.ClientOptions{Durability: client.DurabilityBatched})
+	results, err = batched.Batch(ctx, []client.BatchOperation{{Op: client.BatchOpSet, Key: "k5", Value: "v5"}})
+	if err != nil || results[0].Error != "" {
+		t.Fatalf("batched batch results %+v error %v", results, err)
+		return
+	}
+	unknown := client.NewClientWithOptions(server.URL, &client.ClientOptions{Durability: "unknown", MaxRetries: -1})
+	_, err = unknown.Batch(ctx, []client.BatchOperation{{Op: client.BatchOpSet, Key: "k6", Value: "v6"}})
+	if err != client.ErrBadRequest {
+		t.Fatalf("batch of unknown durability error %v", err)
+		return
+	}
+}
+
+// durabilityStorage records the durability of the writes reaching the
+// storage
+type durabilityStorage struct {
+	KeyValueStorage
+	lock       sync.Mutex
+	durability []lsm.Durability
+}
+
+func (s *durabilityStorage) record(d lsm.Durability) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.durability = append(s.durability, d)
+}
+
+func (s *durabilityStorage) last() lsm.Durability {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.durability[len(s.durability)-1]
+}
+
+func (s *durabilityStorage) Set(ctx context.Context, key string, value string, opts *SetOptions) (Meta, error) {
+	s.record(opts.Durability)
+	return s.KeyValueStorage.Set(ctx, key, value, opts)
+}
+
+func (s *durabilityStorage) SetBytes(ctx context.Context, key string, value []byte, opts *SetOptions) (Meta, error) {
+	s.record(opts.Durability)
+	return s.KeyValueStorage.SetBytes(ctx, key, value, opts)
+}
+
+func (s *durabilityStorage) Delete(ctx context.Context, key string, opts *DeleteOptions) error {
+	s.record(opts.Durability)
+	return s.KeyValueStorage.Delete(ctx, key, opts)
+}
+
+func (s *durabilityStorage) Txn(ctx context.Context, txn *lsm.Txn) (*lsm.TxnResult, error) {
+	s.record(txn.Durability)
+	return s.KeyValueStorage.Txn(ctx, txn)
+}
+
+func TestRequestDurability(t *testing.T) {
+	server, stop := startTestMds(t, "TestRequestDurability", &MdsParameters{Durability: "none", MinDurability: "batched"})
+	defer stop()
+	storage := &durabilityStorage{KeyValueStorage: GetMds().storage()}
+	GetMds().kvs.Store(storageRef{kvs: storage})
+
+	ctx := context.Background()
+	clients := make(map[string]*client.Client)
+	for _, d := range []string{"", client.DurabilityNone, client.DurabilityBatched, client.DurabilityFsync, "unknown"} {
+		clients[d] = client.NewClientWithOptions(server.URL, &client.ClientOptions{Durability: d, MaxRetries: -1})
+	}
+
+	// the default is raised to the floor like a request below it, stronger
+	// requests are kept
+	expected := map[string]lsm.Durability{
+		"":                       lsm.DurabilityBatched,
+		client.DurabilityNone:    lsm.DurabilityBatched,
+		client.DurabilityBatched: lsm.DurabilityBatched,
+		client.DurabilityFsync:   lsm.DurabilitySync,
+	}
+	for d, want := range expected {
+		c := clients[d]
+		writes := []struct {
+			name  string
+			write func() error
+		}{
+			{"set", func() error { return c.SetKey(ctx, "k", "v") }},
+			{"raw set", func() error {
+				_, err := c.SetKeyBytes(ctx, "k", []byte("v"), nil)
+				return err
+			}},
+			{"delete", func() error { return c.DeleteKey(ctx, "k") }},
+			{"batch", func() error { return c.BatchSet(ctx, map[string]string{"k": "v"}) }},
+		}
+		for _, w := range writes {
+			err := w.write()
+			if err != nil {
+				t.Fatalf("%s of durability %q error %v", w.name, d, err)
+				return
+			}
+			if got := storage.last(); got != want {
+				t.Fatalf("%s of durability %q got %v want %v", w.name, d, got, want)
+				return
+			}
+		}
+	}
+
+	err := clients["unknown"].SetKey(ctx, "k", "v")
+	if err != client.ErrBadRequest {
+		t.Fatalf("set of unknown durability error %v", err)
+		return
+	}
+}
+
+func TestGetKeyRaw(t *testing.T) {
+	server, stop := startTestMds(t, "TestGetKeyRaw", &MdsParameters{})
+	defer stop()
+
+	// every byte value, the value isn't valid utf8
+	value := make([]byte, 512)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	ctx := context.Background()
+	c := client.NewClient(server.URL)
+	_, err := c.SetKeyBytes(ctx, "k1", value, nil)
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+
+	resp, err := http.Get(server.URL + "/get/k1?raw=true")
+	if err != nil {
+		t.Fatalf("get error %v", err)
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("get status %d error %v", resp.StatusCode, err)
+		return
+	}
+	if resp.Header.Get("Content-Type") != "application/octet-stream" || resp.ContentLength != int64(len(value)) {
+		t.Fatalf("content type %s length %d", resp.Header.Get("Content-Type"), resp.ContentLength)
+		return
+	}
+	if !bytes.Equal(body, value) {
+		t.Fatalf("body %x expected %x", body, value)
+		return
+	}
+	got, err := c.GetKeyBytes(ctx, "k1")
+	if err != nil || !bytes.Equal(got, value) {
+		t.Fatalf("client value %x error %v", got, err)
+		return
+	}
+
+	// errors are still json
+	resp, err = http.Get(server.URL + "/get/k2?raw=true")
+	if err != nil {
+		t.Fatalf("get error %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("missing key status %d content type %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+		return
+	}
+	_, err = c.GetKeyBytes(ctx, "k2")
+	if err != client.ErrNotFound {
+		t.Fatalf("client missing key error %v", err)
+		return
+	}
+}
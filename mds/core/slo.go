@@ -0,0 +1,109 @@
+package mds
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"ddb/lib/common/clock"
+	"ddb/lib/common/metrics"
+)
+
+// slo is a latency objective of the requests of an operation
+type slo struct {
+	op        string
+	threshold time.Duration
+	target    float64
+	tracker   *metrics.SloTracker
+}
+
+// parseSlos parses comma separated objectives op:threshold:target, e.g.
+// get:10ms:0.99 means 99% of gets take at most 10ms
+func parseSlos(spec string) ([]*slo, error) {
+	slos := make([]*slo, 0)
+	for _, item := range strings.Split(spec, ",") {
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) != 3 {
+			return nil, ErrInvalidSlo
+		}
+		switch parts[0] {
+		case "set", "get", "delete", "batch", "scan", "txn":
+		default:
+			return nil, ErrInvalidSlo
+		}
+		threshold, err := time.ParseDuration(parts[1])
+		if err != nil || threshold <= 0 {
+			return nil, ErrInvalidSlo
+		}
+		target, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || target <= 0 || target >= 1 {
+			return nil, ErrInvalidSlo
+		}
+		slos = append(slos, &slo{op: parts[0], threshold: threshold, target: target})
+	}
+	return slos, nil
+}
+
+// histogram returns the latency histogram of op
+func (stats *Stats) histogram(op string) *metrics.Histogram {
+	switch op {
+	case "set":
+		return stats.setKey
+	case "get":
+		return stats.getKey
+	case "delete":
+		return stats.deleteKey
+	case "batch":
+		return stats.batch
+	case "scan":
+		return stats.scan
+	default:
+		return stats.txn
+	}
+}
+
+// track feeds the request latencies of their operations to the objectives
+func (stats *Stats) track(slos []*slo, c clock.Clock) {
+	for _, s := range slos {
+		s.tracker = metrics.NewSloTracker(s.threshold, s.target, c)
+		stats.histogram(s.op).Track(s.tracker)
+	}
+	stats.slos = slos
+}
+
+// writeSloMetrics exports the target, compliance and burn rate of every
+// objective by window, alerts fire on burn rates above 1 in both a short
+// and a long window
+func (stats *Stats) writeSloMetrics(mw *metrics.Writer) {
+	if len(stats.slos) == 0 {
+		return
+	}
+
+	windowLabel := func(window time.Duration) string {
+		return strings.TrimSuffix(strings.TrimSuffix(window.String(), "0s"), "0m")
+	}
+	labels := func(s *slo) []string {
+		return []string{"op", s.op, "threshold", s.threshold.String()}
+	}
+
+	mw.Family("ddb_slo_target", metrics.TypeGauge, "Fraction of requests of an operation which should take at most the threshold.")
+	for _, s := range stats.slos {
+		mw.Sample("ddb_slo_target", s.target, labels(s)...)
+	}
+	mw.Family("ddb_slo_compliance", metrics.TypeGauge, "Fraction of requests within the threshold in the window, 1 without requests.")
+	for _, s := range stats.slos {
+		for _, window := range metrics.SloWindows {
+			mw.Sample("ddb_slo_compliance", s.tracker.Compliance(window), append(labels(s), "window", windowLabel(window))...)
+		}
+	}
+	mw.Family("ddb_slo_burn_rate", metrics.TypeGauge, "Error budget consumption in the window relative to the target, 1 spends exactly the budget.")
+	for _, s := range stats.slos {
+		for _, window := range metrics.SloWindows {
+			mw.Sample("ddb_slo_burn_rate", s.tracker.BurnRate(window), append(labels(s), "window", windowLabel(window))...)
+		}
+	}
+}
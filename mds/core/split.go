@@ -0,0 +1,328 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	client "ddb/client/core"
+	log "ddb/lib/common/log"
+	"ddb/lib/common/lsm"
+)
+
+const (
+	rangesFileName = "ranges.json"
+	// Keys copied or deleted at once by a split
+	splitPageSize = 1000
+	// Time a rollback may take to delete the copied keys from the target
+	splitRollbackTimeout = 30 * time.Second
+)
+
+// A split moves a key range to another server: writes to the range are
+// frozen, the keys are copied to the target, requests for the range are
+// redirected to the target from then on and the keys are deleted locally.
+// The range states are persisted so the redirect survives restarts.
+
+// rangeTable keeps the key ranges frozen or moved by splits
+type rangeTable struct {
+	// Held shared by requests for keys for their whole duration, so
+	// changing a range waits for the requests in flight
+	lock     sync.RWMutex
+	ranges   []client.KeyRange
+	filePath string
+}
+
+func newRangeTable(filePath string) (*rangeTable, error) {
+	rt := &rangeTable{filePath: filePath, ranges: make([]client.KeyRange, 0)}
+
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rt, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &rt.ranges)
+	if err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// save writes the ranges file, caller must hold lock
+func (rt *rangeTable) save() error {
+	data, err := json.Marshal(rt.ranges)
+	if err != nil {
+		return err
+	}
+	tmpPath := rt.filePath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, rt.filePath)
+}
+
+func inRange(kr *client.KeyRange, key string) bool {
+	return key >= kr.Start && (kr.End == "" || key < kr.End)
+}
+
+// find returns the range holding key or nil, caller must hold lock
+func (rt *rangeTable) find(key string) *client.KeyRange {
+	for i := range rt.ranges {
+		if inRange(&rt.ranges[i], key) {
+			return &rt.ranges[i]
+		}
+	}
+	return nil
+}
+
+// check returns ErrMoved for keys of a moved range and ErrFrozen for
+// writes to a frozen one, caller must hold lock shared
+func (rt *rangeTable) check(key string, write bool) error {
+	kr := rt.find(key)
+	switch {
+	case kr == nil:
+		return nil
+	case kr.State == client.RangeMoved:
+		return ErrMoved
+	case write:
+		return ErrFrozen
+	default:
+		return nil
+	}
+}
+
+// overlaps reports whether keys [start, end) overlap a range
+func (rt *rangeTable) overlaps(start string, end string) bool {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	for _, kr := range rt.ranges {
+		if (end == "" || kr.Start < end) && (kr.End == "" || start < kr.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// state returns the state of the range [kr.Start, kr.End), empty if it
+// isn't in the table
+func (rt *rangeTable) state(kr client.KeyRange) string {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	for _, r := range rt.ranges {
+		if r.Start == kr.Start && r.End == kr.End {
+			return r.State
+		}
+	}
+	return ""
+}
+
+// set adds or updates the range once the requests in flight are done
+func (rt *rangeTable) set(kr client.KeyRange) error {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	for i, r := range rt.ranges {
+		if r.Start == kr.Start && r.End == kr.End {
+			rt.ranges[i] = kr
+			return rt.save()
+		}
+	}
+	rt.ranges = append(rt.ranges, kr)
+	return rt.save()
+}
+
+func (rt *rangeTable) remove(kr client.KeyRange) error {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	for i, r := range rt.ranges {
+		if r.Start == kr.Start && r.End == kr.End {
+			rt.ranges = append(rt.ranges[:i], rt.ranges[i+1:]...)
+			return rt.save()
+		}
+	}
+	return nil
+}
+
+func (rt *rangeTable) list() []client.KeyRange {
+	rt.lock.RLock()
+	defer rt.lock.RUnlock()
+
+	return append([]client.KeyRange(nil), rt.ranges...)
+}
+
+// owning redirects requests for a key of a moved range to its target and
+// rejects writes to a frozen range, handlers of requests with keys in the
+// body check them with rangeTable.check
+func owning(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rt := GetMds().ranges
+		rt.lock.RLock()
+		defer rt.lock.RUnlock()
+
+		key, ok := mux.Vars(r)["key"]
+		if ok {
+			kr := rt.find(key)
+			if kr != nil && kr.State == client.RangeMoved {
+				http.Redirect(w, r, kr.Target+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+				return
+			}
+			if kr != nil && r.Method != http.MethodGet {
+				completeRequest(w, "", ErrFrozen, nil)
+				return
+			}
+		}
+		handler(w, r)
+	}
+}
+
+// checkSplit validates the arguments of a split job
+func (mds *Mds) checkSplit(start string, end string, target string) error {
+	if target == "" || (end != "" && start >= end) {
+		return ErrBadRequest
+	}
+	if mds.raft != nil {
+		return ErrNotImplemented
+	}
+	if mds.isFollower() {
+		return ErrReadOnly
+	}
+	if mds.ranges.overlaps(start, end) {
+		return ErrAlreadyExists
+	}
+	return nil
+}
+
+// scanRange calls fn with the live keys of kr page by page
+func (mds *Mds) scanRange(ctx context.Context, kr client.KeyRange, fn func(changes []lsm.Change) error) error {
+	start := kr.Start
+	for {
+		changes, err := mds.storage().ScanChanges(ctx, start, kr.End, splitPageSize)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		err = fn(changes)
+		if err != nil {
+			return err
+		}
+		if len(changes) < splitPageSize {
+			return nil
+		}
+		start = changes[len(changes)-1].Key + "\x00"
+	}
+}
+
+// split runs a split job, a split interrupted before the redirect is
+// rolled back and one interrupted later resumes deleting the moved keys
+func (mds *Mds) split(ctx context.Context, job client.Job, progress func(float64)) error {
+	kr := client.KeyRange{Start: job.Start, End: job.End, Target: job.Target}
+	target := client.NewClientWithOptions(job.Target, mds.peerOptions())
+
+	if mds.ranges.state(kr) != client.RangeMoved {
+		kr.State = client.RangeFrozen
+		err := mds.ranges.set(kr)
+		if err != nil {
+			return err
+		}
+		mds.log.Pf(0, "split %q-%q to %s frozen", kr.Start, kr.End, kr.Target)
+
+		err = mds.copyRange(ctx, target, kr, progress)
+		if err == nil {
+			kr.State = client.RangeMoved
+			err = mds.ranges.set(kr)
+		}
+		if err != nil {
+			mds.rollbackSplit(target, kr)
+			return err
+		}
+		mds.log.Pf(0, "split %q-%q to %s moved", kr.Start, kr.End, kr.Target)
+	}
+
+	progress(0.9)
+	return mds.scanRange(ctx, kr, func(changes []lsm.Change) error {
+		keys := make([]string, 0, len(changes))
+		for _, change := range changes {
+			keys = append(keys, change.Key)
+		}
+		_, err := mds.storage().DeleteKeys(ctx, keys, nil)
+		return err
+	})
+}
+
+// copyRange writes the keys of the frozen range to target, it reports
+// progress up to 0.9
+func (mds *Mds) copyRange(ctx context.Context, target *client.Client, kr client.KeyRange, progress func(float64)) error {
+	total := 0
+	err := mds.scanRange(ctx, kr, func(changes []lsm.Change) error {
+		total += len(changes)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	copied := 0
+	return mds.scanRange(ctx, kr, func(changes []lsm.Change) error {
+		for _, change := range changes {
+			opts := &client.RawSetOptions{}
+			if change.ExpiresAt != 0 {
+				opts.Ttl = time.Unix(0, change.ExpiresAt).Sub(mds.hlc.Now())
+				if opts.Ttl <= 0 {
+					continue
+				}
+			}
+			_, err := target.SetKeyBytes(ctx, change.Key, change.Value, opts)
+			if err != nil {
+				return err
+			}
+		}
+		copied += len(changes)
+		progress(0.9 * float64(copied) / float64(total))
+		return nil
+	})
+}
+
+// rollbackSplit deletes the copied keys from target and unfreezes the
+// range, failures are logged since the split fails anyway
+func (mds *Mds) rollbackSplit(target *client.Client, kr client.KeyRange) {
+	ctx, cancel := context.WithTimeout(context.Background(), splitRollbackTimeout)
+	defer cancel()
+
+	err := mds.scanRange(ctx, kr, func(changes []lsm.Change) error {
+		keys := make([]string, 0, len(changes))
+		for _, change := range changes {
+			keys = append(keys, change.Key)
+		}
+		_, err := target.DeleteKeys(ctx, keys)
+		return err
+	})
+	if err != nil {
+		mds.log.Pf(log.LevelError, "split %q-%q rollback delete from %s error %v", kr.Start, kr.End, kr.Target, err)
+	}
+
+	err = mds.ranges.remove(kr)
+	if err != nil {
+		mds.log.Pf(log.LevelError, "split %q-%q rollback unfreeze error %v", kr.Start, kr.End, err)
+		return
+	}
+	mds.log.Pf(0, "split %q-%q to %s rolled back", kr.Start, kr.End, kr.Target)
+}
+
+func listRanges(w http.ResponseWriter, r *http.Request) {
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.RangesResponse{Ranges: GetMds().ranges.list()}
+	completeRequest(w, requestId, nil, resp)
+}
@@ -0,0 +1,164 @@
+package mds
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/lsm"
+)
+
+// splitTarget stands in for the server a split moves keys to, it fails
+// sets once it holds failAfter keys
+type splitTarget struct {
+	lock      sync.Mutex
+	keys      map[string]string
+	failAfter int
+}
+
+func (st *splitTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/set/"):
+		if st.failAfter > 0 && len(st.keys) >= st.failAfter {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&client.BaseResponse{Error: ErrBadRequest.Error()})
+			return
+		}
+		value, _ := ioutil.ReadAll(r.Body)
+		st.keys[strings.TrimPrefix(r.URL.Path, "/set/")] = string(value)
+		json.NewEncoder(w).Encode(&client.SetKeyResponse{Version: 1})
+	case r.URL.Path == "/mdelete":
+		req := &client.DeleteKeysRequest{}
+		json.NewDecoder(r.Body).Decode(req)
+		resp := &client.BatchResponse{Results: make([]client.BatchResult, len(req.Keys))}
+		for i, key := range req.Keys {
+			resp.Results[i].Key = key
+			delete(st.keys, key)
+		}
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (st *splitTarget) snapshot() map[string]string {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	keys := make(map[string]string, len(st.keys))
+	for key, value := range st.keys {
+		keys[key] = value
+	}
+	return keys
+}
+
+func TestSplit(t *testing.T) {
+	server, stop := startTestMds(t, "TestSplit", &MdsParameters{})
+	defer stop()
+	debug := httptest.NewServer(GetMds().debugServer.Handler)
+	defer debug.Close()
+	st := &splitTarget{keys: make(map[string]string)}
+	target := httptest.NewServer(st)
+	defer target.Close()
+
+	ctx := context.Background()
+	api := client.NewClient(server.URL)
+	admin := client.NewClient(debug.URL)
+	for _, key := range []string{"a1", "a2", "b1", "c1", "c2", "c3"} {
+		err := api.SetKey(ctx, key, "v"+key)
+		if err != nil {
+			t.Fatalf("set %s error %v", key, err)
+			return
+		}
+	}
+	split := func(start string, end string) *client.Job {
+		job, err := admin.Split(ctx, start, end, target.URL)
+		if err != nil {
+			t.Fatalf("split error %v", err)
+		}
+		job, err = admin.WaitJob(ctx, job.Id, 10*time.Millisecond)
+		if err != nil {
+			t.Fatalf("wait job error %v", err)
+		}
+		return job
+	}
+
+	job := split("a", "b")
+	if job.State != client.JobSucceeded {
+		t.Fatalf("split job %+v", job)
+		return
+	}
+	keys := st.snapshot()
+	if len(keys) != 2 || keys["a1"] != "va1" || keys["a2"] != "va2" {
+		t.Fatalf("target keys %v", keys)
+		return
+	}
+	for _, key := range []string{"a1", "a2"} {
+		_, _, err := GetMds().storage().Get(ctx, key)
+		if err != lsm.ErrNotFound {
+			t.Fatalf("moved key %s still stored error %v", key, err)
+			return
+		}
+	}
+	ranges, err := admin.Ranges(ctx)
+	if err != nil || len(ranges) != 1 || ranges[0].State != client.RangeMoved || ranges[0].Target != target.URL {
+		t.Fatalf("ranges %+v error %v", ranges, err)
+		return
+	}
+
+	// requests for moved keys are redirected to the target
+	noRedirect := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := noRedirect.Get(server.URL + "/get/a1?raw=true")
+	if err != nil {
+		t.Fatalf("get error %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != target.URL+"/get/a1?raw=true" {
+		t.Fatalf("get status %d location %s", resp.StatusCode, resp.Header.Get("Location"))
+		return
+	}
+	value, err := api.GetKey(ctx, "b1")
+	if err != nil || value != "vb1" {
+		t.Fatalf("get b1 %s error %v", value, err)
+		return
+	}
+
+	// a split failing to copy is rolled back
+	st.lock.Lock()
+	st.failAfter = 3
+	st.lock.Unlock()
+	job = split("c", "d")
+	if job.State != client.JobFailed {
+		t.Fatalf("failed split job %+v", job)
+		return
+	}
+	keys = st.snapshot()
+	if len(keys) != 2 {
+		t.Fatalf("target keys after rollback %v", keys)
+		return
+	}
+	ranges, err = admin.Ranges(ctx)
+	if err != nil || len(ranges) != 1 {
+		t.Fatalf("ranges after rollback %+v error %v", ranges, err)
+		return
+	}
+	err = api.SetKey(ctx, "c1", "vc1")
+	if err != nil {
+		t.Fatalf("set after rollback error %v", err)
+		return
+	}
+}
@@ -0,0 +1,117 @@
+package mds
+
+import (
+	"math"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/clock"
+	"ddb/lib/common/metrics"
+)
+
+// Operations of the request stats
+var statsOps = []string{"set", "get", "delete", "batch", "scan", "txn"}
+
+// trackWindows feeds the request latencies into rolling windows, /stats
+// serves them besides the lifetime totals which hide recent regressions
+func (stats *Stats) trackWindows(c clock.Clock) {
+	stats.windows = make(map[string]*metrics.Window, len(statsOps))
+	for _, op := range statsOps {
+		stats.windows[op] = metrics.NewWindow(metrics.LatencyBuckets, c)
+		stats.histogram(op).Track(stats.windows[op])
+	}
+	atomic.StoreInt64(&stats.since, c.Now().UnixNano())
+}
+
+// reset restarts the totals and the windows, the latency objectives keep
+// their windows
+func (stats *Stats) reset(now time.Time) {
+	for _, op := range statsOps {
+		stats.histogram(op).Reset()
+		stats.windows[op].Reset()
+	}
+	stats.responses.Reset()
+	atomic.StoreInt64(&stats.since, now.UnixNano())
+}
+
+func opStats(s *metrics.Summary, seconds float64) client.OpStats {
+	ms := func(v float64) float64 {
+		if math.IsInf(v, 1) {
+			v = s.Bounds[len(s.Bounds)-1]
+		}
+		return v * 1000
+	}
+
+	stats := client.OpStats{Count: s.Count, MeanMs: s.Mean() * 1000, P50Ms: ms(s.Quantile(0.5)), P99Ms: ms(s.Quantile(0.99))}
+	if seconds > 0 {
+		stats.Rate = float64(s.Count) / seconds
+	}
+	return stats
+}
+
+// getStats serves the request stats of ?window=, a go duration of at most
+// an hour, or the totals since the start or the last reset without it
+func getStats(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	requestId := r.Header.Get("X-Request-Id")
+	resp := &client.StatsResponse{Ops: make(map[string]client.OpStats)}
+	defer func() {
+		completeRequest(w, requestId, err, resp)
+	}()
+
+	window := time.Duration(0)
+	if value := r.URL.Query().Get("window"); value != "" {
+		window, err = time.ParseDuration(value)
+		if err != nil || window <= 0 || window > metrics.MaxWindow {
+			err = ErrBadRequest
+			return
+		}
+	}
+
+	mds := GetMds()
+	now := mds.clock.Now()
+	since := time.Unix(0, atomic.LoadInt64(&mds.stats.since))
+	if window > 0 {
+		resp.Window = window.String()
+		// a window reaching before the reset covers only the time after it
+		if start := now.Add(-window); start.After(since) {
+			since = start
+		}
+	}
+	resp.Since = since.UnixNano()
+	seconds := now.Sub(since).Seconds()
+
+	for _, op := range statsOps {
+		var s metrics.Summary
+		if window > 0 {
+			s = mds.stats.windows[op].Summary(window)
+		} else {
+			s = mds.stats.histogram(op).Summary()
+		}
+		resp.Ops[op] = opStats(&s, seconds)
+	}
+	if window == 0 {
+		resp.Responses = mds.stats.responses.Values()
+	}
+}
+
+func resetStats(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	req := &client.BaseRequest{}
+	resp := &client.BaseResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request reset stats")
+	GetMds().stats.reset(GetMds().clock.Now())
+}
@@ -0,0 +1,71 @@
+package mds
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/clock"
+)
+
+func TestStatsWindows(t *testing.T) {
+	c := clock.NewManual(time.Now())
+	server, stop := startTestMds(t, "TestStatsWindows", &MdsParameters{Clock: c})
+	defer stop()
+	debug := httptest.NewServer(GetMds().debugServer.Handler)
+	defer debug.Close()
+
+	ctx := context.Background()
+	api := client.NewClient(server.URL)
+	admin := client.NewClient(debug.URL)
+	setCount := func(window time.Duration) uint64 {
+		resp, err := api.Stats(ctx, window)
+		if err != nil {
+			t.Fatalf("stats %v error %v", window, err)
+		}
+		return resp.Ops["set"].Count
+	}
+
+	for i := 0; i < 3; i++ {
+		err := api.SetKey(ctx, "k1", "v1")
+		if err != nil {
+			t.Fatalf("set error %v", err)
+			return
+		}
+	}
+	if setCount(0) != 3 || setCount(time.Minute) != 3 {
+		t.Fatalf("set count %d window %d", setCount(0), setCount(time.Minute))
+		return
+	}
+
+	// the window drops older requests, the totals keep them
+	c.Advance(2 * time.Minute)
+	err := api.SetKey(ctx, "k1", "v2")
+	if err != nil {
+		t.Fatalf("set error %v", err)
+		return
+	}
+	if setCount(0) != 4 || setCount(time.Minute) != 1 || setCount(5*time.Minute) != 4 {
+		t.Fatalf("set count %d window %d", setCount(0), setCount(time.Minute))
+		return
+	}
+
+	_, err = api.Stats(ctx, 2*time.Hour)
+	if err != client.ErrBadRequest {
+		t.Fatalf("stats of too long window error %v", err)
+		return
+	}
+
+	// a reset restarts both
+	err = admin.ResetStats(ctx)
+	if err != nil {
+		t.Fatalf("reset error %v", err)
+		return
+	}
+	if setCount(0) != 0 || setCount(5*time.Minute) != 0 {
+		t.Fatalf("set count after reset %d window %d", setCount(0), setCount(5*time.Minute))
+		return
+	}
+}
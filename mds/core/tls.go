@@ -0,0 +1,64 @@
+package mds
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	client "ddb/client/core"
+)
+
+// newServerTlsConfig returns nil if the servers speak plain http. With a
+// client ca file only clients presenting a certificate it signed are
+// served.
+func newServerTlsConfig(params *MdsParameters) (*tls.Config, error) {
+	if params.TlsCertFile == "" && params.TlsKeyFile == "" {
+		if params.TlsClientCaFile != "" {
+			return nil, ErrBadRequest
+		}
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(params.TlsCertFile, params.TlsKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if params.TlsClientCaFile != "" {
+		data, err := ioutil.ReadFile(params.TlsClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, ErrBadRequest
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// newPeerTlsConfig returns the config of requests to the primary, raft peers
+// and the controller, nil if tls isn't configured. The server certificate
+// is presented to peers which verify clients.
+func newPeerTlsConfig(params *MdsParameters) (*tls.Config, error) {
+	if params.TlsCaFile == "" && params.TlsCertFile == "" {
+		return nil, nil
+	}
+	return client.NewTlsConfig(params.TlsCaFile, params.TlsCertFile, params.TlsKeyFile)
+}
+
+// peerOptions returns the client options of requests to the primary and the
+// controller
+func (mds *Mds) peerOptions() *client.ClientOptions {
+	return &client.ClientOptions{
+		Credentials: mds.peerCredentials,
+		TlsConfig:   mds.peerTls,
+		Clock:       mds.clock,
+	}
+}
@@ -0,0 +1,97 @@
+package mds
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"ddb/lib/common/metrics"
+)
+
+// Operations traffic is counted by, other paths count as other
+var trafficOps = map[string]bool{
+	"set": true, "get": true, "delete": true, "batch": true, "mdelete": true,
+	"txn": true, "scan": true, "replication": true, "raft": true,
+}
+
+// traffic counts request and response payload bytes by operation and by
+// credential id, requests without authentication count as anonymous
+type traffic struct {
+	requestBytes        *metrics.CounterVec
+	responseBytes       *metrics.CounterVec
+	tenantRequestBytes  *metrics.CounterVec
+	tenantResponseBytes *metrics.CounterVec
+}
+
+func newTraffic() *traffic {
+	return &traffic{
+		requestBytes:        metrics.NewCounterVec(),
+		responseBytes:       metrics.NewCounterVec(),
+		tenantRequestBytes:  metrics.NewCounterVec(),
+		tenantResponseBytes: metrics.NewCounterVec(),
+	}
+}
+
+// trafficOp returns the operation of an api path
+func trafficOp(path string) string {
+	op := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	if !trafficOps[op] {
+		return "other"
+	}
+	return op
+}
+
+// countingResponseWriter counts the bytes of a response body
+type countingResponseWriter struct {
+	http.ResponseWriter
+	bytes int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// metering counts the payload bytes of the requests served by handler, it
+// must run inside authenticating to see the credentials
+func metering(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cw := &countingResponseWriter{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		handler(cw, r)
+
+		tenant := "anonymous"
+		if cred := credentialOf(r); cred != nil {
+			tenant = cred.Id
+		}
+		op := trafficOp(r.URL.Path)
+		t := GetMds().stats.traffic
+		t.requestBytes.Add(op, uint64(body.bytes))
+		t.responseBytes.Add(op, uint64(cw.bytes))
+		t.tenantRequestBytes.Add(tenant, uint64(body.bytes))
+		t.tenantResponseBytes.Add(tenant, uint64(cw.bytes))
+	}
+}
+
+func writeCounterVec(mw *metrics.Writer, name string, help string, label string, c *metrics.CounterVec) {
+	values := c.Values()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	mw.Family(name, metrics.TypeCounter, help)
+	for _, key := range keys {
+		mw.Sample(name, float64(values[key]), label, key)
+	}
+}
+
+func (t *traffic) writeMetrics(mw *metrics.Writer) {
+	writeCounterVec(mw, "ddb_request_bytes_total", "Api request payload bytes by operation.", "op", t.requestBytes)
+	writeCounterVec(mw, "ddb_response_bytes_total", "Api response payload bytes by operation.", "op", t.responseBytes)
+	writeCounterVec(mw, "ddb_tenant_request_bytes_total", "Api request payload bytes by credential.", "tenant", t.tenantRequestBytes)
+	writeCounterVec(mw, "ddb_tenant_response_bytes_total", "Api response payload bytes by credential.", "tenant", t.tenantResponseBytes)
+}
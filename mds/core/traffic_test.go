@@ -0,0 +1,69 @@
+package mds
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestTraffic(t *testing.T) {
+	server, stop := startTestMds(t, "TestTraffic", &MdsParameters{})
+	defer stop()
+
+	// requests of known payloads, the response sizes are the body bytes
+	// the client read
+	value := bytes.Repeat([]byte("v"), 100)
+	responseBytes := make(map[string]int)
+	requests := []struct {
+		op     string
+		method string
+		path   string
+		body   []byte
+	}{
+		{"set", "POST", "/set/k1", value},
+		{"set", "POST", "/set/k2", value[:40]},
+		{"get", "GET", "/get/k1?raw=true", nil},
+	}
+	for _, req := range requests {
+		httpReq, err := http.NewRequest(req.method, server.URL+req.path, bytes.NewReader(req.body))
+		if err != nil {
+			t.Fatalf("request error %v", err)
+			return
+		}
+		httpReq.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			t.Fatalf("%s %s error %v", req.method, req.path, err)
+			return
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s status %d error %v", req.method, req.path, resp.StatusCode, err)
+			return
+		}
+		responseBytes[req.op] += len(body)
+	}
+	if responseBytes["get"] != len(value) {
+		t.Fatalf("raw get returned %d bytes", responseBytes["get"])
+		return
+	}
+
+	samples := scrapeMetrics(t, server.URL)
+	expected := map[string]float64{
+		`ddb_request_bytes_total{op="set"}`:                   140,
+		`ddb_request_bytes_total{op="get"}`:                   0,
+		`ddb_response_bytes_total{op="set"}`:                  float64(responseBytes["set"]),
+		`ddb_response_bytes_total{op="get"}`:                  100,
+		`ddb_tenant_request_bytes_total{tenant="anonymous"}`:  140,
+		`ddb_tenant_response_bytes_total{tenant="anonymous"}`: float64(responseBytes["set"] + 100),
+	}
+	for name, value := range expected {
+		got, ok := samples[name]
+		if !ok || got != value {
+			t.Fatalf("metric %s %v expected %v", name, got, value)
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package mds
+
+import (
+	"runtime"
+
+	"ddb/lib/common/lsm"
+)
+
+const (
+	// Share of the physical memory the memtable may use, used to size the
+	// memtable when not set
+	memtableMemoryShare = 64
+	minMemtableSize     = 1024 * 1024
+	maxMemtableSize     = 256 * 1024 * 1024
+	// Share of the physical memory the block cache may use, used to size
+	// the cache when not set
+	blockCacheMemoryShare = 16
+	minBlockCacheSize     = 32 * 1024 * 1024
+	maxBlockCacheSize     = 4 * 1024 * 1024 * 1024
+)
+
+// Tuning is the resource report and derived settings chosen at startup.
+// Memory sizes the memtable and the block cache, the cpus are left to the go
+// runtime and placement across numa nodes to the os.
+type Tuning struct {
+	NumCpu         int
+	GoMaxProcs     int
+	TotalMemory    uint64
+	DiskTotal      uint64
+	DiskFree       uint64
+	MemtableNodes  int
+	MemtableSize   int64
+	BlockCacheSize int64
+	MergeTimeoutMs int
+}
+
+// newTuning detects the host resources and sizes the storage, explicit
+// parameters always take precedence over detected values
+func newTuning(params *MdsParameters) *Tuning {
+	t := new(Tuning)
+	t.NumCpu = runtime.NumCPU()
+	t.TotalMemory = totalMemory()
+	t.DiskTotal, t.DiskFree = diskSpace(params.StoragePath)
+
+	// the runtime default follows GOMAXPROCS and the cpu quota
+	t.GoMaxProcs = params.GoMaxProcs
+	if t.GoMaxProcs <= 0 {
+		t.GoMaxProcs = runtime.GOMAXPROCS(0)
+	}
+
+	t.MemtableNodes = params.MemtableNodes
+	t.MemtableSize = params.MemtableSize
+	if t.MemtableSize <= 0 {
+		t.MemtableSize = int64(t.TotalMemory / memtableMemoryShare)
+		if t.MemtableSize < minMemtableSize {
+			t.MemtableSize = minMemtableSize
+		}
+		if t.MemtableSize > maxMemtableSize {
+			t.MemtableSize = maxMemtableSize
+		}
+	}
+
+	// without the memory size the storage default is kept
+	t.BlockCacheSize = params.BlockCacheSize
+	if t.BlockCacheSize == 0 && t.TotalMemory != 0 {
+		t.BlockCacheSize = int64(t.TotalMemory / blockCacheMemoryShare)
+		if t.BlockCacheSize < minBlockCacheSize {
+			t.BlockCacheSize = minBlockCacheSize
+		}
+		if t.BlockCacheSize > maxBlockCacheSize {
+			t.BlockCacheSize = maxBlockCacheSize
+		}
+	}
+
+	t.MergeTimeoutMs = params.MergeTimeoutMs
+	return t
+}
+
+func (t *Tuning) apply(lsmParams *lsm.LsmParameters) {
+	if t.GoMaxProcs != runtime.GOMAXPROCS(0) {
+		runtime.GOMAXPROCS(t.GoMaxProcs)
+	}
+	lsmParams.MaxMemoryNodeCount = t.MemtableNodes
+	lsmParams.MemtableSize = t.MemtableSize
+	lsmParams.BlockCacheSize = t.BlockCacheSize
+	lsmParams.MergeTimeoutMs = t.MergeTimeoutMs
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package mds
+
+func totalMemory() uint64 {
+	return 0
+}
+
+func diskSpace(path string) (uint64, uint64) {
+	return 0, 0
+}
@@ -0,0 +1,138 @@
+package mds
+
+import (
+	"net/http"
+	"time"
+
+	client "ddb/client/core"
+	"ddb/lib/common/lsm"
+)
+
+var txnOps = map[string]int{
+	client.BatchOpSet:    lsm.TxnSet,
+	client.BatchOpGet:    lsm.TxnGet,
+	client.BatchOpDelete: lsm.TxnDelete,
+}
+
+// newTxn converts and checks a transaction request, keys the credential of
+// r can't access make the whole transaction forbidden
+func newTxn(r *http.Request, req *client.TxnRequest) (*lsm.Txn, error) {
+	if len(req.Compare)+len(req.Success)+len(req.Failure) > client.MaxBatchOperations {
+		return nil, ErrBadRequest
+	}
+
+	durability, err := requestDurability(req.Durability)
+	if err != nil {
+		return nil, err
+	}
+	txn := &lsm.Txn{Durability: durability}
+
+	for _, cmp := range req.Compare {
+		if cmp.Key == "" {
+			return nil, ErrBadRequest
+		}
+		if !canRead(r, cmp.Key) {
+			return nil, ErrForbidden
+		}
+		err = GetMds().ranges.check(cmp.Key, false)
+		if err != nil {
+			return nil, err
+		}
+
+		c := lsm.Compare{Key: cmp.Key}
+		switch cmp.Target {
+		case client.TxnCompareVersion:
+			c.CompareVersion = true
+			c.Version = cmp.Version
+		case client.TxnCompareValue:
+			c.CompareValue = true
+			c.Value = []byte(cmp.Value)
+		default:
+			return nil, ErrBadRequest
+		}
+		txn.Compares = append(txn.Compares, c)
+	}
+
+	txn.Success, err = newTxnOps(r, req.Success)
+	if err != nil {
+		return nil, err
+	}
+	txn.Failure, err = newTxnOps(r, req.Failure)
+	if err != nil {
+		return nil, err
+	}
+	return txn, nil
+}
+
+func newTxnOps(r *http.Request, ops []client.BatchOperation) ([]lsm.TxnOp, error) {
+	result := make([]lsm.TxnOp, 0, len(ops))
+	for _, op := range ops {
+		txnOp, ok := txnOps[op.Op]
+		if !ok || op.Key == "" || (txnOp == lsm.TxnSet && op.Value == "") {
+			return nil, ErrBadRequest
+		}
+		if txnOp == lsm.TxnGet && !canRead(r, op.Key) {
+			return nil, ErrForbidden
+		}
+		if txnOp != lsm.TxnGet && !canWrite(r, op.Key) {
+			return nil, ErrForbidden
+		}
+		err := GetMds().ranges.check(op.Key, txnOp != lsm.TxnGet)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, lsm.TxnOp{Op: txnOp, Key: op.Key, Value: []byte(op.Value)})
+	}
+	return result, nil
+}
+
+func txn(w http.ResponseWriter, r *http.Request) {
+	timeStart := time.Now()
+	var err error
+
+	req := &client.TxnRequest{}
+	resp := &client.TxnResponse{}
+	defer func() {
+		completeRequest(w, req.RequestId, err, resp)
+		GetMds().stats.txn.Observe(time.Since(timeStart).Seconds())
+	}()
+
+	err = decodeJson(w, r, req)
+	if err != nil {
+		return
+	}
+
+	requestLog(r).Pf(0, "request txn %d compares", len(req.Compare))
+
+	t, err := newTxn(r, req)
+	if err != nil {
+		return
+	}
+
+	result, err := GetMds().storage().Txn(r.Context(), t)
+	if err != nil {
+		return
+	}
+
+	ops := t.Success
+	if !result.Succeeded {
+		ops = t.Failure
+	}
+	resp.Succeeded = result.Succeeded
+	resp.Results = make([]client.BatchResult, len(result.Results))
+	for i, res := range result.Results {
+		resp.Results[i] = client.BatchResult{Key: res.Key, Value: string(res.Value), Version: res.Version}
+		if res.Err != nil {
+			resp.Results[i].Error = res.Err.Error()
+		}
+
+		switch ops[i].Op {
+		case lsm.TxnGet:
+			GetMds().access.read(res.Key)
+		case lsm.TxnSet:
+			GetMds().access.write(res.Key, len(ops[i].Value))
+		case lsm.TxnDelete:
+			GetMds().access.delete(res.Key)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	mds "ddb/mds/core"
 	"flag"
 	"fmt"
+	"os"
 )
 
 func main() {
@@ -12,13 +13,71 @@ func main() {
 	flag.StringVar(&params.ApiAddress, "apiAddress", "127.0.0.1:8000", "api address")
 	flag.StringVar(&params.DebugAddress, "debugAddress", "127.0.0.1:8001", "debug address")
 	flag.StringVar(&params.LogFile, "logFile", "mds.log", "log file path")
+	flag.IntVar(&params.LogLevel, "logLevel", 0, "log verbosity: -2 errors, -1 warnings, 0 info, 1 debug")
+	flag.StringVar(&params.LogFormat, "logFormat", "text", "log format: text or json")
+	flag.Int64Var(&params.LogMaxSize, "logMaxSize", 0, "size in bytes after which the log file is rotated, 0 means no limit")
+	flag.IntVar(&params.LogMaxAgeMs, "logMaxAgeMs", 0, "age in milliseconds after which the log file is rotated, 0 means no limit")
+	flag.IntVar(&params.LogKeep, "logKeep", 0, "rotated log files kept, 0 keeps all")
 	flag.StringVar(&params.PidFile, "pidFile", "mds.pid", "pid file")
 	flag.StringVar(&params.StoragePath, "storagePath", ".", "storage path")
+	flag.StringVar(&params.Checksum, "checksum", "xxhash64", "storage checksum algorithm: xxhash64, crc32c or sha256")
+	flag.StringVar(&params.Compression, "compression", "none", "block compression of new sstables: none, snappy or zstd")
+	flag.IntVar(&params.GoMaxProcs, "goMaxProcs", 0, "GOMAXPROCS, 0 keeps the go runtime default")
+	flag.IntVar(&params.MemtableNodes, "memtableNodes", 0, "memtable node count triggering compaction, 0 means no count limit")
+	flag.Int64Var(&params.MemtableSize, "memtableSize", 0, "memtable size in bytes triggering compaction, 0 means size by memory")
+	flag.IntVar(&params.MergeTimeoutMs, "mergeTimeoutMs", 0, "interval between sstable merges in milliseconds, 0 means default")
+	flag.Int64Var(&params.BlockCacheSize, "blockCacheSize", 0, "sstable block cache size in bytes, 0 means size by memory, negative disables")
+	flag.Float64Var(&params.CacheVerifyRate, "cacheVerifyRate", 0, "fraction of block cache hits re-read from sstables to detect stale cache, 0 disables")
+	flag.StringVar(&params.Durability, "durability", "", "durability of writes not setting one: fsync, batched or none, empty means fsync")
+	flag.StringVar(&params.MinDurability, "minDurability", "", "weakest durability of a write, weaker requests get it: fsync, batched or none, empty means none")
+	flag.IntVar(&params.SyncIntervalMs, "syncIntervalMs", 0, "interval of log syncs for writes of batched durability in milliseconds, 0 means default")
+	flag.IntVar(&params.CoalesceThreshold, "coalesceThreshold", 0, "writes per second to a key after which only its latest value per window is logged, 0 disables")
+	flag.IntVar(&params.CoalesceWindowMs, "coalesceWindowMs", 0, "window of coalesced writes to hot keys in milliseconds, 0 means default")
+	flag.IntVar(&params.CompactionMinTables, "compactionMinTables", 0, "number of similarly sized sstables merged at once, 0 means default")
+	flag.Float64Var(&params.CompactionSizeRatio, "compactionSizeRatio", 0, "maximum size ratio of sstables merged together, 0 means default")
+	flag.Int64Var(&params.CompactionMinTierSize, "compactionMinTierSize", 0, "sstables smaller than this many bytes share the lowest tier, 0 means default")
+	flag.IntVar(&params.MaxTables, "maxTables", 0, "sstable count above which sstables are merged regardless of their sizes and /readyz warns, 0 means default, negative no limit")
+	flag.Int64Var(&params.MergeBytesPerSec, "mergeBytesPerSec", 0, "bytes per second sstable merges write at most, 0 means no limit")
+	flag.IntVar(&params.WriteStallTimeoutMs, "writeStallTimeoutMs", 0, "time writers wait for a flush of a busy memtable before failing with 429 in milliseconds, 0 means default, negative fails at once")
+	flag.IntVar(&params.WriteSlowdownFactor, "writeSlowdownFactor", 0, "memtable size relative to the flush threshold at which every write is delayed, 0 disables")
+	flag.IntVar(&params.WriteSlowdownTables, "writeSlowdownTables", 0, "sstable count at which every write is delayed, 0 disables")
+	flag.IntVar(&params.WriteSlowdownDelayMs, "writeSlowdownDelayMs", 0, "delay of slowed down writes in milliseconds, 0 means default")
+	flag.IntVar(&params.WriteStopFactor, "writeStopFactor", 0, "memtable size relative to the flush threshold at which writers queue for a flush, 0 means default")
+	flag.IntVar(&params.WriteStopTables, "writeStopTables", 0, "sstable count at which writers queue for a merge, should be above -maxTables, 0 disables")
+	flag.Int64Var(&params.WalSegmentSize, "walSegmentSize", 0, "write ahead log segment size in bytes, 0 means default")
+	flag.Int64Var(&params.MaxValueSize, "maxValueSize", 0, "largest accepted value in bytes, 0 means default")
+	flag.StringVar(&params.ReplicaOf, "replicaOf", "", "api address of the primary to replicate from, e.g. http://host:8080")
+	flag.IntVar(&params.ReplicationLogSize, "replicationLogSize", 0, "writes kept in memory for followers, 0 means default")
+	flag.StringVar(&params.RaftId, "raftId", "", "api url of this node in a raft cluster, e.g. http://host:8000")
+	flag.StringVar(&params.RaftPeers, "raftPeers", "", "comma separated api urls of all raft cluster nodes")
+	flag.StringVar(&params.AuthFile, "authFile", "", "json file of credentials, requests are only served with one of them if set")
+	flag.StringVar(&params.PeerKeyId, "peerKeyId", "", "id of the credential requests to the primary and raft peers are signed with")
+	flag.StringVar(&params.ControllerUrl, "controllerUrl", "", "url of a controller to report health, stats and config to and take config pushes from")
+	flag.IntVar(&params.ReportIntervalMs, "reportIntervalMs", 0, "interval between reports to the controller in milliseconds, 0 means default")
+	flag.StringVar(&params.NodeId, "nodeId", "", "node id in reports to the controller, empty means the api address")
+	flag.StringVar(&params.TlsCertFile, "tlsCertFile", "", "pem certificate of the https api and debug servers, plain http if unset")
+	flag.StringVar(&params.TlsKeyFile, "tlsKeyFile", "", "pem key of the tls certificate")
+	flag.StringVar(&params.TlsClientCaFile, "tlsClientCaFile", "", "pem ca certificates clients must present a certificate signed by")
+	flag.StringVar(&params.TlsCaFile, "tlsCaFile", "", "pem ca certificates trusted in requests to https peers and the controller")
+	flag.StringVar(&params.AccessSink, "accessSink", "", "file or http url to export access pattern summaries to")
+	flag.IntVar(&params.AccessExportIntervalMs, "accessExportIntervalMs", 0, "interval between access pattern exports in milliseconds, 0 means default")
+	flag.StringVar(&params.AccessPrefixes, "accessPrefixes", "", "comma separated key prefixes reported by name in access patterns, other keys are anonymized")
+	flag.IntVar(&params.ShutdownTimeoutMs, "shutdownTimeoutMs", 0, "time requests in flight are waited for on shutdown in milliseconds, 0 means default")
+	flag.BoolVar(&params.Warmup, "warmup", false, "read the sstable blocks hot before the restart into the cache after startup")
+	flag.StringVar(&params.Slos, "slo", "", "comma separated latency objectives op:threshold:target exported in /metrics, e.g. get:10ms:0.99")
+	flag.Float64Var(&params.RequestSampleRate, "requestSampleRate", 0, "fraction of api requests captured with headers, sizes and timings into /admin/samples")
+	flag.StringVar(&params.BackupDir, "backupDir", "", "directory of backups exported in /metrics and pruned by the retention")
+	flag.IntVar(&params.BackupKeepDaily, "backupKeepDaily", 0, "days whose newest backup in backupDir is kept")
+	flag.IntVar(&params.BackupKeepWeekly, "backupKeepWeekly", 0, "weeks whose newest backup in backupDir is kept")
+	flag.StringVar(&params.CountPrefixes, "countPrefixes", "", "comma separated key prefixes to count live keys for")
+	flag.IntVar(&params.DedupSize, "dedupSize", 0, "successful writes kept by request id so resends aren't applied twice, 0 means default and negative disables it")
+	flag.IntVar(&params.DedupTtlMs, "dedupTtlMs", 0, "time write responses are kept for deduplication in milliseconds, 0 means default")
 
 	flag.Parse()
 
 	err := mds.GetMds().Run(&params)
 	if err != nil {
 		fmt.Printf("mds run error %v\n", err)
+		os.Exit(1)
 	}
 }